@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Supported access log formats.
+const (
+	LogFormatStructured = "structured"
+	LogFormatCombined   = "combined"
+)
+
+// accessLogger writes one line per handled request, either as structured
+// key/value pairs or in the Apache Combined Log Format.
+type accessLogger struct {
+	format string
+
+	mu sync.Mutex
+	w  io.Writer
+
+	structured *slog.Logger
+}
+
+func newAccessLogger(w io.Writer, format string) *accessLogger {
+	return &accessLogger{
+		format:     format,
+		w:          w,
+		structured: slog.New(slog.NewTextHandler(w, nil)),
+	}
+}
+
+// remoteIP strips the port from a remote address.
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func (l *accessLogger) log(req *Request, res *Response, start time.Time, duration time.Duration) {
+	if l == nil {
+		return
+	}
+
+	// What was written after the head, streamed or not, none for a HEAD
+	sent := res.bodyWritten
+
+	if l.format != LogFormatCombined {
+		l.structured.Info("request",
+			"remote", remoteIP(req.RemoteAddr),
+			"method", req.Method,
+			"uri", req.OriginalURI(),
+			"status", res.StatusCode,
+			"bytes", sent,
+			"duration", duration,
+		)
+		return
+	}
+
+	// %h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-Agent}i"
+	bytes := "-"
+	if sent > 0 {
+		bytes = fmt.Sprint(sent)
+	}
+	referer, ok := req.Headers.Get("Referer")
+	if !ok {
+		referer = "-"
+	}
+	userAgent, ok := req.Headers.Get("User-Agent")
+	if !ok {
+		userAgent = "-"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, "%s - - [%s] \"%s %s %s\" %d %s %q %q\n",
+		remoteIP(req.RemoteAddr),
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		req.Method, req.OriginalURI(), req.HTTPVersion,
+		res.StatusCode,
+		bytes,
+		referer,
+		userAgent,
+	)
+}
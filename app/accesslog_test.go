@@ -0,0 +1,59 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogCombined(t *testing.T) {
+	start := time.Date(2030, 5, 6, 7, 8, 9, 0, time.FixedZone("", 2*3600))
+	tests := []struct {
+		name    string
+		headers []string
+		written int64
+		want    string
+	}{
+		{
+			name:    "referer and user agent",
+			headers: []string{"Referer", "http://example.com/from", "User-Agent", `curl/8.0 "quoted"`},
+			written: 42,
+			want:    `192.0.2.1 - - [06/May/2030:07:08:09 +0200] "GET /echo/abc?x=1 HTTP/1.1" 200 42 "http://example.com/from" "curl/8.0 \"quoted\""` + "\n",
+		},
+		{
+			name: "neither, no body",
+			want: `192.0.2.1 - - [06/May/2030:07:08:09 +0200] "GET /echo/abc?x=1 HTTP/1.1" 200 - "-" "-"` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			l := newAccessLogger(&out, LogFormatCombined)
+			req := newTestRequest("GET", "/echo/abc?x=1", tt.headers...)
+			req.RemoteAddr = "192.0.2.1:54321"
+			res := NewResponse()
+			res.bodyWritten = tt.written
+			l.log(req, res, start, time.Millisecond)
+			if out.String() != tt.want {
+				t.Errorf("got  %q\nwant %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+// Structured is the default, one key=value line per request.
+func TestAccessLogStructured(t *testing.T) {
+	var out strings.Builder
+	l := newAccessLogger(&out, LogFormatStructured)
+	req := newTestRequest("DELETE", "/files/a.txt", "Referer", "http://example.com/")
+	req.RemoteAddr = "[2001:db8::1]:4221"
+	res := NewResponse()
+	res.StatusCode = 404
+	l.log(req, res, time.Now(), 1500*time.Microsecond)
+
+	want := regexp.MustCompile(`^time=\S+ level=INFO msg=request remote=2001:db8::1 method=DELETE uri=/files/a.txt status=404 bytes=0 duration=1.5ms\n$`)
+	if !want.MatchString(out.String()) {
+		t.Errorf("got %q", out.String())
+	}
+}
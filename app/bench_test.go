@@ -0,0 +1,174 @@
+package main
+
+// End-to-end benchmarks: a loopback listener, the real connection loop and
+// the real router, next to BenchmarkEcho for the small GET. To compare a change against a baseline:
+//
+//	go test -run '^$' -bench . -count 10 ./app > old.txt
+//	(apply the change)
+//	go test -run '^$' -bench . -count 10 ./app > new.txt
+//	benchstat old.txt new.txt
+//
+// benchstat is installed with go install golang.org/x/perf/cmd/benchstat@latest.
+// The allocation budgets below fail in plain go test, so a change that
+// bloats the hot path is caught without running the benchmarks.
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fileRouter serves dir at /files/ the way main does, without middleware.
+func fileRouter(dir string) *Router {
+	router := echoRouter()
+	fs := NewFileServer("/files/", dir)
+	router.HandlePrefix(fs.Prefix, fs.Handle, fs.Methods()...).Stream()
+	return router
+}
+
+func BenchmarkServerFileDownload(b *testing.B) {
+	dir := b.TempDir()
+	body := bytes.Repeat([]byte("x"), 1<<20)
+	if err := os.WriteFile(filepath.Join(dir, "big"), body, 0644); err != nil {
+		b.Fatal(err)
+	}
+	_, addr := startServer(b, fileRouter(dir))
+	c := dial(b, addr)
+	req := newTestRequest("GET", "/files/big")
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	for b.Loop() {
+		res, err := c.Do(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(res.Body) != len(body) {
+			b.Fatalf("got %d bytes", len(res.Body))
+		}
+	}
+}
+
+func BenchmarkServerFileUpload(b *testing.B) {
+	_, addr := startServer(b, fileRouter(b.TempDir()))
+	c := dial(b, addr)
+	req := newTestRequest("PUT", "/files/upload")
+	req.Body = strings.Repeat("x", 1<<20)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(req.Body)))
+	for b.Loop() {
+		res, err := c.Do(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if res.StatusCode >= 300 {
+			b.Fatalf("got %d", res.StatusCode)
+		}
+	}
+}
+
+// BenchmarkServerKeepAliveSession measures a session of 100 requests on
+// one connection, the connection set up included.
+func BenchmarkServerKeepAliveSession(b *testing.B) {
+	_, addr := startServer(b, echoRouter())
+	req := newTestRequest("GET", "/echo/abc")
+
+	b.ReportAllocs()
+	for b.Loop() {
+		c, err := Dial(addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for range 100 {
+			if _, err := c.Do(req); err != nil {
+				b.Fatal(err)
+			}
+		}
+		c.Close()
+	}
+}
+
+// parseAllocBudget bounds the allocations of ReadRequestHead for a small
+// request: the request itself, its headers and the strings read.
+const parseAllocBudget = 19
+
+func TestReadRequestHeadAllocs(t *testing.T) {
+	raw := "GET /echo/abc HTTP/1.1\r\nHost: localhost\r\nUser-Agent: test\r\nAccept: */*\r\n\r\n"
+	var in strings.Reader
+	reader := bufio.NewReader(&in)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		in.Reset(raw)
+		reader.Reset(&in)
+		if _, err := ReadRequestHead(reader, DefaultRequestLimits); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > parseAllocBudget {
+		t.Errorf("ReadRequestHead: %.0f allocations, the budget is %d", allocs, parseAllocBudget)
+	}
+}
+
+// finalizeAllocBudget bounds the allocations of finalize for a small
+// response, the Date and Content-Length headers included, along with the
+// building of the response itself.
+const finalizeAllocBudget = 9
+
+func TestFinalizeAllocs(t *testing.T) {
+	s := NewServer("", echoRouter())
+	req := newTestRequest("GET", "/echo/abc")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		res := &Response{StatusLine: StatusLine{HTTPVersion: "HTTP/1.1", StatusCode: 200}, Headers: Headers{"content-type": "text/plain"}, Body: "abc"}
+		s.finalize(req, res)
+	})
+	if allocs > finalizeAllocBudget {
+		t.Errorf("finalize: %.0f allocations, the budget is %d", allocs, finalizeAllocBudget)
+	}
+}
+
+// BenchmarkServerConnectionFlood opens connections 200 at a time, each for
+// a single request, with a goroutine per connection and on a worker pool.
+func BenchmarkServerConnectionFlood(b *testing.B) {
+	const conns = 200
+	for _, bench := range []struct {
+		name    string
+		workers int
+	}{
+		{"goroutine per connection", 0},
+		{"pool", runtime.GOMAXPROCS(0) * 4},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			_, addr := startServer(b, echoRouter(), func(s *Server) {
+				s.Workers = bench.workers
+				s.WorkerQueue = conns
+			})
+			req := newTestRequest("GET", "/echo/abc", "Connection", "close")
+
+			b.ReportAllocs()
+			for b.Loop() {
+				var wg sync.WaitGroup
+				for range conns {
+					wg.Go(func() {
+						c, err := Dial(addr)
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						defer c.Close()
+						if _, err := c.Do(req); err != nil {
+							b.Error(err)
+						}
+					})
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
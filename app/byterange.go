@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileSection is the part of a file a response carries.
+type fileSection struct {
+	offset, length int64
+}
+
+// rangeOutcome is what a Range header makes of a request for a file.
+type rangeOutcome int
+
+const (
+	// rangeIgnored serves the whole file: no Range, one the server doesn't
+	// support (another unit, several ranges) or a malformed one.
+	rangeIgnored rangeOutcome = iota
+	rangeSatisfiable
+	rangeUnsatisfiable
+)
+
+// parseRange resolves the Range header value against a file of size bytes.
+// Only a single range of bytes is supported, as "bytes=first-last",
+// "bytes=first-" or the suffix form "bytes=-length".
+func parseRange(value string, size int64) (fileSection, rangeOutcome) {
+	unit, spec, ok := strings.Cut(strings.TrimSpace(value), "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") || strings.Contains(spec, ",") {
+		return fileSection{}, rangeIgnored
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok || first == "" && last == "" {
+		return fileSection{}, rangeIgnored
+	}
+
+	if first == "" {
+		suffix, err := strconv.ParseUint(last, 10, 63)
+		if err != nil {
+			return fileSection{}, rangeIgnored
+		}
+		if suffix == 0 || size == 0 {
+			return fileSection{}, rangeUnsatisfiable
+		}
+		length := min(int64(suffix), size)
+		return fileSection{offset: size - length, length: length}, rangeSatisfiable
+	}
+
+	start, err := strconv.ParseUint(first, 10, 63)
+	if err != nil {
+		return fileSection{}, rangeIgnored
+	}
+	end := uint64(size - 1)
+	if last != "" {
+		if end, err = strconv.ParseUint(last, 10, 63); err != nil || end < start {
+			return fileSection{}, rangeIgnored
+		}
+	}
+	if start >= uint64(size) {
+		return fileSection{}, rangeUnsatisfiable
+	}
+	end = min(end, uint64(size-1))
+	return fileSection{offset: int64(start), length: int64(end-start) + 1}, rangeSatisfiable
+}
+
+// ifRangeMatches reports whether the If-Range value still designates the
+// representation last modified at lastModified, or whose current ETag is
+// computed by etag. Entity tags are compared strongly, so a weak one never
+// matches and the whole file is sent. now places two digit years.
+func ifRangeMatches(value string, lastModified, now time.Time, etag func() (string, error)) bool {
+	value = strings.TrimSpace(value)
+	if isWeakETag(value) {
+		return false
+	}
+	if strings.HasPrefix(value, `"`) {
+		current, err := etag()
+		return err == nil && ETagsMatchStrong(value, current)
+	}
+	t, err := parseHTTPDate(value, now)
+	return err == nil && t.Equal(lastModified)
+}
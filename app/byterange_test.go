@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIfRange(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "data.txt")
+	if err := os.WriteFile(filePath, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filePath, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	etag, err := fileETag(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := startServer(t, fileRouter(dir))
+	c := dial(t, addr)
+
+	tests := []struct {
+		name    string
+		ifRange string
+		status  int
+	}{
+		{name: "current ETag", ifRange: etag, status: 206},
+		{name: "other ETag", ifRange: `"0000"`, status: 200},
+		{name: "weak current ETag", ifRange: "W/" + etag, status: 200},
+		{name: "current date", ifRange: FormatHTTPDate(modified), status: 206},
+		{name: "older date", ifRange: FormatHTTPDate(modified.Add(-time.Hour)), status: 200},
+		{name: "invalid date", ifRange: "yesterday", status: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := c.Do(newTestRequest("GET", "/files/data.txt", "Range", "bytes=2-4", "If-Range", tt.ifRange))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "0123456789"
+			if tt.status == 206 {
+				want = "234"
+			}
+			if res.StatusCode != tt.status || res.Body != want {
+				t.Errorf("got %d %q, want %d %q", res.StatusCode, res.Body, tt.status, want)
+			}
+		})
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		value   string
+		size    int64
+		section fileSection
+		outcome rangeOutcome
+	}{
+		{"bytes=0-4", 10, fileSection{0, 5}, rangeSatisfiable},
+		{"bytes=5-", 10, fileSection{5, 5}, rangeSatisfiable},
+		{"bytes=-3", 10, fileSection{7, 3}, rangeSatisfiable},
+		{"bytes=-30", 10, fileSection{0, 10}, rangeSatisfiable},
+		{"bytes=8-100", 10, fileSection{8, 2}, rangeSatisfiable},
+		{" Bytes = 1-1 ", 10, fileSection{1, 1}, rangeSatisfiable},
+		{"bytes=10-", 10, fileSection{}, rangeUnsatisfiable},
+		{"bytes=-0", 10, fileSection{}, rangeUnsatisfiable},
+		{"bytes=-5", 0, fileSection{}, rangeUnsatisfiable},
+		{"bytes=0-0", 0, fileSection{}, rangeUnsatisfiable},
+		{"bytes=0-1,3-4", 10, fileSection{}, rangeIgnored},
+		{"items=0-1", 10, fileSection{}, rangeIgnored},
+		{"bytes=4-2", 10, fileSection{}, rangeIgnored},
+		{"bytes=-", 10, fileSection{}, rangeIgnored},
+		{"bytes=a-b", 10, fileSection{}, rangeIgnored},
+		{"bytes=-1-2", 10, fileSection{}, rangeIgnored},
+		{"bytes 0-4", 10, fileSection{}, rangeIgnored},
+	}
+	for _, tt := range tests {
+		section, outcome := parseRange(tt.value, tt.size)
+		if section != tt.section || outcome != tt.outcome {
+			t.Errorf("parseRange(%q, %d) = %v, %d, want %v, %d", tt.value, tt.size, section, outcome, tt.section, tt.outcome)
+		}
+	}
+}
+
+// A ranged request is never compressed: the range applies to the identity
+// bytes, whatever Accept-Encoding says.
+func TestRangeNotCompressed(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Repeat("0123456789", 1000)
+	if err := os.WriteFile(filepath.Join(dir, "digits.txt"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, addr := startServer(t, gzipFileRouter(dir))
+	c := dial(t, addr)
+
+	tests := []struct {
+		rangeValue, body, contentRange string
+		status                         int
+	}{
+		{"bytes=100-2099", content[100:2100], "bytes 100-2099/10000", 206},
+		{"bytes=-5", "56789", "bytes 9995-9999/10000", 206},
+		{"bytes=20000-", "", "bytes */10000", 416},
+		// Ignored, but the request still isn't compressed
+		{"bytes=0-1,5-6", content, "", 200},
+	}
+	for _, tt := range tests {
+		res, err := c.Do(newTestRequest("GET", "/files/digits.txt", "Range", tt.rangeValue, "Accept-Encoding", "gzip"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoding, compressed := res.Headers.Get("Content-Encoding")
+		contentRange, _ := res.Headers.Get("Content-Range")
+		if res.StatusCode != tt.status || compressed || contentRange != tt.contentRange {
+			t.Errorf("%s: got %d, Content-Encoding %q, Content-Range %q", tt.rangeValue, res.StatusCode, encoding, contentRange)
+		}
+		if tt.status != 416 && res.Body != tt.body {
+			t.Errorf("%s: got %d bytes, not the identity range", tt.rangeValue, len(res.Body))
+		}
+		if ranges, _ := res.Headers.Get("Accept-Ranges"); tt.status != 416 && ranges != "bytes" {
+			t.Errorf("%s: Accept-Ranges %q", tt.rangeValue, ranges)
+		}
+	}
+
+	// Without Range, the file is compressed as usual
+	res, err := c.Do(newTestRequest("GET", "/files/digits.txt", "Accept-Encoding", "gzip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoding, _ := res.Headers.Get("Content-Encoding"); encoding != "gzip" {
+		t.Errorf("no Range: Content-Encoding %q", encoding)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RequestCapture saves the raw bytes of every request read by the server,
+// to replay misbehaving clients offline. Each request gets a timestamped
+// .http file with its bytes and a .json file describing how it was answered.
+type RequestCapture struct {
+	Dir string
+	// MaxBody is how many bytes of each body are kept.
+	MaxBody int
+	// Redact lists the headers whose values are replaced before writing.
+	Redact []string
+
+	seq atomic.Int64
+}
+
+// NewRequestCapture creates a RequestCapture writing to dir, keeping 64KB of
+// each body and redacting the credentials.
+func NewRequestCapture(dir string) *RequestCapture {
+	return &RequestCapture{
+		Dir:     dir,
+		MaxBody: 64 << 10,
+		Redact:  []string{"Authorization", "Proxy-Authorization", "Cookie"},
+	}
+}
+
+// limit is how many bytes of a request are worth recording: the longest
+// head the server reads and the MaxBody kept of the body.
+func (c *RequestCapture) limit(limits RequestLimits) int {
+	return limits.MaxRequestLineBytes + limits.MaxHeaderBytes + 2 + c.MaxBody
+}
+
+// captureReader records what is read from the connection, up to limit bytes
+// of each request. Past the limit it only keeps the last bytes read, which
+// may have been read ahead for the next request.
+type captureReader struct {
+	r     io.Reader
+	limit int
+	buf   []byte
+	tail  []byte // the last bytes read past limit
+	read  int    // bytes read since the last take, recorded or not
+}
+
+func (cr *captureReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.read += n
+	data := p[:n]
+	if room := cr.limit - len(cr.buf); room > 0 {
+		k := min(len(data), room)
+		cr.buf = append(cr.buf, data[:k]...)
+		data = data[k:]
+	}
+	if len(data) > 0 {
+		// The connection reader never holds more than its buffer ahead
+		cr.tail = append(cr.tail, data...)
+		if extra := len(cr.tail) - connReadBufferSize; extra > 0 {
+			cr.tail = append(cr.tail[:0], cr.tail[extra:]...)
+		}
+	}
+	return n, err
+}
+
+// take returns the recorded bytes of the request just read and its full
+// size. The last buffered bytes were read ahead and are kept for the next
+// request.
+func (cr *captureReader) take(buffered int) (raw []byte, size int) {
+	size = cr.read - buffered
+	var ahead []byte
+	if fromBuf := buffered - len(cr.tail); fromBuf > 0 {
+		ahead = append(ahead, cr.buf[len(cr.buf)-fromBuf:]...)
+		ahead = append(ahead, cr.tail...)
+	} else {
+		ahead = append(ahead, cr.tail[len(cr.tail)-buffered:]...)
+	}
+	raw = cr.buf[:min(len(cr.buf), size)]
+	cr.buf, cr.tail, cr.read = ahead, nil, buffered
+	return raw, size
+}
+
+type captureInfo struct {
+	Remote     string    `json:"remote"`
+	Start      time.Time `json:"start"`
+	DurationMS float64   `json:"duration_ms"`
+	Status     int       `json:"status"`
+	Bytes      int       `json:"bytes"`
+	Truncated  bool      `json:"truncated"`
+}
+
+// redact replaces the values of the Redact headers in the head of a raw request.
+func (c *RequestCapture) redact(head []byte) []byte {
+	lines := bytes.SplitAfter(head, []byte("\n"))
+	for i, line := range lines[1:] {
+		name, _, ok := bytes.Cut(line, []byte(":"))
+		if ok && slices.ContainsFunc(c.Redact, func(h string) bool { return strings.EqualFold(h, string(name)) }) {
+			lines[i+1] = []byte(string(name) + ": [REDACTED]\r\n")
+		}
+	}
+	return bytes.Join(lines, nil)
+}
+
+// save writes a captured request of size bytes, of which raw were
+// recorded, and what became of it.
+func (c *RequestCapture) save(raw []byte, size int, info captureInfo) {
+	info.Bytes = size
+	info.Truncated = len(raw) < size
+	head, body := raw, []byte(nil)
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		head, body = raw[:i+2], raw[i+2:]
+	}
+	// The blank line ending the head is the first 2 bytes of body
+	if len(body) > c.MaxBody+2 {
+		body = body[:c.MaxBody+2]
+		info.Truncated = true
+	}
+
+	name := fmt.Sprintf("%s-%d", info.Start.UTC().Format("20060102T150405.000000000Z"), c.seq.Add(1))
+	sidecar, err := json.Marshal(info)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(c.Dir, name+".http"), append(c.redact(head), body...), 0600)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(c.Dir, name+".json"), sidecar, 0600)
+	}
+	if err != nil {
+		fmt.Println("Error writing request capture: ", err.Error())
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// A large body is counted but only its first MaxBody bytes are kept, in
+// memory as on disk.
+func TestCaptureTruncatesLargeBody(t *testing.T) {
+	dir := t.TempDir()
+	capture := NewRequestCapture(dir)
+	capture.MaxBody = 16
+	router := echoRouter()
+	router.HandleExact("/upload", func(req *Request, res *Response) {}, "POST")
+	_, addr := startServer(t, router, func(s *Server) { s.Capture = capture })
+	c := dial(t, addr)
+
+	body := strings.Repeat("x", 1<<20)
+	req := newTestRequest("POST", "/upload")
+	req.Body = body
+	if _, err := c.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do(newTestRequest("GET", "/echo/next")); err != nil {
+		t.Fatal(err)
+	}
+	// The captures are saved once the responses have been written
+	var saved []savedCapture
+	for range 100 {
+		if saved = readCaptures(t, dir); len(saved) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(saved) != 2 {
+		t.Fatalf("%d captures, want 2", len(saved))
+	}
+
+	for _, info := range saved {
+		raw, err := os.ReadFile(info.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(string(raw), "POST") {
+			if !info.Truncated || info.Bytes < len(body) {
+				t.Errorf("POST capture: truncated %v, %d bytes", info.Truncated, info.Bytes)
+			}
+			if _, kept, _ := strings.Cut(string(raw), "\r\n\r\n"); len(kept) != capture.MaxBody {
+				t.Errorf("POST capture kept %d bytes of body, want %d", len(kept), capture.MaxBody)
+			}
+		} else if !strings.HasPrefix(string(raw), "GET /echo/next ") || info.Truncated {
+			t.Errorf("next capture: %q, truncated %v", raw, info.Truncated)
+		}
+	}
+}
+
+func TestCaptureReaderLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int
+		ahead     string
+		wantRaw   string
+		wantTrunc bool
+	}{
+		{name: "under the limit", limit: 200, ahead: "next", wantRaw: strings.Repeat("a", 100)},
+		{name: "over the limit", limit: 10, ahead: "next", wantRaw: strings.Repeat("a", 10), wantTrunc: true},
+		{name: "read ahead within the limit", limit: 102, ahead: "next", wantRaw: strings.Repeat("a", 100)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := &captureReader{r: strings.NewReader(strings.Repeat("a", 100) + tt.ahead), limit: tt.limit}
+			if _, err := io.ReadAll(iotest.OneByteReader(cr)); err != nil {
+				t.Fatal(err)
+			}
+			if len(cr.buf) > tt.limit {
+				t.Errorf("recorded %d bytes over a limit of %d", len(cr.buf), tt.limit)
+			}
+			raw, size := cr.take(len(tt.ahead))
+			if string(raw) != tt.wantRaw || size != 100 || (len(raw) < size) != tt.wantTrunc {
+				t.Errorf("take: %q, size %d", raw, size)
+			}
+			if string(cr.buf) != tt.ahead || cr.read != len(tt.ahead) {
+				t.Errorf("kept %q, read %d, want the bytes read ahead", cr.buf, cr.read)
+			}
+		})
+	}
+}
+
+type savedCapture struct {
+	captureInfo
+	file string
+}
+
+// readCaptures lists the captures saved in dir.
+func readCaptures(t *testing.T, dir string) []savedCapture {
+	t.Helper()
+	sidecars, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	var saved []savedCapture
+	for _, name := range sidecars {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s savedCapture
+		if err := json.Unmarshal(data, &s.captureInfo); err != nil {
+			continue // still being written
+		}
+		s.file = strings.TrimSuffix(name, ".json") + ".http"
+		saved = append(saved, s)
+	}
+	return saved
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Client is a minimal HTTP/1.1 client over a single connection, reused
+// for sequential requests as long as the server keeps it open. It is meant
+// for exercising the server, so there are no redirects or cookies.
+type Client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Dial connects a Client to addr.
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// DialTLS connects a Client to addr over TLS. insecureSkipVerify accepts
+// any certificate, like the self-signed ones used for testing.
+func DialTLS(addr string, insecureSkipVerify bool) (*Client, error) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: insecureSkipVerify})
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends req and reads the final response to it, skipping interim ones.
+func (c *Client) Do(req *Request) (*Response, error) {
+	if err := req.Write(c.conn); err != nil {
+		return nil, err
+	}
+	for {
+		res, err := ReadResponse(c.reader, req.Method)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode >= 200 || res.StatusCode == 101 {
+			return res, nil
+		}
+	}
+}
+
+// Write sends req the way a client would. A Content-Length is added for the
+// body when neither it nor a Transfer-Encoding is set.
+func (r *Request) Write(w io.Writer) error {
+	b := make([]byte, 0, 256+len(r.Body))
+	version := r.HTTPVersion
+	if version == "" {
+		version = "HTTP/1.1"
+	}
+	b = fmt.Appendf(b, "%s %s %s\r\n", r.Method, r.RequestURI, version)
+	_, hasLength := r.Headers.Get("Content-Length")
+	_, hasEncoding := r.Headers.Get("Transfer-Encoding")
+	if r.Body != "" && !hasLength && !hasEncoding {
+		b = fmt.Appendf(b, "content-length: %d\r\n", len(r.Body))
+	}
+	for k, v := range r.Headers {
+		b = fmt.Appendf(b, "%s: %s\r\n", k, v)
+	}
+	b = append(b, "\r\n"...)
+	b = append(b, r.Body...)
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadResponse reads a response to a request with method from reader.
+// The body is framed by Transfer-Encoding: chunked, Content-Length, or the
+// end of the connection, and is always empty for HEAD.
+func ReadResponse(reader *bufio.Reader, method string) (*Response, error) {
+	limits := DefaultRequestLimits
+	line, err := readLine(reader, limits.MaxRequestLineBytes)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid status line '%s'", line)
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid status line '%s'", line)
+	}
+	res := &Response{StatusLine: StatusLine{HTTPVersion: parts[0], StatusCode: code}, Headers: NewHeaders()}
+	if len(parts) == 3 {
+		res.ReasonPhrase = parts[2]
+	}
+
+	for count := 0; ; count++ {
+		line, err := readLine(reader, limits.MaxHeaderBytes)
+		if err != nil {
+			return nil, err
+		}
+		if line == "\r\n" || line == "\n" {
+			break
+		}
+		if count == limits.MaxHeaderCount {
+			return nil, ErrHeadersTooLarge
+		}
+		if name, value, ok := strings.Cut(strings.TrimSpace(line), ":"); ok {
+			res.Headers.Add(name, strings.TrimSpace(value))
+		}
+	}
+	connection, _ := res.Headers.Get("Connection")
+	res.Close = strings.EqualFold(connection, "close")
+
+	if method == "HEAD" || !bodyAllowed(code) {
+		return res, nil
+	}
+	if te, found := res.Headers.Get("Transfer-Encoding"); found && strings.EqualFold(te, "chunked") {
+		body, err := readChunked(reader, 0)
+		res.Body = string(body)
+		return res, err
+	}
+	if n, found := res.Headers.Get("Content-Length"); found {
+		length, err := strconv.Atoi(n)
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("invalid Content-Length '%s'", n)
+		}
+		body := make([]byte, length)
+		_, err = io.ReadFull(reader, body)
+		res.Body = string(body)
+		return res, err
+	}
+	body, err := io.ReadAll(reader)
+	res.Body = string(body)
+	res.Close = true
+	return res, err
+}
+
+// readChunked decodes a chunked body from reader, dropping the trailers.
+// limit caps the decoded size, 0 means no limit.
+func readChunked(reader *bufio.Reader, limit int) ([]byte, error) {
+	return io.ReadAll(&chunkedReader{r: reader, limit: int64(limit)})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientRouter answers the requests of a typical client session.
+func clientRouter() *Router {
+	router := echoRouter()
+	router.HandleExact("/user-agent", userAgentHandler, "GET")
+	router.HandleExact("/stream", func(req *Request, res *Response) {
+		res.Stream = func(w io.Writer) error {
+			for _, part := range []string{"one ", "two ", "three"} {
+				if _, err := io.WriteString(w, part); err != nil {
+					return err
+				}
+				if err := flush(w); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}, "GET")
+	router.HandleExact("/upload", func(req *Request, res *Response) {
+		res.Body = strings.ToUpper(req.Body)
+	}, "POST")
+	return router
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	s, addr := startServer(t, clientRouter())
+	c := dial(t, addr)
+
+	for _, value := range []string{"a", "bb", "ccc"} {
+		res, err := c.Do(newTestRequest("GET", "/echo/"+value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 200 || res.Body != value || res.Close {
+			t.Errorf("GET /echo/%s: got %d %q, close %v", value, res.StatusCode, res.Body, res.Close)
+		}
+	}
+	res, err := c.Do(newTestRequest("GET", "/user-agent", "User-Agent", "client/1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Body != "client/1.0" {
+		t.Errorf("GET /user-agent: got %q", res.Body)
+	}
+	if n := s.metrics.accepted.Load(); n != 1 {
+		t.Errorf("%d connections accepted, want 1", n)
+	}
+}
+
+func TestClientChunkedResponse(t *testing.T) {
+	_, addr := startServer(t, clientRouter())
+	c := dial(t, addr)
+
+	res, err := c.Do(newTestRequest("GET", "/stream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if te, _ := res.Headers.Get("Transfer-Encoding"); te != "chunked" {
+		t.Errorf("Transfer-Encoding %q, want chunked", te)
+	}
+	if res.Body != "one two three" {
+		t.Errorf("got %q", res.Body)
+	}
+	// The connection is still usable after the last chunk
+	if res, err := c.Do(newTestRequest("GET", "/echo/after")); err != nil || res.Body != "after" {
+		t.Errorf("next request: %v, %+v", err, res)
+	}
+}
+
+func TestClientHEAD(t *testing.T) {
+	_, addr := startServer(t, clientRouter())
+	c := dial(t, addr)
+
+	res, err := c.Do(newTestRequest("HEAD", "/echo/abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := res.Headers.Get("Content-Length"); res.StatusCode != 200 || n != "3" || res.Body != "" {
+		t.Errorf("HEAD /echo/abc: got %d, Content-Length %q, body %q", res.StatusCode, n, res.Body)
+	}
+	if res, err := c.Do(newTestRequest("GET", "/echo/abc")); err != nil || res.Body != "abc" {
+		t.Errorf("GET after HEAD: %v, %+v", err, res)
+	}
+}
+
+func TestClientExpectContinue(t *testing.T) {
+	_, addr := startServer(t, clientRouter())
+	c := dial(t, addr)
+
+	req := newTestRequest("POST", "/upload", "Expect", "100-continue")
+	req.Body = "shout"
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 || res.Body != "SHOUT" {
+		t.Errorf("got %d %q", res.StatusCode, res.Body)
+	}
+}
+
+func TestClientConnectionClose(t *testing.T) {
+	_, addr := startServer(t, clientRouter())
+	c := dial(t, addr)
+
+	res, err := c.Do(newTestRequest("GET", "/echo/bye", "Connection", "close"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Close || res.Body != "bye" {
+		t.Errorf("got %q, close %v", res.Body, res.Close)
+	}
+	if _, err := c.Do(newTestRequest("GET", "/echo/again")); err == nil {
+		t.Error("request after Connection: close succeeded")
+	}
+}
+
+// An HTTP/1.0 client can't read chunks, so a stream of unknown length
+// ends with the connection.
+func TestClientHTTP10Stream(t *testing.T) {
+	_, addr := startServer(t, clientRouter())
+	c := dial(t, addr)
+
+	req := newTestRequest("GET", "/stream")
+	req.HTTPVersion = "HTTP/1.0"
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.HTTPVersion != "HTTP/1.0" || res.Body != "one two three" || !res.Close {
+		t.Errorf("got %s %q, close %v", res.HTTPVersion, res.Body, res.Close)
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(l.Addr().String(), clientRouter())
+	s.AccessLog = nil
+	s.ShutdownGrace = time.Second
+	served := make(chan error, 1)
+	go func() { served <- s.ServeTLS(l, certFile, keyFile) }()
+	t.Cleanup(func() {
+		s.Shutdown()
+		if err := <-served; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("ServeTLS returned %v", err)
+		}
+	})
+
+	c, err := DialTLS(l.Addr().String(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, value := range []string{"secure", "again"} {
+		res, err := c.Do(newTestRequest("GET", "/echo/"+value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Body != value {
+			t.Errorf("got %q, want %q", res.Body, value)
+		}
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key
+// to the test's directory.
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
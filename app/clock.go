@@ -0,0 +1,18 @@
+package main
+
+import "time"
+
+// Clock tells the time to everything that timestamps or ages things
+// (Date headers, access logs, request timings, caches, conditional
+// requests, partial uploads), so it can be pinned down.
+// Network deadlines always use the real clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the wall clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestClockDateAndTimings(t *testing.T) {
+	clock := newFakeClock(time.Date(2030, 5, 6, 7, 8, 9, 0, time.UTC))
+	router := echoRouter()
+	router.HandleExact("/slow", func(req *Request, res *Response) {
+		clock.Advance(3 * time.Second)
+	}, "GET")
+	timings := make(chan Timings, 1)
+	_, addr := startServer(t, router, func(s *Server) {
+		s.Clock = clock
+		s.OnRequestEnd = func(req *Request, res *Response, t Timings) { timings <- t }
+	})
+	c := dial(t, addr)
+
+	res, err := c.Do(newTestRequest("GET", "/slow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if date, _ := res.Headers.Get("Date"); date != "Mon, 06 May 2030 07:08:12 GMT" {
+		t.Errorf("Date %q, want the time on the clock", date)
+	}
+	got := <-timings
+	if got.Handler != 3*time.Second || got.Total != 3*time.Second || got.Parse != 0 {
+		t.Errorf("timings %+v, want the 3s spent in the handler only", got)
+	}
+}
+
+// Two digit years are placed in the century of the server's clock.
+func TestClockIfModifiedSince(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "old.txt")
+	if err := os.WriteFile(filePath, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filePath, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	// 94 is 1994 until 2044, when 2094 gets within 50 years
+	since := "Sunday, 06-Nov-94 08:49:37 GMT"
+
+	for _, tt := range []struct {
+		year   int
+		status int
+	}{{2070, 304}, {2040, 200}} {
+		t.Run(fmt.Sprint(tt.year), func(t *testing.T) {
+			clock := newFakeClock(time.Date(tt.year, 1, 1, 0, 0, 0, 0, time.UTC))
+			_, addr := startServer(t, fileRouter(dir), func(s *Server) { s.Clock = clock })
+			res, err := dial(t, addr).Do(newTestRequest("GET", "/files/old.txt", "If-Modified-Since", since))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.status {
+				t.Errorf("got %d, want %d", res.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+// A partial upload left alone for longer than partialUploadTTL on the
+// server's clock is forgotten.
+func TestClockPartialUploadExpiry(t *testing.T) {
+	dir := t.TempDir()
+	clock := newFakeClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	_, addr := startServer(t, fileRouter(dir), func(s *Server) { s.Clock = clock })
+	c := dial(t, addr)
+	piece := func(name, contentRange string) *Response {
+		t.Helper()
+		req := newTestRequest("PATCH", "/files/"+name, "Content-Range", contentRange)
+		req.Body = "abcd"
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if res := piece("slow.txt", "bytes 0-3/8"); res.StatusCode != 308 {
+		t.Fatalf("first piece: got %d", res.StatusCode)
+	}
+	clock.Advance(partialUploadTTL + time.Second)
+	// Any upload sweeps the expired ones
+	piece("other.txt", "bytes 0-3/8")
+	if _, err := os.Stat(stagingPath(filepath.Join(dir, "slow.txt"))); !os.IsNotExist(err) {
+		t.Errorf("staging file of the expired upload: %v", err)
+	}
+	// The second half alone doesn't complete the file any more
+	if res := piece("slow.txt", "bytes 4-7/8"); res.StatusCode != 308 {
+		t.Errorf("second piece: got %d, want 308", res.StatusCode)
+	}
+	if r, _ := os.Stat(filepath.Join(dir, "slow.txt")); r != nil {
+		t.Error("the expired upload was completed")
+	}
+}
+
+// captureStdout returns what f printed to the standard output.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	read := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		read <- string(data)
+	}()
+	defer func() { os.Stdout = saved }()
+	f()
+	w.Close()
+	return <-read
+}
+
+func TestSlowRequestWarning(t *testing.T) {
+	clock := newFakeClock(time.Date(2030, 5, 6, 7, 8, 9, 0, time.UTC))
+	router := echoRouter()
+	router.HandleExact("/slow", func(req *Request, res *Response) {
+		clock.Advance(1500 * time.Millisecond)
+	}, "GET")
+	_, addr := startServer(t, router, func(s *Server) {
+		s.Clock = clock
+		s.SlowRequestThreshold = time.Second
+	})
+	c := dial(t, addr)
+
+	out := captureStdout(t, func() {
+		for _, target := range []string{"/slow?x=1", "/echo/fast", "/echo/last"} {
+			// The warning of a request is printed before the next one is read
+			if _, err := c.Do(newTestRequest("GET", target)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if !strings.Contains(out, "Slow request: GET /slow?x=1 took 1.5s\n") {
+		t.Errorf("no warning for the slow request in %q", out)
+	}
+	if strings.Contains(out, "/echo/fast") {
+		t.Errorf("warning for the fast request in %q", out)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSPolicy describes which cross-origin requests browsers may make.
+type CORSPolicy struct {
+	// AllowedOrigins lists the origins allowed, like "https://example.com". "*" allows any.
+	AllowedOrigins []string
+	// AllowedHeaders lists the request headers a preflight may ask for.
+	AllowedHeaders []string
+	// MaxAge, when positive, lets browsers cache preflight results.
+	MaxAge time.Duration
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for origin, "" if it isn't allowed.
+func (p *CORSPolicy) allowOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	if slices.Contains(p.AllowedOrigins, "*") {
+		return "*"
+	}
+	if slices.Contains(p.AllowedOrigins, origin) {
+		return origin
+	}
+	return ""
+}
+
+// isPreflight reports whether req is a CORS preflight from an allowed origin.
+func (p *CORSPolicy) isPreflight(req *Request) bool {
+	if req.Method != "OPTIONS" {
+		return false
+	}
+	origin, _ := req.Headers.Get("Origin")
+	_, found := req.Headers.Get("Access-Control-Request-Method")
+	return found && p.allowOrigin(origin) != ""
+}
+
+// preflight answers a preflight for a path taking methods. The browser
+// compares the method it asked for with the list.
+func (p *CORSPolicy) preflight(req *Request, res *Response, methods []string) {
+	allowed(res, methods)
+	res.Headers.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(p.AllowedHeaders) > 0 {
+		res.Headers.Set("Access-Control-Allow-Headers", strings.Join(p.AllowedHeaders, ", "))
+	}
+	if p.MaxAge > 0 {
+		res.Headers.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+	}
+}
+
+// decorate adds the CORS headers to a response to an allowed origin.
+func (p *CORSPolicy) decorate(req *Request, res *Response) {
+	origin, _ := req.Headers.Get("Origin")
+	allow := p.allowOrigin(origin)
+	if allow == "" {
+		return
+	}
+	res.Headers.Set("Access-Control-Allow-Origin", allow)
+	if allow != "*" {
+		res.Vary("Origin")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// A preflight succeeds for a route without an OPTIONS handler, listing
+// what the path takes, and allowed origins see the CORS headers on the
+// actual responses.
+func TestCORSPreflight(t *testing.T) {
+	router := &Router{CORS: &CORSPolicy{
+		AllowedOrigins: []string{"https://app.example"},
+		AllowedHeaders: []string{"Content-Type"},
+		MaxAge:         10 * time.Minute,
+	}}
+	router.HandleExact("/api/new-thing", func(req *Request, res *Response) {
+		res.StatusCode = 201
+		res.ReasonPhrase = StatusText(201)
+	}, "POST")
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+	do := func(method, target string, headers ...string) *Response {
+		t.Helper()
+		res, err := c.Do(newTestRequest(method, target, headers...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := do("OPTIONS", "/api/new-thing", "Origin", "https://app.example", "Access-Control-Request-Method", "POST")
+	methods, _ := res.Headers.Get("Access-Control-Allow-Methods")
+	origin, _ := res.Headers.Get("Access-Control-Allow-Origin")
+	maxAge, _ := res.Headers.Get("Access-Control-Max-Age")
+	allowHeaders, _ := res.Headers.Get("Access-Control-Allow-Headers")
+	if res.StatusCode/100 != 2 || methods != "POST, OPTIONS" || origin != "https://app.example" || maxAge != "600" || allowHeaders != "Content-Type" {
+		t.Errorf("preflight: got %d, methods %q, origin %q, max age %q, headers %q", res.StatusCode, methods, origin, maxAge, allowHeaders)
+	}
+
+	res = do("POST", "/api/new-thing", "Origin", "https://app.example")
+	origin, _ = res.Headers.Get("Access-Control-Allow-Origin")
+	if res.StatusCode != 201 || origin != "https://app.example" || !slices.Contains(res.Headers.Values("Vary"), "Origin") {
+		t.Errorf("POST: got %d, origin %q, Vary %v", res.StatusCode, origin, res.Headers.Values("Vary"))
+	}
+
+	// Other origins, and paths no route takes, get no CORS answer
+	for _, tt := range []struct {
+		target, origin string
+		status         int
+	}{
+		{"/api/new-thing", "https://evil.example", 204},
+		{"/api/missing", "https://app.example", 404},
+	} {
+		res := do("OPTIONS", tt.target, "Origin", tt.origin, "Access-Control-Request-Method", "POST")
+		if _, found := res.Headers.Get("Access-Control-Allow-Methods"); res.StatusCode != tt.status || found {
+			t.Errorf("OPTIONS %s from %s: got %d, %v", tt.target, tt.origin, res.StatusCode, res.Headers)
+		}
+	}
+}
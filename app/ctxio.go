@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// copyBufferSize is how much is copied between two context checks.
+const copyBufferSize = 32 * 1024
+
+// copyContext is io.Copy, except it stops with ctx.Err() as soon as ctx is
+// done, checking before every buffer.
+func copyContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	buf := make([]byte, copyBufferSize)
+	var written int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			w, werr := dst.Write(buf[:n])
+			written += int64(w)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// writeFileAtomic writes src to a temporary file next to path and renames it
+// into place once complete, so readers never see a partial file. If ctx is
+// done, check (when not nil) rejects the content or anything fails, the
+// temporary file is removed and path is untouched.
+func writeFileAtomic(ctx context.Context, path string, src io.Reader, perm os.FileMode, check func() error) error {
+	tmp, err := stageFile(ctx, path, src, perm, check)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// stageFile is the first half of writeFileAtomic: it writes src to a
+// temporary file next to path and returns its name, for the caller to
+// rename into place or remove. Nothing is left behind when it fails.
+func stageFile(ctx context.Context, path string, src io.Reader, perm os.FileMode, check func() error) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = copyContext(ctx, tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && check != nil {
+		err = check()
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// countingFile stands for a huge file, counting the bytes read from it.
+type countingFile struct {
+	read int64
+}
+
+func (r *countingFile) Read(p []byte) (int, error) {
+	r.read += int64(len(p))
+	return len(p), nil
+}
+
+// cancelAfter is a client going away once it received limit bytes.
+type cancelAfter struct {
+	limit, written int64
+	cancel         context.CancelFunc
+}
+
+func (w *cancelAfter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	if w.written >= w.limit {
+		w.cancel()
+	}
+	return len(p), nil
+}
+
+// Once the context is done, at most one more buffer is read from the file.
+func TestCopyContextStopsReading(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	src := &countingFile{}
+	dst := &cancelAfter{limit: 100 * copyBufferSize / 3, cancel: cancel}
+
+	written, err := copyContext(ctx, dst, src)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want the context error", err)
+	}
+	if src.read > dst.limit+copyBufferSize {
+		t.Errorf("read %d bytes, more than a buffer past the %d where the client left", src.read, dst.limit)
+	}
+	if written != dst.written {
+		t.Errorf("reported %d bytes written, %d were", written, dst.written)
+	}
+}
+
+// An upload whose client went away leaves neither the file changed nor a
+// temporary file behind.
+func TestWriteFileAtomicCanceled(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kept.txt")
+	os.WriteFile(path, []byte("old"), 0644)
+	ctx, cancel := context.WithCancel(context.Background())
+	src := io.TeeReader(&io.LimitedReader{R: &countingFile{}, N: 1 << 30}, &cancelAfter{limit: 3 * copyBufferSize, cancel: cancel})
+
+	if err := writeFileAtomic(ctx, path, src, 0644, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want the context error", err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "old" {
+		t.Errorf("the file became %d bytes", len(got))
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d entries left in the directory", len(entries))
+	}
+}
+
+func TestDirListingCanceled(t *testing.T) {
+	dir := t.TempDir()
+	for i := range 10 {
+		os.WriteFile(filepath.Join(dir, fmt.Sprint(i)), nil, 0644)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	listed := func(string, os.DirEntry) bool { return true }
+	if _, err := renderDirListingJSON(ctx, dir, listed); !errors.Is(err, context.Canceled) {
+		t.Errorf("JSON: got %v", err)
+	}
+	if _, err := renderDirListingHTML(ctx, "/files/", dir, listed); !errors.Is(err, context.Canceled) {
+		t.Errorf("HTML: got %v", err)
+	}
+}
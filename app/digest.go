@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// reprDigestAlgorithms are the Repr-Digest algorithms uploads can be checked with (RFC 9530).
+var reprDigestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// uploadDigest is a digest the client announced for an upload.
+type uploadDigest struct {
+	// header is Content-MD5 or Repr-Digest, algorithm the Repr-Digest key.
+	header, algorithm string
+	want              []byte
+	hash              hash.Hash
+}
+
+type uploadDigests []*uploadDigest
+
+// digestMismatchError is returned when an upload doesn't match its announced digest.
+type digestMismatchError struct {
+	digest *uploadDigest
+}
+
+func (e *digestMismatchError) Error() string {
+	if e.digest.header == "Content-MD5" {
+		return "body doesn't match Content-MD5"
+	}
+	return fmt.Sprintf("body doesn't match its %s Repr-Digest", e.digest.algorithm)
+}
+
+// statusCode is 400 for Content-MD5, like servers used to answer, and 422 for Repr-Digest.
+func (e *digestMismatchError) statusCode() int {
+	if e.digest.header == "Content-MD5" {
+		return 400
+	}
+	return 422
+}
+
+// parseUploadDigests reads the Content-MD5 and Repr-Digest headers of an upload.
+// Unknown Repr-Digest algorithms are skipped, but at least one must be known.
+func parseUploadDigests(headers Headers) (uploadDigests, error) {
+	var digests uploadDigests
+	if value, found := headers.Get("Content-MD5"); found {
+		want, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(want) != md5.Size {
+			return nil, fmt.Errorf("invalid Content-MD5 '%s'", value)
+		}
+		digests = append(digests, &uploadDigest{header: "Content-MD5", want: want, hash: md5.New()})
+	}
+
+	value, found := headers.Get("Repr-Digest")
+	if !found {
+		return digests, nil
+	}
+	known := false
+	for _, member := range strings.Split(value, ",") {
+		algorithm, encoded, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid Repr-Digest '%s'", value)
+		}
+		algorithm = strings.ToLower(algorithm)
+		newHash, supported := reprDigestAlgorithms[algorithm]
+		if !supported {
+			continue
+		}
+		// Structured field byte sequences are base64 between colons
+		inner, ok := strings.CutPrefix(encoded, ":")
+		inner, ok2 := strings.CutSuffix(inner, ":")
+		want, err := base64.StdEncoding.DecodeString(inner)
+		if !ok || !ok2 || err != nil {
+			return nil, fmt.Errorf("invalid %s digest in Repr-Digest '%s'", algorithm, value)
+		}
+		digests = append(digests, &uploadDigest{header: "Repr-Digest", algorithm: algorithm, want: want, hash: newHash()})
+		known = true
+	}
+	if !known {
+		return nil, errors.New("no supported algorithm in Repr-Digest")
+	}
+	return digests, nil
+}
+
+// writer feeds every digest at once.
+func (d uploadDigests) writer() io.Writer {
+	writers := make([]io.Writer, len(d))
+	for i, digest := range d {
+		writers[i] = digest.hash
+	}
+	return io.MultiWriter(writers...)
+}
+
+// verify fails with a *digestMismatchError unless the data written matches every digest.
+func (d uploadDigests) verify() error {
+	for _, digest := range d {
+		if !bytes.Equal(digest.hash.Sum(nil), digest.want) {
+			return &digestMismatchError{digest: digest}
+		}
+	}
+	return nil
+}
+
+// echo sets the digests of what was stored, in the forms the client used.
+func (d uploadDigests) echo(headers Headers) {
+	var repr []string
+	for _, digest := range d {
+		sum := base64.StdEncoding.EncodeToString(digest.hash.Sum(nil))
+		if digest.header == "Content-MD5" {
+			headers.Set("Content-MD5", sum)
+		} else {
+			repr = append(repr, digest.algorithm+"=:"+sum+":")
+		}
+	}
+	if len(repr) > 0 {
+		headers.Set("Repr-Digest", strings.Join(repr, ", "))
+	}
+}
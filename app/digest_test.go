@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func md5Header(content string) string {
+	sum := md5.Sum([]byte(content))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func sha256Member(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+func sha512Member(content string) string {
+	sum := sha512.Sum512([]byte(content))
+	return "sha-512=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+func TestUploadDigests(t *testing.T) {
+	const content = "the stored content\n"
+	tests := []struct {
+		name     string
+		headers  []string
+		status   int
+		wantEcho [2]string
+	}{
+		{"Content-MD5 match", []string{"Content-MD5", md5Header(content)}, 201, [2]string{"Content-MD5", md5Header(content)}},
+		{"Content-MD5 mismatch", []string{"Content-MD5", md5Header("other")}, 400, [2]string{}},
+		{"Content-MD5 invalid", []string{"Content-MD5", "not base64"}, 400, [2]string{}},
+		{"Repr-Digest match", []string{"Repr-Digest", sha256Member(content)}, 201, [2]string{"Repr-Digest", sha256Member(content)}},
+		{"Repr-Digest mismatch", []string{"Repr-Digest", sha256Member("other")}, 422, [2]string{}},
+		{"several algorithms", []string{"Repr-Digest", sha256Member(content) + ", " + sha512Member(content)}, 201,
+			[2]string{"Repr-Digest", sha256Member(content) + ", " + sha512Member(content)}},
+		{"one of several mismatching", []string{"Repr-Digest", sha256Member(content) + ", " + sha512Member("other")}, 422, [2]string{}},
+		{"unknown algorithm ignored", []string{"Repr-Digest", "crc32c=:AAAAAA==:, " + sha256Member(content)}, 201,
+			[2]string{"Repr-Digest", sha256Member(content)}},
+		{"only unknown algorithms", []string{"Repr-Digest", "crc32c=:AAAAAA==:"}, 400, [2]string{}},
+		{"both headers", []string{"Content-MD5", md5Header(content), "Repr-Digest", sha256Member(content)}, 201,
+			[2]string{"Repr-Digest", sha256Member(content)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			target := filepath.Join(dir, "kept.txt")
+			if err := os.WriteFile(target, []byte("the old content"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, addr := startServer(t, fileRouter(dir))
+			c := dial(t, addr)
+
+			req := newTestRequest("PUT", "/files/kept.txt", tt.headers...)
+			req.Body = content
+			res, err := c.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.status {
+				t.Fatalf("got %d, want %d", res.StatusCode, tt.status)
+			}
+			got, _ := os.ReadFile(target)
+			if tt.status != 201 {
+				if string(got) != "the old content" {
+					t.Errorf("the existing file became %q", got)
+				}
+			} else {
+				if string(got) != content {
+					t.Errorf("stored %q", got)
+				}
+				if echo, _ := res.Headers.Get(tt.wantEcho[0]); echo != tt.wantEcho[1] {
+					t.Errorf("%s %q, want %q", tt.wantEcho[0], echo, tt.wantEcho[1])
+				}
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+				t.Errorf("%d entries in the directory, want the file alone", len(entries))
+			}
+		})
+	}
+}
+
+// The digest of a resumable upload is the one of the whole file and is
+// checked once the last chunk is in, whichever chunk announced it.
+func TestRangeUploadDigests(t *testing.T) {
+	const content = "aaaabbbb"
+	tests := []struct {
+		name    string
+		headers [2][]string // of the first and of the last chunk
+		status  int
+	}{
+		{"announced first", [2][]string{{"Repr-Digest", sha256Member(content)}, nil}, 201},
+		{"announced last", [2][]string{nil, {"Content-MD5", md5Header(content)}}, 201},
+		{"Repr-Digest mismatch", [2][]string{{"Repr-Digest", sha256Member("aaaacccc")}, nil}, 422},
+		{"Content-MD5 mismatch", [2][]string{nil, {"Content-MD5", md5Header("aaaa")}}, 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			_, addr := startServer(t, fileRouter(dir))
+			c := dial(t, addr)
+
+			for i, rng := range []string{"bytes 0-3/8", "bytes 4-7/8"} {
+				headers := append([]string{"Content-Range", rng}, tt.headers[i]...)
+				req := newTestRequest("PATCH", "/files/whole.txt", headers...)
+				req.Body = content[i*4 : i*4+4]
+				res, err := c.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := 308
+				if i == 1 {
+					want = tt.status
+				}
+				if res.StatusCode != want {
+					t.Fatalf("chunk %d: got %d, want %d", i, res.StatusCode, want)
+				}
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "whole.txt"))
+			if tt.status == 201 && string(got) != content {
+				t.Errorf("stored %q, %v", got, err)
+			}
+			if tt.status != 201 && err == nil {
+				t.Errorf("a mismatching upload was stored: %q", got)
+			}
+			if _, err := os.Stat(stagingPath(filepath.Join(dir, "whole.txt"))); !os.IsNotExist(err) {
+				t.Errorf("staging file left behind: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// RFC 9110 8.8.3 - entity-tag = [ weak ] opaque-tag
+// weak = %s"W/"
+// opaque-tag = DQUOTE *etagc DQUOTE
+
+// isWeakETag reports whether etag carries the W/ prefix.
+func isWeakETag(etag string) bool {
+	return strings.HasPrefix(etag, "W/")
+}
+
+// ETagsMatchStrong implements the strong comparison: both validators are
+// strong and their opaque tags are identical. Used by If-Match and If-Range.
+func ETagsMatchStrong(a, b string) bool {
+	return !isWeakETag(a) && !isWeakETag(b) && a == b
+}
+
+// ETagsMatchWeak implements the weak comparison: the opaque tags are
+// identical, whether either validator is weak or not. Used by If-None-Match.
+func ETagsMatchWeak(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// ParseETagList splits a header value like `W/"a", "b,c", *` into its entity-tags.
+// Commas inside the quotes belong to the tag. Malformed elements are skipped.
+func ParseETagList(value string) []string {
+	var tags []string
+	for i := 0; i < len(value); {
+		switch c := value[i]; {
+		case c == ' ' || c == '\t' || c == ',':
+			i++
+		case c == '*':
+			tags = append(tags, "*")
+			i++
+		default:
+			start := i
+			if strings.HasPrefix(value[i:], "W/") {
+				i += 2
+			}
+			if i >= len(value) || value[i] != '"' {
+				// Not an entity-tag, skip to the next element
+				for i < len(value) && value[i] != ',' {
+					i++
+				}
+				continue
+			}
+			end := strings.IndexByte(value[i+1:], '"')
+			if end < 0 {
+				return tags
+			}
+			i += end + 2
+			tags = append(tags, value[start:i])
+		}
+	}
+	return tags
+}
+
+// ETagListMatches reports whether etag matches any tag of a conditional
+// header value, using the strong or weak comparison. "*" matches any current representation.
+func ETagListMatches(value, etag string, strong bool) bool {
+	for _, tag := range ParseETagList(value) {
+		if tag == "*" {
+			return etag != ""
+		}
+		if strong && ETagsMatchStrong(tag, etag) || !strong && ETagsMatchWeak(tag, etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentETag derives the strong ETag of a body from its SHA-256.
+func contentETag(sum [sha256.Size]byte) string {
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// ETag adds a strong ETag computed from the body to successful GET responses
+// and answers a matching If-None-Match with 304 Not Modified.
+// Streamed bodies are buffered up to maxBuffer bytes, larger ones are sent without an ETag.
+func ETag(maxBuffer int) Middleware {
+	recorder := NewResponseRecorder(maxBuffer)
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *Request, res *Response) {
+			next(req, res)
+
+			// The body of the answer to a HEAD isn't sent, so it isn't
+			// produced to compute the tag either
+			if res.StatusCode != 200 || req.Method != "GET" {
+				return
+			}
+			if _, found := res.Headers.Get("ETag"); found {
+				return
+			}
+
+			buffered, err := recorder.Record(res)
+			if err != nil {
+				fmt.Println("Error buffering response: ", err.Error())
+				// What the stream produced is lost, it can't be sent again
+				res.StatusCode = 500
+				res.ReasonPhrase = "Internal Server Error"
+				res.Stream = nil
+				res.Body = ""
+				delete(res.Headers, "content-length")
+				return
+			}
+			if !buffered {
+				return
+			}
+
+			etag := contentETag(sha256.Sum256([]byte(res.Body)))
+			res.Headers.Set("ETag", etag)
+
+			// A middleware about to encode the body sends another tag,
+			// it compares If-None-Match with that one
+			if !req.encodingPending {
+				notModified(req, res, etag)
+			}
+		}
+	}
+}
+
+// notModified turns res into a 304 Not Modified if If-None-Match matches
+// etag, the tag of the representation sent, and reports whether it did.
+func notModified(req *Request, res *Response, etag string) bool {
+	// If-None-Match uses the weak comparison
+	inm, found := req.Headers.Get("If-None-Match")
+	if !found || !ETagListMatches(inm, etag, false) {
+		return false
+	}
+	res.StatusCode = 304
+	res.ReasonPhrase = "Not Modified"
+	res.Body = ""
+	res.Stream = nil
+	delete(res.Headers, "content-length")
+	return true
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// MetadataContentType is the media type of the file metadata representation.
+const MetadataContentType = "application/vnd.server.metadata+json"
+
+// metadataHashLimit is the largest file hashed for its metadata. It matches
+// the buffer of the ETag middleware, so the advertised ETag is the one a GET
+// of the content gets.
+const metadataHashLimit = 1 << 20
+
+type fileMetadata struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"modTime"`
+	ContentType string    `json:"contentType"`
+	ETag        string    `json:"etag,omitempty"`
+	SHA256      string    `json:"sha256,omitempty"`
+}
+
+// wantsMetadata reports whether the client asks for the metadata of a file
+// rather than its content, with ?meta=1 or by preferring MetadataContentType.
+func wantsMetadata(req *Request) bool {
+	if req.Query().Get("meta") == "1" {
+		return true
+	}
+	return Negotiate(req, []string{"application/octet-stream", MetadataContentType}) == MetadataContentType
+}
+
+// serveFileMetadata answers with a JSON description of the file at filePath.
+// Files up to metadataHashLimit bytes are read to include their checksum.
+func serveFileMetadata(req *Request, res *Response, filePath string, info os.FileInfo) {
+	meta := fileMetadata{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		ModTime: info.ModTime().UTC(),
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		statError(res, filePath, err)
+		return
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	sniff := &prefixWriter{limit: 512}
+	if info.Size() <= metadataHashLimit {
+		_, err = copyContext(req.Context(), io.MultiWriter(hash, sniff), f)
+	} else {
+		_, err = io.CopyN(sniff, f, 512)
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		fmt.Printf("Error reading file: %v\n", err)
+		res.StatusCode = 500
+		res.ReasonPhrase = "Internal Server Error"
+		return
+	}
+
+	meta.ContentType = mime.TypeByExtension(filepath.Ext(filePath))
+	if meta.ContentType == "" {
+		meta.ContentType = http.DetectContentType(sniff.buf)
+	}
+	if info.Size() <= metadataHashLimit {
+		var sum [sha256.Size]byte
+		hash.Sum(sum[:0])
+		meta.ETag = contentETag(sum)
+		meta.SHA256 = hex.EncodeToString(sum[:])
+	}
+
+	body, err := json.Marshal(meta)
+	if err != nil {
+		res.StatusCode = 500
+		res.ReasonPhrase = "Internal Server Error"
+		return
+	}
+	res.Headers.Set("Content-Type", MetadataContentType)
+	res.Headers.Set("Content-Length", strconv.Itoa(len(body)))
+	res.Body = string(body)
+}
+
+// prefixWriter keeps the first limit bytes written to it.
+type prefixWriter struct {
+	buf   []byte
+	limit int
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	if room := w.limit - len(w.buf); room > 0 {
+		w.buf = append(w.buf, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// One URL serves the content of a file or its metadata, picked by Accept
+// or ?meta=1, and says it varies with Accept.
+func TestFileMetadata(t *testing.T) {
+	dir := t.TempDir()
+	content := "%PDF-1.4 report"
+	os.WriteFile(filepath.Join(dir, "report.pdf"), []byte(content), 0644)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "sub", "a.txt"), []byte("a"), 0644)
+	_, addr := startServer(t, fileRouter(dir))
+	c := dial(t, addr)
+
+	get := func(target string, headers ...string) *Response {
+		t.Helper()
+		res, err := c.Do(newTestRequest("GET", target, headers...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 200 || !slices.Contains(res.Headers.Values("Vary"), "Accept") {
+			t.Errorf("GET %s %v: got %d, Vary %v", target, headers, res.StatusCode, res.Headers.Values("Vary"))
+		}
+		return res
+	}
+
+	for _, headers := range [][]string{nil, {"Accept", "*/*"}, {"Accept", "application/pdf"}} {
+		if res := get("/files/report.pdf", headers...); res.Body != content {
+			t.Errorf("Accept %v: got %q, want the content", headers, res.Body)
+		}
+	}
+
+	sum := sha256.Sum256([]byte(content))
+	for _, tt := range []struct {
+		target  string
+		headers []string
+	}{
+		{"/files/report.pdf", []string{"Accept", MetadataContentType}},
+		{"/files/report.pdf", []string{"Accept", "application/octet-stream;q=0.5, " + MetadataContentType}},
+		{"/files/report.pdf?meta=1", nil},
+	} {
+		res := get(tt.target, tt.headers...)
+		if ct, _ := res.Headers.Get("Content-Type"); ct != MetadataContentType {
+			t.Errorf("%s %v: Content-Type %q", tt.target, tt.headers, ct)
+		}
+		var meta fileMetadata
+		if err := json.Unmarshal([]byte(res.Body), &meta); err != nil {
+			t.Fatalf("%s %v: %v in %q", tt.target, tt.headers, err, res.Body)
+		}
+		if meta.Name != "report.pdf" || meta.Size != int64(len(content)) || meta.ContentType != "application/pdf" ||
+			meta.SHA256 != hex.EncodeToString(sum[:]) || meta.ETag != contentETag(sum) || meta.ModTime.IsZero() {
+			t.Errorf("%s %v: got %+v", tt.target, tt.headers, meta)
+		}
+	}
+
+	// A directory delegates to its JSON listing
+	res := get("/files/sub/?meta=1")
+	if ct, _ := res.Headers.Get("Content-Type"); ct != "application/json" || !strings.Contains(res.Body, "a.txt") {
+		t.Errorf("directory metadata: %q, %q", ct, res.Body)
+	}
+}
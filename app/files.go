@@ -0,0 +1,766 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FileServer serves the files under Root at the URL paths starting with
+// Prefix, and stores the ones uploaded there.
+type FileServer struct {
+	Prefix string
+	Root   string
+	// ReadOnly only registers GET, so uploads get a 405.
+	ReadOnly bool
+	// Listing renders directory indexes. Without it directories are 404s.
+	Listing bool
+	// MaxAge, when positive, is advertised in a Cache-Control header on files.
+	MaxAge time.Duration
+	// MaxPartSize and MaxUploadSize bound each file and the whole of a
+	// multipart upload, 0 means no limit.
+	MaxPartSize   int64
+	MaxUploadSize int64
+	// WebDAV answers PROPFIND, read-only or not.
+	WebDAV bool
+	// Index, when set, is the file served for a directory containing it, instead of a listing.
+	Index string
+	// MmapThreshold, when positive, serves the files of at least this many
+	// bytes from a memory mapping kept while the file is unchanged, saving
+	// the reads of files requested over and over.
+	MmapThreshold int64
+	// AbsoluteRedirects makes the redirects to directory URLs absolute, with
+	// the scheme and host the request came with.
+	AbsoluteRedirects bool
+	// ConflictOnBusyWrite answers 409 Conflict to a request writing a file
+	// that another request is being written to, instead of waiting its turn.
+	ConflictOnBusyWrite bool
+	// ConsistentReads only serves a file once two looks at it, through its
+	// path and through the opened file, agree on its size and modification
+	// time. A file still changing after a few tries gets a 503, and one
+	// changing while it is sent has its connection cut short rather than
+	// the client getting a mix of two versions.
+	ConsistentReads bool
+	// SanitizeName, when set, vets the name of every file or directory
+	// written or deleted, and may rewrite it. An error rejects the request
+	// with a 400.
+	SanitizeName func(name string) (string, error)
+}
+
+// NewFileServer creates a writable FileServer with listings for root at prefix.
+func NewFileServer(prefix, root string) *FileServer {
+	return &FileServer{
+		Prefix:        prefix,
+		Root:          root,
+		Listing:       true,
+		MaxPartSize:   16 << 20,
+		MaxUploadSize: 64 << 20,
+		SanitizeName:  DefaultSanitizeName,
+	}
+}
+
+// maxNameBytes is the longest file name most file systems accept.
+const maxNameBytes = 255
+
+// DefaultSanitizeName rejects the names that are trouble on some file
+// system: too long, hidden or clashing with the staging files (leading
+// dot), carrying control characters or a colon, ending with a dot or a
+// space, or reserved on Windows (CON, NUL, COM1...).
+func DefaultSanitizeName(name string) (string, error) {
+	switch {
+	case len(name) > maxNameBytes:
+		return "", fmt.Errorf("name longer than %d bytes", maxNameBytes)
+	case strings.HasPrefix(name, "."):
+		return "", errors.New("name starts with a dot")
+	case strings.ContainsFunc(name, func(r rune) bool { return r < 0x20 || r == 0x7f || r == ':' }):
+		return "", errors.New("name contains a control character or a colon")
+	case strings.HasSuffix(name, ".") || strings.HasSuffix(name, " "):
+		return "", errors.New("name ends with a dot or a space")
+	}
+	stem, _, _ := strings.Cut(strings.ToUpper(name), ".")
+	switch stem {
+	case "CON", "PRN", "AUX", "NUL":
+		return "", fmt.Errorf("reserved name '%s'", name)
+	}
+	if len(stem) == 4 && (strings.HasPrefix(stem, "COM") || strings.HasPrefix(stem, "LPT")) && '1' <= stem[3] && stem[3] <= '9' {
+		return "", fmt.Errorf("reserved name '%s'", name)
+	}
+	return name, nil
+}
+
+// sanitize runs SanitizeName on the last element of a path about to be
+// written or deleted, answering 400 when it is refused.
+func (fs *FileServer) sanitize(res *Response, filePath string) (string, bool) {
+	if fs.SanitizeName == nil {
+		return filePath, true
+	}
+	name, err := fs.SanitizeName(filepath.Base(filePath))
+	if err == nil && (name == "" || !safeName(name) || strings.Contains(name, "/") || name == "..") {
+		err = fmt.Errorf("invalid rewritten name '%s'", name)
+	}
+	if err != nil {
+		fmt.Println("Rejected file name: ", err.Error())
+		res.StatusCode = 400
+		res.ReasonPhrase = "Bad Request"
+		res.Headers.Set("Content-Type", "text/plain; charset=utf-8")
+		res.Body = err.Error() + "\n"
+		return "", false
+	}
+	return filepath.Join(filepath.Dir(filePath), name), true
+}
+
+// resolve maps a request URI to a path under Root.
+// It reports false when the path would escape Root, by its ".." segments
+// or through a symbolic link, or goes through a hidden name.
+func (fs *FileServer) resolve(uri string) (string, bool) {
+	name := strings.TrimPrefix(uri, fs.Prefix)
+	if !safeName(name) {
+		return "", false
+	}
+	filePath := filepath.Join(fs.Root, name)
+	if !isWithin(fs.Root, filePath) || !fs.linksWithin(filePath) {
+		return "", false
+	}
+	rel, _ := filepath.Rel(fs.Root, filePath)
+	for _, segment := range strings.Split(filepath.ToSlash(rel), "/") {
+		if hiddenName(segment) {
+			return "", false
+		}
+	}
+	return filePath, true
+}
+
+// hiddenName reports whether a file name is kept out of reach of the
+// clients: the dot-prefixed ones, which are the staging files of the
+// uploads in progress as well as the dotfiles of whoever shares the
+// directory. They are neither served, written nor listed.
+func hiddenName(name string) bool {
+	return strings.HasPrefix(name, ".") && name != "."
+}
+
+// listed reports whether the entry of dir shows in its listings: not
+// when hidden, nor when a symbolic link leading out of Root, which
+// requests can't follow either. Only links cost more than the entry.
+func (fs *FileServer) listed(dir string, entry os.DirEntry) bool {
+	if hiddenName(entry.Name()) {
+		return false
+	}
+	return entry.Type()&os.ModeSymlink == 0 || fs.linksWithin(filepath.Join(dir, entry.Name()))
+}
+
+// isWithin reports whether path is dir or under it.
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// linksWithin reports whether the symbolic links along filePath leave it
+// under Root. Only its existing part is followed, what is still to be
+// created can't be a link, but a dangling link would be written through.
+func (fs *FileServer) linksWithin(filePath string) bool {
+	root, err := filepath.EvalSymlinks(fs.Root)
+	if err != nil {
+		root = fs.Root
+	}
+	for existing := filePath; ; existing = filepath.Dir(existing) {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			return isWithin(root, resolved)
+		}
+		// A name too long to exist is left for the name checks to refuse
+		if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) && !errors.Is(err, syscall.ENAMETOOLONG) {
+			return false
+		}
+		if info, err := os.Lstat(existing); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return false
+		}
+		if filepath.Dir(existing) == existing {
+			return true
+		}
+	}
+}
+
+// safeName rejects names that only mean something on some platforms:
+// backslash separators, drive letters like "C:" and NUL bytes. They are
+// refused everywhere so the guard doesn't depend on the build target.
+func safeName(name string) bool {
+	if strings.ContainsAny(name, "\\\x00") {
+		return false
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if len(segment) >= 2 && segment[1] == ':' && isASCIILetter(segment[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isASCIILetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// canonicalURL returns the URL path of the file at filePath, under Root.
+func (fs *FileServer) canonicalURL(filePath string) string {
+	rel, err := filepath.Rel(fs.Root, filePath)
+	if err != nil || rel == "." {
+		return fs.Prefix
+	}
+	return (&url.URL{Path: fs.Prefix + filepath.ToSlash(rel)}).EscapedPath()
+}
+
+// Methods returns the methods to register the FileServer with.
+func (fs *FileServer) Methods() []string {
+	methods := []string{"GET"}
+	if !fs.ReadOnly {
+		methods = append(methods, "POST", "PUT", "PATCH", "DELETE", "MKCOL")
+	}
+	if fs.WebDAV {
+		methods = append(methods, "PROPFIND")
+	}
+	return methods
+}
+
+func (fs *FileServer) Handle(req *Request, res *Response) {
+	// No file name holds a slash, so an encoded one names nothing
+	if strings.Contains(strings.ToLower(req.RawPath()), "%2f") {
+		res.StatusCode = 404
+		res.ReasonPhrase = "Not Found"
+		return
+	}
+	uri := req.RawPath()
+	filePath, ok := fs.resolve(req.Path())
+	if !ok {
+		res.StatusCode = 403
+		res.ReasonPhrase = "Forbidden"
+		return
+	}
+
+	if req.Method == "PROPFIND" {
+		fs.propfindHandler(req, res, uri, filePath)
+		return
+	}
+
+	// The names written or deleted are vetted whether or not the file exists
+	// already, so a name refused on creation can't be reached another way
+	switch req.Method {
+	case "MKCOL", "PATCH", "POST", "PUT", "DELETE":
+		if filePath != filepath.Clean(fs.Root) {
+			if filePath, ok = fs.sanitize(res, filePath); !ok {
+				return
+			}
+		}
+	}
+
+	if req.Method == "MKCOL" || req.Method == "POST" && headerIsTrue(req, "X-Create-Directory") {
+		dirCreateHandler(req, res, filePath)
+		return
+	}
+
+	if req.Method == "DELETE" {
+		fileDeleteHandler(req, res, filePath)
+		return
+	}
+
+	if req.Method == "PATCH" {
+		// Only ranges of a resumable upload can be patched in
+		cr, found := req.Headers.Get("Content-Range")
+		if !found {
+			res.StatusCode = 400
+			res.ReasonPhrase = "Bad Request"
+			return
+		}
+		fileRangeUploadHandler(req, res, filePath, cr)
+		return
+	}
+
+	if req.Method == "POST" || req.Method == "PUT" {
+		if cr, found := req.Headers.Get("Content-Range"); found {
+			fileRangeUploadHandler(req, res, filePath, cr)
+			return
+		}
+		if boundary, ok := multipartBoundary(req); ok && req.Method == "POST" {
+			if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+				fs.multipartUploadHandler(req, res, req.Path(), boundary)
+				return
+			}
+		}
+		if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+			res.StatusCode = 409
+			res.ReasonPhrase = "Conflict"
+			res.Headers.Set("Content-Type", "text/plain; charset=utf-8")
+			res.Body = "a directory exists at this path\n"
+			return
+		}
+		fileCreateHandler(req, res, filePath, fs.ConflictOnBusyWrite)
+		return
+	}
+
+	info, err := os.Stat(filePath)
+	meta := wantsMetadata(req)
+	// Relative links within a directory only work from its URL with the slash
+	if err == nil && info.IsDir() && !strings.HasSuffix(uri, "/") {
+		fs.redirectToDir(req, res)
+		return
+	}
+	if err == nil && info.IsDir() && fs.Index != "" {
+		index := filepath.Join(filePath, fs.Index)
+		if indexInfo, indexErr := os.Stat(index); indexErr == nil && indexInfo.Mode().IsRegular() {
+			filePath, info = index, indexInfo
+		}
+	}
+	if err == nil && info.IsDir() {
+		if fs.Listing {
+			if meta {
+				fs.serveDirListing(req, res, filePath, info, true)
+			} else {
+				fs.dirListingHandler(req, res, filePath, info)
+			}
+			return
+		}
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		statError(res, filePath, err)
+		return
+	}
+
+	if fs.ConsistentReads {
+		var settled bool
+		if info, settled = settleFile(res, filePath, info); !settled {
+			return
+		}
+	}
+
+	if fs.MaxAge > 0 {
+		res.Headers.Set("Cache-Control", "max-age="+strconv.Itoa(int(fs.MaxAge.Seconds())))
+	}
+	// The same URL serves the content or the metadata depending on Accept
+	res.Vary("Accept")
+	res.Headers.Set("Content-Location", fs.canonicalURL(filePath))
+	if meta {
+		serveFileMetadata(req, res, filePath, info)
+		return
+	}
+	if fs.MmapThreshold > 0 && info.Size() >= fs.MmapThreshold {
+		serveMapped(req, res, filePath, info)
+		return
+	}
+	if fs.ConsistentReads {
+		serveSnapshot(req, res, filePath, info)
+		return
+	}
+	ServeFile(req, res, filePath, info)
+}
+
+// settleAttempts and settleDelay bound the wait for a file being written.
+const (
+	settleAttempts = 3
+	settleDelay    = 20 * time.Millisecond
+)
+
+// settleFile checks that the file at filePath, last described by info,
+// isn't being changed: the opened file and a stat taken after opening it
+// must both match the description. It looks again a few times before
+// giving up with a 503, and returns the description it settled on.
+func settleFile(res *Response, filePath string, info os.FileInfo) (os.FileInfo, bool) {
+	for attempt := 1; ; attempt++ {
+		opened, after, err := statTwice(filePath)
+		if err != nil {
+			statError(res, filePath, err)
+			return nil, false
+		}
+		if sameVersion(info, opened) && sameVersion(opened, after) {
+			return info, true
+		}
+		if attempt == settleAttempts {
+			fmt.Printf("File '%s' is still changing, giving up\n", filePath)
+			unavailable(res, time.Second)
+			res.Headers.Set("Content-Type", "text/plain; charset=utf-8")
+			res.Body = "file is being written, try again later\n"
+			return nil, false
+		}
+		time.Sleep(settleDelay)
+		info = after
+	}
+}
+
+// statTwice describes filePath through the opened file, then through its path.
+func statTwice(filePath string) (os.FileInfo, os.FileInfo, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	opened, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	after, err := os.Stat(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return opened, after, nil
+}
+
+// serveSnapshot is ServeFile refusing to send anything but the version of
+// the file described by info: the file opened must still be that version,
+// and still be when all of it has been sent. Otherwise the stream fails,
+// which cuts the connection short so the client can tell.
+func serveSnapshot(req *Request, res *Response, filePath string, info os.FileInfo) {
+	section := serveFile(req, res, filePath, info)
+	if res.Stream == nil {
+		return
+	}
+	res.Stream = func(w io.Writer) error {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if opened, err := f.Stat(); err != nil || !sameVersion(info, opened) {
+			return fmt.Errorf("file '%s' changed before being sent", filePath)
+		}
+		n, err := copyContext(req.Context(), w, io.NewSectionReader(f, section.offset, section.length))
+		if err != nil {
+			return err
+		}
+		if sent, err := f.Stat(); err != nil || n != section.length || !sameVersion(info, sent) {
+			return fmt.Errorf("file '%s' changed while being sent", filePath)
+		}
+		return nil
+	}
+}
+
+// statError turns a failure to stat filePath into a 404 or a 500.
+func statError(res *Response, filePath string, err error) {
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("File '%s' not found, need to create it\n", filePath)
+		res.StatusCode = 404
+		res.ReasonPhrase = "Not Found"
+	} else {
+		fmt.Printf("Error opening file: %v\n", err)
+		res.StatusCode = 500
+		res.ReasonPhrase = "Internal Server Error"
+	}
+}
+
+// ServeFile answers req with the content of the regular file at filePath,
+// described by info. A GET with a single byte Range gets that part of it.
+func ServeFile(req *Request, res *Response, filePath string, info os.FileInfo) {
+	serveFile(req, res, filePath, info)
+}
+
+// serveFile is ServeFile, returning the section of the file res streams.
+func serveFile(req *Request, res *Response, filePath string, info os.FileInfo) fileSection {
+	section := fileSection{length: info.Size()}
+	// HTTP-dates have a one second resolution
+	lastModified := info.ModTime().Truncate(time.Second)
+	res.Headers.Set("Last-Modified", FormatHTTPDate(lastModified))
+
+	// If-None-Match takes precedence, it is handled by the ETag middleware
+	if _, found := req.Headers.Get("If-None-Match"); !found {
+		if ims, found := req.Headers.Get("If-Modified-Since"); found {
+			// An invalid date is ignored, as if the header wasn't sent
+			if t, err := parseHTTPDate(ims, req.now()); err == nil && !lastModified.After(t) {
+				res.StatusCode = 304
+				res.ReasonPhrase = "Not Modified"
+				return section
+			}
+		}
+	}
+
+	res.Headers.Set("Accept-Ranges", "bytes")
+	if value, found := req.Headers.Get("Range"); found && req.Method == "GET" {
+		ifRange, conditional := req.Headers.Get("If-Range")
+		if !conditional || ifRangeMatches(ifRange, lastModified, req.now(), func() (string, error) { return fileETag(filePath) }) {
+			switch ranged, outcome := parseRange(value, info.Size()); outcome {
+			case rangeSatisfiable:
+				section = ranged
+				res.StatusCode = 206
+				res.ReasonPhrase = StatusText(206)
+				res.Headers.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", section.offset, section.offset+section.length-1, info.Size()))
+			case rangeUnsatisfiable:
+				res.StatusCode = 416
+				res.ReasonPhrase = StatusText(416)
+				res.Headers.Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size()))
+				return section
+			}
+		}
+	}
+
+	res.Headers.Set("Content-Type", "application/octet-stream")
+	res.Headers.Set("Content-Length", strconv.FormatInt(section.length, 10))
+	// Stream from disk, stopping as soon as the client is gone
+	res.Stream = func(w io.Writer) error {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, err := copyContext(req.Context(), w, io.NewSectionReader(f, section.offset, section.length))
+		if err == nil && n != section.length {
+			err = fmt.Errorf("file '%s' shrank while being sent", filePath)
+		}
+		return err
+	}
+	return section
+}
+
+// fileCreateHandler writes the body to filePath. Writes to the same path
+// take turns, unless conflict is set: a write finding another one in
+// progress is then refused with a 409.
+func fileCreateHandler(req *Request, res *Response, filePath string, conflict bool) {
+	digests, err := parseUploadDigests(req.Headers)
+	if err != nil {
+		fmt.Println("Error reading upload digest: ", err.Error())
+		res.StatusCode = 400
+		res.ReasonPhrase = "Bad Request"
+		return
+	}
+
+	// The body goes straight to the file, the digests are computed on the way
+	src := req.BodyReader()
+	if len(digests) > 0 {
+		src = io.TeeReader(src, digests.writer())
+	}
+	var unlock func()
+	if conflict {
+		var ok bool
+		if unlock, ok = filePathLocks.tryLock(filePath); !ok {
+			res.StatusCode = 409
+			res.ReasonPhrase = "Conflict"
+			res.Headers.Set("Content-Type", "text/plain; charset=utf-8")
+			res.Body = "file is being written by another request\n"
+			return
+		}
+	} else {
+		unlock = filePathLocks.lock(filePath)
+	}
+	err = writeFileAtomic(req.Context(), filePath, src, 0644, digests.verify)
+	unlock()
+	var mismatch *digestMismatchError
+	if errors.As(err, &mismatch) {
+		fmt.Println("Rejected upload: ", err.Error())
+		res.StatusCode = mismatch.statusCode()
+		res.ReasonPhrase = StatusText(res.StatusCode)
+		return
+	}
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		fmt.Println("Error reading body: ", err.Error())
+		parseErr.respond(res)
+		return
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		fmt.Println("Error reading body: ", err.Error())
+		res.StatusCode = 400
+		res.ReasonPhrase = "Bad Request"
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error writing file: %v\n", err)
+		res.StatusCode = 500
+		res.ReasonPhrase = "Internal Server Error"
+		return
+	}
+
+	digests.echo(res.Headers)
+	res.StatusCode = 201
+	res.ReasonPhrase = "Created"
+}
+
+// redirectToDir answers a request for a directory URL missing its trailing
+// slash with a 301 to the URL with it, keeping the query.
+func (fs *FileServer) redirectToDir(req *Request, res *Response) {
+	path, query, hasQuery := strings.Cut(req.sentTarget(), "?")
+	location := path + "/"
+	if hasQuery {
+		location += "?" + query
+	}
+	if fs.AbsoluteRedirects {
+		scheme := "http"
+		if req.IsTLS() {
+			scheme = "https"
+		}
+		location = scheme + "://" + req.EffectiveHost() + location
+	}
+	res.StatusCode = 301
+	res.ReasonPhrase = "Moved Permanently"
+	res.Headers.Set("Location", location)
+}
+
+// bufferBody reads a streamed body whole for the handlers that need it so,
+// answering 400 when it can't be.
+func bufferBody(req *Request, res *Response) bool {
+	if err := req.BufferBody(); err != nil {
+		fmt.Println("Error reading body: ", err.Error())
+		res.StatusCode = 400
+		res.ReasonPhrase = "Bad Request"
+		var parseErr *ParseError
+		if errors.As(err, &parseErr) {
+			parseErr.respond(res)
+		}
+		return false
+	}
+	return true
+}
+
+// headerIsTrue reports whether the header name of req is "true".
+func headerIsTrue(req *Request, name string) bool {
+	value, _ := req.Headers.Get(name)
+	return strings.EqualFold(strings.TrimSpace(value), "true")
+}
+
+// dirCreateHandler creates the directory at dirPath. Its parent must exist,
+// unless the request carries X-Create-Parents: true.
+func dirCreateHandler(req *Request, res *Response, dirPath string) {
+	unlock := filePathLocks.lock(dirPath)
+	defer unlock()
+
+	if _, err := os.Stat(dirPath); err == nil {
+		res.StatusCode = 409
+		res.ReasonPhrase = StatusText(409)
+		return
+	}
+
+	mkdir := os.Mkdir
+	if headerIsTrue(req, "X-Create-Parents") {
+		mkdir = os.MkdirAll
+	}
+	err := mkdir(dirPath, 0755)
+	switch {
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, syscall.ENOTDIR):
+		// A parent is missing, or is a file
+		res.StatusCode = 409
+		res.ReasonPhrase = StatusText(409)
+	case errors.Is(err, os.ErrExist):
+		res.StatusCode = 409
+		res.ReasonPhrase = StatusText(409)
+	case err != nil:
+		fmt.Printf("Error creating directory: %v\n", err)
+		res.StatusCode = 500
+		res.ReasonPhrase = "Internal Server Error"
+	default:
+		res.StatusCode = 201
+		res.ReasonPhrase = "Created"
+	}
+}
+
+// fileDeleteHandler removes the file at filePath. With If-Match the file is
+// only removed if its current ETag matches, "*" meaning it merely has to exist.
+func fileDeleteHandler(req *Request, res *Response, filePath string) {
+	unlock := filePathLocks.lock(filePath)
+	defer unlock()
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		statError(res, filePath, err)
+		return
+	}
+	if info.IsDir() {
+		res.StatusCode = 403
+		res.ReasonPhrase = "Forbidden"
+		return
+	}
+
+	if ifMatch, found := req.Headers.Get("If-Match"); found {
+		etag, err := fileETag(filePath)
+		if err != nil {
+			statError(res, filePath, err)
+			return
+		}
+		// If-Match uses the strong comparison
+		if !ETagListMatches(ifMatch, etag, true) {
+			res.StatusCode = 412
+			res.ReasonPhrase = StatusText(412)
+			res.Headers.Set("ETag", etag)
+			return
+		}
+	}
+
+	if err := os.Remove(filePath); err != nil {
+		statError(res, filePath, err)
+		return
+	}
+	res.StatusCode = 204
+	res.ReasonPhrase = StatusText(204)
+}
+
+// ParseMount parses a --mount value: "/prefix=/dir" optionally followed by
+// ";ro" (read-only), ";nolisting", ";index=NAME" and ";maxage=SECONDS".
+func ParseMount(spec string) (*FileServer, error) {
+	options := strings.Split(spec, ";")
+	prefix, root, ok := strings.Cut(options[0], "=")
+	if !ok || !strings.HasPrefix(prefix, "/") || root == "" {
+		return nil, fmt.Errorf("invalid mount '%s', expected /prefix=/dir", spec)
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	fs := NewFileServer(prefix, root)
+	for _, option := range options[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+		switch name {
+		case "ro":
+			fs.ReadOnly = true
+		case "nolisting":
+			fs.Listing = false
+		case "index":
+			if value == "" || strings.ContainsAny(value, "/\\") {
+				return nil, fmt.Errorf("invalid index '%s' in mount '%s'", value, spec)
+			}
+			fs.Index = value
+		case "maxage":
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds < 0 {
+				return nil, fmt.Errorf("invalid maxage '%s' in mount '%s'", value, spec)
+			}
+			fs.MaxAge = time.Duration(seconds) * time.Second
+		default:
+			return nil, fmt.Errorf("unknown option '%s' in mount '%s'", name, spec)
+		}
+	}
+	return fs, nil
+}
+
+// ReadMountsFile reads mounts from a file holding one --mount value per
+// line. Blank lines and lines starting with "#" are skipped.
+func ReadMountsFile(path string) ([]*FileServer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var mounts []*FileServer
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fs, err := ParseMount(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		mounts = append(mounts, fs)
+	}
+	return mounts, nil
+}
+
+// CheckMounts rejects mounts whose prefixes overlap, since only one of them could ever match.
+func CheckMounts(mounts []*FileServer) error {
+	for i, a := range mounts {
+		for _, b := range mounts[i+1:] {
+			if strings.HasPrefix(a.Prefix, b.Prefix) || strings.HasPrefix(b.Prefix, a.Prefix) {
+				return fmt.Errorf("mounts '%s' and '%s' overlap", a.Prefix, b.Prefix)
+			}
+		}
+	}
+	return nil
+}
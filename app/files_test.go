@@ -0,0 +1,753 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultSanitizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"report.txt", true},
+		{"résumé.pdf", true},
+		{strings.Repeat("a", maxNameBytes), true},
+		{strings.Repeat("a", maxNameBytes+1), false},
+		{".hidden", false},
+		{".x.txt.upload", false},
+		{"a:b", false},
+		{"tab\there", false},
+		{"trailing.", false},
+		{"trailing ", false},
+		{"CON", false},
+		{"nul.txt", false},
+		{"Com1.log", false},
+		{"LPT9", false},
+		{"COM0", true},
+		{"CONSOLE", true},
+	}
+	for _, tt := range tests {
+		got, err := DefaultSanitizeName(tt.name)
+		if ok := err == nil; ok != tt.ok || ok && got != tt.name {
+			t.Errorf("DefaultSanitizeName(%.20q): got %q, %v", tt.name, got, err)
+		}
+	}
+}
+
+func TestUploadNameSanitized(t *testing.T) {
+	dir := t.TempDir()
+	// Put there behind the server's back, it still can't be written or deleted
+	if err := os.WriteFile(filepath.Join(dir, "NUL.txt"), []byte("kept"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, addr := startServer(t, fileRouter(dir))
+	c := dial(t, addr)
+
+	long := strings.Repeat("x", maxNameBytes+1)
+	tests := []struct {
+		method, name string
+	}{
+		{"PUT", long},
+		{"POST", long},
+		{"PUT", "aux"},
+		{"MKCOL", "PRN"},
+		{"PUT", "NUL.txt"},
+		{"PATCH", "NUL.txt"},
+		{"DELETE", "NUL.txt"},
+	}
+	for _, tt := range tests {
+		req := newTestRequest(tt.method, "/files/"+tt.name, "Content-Range", "bytes 0-3/4")
+		req.Body = "data"
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 400 {
+			t.Errorf("%s %.20s: got %d, want 400", tt.method, tt.name, res.StatusCode)
+		}
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "NUL.txt")); err != nil || string(got) != "kept" {
+		t.Errorf("NUL.txt: %q, %v", got, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d entries in the directory, want NUL.txt alone", len(entries))
+	}
+
+	// A multipart part is held to the same rules
+	res, err := c.Do(multipartRequest(t, "/files/", [][2]string{{"fine.txt", "1"}, {"CON", "2"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 400 {
+		t.Errorf("multipart with a reserved name: got %d, want 400", res.StatusCode)
+	}
+}
+
+// A rewritten name is the one written, and deleted.
+func TestUploadNameRewritten(t *testing.T) {
+	dir := t.TempDir()
+	router := &Router{}
+	fs := NewFileServer("/files/", dir)
+	fs.SanitizeName = func(name string) (string, error) { return strings.ReplaceAll(name, " ", "_"), nil }
+	router.HandlePrefix(fs.Prefix, fs.Handle, fs.Methods()...).Stream()
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	req := newTestRequest("PUT", "/files/my%20notes.txt")
+	req.Body = "notes"
+	if res, err := c.Do(req); err != nil || res.StatusCode != 201 {
+		t.Fatalf("PUT: %v, %+v", err, res)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "my_notes.txt")); err != nil || string(got) != "notes" {
+		t.Errorf("my_notes.txt: %q, %v", got, err)
+	}
+	if res, err := c.Do(newTestRequest("DELETE", "/files/my%20notes.txt")); err != nil || res.StatusCode != 204 {
+		t.Fatalf("DELETE: %v, %+v", err, res)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "my_notes.txt")); !os.IsNotExist(err) {
+		t.Errorf("my_notes.txt after DELETE: %v", err)
+	}
+}
+
+func TestReadMountsFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "mounts")
+	content := "# static assets\n/assets=/srv/assets;ro;maxage=60\n\n  /docs/=/srv/docs;nolisting;index=home.html\n"
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mounts, err := ReadMountsFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 2 {
+		t.Fatalf("%d mounts, want 2", len(mounts))
+	}
+	assets, docs := mounts[0], mounts[1]
+	if assets.Prefix != "/assets/" || assets.Root != "/srv/assets" || !assets.ReadOnly || assets.MaxAge != 60*time.Second || !assets.Listing {
+		t.Errorf("assets: %+v", assets)
+	}
+	if docs.Prefix != "/docs/" || docs.ReadOnly || docs.Listing || docs.Index != "home.html" {
+		t.Errorf("docs: %+v", docs)
+	}
+
+	if err := os.WriteFile(name, []byte("/ok=/srv\n/bad=/srv;fast\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadMountsFile(name); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("got %v, want an error on line 2", err)
+	}
+}
+
+func TestCheckMounts(t *testing.T) {
+	tests := []struct {
+		prefixes []string
+		ok       bool
+	}{
+		{[]string{"/files/", "/assets/"}, true},
+		{[]string{"/files/", "/files/"}, false},
+		{[]string{"/assets/", "/assets/img/"}, false},
+		{[]string{"/files/", "/filesystem/"}, true},
+	}
+	for _, tt := range tests {
+		var mounts []*FileServer
+		for _, prefix := range tt.prefixes {
+			mounts = append(mounts, NewFileServer(prefix, t.TempDir()))
+		}
+		if err := CheckMounts(mounts); (err == nil) != tt.ok {
+			t.Errorf("%v: got %v", tt.prefixes, err)
+		}
+	}
+}
+
+// Two mounts keep their own options, and no path under one reaches the
+// files of the other, even with their directories side by side.
+func TestMountsIsolated(t *testing.T) {
+	parent := t.TempDir()
+	publicDir, privateDir := filepath.Join(parent, "public"), filepath.Join(parent, "private")
+	for _, dir := range []string{publicDir, privateDir} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(publicDir, "a.txt"), []byte("public"), 0644)
+	os.WriteFile(filepath.Join(privateDir, "secret.txt"), []byte("secret"), 0644)
+
+	public, err := ParseMount("/public=" + publicDir + ";ro;nolisting;maxage=60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := ParseMount("/private=" + privateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := &Router{AutoHEAD: true}
+	for _, fs := range []*FileServer{public, private} {
+		router.HandlePrefix(fs.Prefix, fs.Handle, fs.Methods()...).Stream()
+	}
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	// "/public/%2e%2e/private/..." is the URL of the private file spelled
+	// otherwise, and lands on its mount like it. The encoded slashes and
+	// backslashes stay within the name of a file of the public mount.
+	for _, target := range []string{
+		"/public/..%2fprivate/secret.txt",
+		"/public/..%5cprivate%5csecret.txt",
+		"/public/%2e%2e%2fprivate%2fsecret.txt",
+	} {
+		res, err := c.Do(newTestRequest("GET", target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode == 200 || strings.Contains(res.Body, "secret") {
+			t.Errorf("GET %s reached the other mount: %d %q", target, res.StatusCode, res.Body)
+		}
+	}
+
+	check := func(method, target string, wantStatus int) *Response {
+		t.Helper()
+		req := newTestRequest(method, target)
+		req.Body = "new"
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != wantStatus {
+			t.Errorf("%s %s: got %d, want %d", method, target, res.StatusCode, wantStatus)
+		}
+		return res
+	}
+	if res := check("GET", "/public/a.txt", 200); !strings.Contains(res.Headers.Values("Cache-Control")[0], "max-age=60") {
+		t.Errorf("public Cache-Control %v", res.Headers.Values("Cache-Control"))
+	}
+	if res := check("GET", "/private/secret.txt", 200); len(res.Headers.Values("Cache-Control")) != 0 {
+		t.Errorf("private Cache-Control %v", res.Headers.Values("Cache-Control"))
+	}
+	check("PUT", "/public/new.txt", 405)
+	check("PUT", "/private/new.txt", 201)
+	check("GET", "/public/", 404)
+	check("GET", "/private/", 200)
+	if _, err := os.Stat(filepath.Join(publicDir, "new.txt")); err == nil {
+		t.Error("the read-only mount was written to")
+	}
+}
+
+// Backslashes and drive letters are refused whatever the platform, as
+// they would be separators or absolute paths on Windows.
+func TestFilePathPlatformNames(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+	fs := NewFileServer("/files/", dir)
+	for _, tt := range []struct {
+		uri string
+		ok  bool
+	}{
+		{"/files/a.txt", true},
+		{"/files/sub/ab:c.txt", true},
+		{"/files/..\\..\\etc\\passwd", false},
+		{"/files/sub\\a.txt", false},
+		{"/files/C:\\Windows\\win.ini", false},
+		{"/files/C:/Windows/win.ini", false},
+		{"/files/sub/d:", false},
+		{"/files/a\x00.txt", false},
+	} {
+		if _, ok := fs.resolve(tt.uri); ok != tt.ok {
+			t.Errorf("resolve(%q): got %v, want %v", tt.uri, ok, tt.ok)
+		}
+	}
+
+	_, addr := startServer(t, fileRouter(dir))
+	c := dial(t, addr)
+	for _, target := range []string{"/files/..%5c..%5cetc%5cpasswd", "/files/C:%5cWindows%5cwin.ini", "/files/c:/a.txt"} {
+		for _, method := range []string{"GET", "PUT"} {
+			req := newTestRequest(method, target)
+			req.Body = "x"
+			res, err := c.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != 403 {
+				t.Errorf("%s %s: got %d, want 403", method, target, res.StatusCode)
+			}
+		}
+	}
+}
+
+func TestDirCreate(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("x"), 0644)
+	_, addr := startServer(t, fileRouter(dir))
+	c := dial(t, addr)
+	do := func(method, target string, headers ...string) *Response {
+		t.Helper()
+		res, err := c.Do(newTestRequest(method, target, headers...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	for _, tt := range []struct {
+		method, target string
+		headers        []string
+		status         int
+	}{
+		{"MKCOL", "/files/newdir", nil, 201},
+		{"MKCOL", "/files/newdir", nil, 409},
+		{"MKCOL", "/files/file.txt", nil, 409},
+		{"MKCOL", "/files/file.txt/sub", nil, 409},
+		{"MKCOL", "/files/a/b/c", nil, 409},
+		{"MKCOL", "/files/a/b/c", []string{"X-Create-Parents", "true"}, 201},
+		{"POST", "/files/posted/", []string{"X-Create-Directory", "true"}, 201},
+		{"POST", "/files/x/y/", []string{"X-Create-Directory", "true"}, 409},
+	} {
+		if res := do(tt.method, tt.target, tt.headers...); res.StatusCode != tt.status {
+			t.Errorf("%s %s %v: got %d, want %d", tt.method, tt.target, tt.headers, res.StatusCode, tt.status)
+		}
+	}
+	for _, name := range []string{"newdir", "a/b/c", "posted"} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err != nil || !info.IsDir() {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// The new directory is listed and takes uploads
+	if res := do("GET", "/files/", "Accept", "application/json"); !strings.Contains(res.Body, "newdir") {
+		t.Errorf("listing %q", res.Body)
+	}
+	req := newTestRequest("PUT", "/files/newdir/in.txt")
+	req.Body = "inside"
+	if res, err := c.Do(req); err != nil || res.StatusCode != 201 {
+		t.Errorf("upload into the new directory: %v, %+v", err, res)
+	}
+
+	readOnly := &Router{}
+	fs := NewFileServer("/files/", dir)
+	fs.ReadOnly = true
+	readOnly.HandlePrefix(fs.Prefix, fs.Handle, fs.Methods()...).Stream()
+	_, addr = startServer(t, readOnly)
+	c = dial(t, addr)
+	if res := do("MKCOL", "/files/refused"); res.StatusCode != 405 {
+		t.Errorf("read-only MKCOL: got %d", res.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "refused")); err == nil {
+		t.Error("the read-only mount created a directory")
+	}
+}
+
+// Files are served with their canonical URL as Content-Location, the index
+// file of a directory included.
+func TestContentLocation(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "dir"), 0755)
+	os.MkdirAll(filepath.Join(dir, "bare"), 0755)
+	os.WriteFile(filepath.Join(dir, "dir", "index.html"), []byte("<h1>index</h1>"), 0644)
+	os.WriteFile(filepath.Join(dir, "a b.txt"), []byte("a"), 0644)
+	fs, err := ParseMount("/files/=" + dir + ";index=index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := &Router{}
+	router.HandlePrefix(fs.Prefix, fs.Handle, fs.Methods()...).Stream()
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	for _, tt := range []struct {
+		target, location, body string
+	}{
+		{"/files/dir/", "/files/dir/index.html", "<h1>index</h1>"},
+		{"/files/dir/index.html", "/files/dir/index.html", "<h1>index</h1>"},
+		{"/files/./dir//index.html", "/files/dir/index.html", "<h1>index</h1>"},
+		{"/files/a%20b.txt", "/files/a%20b.txt", "a"},
+	} {
+		res, err := c.Do(newTestRequest("GET", tt.target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if location, _ := res.Headers.Get("Content-Location"); res.StatusCode != 200 || location != tt.location || res.Body != tt.body {
+			t.Errorf("GET %s: got %d, Content-Location %q, body %q", tt.target, res.StatusCode, location, res.Body)
+		}
+	}
+
+	// Without an index file, the directory is listed
+	res, err := c.Do(newTestRequest("GET", "/files/bare/", "Accept", "application/json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct, _ := res.Headers.Get("Content-Type"); res.StatusCode != 200 || ct != "application/json" {
+		t.Errorf("directory without an index: got %d, %q", res.StatusCode, ct)
+	}
+}
+
+// An upload is copied to its file as it arrives: the server allocates a
+// small fraction of its size, and stops at the body limit.
+func TestFileUploadStreamed(t *testing.T) {
+	dir := t.TempDir()
+	_, addr := startServer(t, fileRouter(dir), func(s *Server) { s.RequestLimits.MaxBodySize = 64 << 20 })
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	const size = 32 << 20
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 4<<10)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	fmt.Fprintf(conn, "PUT /files/big.bin HTTP/1.1\r\nHost: x\r\nContent-Length: %d\r\n\r\n", size)
+	for range size / len(chunk) {
+		if _, err := conn.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := ReadResponse(reader, "PUT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if res.StatusCode != 201 {
+		t.Fatalf("got %d", res.StatusCode)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/8 {
+		t.Errorf("%d bytes allocated for a %d byte upload", allocated, size)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "big.bin"))
+	if err != nil || !bytes.Equal(got, bytes.Repeat(chunk, size/len(chunk))) {
+		t.Errorf("the file holds %d bytes, not the upload: %v", len(got), err)
+	}
+
+	// A chunked body has no length to check upfront, the copy stops at the limit
+	_, addr = startServer(t, fileRouter(dir), func(s *Server) { s.RequestLimits.MaxBodySize = 1 << 20 })
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	go func() {
+		fmt.Fprintf(conn, "PUT /files/over.bin HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n")
+		for range 2 << 20 / len(chunk) {
+			if _, err := fmt.Fprintf(conn, "%x\r\n%s\r\n", len(chunk), chunk); err != nil {
+				return
+			}
+		}
+		io.WriteString(conn, "0\r\n\r\n")
+	}()
+	if res, err := ReadResponse(bufio.NewReader(conn), "PUT"); err != nil || res.StatusCode != 413 {
+		t.Errorf("chunked body over the limit: %v, %+v", err, res)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "over.bin")); !os.IsNotExist(err) {
+		t.Errorf("the upload over the limit was kept: %v", err)
+	}
+}
+
+// A directory URL without its slash is redirected to the one with it,
+// except for writes, which would lose their body on the way.
+func TestDirRedirect(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "docs"), 0755)
+	os.Mkdir(filepath.Join(dir, "my docs"), 0755)
+	_, addr := startServer(t, fileRouter(dir))
+	c := dial(t, addr)
+
+	for _, tt := range []struct {
+		method, target, location string
+		status                   int
+	}{
+		{"GET", "/files/docs", "/files/docs/", 301},
+		{"GET", "/files/docs?sort=name&x=%20", "/files/docs/?sort=name&x=%20", 301},
+		{"HEAD", "/files/docs", "/files/docs/", 301},
+		{"GET", "/files/my%20docs", "/files/my%20docs/", 301},
+		{"GET", "/files/docs/", "", 200},
+		{"POST", "/files/docs", "", 409},
+		{"PUT", "/files/docs", "", 409},
+	} {
+		req := newTestRequest(tt.method, tt.target, "Accept", "application/json")
+		if tt.method == "POST" || tt.method == "PUT" {
+			req.Body = "data"
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		location, _ := res.Headers.Get("Location")
+		if res.StatusCode != tt.status || location != tt.location {
+			t.Errorf("%s %s: got %d, Location %q, want %d, Location %q", tt.method, tt.target, res.StatusCode, location, tt.status, tt.location)
+		}
+	}
+
+	router := &Router{}
+	fs := NewFileServer("/files/", dir)
+	fs.AbsoluteRedirects = true
+	router.HandlePrefix(fs.Prefix, fs.Handle, fs.Methods()...).Stream()
+	_, addr = startServer(t, router)
+	res, err := dial(t, addr).Do(newTestRequest("GET", "/files/docs?q=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location, _ := res.Headers.Get("Location"); res.StatusCode != 301 || location != "http://localhost/files/docs/?q=1" {
+		t.Errorf("absolute redirect: got %d, Location %q", res.StatusCode, location)
+	}
+}
+
+// A file whose size changed since it was looked up is looked at again; one
+// that keeps changing gets a 503.
+func TestSettleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "growing.log")
+	os.WriteFile(path, []byte("first"), 0644)
+	stale, _ := os.Stat(path)
+	os.WriteFile(path, []byte("first line, then more"), 0644)
+
+	res := NewResponse()
+	info, settled := settleFile(res, path, stale)
+	if !settled || info.Size() != int64(len("first line, then more")) {
+		t.Errorf("settled %v on %v", settled, info)
+	}
+
+	// A writer appending all along
+	current, _ := os.Stat(path)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		defer f.Close()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				f.WriteString("more\n")
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	defer func() { close(stop); <-done }()
+	time.Sleep(10 * time.Millisecond)
+	res = NewResponse()
+	if _, settled := settleFile(res, path, current); settled || res.StatusCode != 503 {
+		t.Errorf("file being written: settled %v, got %d", settled, res.StatusCode)
+	}
+	if retry, _ := res.Headers.Get("Retry-After"); retry == "" {
+		t.Error("no Retry-After")
+	}
+}
+
+// changingWriter appends to the file at path on its first write, as a
+// writer would while the file is sent.
+type changingWriter struct {
+	path    string
+	changed bool
+	bytes.Buffer
+}
+
+func (w *changingWriter) Write(p []byte) (int, error) {
+	if !w.changed {
+		w.changed = true
+		f, err := os.OpenFile(w.path, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return 0, err
+		}
+		f.WriteString(" and a change")
+		f.Close()
+	}
+	return w.Buffer.Write(p)
+}
+
+// A snapshot only ever sends the version of the file it was given.
+func TestServeSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "doc.txt")
+	send := func(change func(), w io.Writer) error {
+		t.Helper()
+		os.WriteFile(path, []byte("content"), 0644)
+		info, _ := os.Stat(path)
+		res := NewResponse()
+		serveSnapshot(newTestRequest("GET", "/files/doc.txt"), res, path, info)
+		if res.Stream == nil {
+			t.Fatalf("no stream, got %d", res.StatusCode)
+		}
+		change()
+		return res.Stream(w)
+	}
+
+	var out bytes.Buffer
+	if err := send(func() {}, &out); err != nil || out.String() != "content" {
+		t.Errorf("unchanged: %v, %q", err, out.String())
+	}
+	replace := func() {
+		os.WriteFile(path+".new", []byte("other content"), 0644)
+		os.Rename(path+".new", path)
+	}
+	if err := send(replace, io.Discard); err == nil {
+		t.Error("a file replaced before being sent was sent")
+	}
+	if err := send(func() {}, &changingWriter{path: path}); err == nil {
+		t.Error("a file changed while being sent ended without an error")
+	}
+}
+
+// A chunked upload lands in the file as if it had a Content-Length.
+func TestFileUploadChunked(t *testing.T) {
+	dir := t.TempDir()
+	_, addr := startServer(t, fileRouter(dir))
+	tests := []struct {
+		name, body string
+		status     int
+	}{
+		{"chunked.txt", "5\r\nhello\r\n7;note=x\r\n, world\r\n0\r\nX-Checksum: 1\r\n\r\n", 201},
+		{"bad-size.txt", "5\r\nhello\r\nzz\r\n!!\r\n0\r\n\r\n", 400},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		fmt.Fprintf(conn, "POST /files/%s HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n%s", tt.name, tt.body)
+		res, err := ReadResponse(bufio.NewReader(conn), "POST")
+		if err != nil || res.StatusCode != tt.status {
+			t.Errorf("%s: got %v, %+v, want %d", tt.name, err, res, tt.status)
+		}
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "chunked.txt")); err != nil || string(got) != "hello, world" {
+		t.Errorf("chunked.txt: %q, %v", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad-size.txt")); !os.IsNotExist(err) {
+		t.Errorf("bad-size.txt was written: %v", err)
+	}
+}
+
+// Files are looked up by the decoded path, an encoded slash excepted: no
+// file name holds one.
+func TestFilePathDecoded(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "my file.txt"), []byte("spaced"), 0644)
+	os.WriteFile(filepath.Join(dir, "100%.txt"), []byte("percent"), 0644)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "sub", "file.txt"), []byte("nested"), 0644)
+	_, addr := startServer(t, fileRouter(dir))
+	c := dial(t, addr)
+
+	tests := []struct {
+		target, body string
+		status       int
+	}{
+		{"/files/my%20file.txt", "spaced", 200},
+		{"/files/my%20file.txt?download=1", "spaced", 200},
+		{"/files/100%25.txt", "percent", 200},
+		{"/files/sub/file.txt", "nested", 200},
+		{"/files/sub%2Ffile.txt", "", 404},
+		{"/files/sub%2ffile.txt", "", 404},
+		{"/files/my%2520file.txt", "", 404},
+	}
+	for _, tt := range tests {
+		res, err := c.Do(newTestRequest("GET", tt.target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tt.status || tt.status == 200 && res.Body != tt.body {
+			t.Errorf("GET %s: got %d %q, want %d %q", tt.target, res.StatusCode, res.Body, tt.status, tt.body)
+		}
+	}
+
+	req := newTestRequest("PUT", "/files/new%20one.txt")
+	req.Body = "uploaded"
+	if res, err := c.Do(req); err != nil || res.StatusCode != 201 {
+		t.Fatalf("PUT: %v, %+v", err, res)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "new one.txt")); err != nil || string(got) != "uploaded" {
+		t.Errorf("new one.txt: %q, %v", got, err)
+	}
+
+	raw := newTestRequest("GET", "/files/a%2Fb%20c?x=%20")
+	if raw.Path() != "/files/a/b c" || raw.RawPath() != "/files/a%2Fb%20c" {
+		t.Errorf("Path %q, RawPath %q", raw.Path(), raw.RawPath())
+	}
+}
+
+// No request reaches a file outside the root, whether by ".." segments or
+// through a symbolic link.
+func TestFileTraversal(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	outside := filepath.Join(parent, "outside")
+	os.Mkdir(root, 0755)
+	os.Mkdir(outside, 0755)
+	os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+	os.WriteFile(filepath.Join(root, "public.txt"), []byte("public"), 0644)
+	os.Mkdir(filepath.Join(root, "docs"), 0755)
+	for link, target := range map[string]string{
+		"escape":      outside,
+		"secret.txt":  filepath.Join(outside, "secret.txt"),
+		"dangling":    filepath.Join(outside, "new.txt"),
+		"inside.txt":  filepath.Join(root, "public.txt"),
+		"docs-inside": filepath.Join(root, "docs"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, addr := startServer(t, fileRouter(root))
+	c := dial(t, addr)
+	do := func(method, target, body string) *Response {
+		t.Helper()
+		req := newTestRequest(method, target)
+		req.Body = body
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	for _, tt := range []struct {
+		method, target string
+		status         int
+	}{
+		{"GET", "/files/public.txt", 200},
+		{"GET", "/files/inside.txt", 200},
+		{"PUT", "/files/docs-inside/note.txt", 201},
+		{"GET", "/files/secret.txt", 403},
+		{"GET", "/files/escape/secret.txt", 403},
+		{"PUT", "/files/escape/new.txt", 403},
+		{"PUT", "/files/dangling", 403},
+		{"DELETE", "/files/secret.txt", 403},
+	} {
+		if res := do(tt.method, tt.target, "written"); res.StatusCode != tt.status {
+			t.Errorf("%s %s: got %d, want %d", tt.method, tt.target, res.StatusCode, tt.status)
+		}
+	}
+	// Dot segments are removed before routing, these don't reach the files
+	for _, target := range []string{"/files/../outside/secret.txt", "/files/../../etc/passwd", "/files/%2e%2e/outside/secret.txt", "/files/..%2Foutside%2Fsecret.txt"} {
+		if res := do("GET", target, ""); res.StatusCode == 200 || strings.Contains(res.Body, "secret") {
+			t.Errorf("GET %s: got %d %q", target, res.StatusCode, res.Body)
+		}
+	}
+	if got, _ := os.ReadFile(filepath.Join(outside, "secret.txt")); string(got) != "secret" {
+		t.Errorf("the file outside was changed: %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); !os.IsNotExist(err) {
+		t.Errorf("a file was written outside: %v", err)
+	}
+
+	fs := NewFileServer("/files/", root)
+	for _, uri := range []string{"/files/../outside/secret.txt", "/files/docs/../../outside"} {
+		if _, ok := fs.resolve(uri); ok {
+			t.Errorf("resolve(%q) stayed within the root", uri)
+		}
+	}
+}
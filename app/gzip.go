@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// gzipETagSuffix marks the entity-tags of gzip-encoded representations.
+const gzipETagSuffix = "-gzip"
+
+// Gzip compresses the 200 responses of clients accepting it, empty bodies,
+// those smaller than minSize and those to Range requests excepted. A
+// compressed body is another representation, so its ETag gets a -gzip
+// suffix, and If-None-Match is compared here, once the tag sent is known.
+func Gzip(minSize int) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *Request, res *Response) {
+			// Ranges apply to the representation sent, and the compressed
+			// one only exists once compressed whole: ranged requests get
+			// the identity bytes
+			_, ranged := req.Headers.Get("Range")
+			accepted := !ranged && NegotiateEncoding(req, []string{"gzip", "identity"}) == "gzip"
+			req.encodingPending = accepted
+			next(req, res)
+			req.encodingPending = false
+
+			if res.StatusCode != 200 && res.StatusCode != 304 {
+				return
+			}
+			res.Vary("Accept-Encoding")
+			if !accepted || res.StatusCode == 304 {
+				return
+			}
+			compress := gzipWanted(req, res, minSize)
+			if compress {
+				gzipETag(res.Headers)
+			}
+			if etag, found := res.Headers.Get("ETag"); found && notModified(req, res, etag) {
+				return
+			}
+			if !compress {
+				return
+			}
+
+			if res.Stream == nil {
+				var buf bytes.Buffer
+				gz := gzip.NewWriter(&buf)
+				gz.Write([]byte(res.Body))
+				gz.Close()
+				res.Body = buf.String()
+				res.Headers.Set("Content-Length", strconv.Itoa(buf.Len()))
+			} else {
+				stream := res.Stream
+				res.Stream = func(w io.Writer) error {
+					gz := gzip.NewWriter(w)
+					if err := stream(gz); err != nil {
+						return err
+					}
+					return gz.Close()
+				}
+				delete(res.Headers, "content-length")
+			}
+			res.Headers.Set("Content-Encoding", "gzip")
+		}
+	}
+}
+
+// gzipWanted reports whether the body of res is worth compressing, and can be.
+func gzipWanted(req *Request, res *Response, minSize int) bool {
+	if _, found := res.Headers.Get("Content-Encoding"); found {
+		return false
+	}
+	if res.Stream == nil {
+		return res.Body != "" && len(res.Body) >= minSize
+	}
+	// The compressed length isn't known before the end, which takes
+	// chunked encoding to frame
+	if n, err := strconv.Atoi(res.Headers["content-length"]); err == nil && n < minSize || req.HTTPVersion != "HTTP/1.1" {
+		return false
+	}
+	return true
+}
+
+// gzipETag marks the ETag of res as the one of the gzip-encoded representation.
+func gzipETag(h Headers) {
+	if etag, found := h.Get("ETag"); found && strings.HasSuffix(etag, `"`) {
+		h.Set("ETag", strings.TrimSuffix(etag, `"`)+gzipETagSuffix+`"`)
+	}
+}
+
+// ratioFloor is the decompressed size under which GunzipBody doesn't look
+// at the compression ratio: small bodies of repeated bytes legitimately
+// compress very well.
+const ratioFloor = 64 << 10
+
+// GunzipBody decompresses the request bodies sent with Content-Encoding:
+// gzip, so the handlers within see them as they were before compression.
+// A body decompressing to more than maxSize bytes gets a 413, and one
+// decompressing to more than maxRatio times its compressed size, the mark
+// of a zip bomb, a 400. Both are caught while decompressing, before all of
+// it is. Other content codings get a 415.
+func GunzipBody(maxSize, maxRatio int64) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *Request, res *Response) {
+			codings := req.Headers.Values("Content-Encoding")
+			if len(codings) == 0 || len(codings) == 1 && strings.EqualFold(codings[0], "identity") {
+				next(req, res)
+				return
+			}
+			if len(codings) > 1 || !strings.EqualFold(codings[0], "gzip") && !strings.EqualFold(codings[0], "x-gzip") {
+				res.StatusCode = 415
+				res.ReasonPhrase = StatusText(415)
+				res.Headers.Set("Accept-Encoding", "gzip")
+				return
+			}
+
+			streamed := req.stream != nil
+			compressed := &countingReader{r: req.BodyReader()}
+			gz, err := gzip.NewReader(compressed)
+			if err != nil {
+				fmt.Println("Error decompressing body: ", err.Error())
+				res.StatusCode = 400
+				res.ReasonPhrase = "Bad Request"
+				return
+			}
+			defer gz.Close()
+			req.decodeBody(&inflateGuard{r: gz, compressed: compressed, maxSize: maxSize, maxRatio: maxRatio})
+			delete(req.Headers, "content-encoding")
+			delete(req.Headers, "content-length")
+			// A route reading its body whole gets it decompressed likewise
+			if !streamed && !bufferBody(req, res) {
+				return
+			}
+			next(req, res)
+		}
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// inflateGuard fails the decompression of a body once its output is over
+// maxSize, or over maxRatio times the compressed bytes read to produce it.
+type inflateGuard struct {
+	r          io.Reader
+	compressed *countingReader
+	maxSize    int64
+	maxRatio   int64
+	n          int64
+}
+
+func (g *inflateGuard) Read(p []byte) (int, error) {
+	n, err := g.r.Read(p)
+	g.n += int64(n)
+	var parseErr *ParseError
+	if err != nil && err != io.EOF && !errors.As(err, &parseErr) {
+		err = badRequest("Invalid Compressed Body", err)
+	}
+	if g.maxSize > 0 && g.n > g.maxSize {
+		return n, bodyTooLarge(g.maxSize, fmt.Errorf("decompressed body over %d bytes", g.maxSize))
+	}
+	if g.maxRatio > 0 && g.n > ratioFloor && g.n > g.maxRatio*g.compressed.n {
+		return n, badRequest("Compression Ratio Too High", fmt.Errorf("body decompresses over %d times its size", g.maxRatio))
+	}
+	return n, err
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// gzipFileRouter serves dir at /files/ with the compression and ETag
+// middlewares main puts in front of the files.
+func gzipFileRouter(dir string) *Router {
+	router := &Router{AutoHEAD: true}
+	fs := NewFileServer("/files/", dir)
+	router.HandlePrefix(fs.Prefix, Chain(fs.Handle, Gzip(1<<10), ETag(1<<20)), fs.Methods()...).Stream()
+	return router
+}
+
+func TestGzipETag(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "page.txt"), []byte(strings.Repeat("compress me ", 1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, addr := startServer(t, gzipFileRouter(dir))
+	c := dial(t, addr)
+	get := func(headers ...string) *Response {
+		t.Helper()
+		res, err := c.Do(newTestRequest("GET", "/files/page.txt", headers...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	identity := get()
+	identityTag, _ := identity.Headers.Get("ETag")
+	gzipped := get("Accept-Encoding", "gzip")
+	gzipTag, _ := gzipped.Headers.Get("ETag")
+	if ce, _ := gzipped.Headers.Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Content-Encoding %q, want gzip", ce)
+	}
+	if identityTag == "" || gzipTag != strings.TrimSuffix(identityTag, `"`)+`-gzip"` {
+		t.Errorf("gzip ETag %q for the identity ETag %q", gzipTag, identityTag)
+	}
+	for _, res := range []*Response{identity, gzipped} {
+		if vary, _ := res.Headers.Get("Vary"); !strings.Contains(vary, "Accept-Encoding") {
+			t.Errorf("Vary %q, want Accept-Encoding", vary)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		encoding string
+		ifNone   string
+		status   int
+		wantTag  string
+	}{
+		{name: "gzip tag, gzip sent", encoding: "gzip", ifNone: gzipTag, status: 304, wantTag: gzipTag},
+		{name: "identity tag, gzip sent", encoding: "gzip", ifNone: identityTag, status: 200, wantTag: gzipTag},
+		{name: "gzip tag, identity sent", encoding: "identity", ifNone: gzipTag, status: 200, wantTag: identityTag},
+		{name: "identity tag, identity sent", encoding: "identity", ifNone: identityTag, status: 304, wantTag: identityTag},
+		{name: "weak gzip tag", encoding: "gzip", ifNone: "W/" + gzipTag, status: 304, wantTag: gzipTag},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := get("Accept-Encoding", tt.encoding, "If-None-Match", tt.ifNone)
+			if etag, _ := res.Headers.Get("ETag"); res.StatusCode != tt.status || etag != tt.wantTag {
+				t.Errorf("got %d with ETag %s, want %d with %s", res.StatusCode, etag, tt.status, tt.wantTag)
+			}
+			if tt.status == 304 && res.Body != "" {
+				t.Errorf("304 with a %d byte body", len(res.Body))
+			}
+		})
+	}
+}
+
+// A body inflating past the limit gets the 413 telling the limit, whether
+// The generated pages are compressed however small, but never when empty.
+func TestGzipPages(t *testing.T) {
+	router := &Router{AutoHEAD: true}
+	router.HandleExact("/", Chain((&Server{}).homeHandler, Gzip(0)), "GET")
+	router.HandlePrefix("/echo/", Chain(echoHandler, Gzip(0)), "GET")
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	tests := []struct {
+		target, accept string
+		gzipped        bool
+	}{
+		{"/echo/hi", "gzip", true},
+		{"/echo/hi", "deflate, gzip;q=0.5", true},
+		{"/echo/hi", "br", false},
+		{"/echo/hi", "", false},
+		{"/", "gzip", false},
+	}
+	for _, tt := range tests {
+		res, err := c.Do(newTestRequest("GET", tt.target, "Accept-Encoding", tt.accept))
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoding, _ := res.Headers.Get("Content-Encoding")
+		length, _ := res.Headers.Get("Content-Length")
+		if (encoding == "gzip") != tt.gzipped || length != strconv.Itoa(len(res.Body)) {
+			t.Errorf("%s with %q: Content-Encoding %q, Content-Length %s for %d bytes", tt.target, tt.accept, encoding, length, len(res.Body))
+			continue
+		}
+		body := res.Body
+		if tt.gzipped {
+			zr, err := gzip.NewReader(strings.NewReader(res.Body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, _ := io.ReadAll(zr)
+			body = string(decoded)
+		}
+		if want := strings.TrimPrefix(tt.target, "/echo/"); tt.target != "/" && body != want {
+			t.Errorf("%s with %q: got %q", tt.target, tt.accept, body)
+		}
+	}
+}
+
+// the route reads it whole or streams it to a file.
+func TestGunzipBodyTooLarge(t *testing.T) {
+	router := &Router{}
+	router.HandleExact("/upload", Chain(func(req *Request, res *Response) {}, GunzipBody(1000, 0)), "POST")
+	fs := NewFileServer("/files/", t.TempDir())
+	router.HandlePrefix(fs.Prefix, Chain(fs.Handle, GunzipBody(1000, 0)), fs.Methods()...).Stream()
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(bytes.Repeat([]byte("x"), 5000))
+	gz.Close()
+	for _, target := range []string{"/upload", "/files/inflated.txt"} {
+		method := "POST"
+		if target != "/upload" {
+			method = "PUT"
+		}
+		req := newTestRequest(method, target, "Content-Encoding", "gzip")
+		req.Body = compressed.String()
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 413 || res.Body != "max 1000 bytes\n" {
+			t.Errorf("%s %s: got %d %q, want 413 with the limit", method, target, res.StatusCode, res.Body)
+		}
+	}
+}
+
+func gzipped(t *testing.T, data []byte) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestGunzipBody(t *testing.T) {
+	dir := t.TempDir()
+	router := &Router{}
+	fs := NewFileServer("/files/", dir)
+	router.HandlePrefix(fs.Prefix, Chain(fs.Handle, GunzipBody(1<<20, 100)), fs.Methods()...).Stream()
+	router.HandleExact("/whole", Chain(func(req *Request, res *Response) {
+		res.Body = strings.ToUpper(req.Body)
+	}, GunzipBody(1<<20, 100)), "POST")
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	// Text compresses a few times, well under the ratio
+	lines := func(count int) string {
+		var text strings.Builder
+		for i := range count {
+			fmt.Fprintf(&text, "line %d\n", i)
+		}
+		return text.String()
+	}
+	text := lines(20000)
+	tests := []struct {
+		name, target, coding, body string
+		status                     int
+	}{
+		{"normal", "/files/normal.txt", "gzip", gzipped(t, []byte(text)), 201},
+		{"small and repetitive", "/files/small.txt", "gzip", gzipped(t, bytes.Repeat([]byte("a"), 32<<10)), 201},
+		{"zip bomb", "/files/bomb.txt", "gzip", gzipped(t, make([]byte, 2<<20)), 400},
+		{"too large", "/files/large.txt", "x-gzip", gzipped(t, []byte(lines(150000))), 413},
+		{"not gzip", "/files/corrupt.txt", "gzip", "not compressed", 400},
+		{"other coding", "/files/br.txt", "br", "whatever", 415},
+		{"identity", "/files/plain.txt", "identity", "plain", 201},
+		{"read whole", "/whole", "gzip", gzipped(t, []byte("shout")), 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "PUT"
+			if tt.target == "/whole" {
+				method = "POST"
+			}
+			req := newTestRequest(method, tt.target, "Content-Encoding", tt.coding)
+			req.Body = tt.body
+			res, err := c.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.status {
+				t.Fatalf("got %d, want %d", res.StatusCode, tt.status)
+			}
+			if tt.status == 415 {
+				if accepted, _ := res.Headers.Get("Accept-Encoding"); accepted != "gzip" {
+					t.Errorf("Accept-Encoding %q", accepted)
+				}
+			}
+			if tt.target == "/whole" && res.Body != "SHOUT" {
+				t.Errorf("body %q", res.Body)
+			}
+		})
+	}
+
+	if got, _ := os.ReadFile(filepath.Join(dir, "normal.txt")); string(got) != text {
+		t.Errorf("normal.txt holds %d bytes, not the decompressed body", len(got))
+	}
+	for _, name := range []string{"bomb.txt", "large.txt", "corrupt.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was written: %v", name, err)
+		}
+	}
+}
+
+// The ratio is checked as the body decompresses, long before all of it
+// has been.
+func TestInflateGuardStopsEarly(t *testing.T) {
+	bomb := gzipped(t, make([]byte, 16<<20))
+	compressed := &countingReader{r: strings.NewReader(bomb)}
+	gz, err := gzip.NewReader(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard := &inflateGuard{r: gz, compressed: compressed, maxRatio: 100}
+	n, err := io.Copy(io.Discard, guard)
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.StatusCode != 400 {
+		t.Fatalf("got %v", err)
+	}
+	if n > 1<<20 {
+		t.Errorf("%d bytes decompressed before stopping", n)
+	}
+}
+
+// Every content route goes through the one middleware, and what it sends
+// gunzips back to the original.
+func TestGzipRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Repeat("file content, compressed on the way ", 100)
+	os.WriteFile(filepath.Join(dir, "big.txt"), []byte(content), 0644)
+	router := gzipFileRouter(dir)
+	router.HandlePrefix("/echo/", Chain(echoHandler, Gzip(0)), "GET")
+	router.HandleExact("/user-agent", Chain(userAgentHandler, Gzip(0)), "GET")
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	tests := []struct {
+		target, want string
+	}{
+		{"/echo/h%C3%A9llo", "héllo"},
+		{"/user-agent", "tester/2.0"},
+		{"/files/big.txt", content},
+	}
+	for _, tt := range tests {
+		for _, accept := range []string{"gzip", "", "br, compress", "gzip;q=0"} {
+			res, err := c.Do(newTestRequest("GET", tt.target, "Accept-Encoding", accept, "User-Agent", "tester/2.0"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoding, found := res.Headers.Get("Content-Encoding")
+			length, _ := res.Headers.Get("Content-Length")
+			if length != strconv.Itoa(len(res.Body)) {
+				t.Errorf("%s with %q: Content-Length %s for %d bytes", tt.target, accept, length, len(res.Body))
+			}
+			body := res.Body
+			if accept == "gzip" {
+				if encoding != "gzip" {
+					t.Errorf("%s: Content-Encoding %q", tt.target, encoding)
+					continue
+				}
+				zr, err := gzip.NewReader(strings.NewReader(res.Body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(decoded)
+			} else if found {
+				t.Errorf("%s with %q: Content-Encoding %q", tt.target, accept, encoding)
+			}
+			if body != tt.want {
+				t.Errorf("%s with %q: got %q", tt.target, accept, body)
+			}
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	supported := []string{"gzip", "br", "identity"}
+	tests := []struct {
+		accept, want string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"deflate, gzip;q=0.8, br;q=0.5", "gzip"},
+		{"gzip;q=0.5, br;q=0.8", "br"},
+		{"br, gzip", "gzip"},
+		{"invalid-encoding-1, gzip, invalid-encoding-2", "gzip"},
+		{"gzip;q=0", ""},
+		{"gzip;q=0, br;q=0", ""},
+		{"identity, gzip;q=0.5", ""},
+		{"*", "gzip"},
+		{"*;q=0.5, gzip;q=0", "br"},
+		{"*;q=0, identity", ""},
+		{"gzip;q=oops", "gzip"},
+		{"gzip;q=2, br;q=", "gzip"},
+		{" gzip ; q=0.3 , br ; q=0.4 ", "br"},
+		{"compress, deflate", ""},
+	}
+	for _, tt := range tests {
+		req := newTestRequest("GET", "/", "Accept-Encoding", tt.accept)
+		if got := NegotiateEncoding(req, supported); got != tt.want {
+			t.Errorf("NegotiateEncoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"gzip", true},
+		{"deflate", false},
+		{"gzip;q=0", false},
+		{"*", true},
+		{"*, gzip;q=0", false},
+		{"*;q=0, gzip;q=0.1", true},
+	}
+	for _, tt := range tests {
+		if got := AcceptsEncoding(newTestRequest("GET", "/", "Accept-Encoding", tt.accept), "gzip"); got != tt.want {
+			t.Errorf("AcceptsEncoding(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
@@ -4,10 +4,17 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Headers is a case-insensitive map for HTTP headers.
@@ -25,6 +32,94 @@ func (h Headers) Set(key, value string) {
 	h[strings.ToLower(key)] = value
 }
 
+// Add appends value to the header with key (case-insensitive). Repeated
+// fields are combined into one comma-separated value, as RFC 9110 5.3 allows.
+func (h Headers) Add(key, value string) {
+	key = strings.ToLower(key)
+	if old, found := h[key]; found {
+		h[key] = old + ", " + value
+		return
+	}
+	h[key] = value
+}
+
+// Values returns the comma-separated elements of the header with key
+// (case-insensitive), trimmed. Commas inside quoted strings don't split.
+func (h Headers) Values(key string) []string {
+	value, found := h.Get(key)
+	if !found {
+		return nil
+	}
+	var values []string
+	quoted, start := false, 0
+	for i := 0; i <= len(value); i++ {
+		if i < len(value) && value[i] == '"' {
+			quoted = !quoted
+		}
+		if i == len(value) || value[i] == ',' && !quoted {
+			if v := strings.TrimSpace(value[start:i]); v != "" {
+				values = append(values, v)
+			}
+			start = i + 1
+		}
+	}
+	return values
+}
+
+// hopByHopHeaders only concern the connection a message came on, whether
+// Connection names them or not.
+var hopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "TE", "Transfer-Encoding", "Upgrade", "Proxy-Authorization"}
+
+// ConnectionTokens returns the options listed by the Connection header, lowercased.
+func (h Headers) ConnectionTokens() []string {
+	tokens := h.Values("Connection")
+	for i, token := range tokens {
+		tokens[i] = strings.ToLower(token)
+	}
+	return tokens
+}
+
+// RemoveHopByHop deletes the headers that must not be passed on to another
+// party: those named by Connection and the standard hop-by-hop ones.
+func (h Headers) RemoveHopByHop() {
+	for _, token := range h.ConnectionTokens() {
+		delete(h, token)
+	}
+	for _, name := range hopByHopHeaders {
+		delete(h, strings.ToLower(name))
+	}
+}
+
+// pruneConnection drops the Connection tokens naming headers that aren't
+// there, keeping the close and keep-alive options.
+func (h Headers) pruneConnection() {
+	if _, found := h.Get("Connection"); !found {
+		return
+	}
+	tokens := slices.DeleteFunc(h.ConnectionTokens(), func(token string) bool {
+		_, found := h.Get(token)
+		return token != "close" && token != "keep-alive" && !found
+	})
+	if len(tokens) == 0 {
+		delete(h, "connection")
+		return
+	}
+	h.Set("Connection", strings.Join(tokens, ", "))
+}
+
+// ValidateHeader checks that name is a token and that value can't break out
+// of its header line. Set doesn't check, so values from outside should be
+// validated first.
+func ValidateHeader(name, value string) error {
+	if !isToken(name) {
+		return fmt.Errorf("invalid header name '%s'", name)
+	}
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return fmt.Errorf("invalid value for header '%s'", name)
+	}
+	return nil
+}
+
 // NewHeaders creates a new Headers map.
 func NewHeaders() Headers {
 	return make(Headers)
@@ -41,21 +136,757 @@ type RequestLine struct {
 	HTTPVersion string
 }
 
+// ParseError is a request the parser rejected, along with the status code
+// and reason phrase to answer it with.
+type ParseError struct {
+	StatusCode int
+	Reason     string
+	Err        error
+	// Body, when set, is sent to the client to explain the rejection.
+	Body string
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+func badRequest(reason string, err error) *ParseError {
+	return &ParseError{StatusCode: 400, Reason: reason, Err: err}
+}
+
+// bodyTooLarge is the 413 for a body over limit bytes, telling the client the limit.
+func bodyTooLarge(limit int64, err error) *ParseError {
+	return &ParseError{
+		StatusCode: 413,
+		Reason:     StatusText(413),
+		Err:        err,
+		Body:       fmt.Sprintf("max %d bytes\n", limit),
+	}
+}
+
+// respond turns res into the answer to the request e rejected.
+func (e *ParseError) respond(res *Response) {
+	res.StatusCode = e.StatusCode
+	res.ReasonPhrase = e.Reason
+	if e.Body != "" {
+		res.Headers.Set("Content-Type", "text/plain; charset=utf-8")
+		res.Headers.Set("Content-Length", strconv.Itoa(len(e.Body)))
+		res.Body = e.Body
+	}
+}
+
+// ErrMissingHeaderTerminator is returned when a request declares a body but
+// a line without a colon shows up where a header was expected, which usually
+// means the client left out the blank line between the headers and the body.
+var ErrMissingHeaderTerminator = errors.New("missing blank line between headers and body")
+
+// ErrEmptyRequestTarget is returned for a request line without a request target,
+// like "GET  HTTP/1.1". The smallest valid target is "/".
+var ErrEmptyRequestTarget = errors.New("empty request target")
+
+// ErrInvalidRequestTarget is returned for a request target with a raw space,
+// a character URIs can't hold, or a malformed percent-encoding.
+var ErrInvalidRequestTarget = errors.New("invalid request target")
+
+// checkRequestTarget reports the first character of target that isn't
+// allowed in a URI (RFC 3986 section 2): anything but the unreserved and
+// reserved characters, and "%" followed by two hex digits.
+func checkRequestTarget(target string) error {
+	for i := 0; i < len(target); i++ {
+		c := target[i]
+		switch {
+		case c == '%':
+			if i+2 >= len(target) || !isHexDigit(target[i+1]) || !isHexDigit(target[i+2]) {
+				return fmt.Errorf("%w: malformed percent-encoding at offset %d", ErrInvalidRequestTarget, i)
+			}
+			i += 2
+		case c >= 0x80:
+			return fmt.Errorf("%w: non-ASCII byte 0x%02x at offset %d", ErrInvalidRequestTarget, c, i)
+		case c <= ' ' || c == 0x7f || strings.IndexByte("\"<>\\^`{|}", c) >= 0:
+			return fmt.Errorf("%w: character %q at offset %d", ErrInvalidRequestTarget, c, i)
+		}
+	}
+	return nil
+}
+
+// isHexDigit reports whether c is a hexadecimal digit, in either case.
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// ErrUnknownMethod is returned for a well-formed method the server doesn't
+// know. Methods are case-sensitive, so "get" is one of them.
+var ErrUnknownMethod = errors.New("unknown method")
+
+// knownMethods are the methods the parser lets through to the router.
+var knownMethods = []string{
+	"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH",
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+// isToken reports whether s is a token as defined by RFC 9110 section 5.6.2.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isTokenChar reports whether c is a tchar, a character allowed in tokens.
+func isTokenChar(c byte) bool {
+	return c > ' ' && c < 0x7f && strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) < 0
+}
+
+// isHTTPVersion reports whether s is of the form HTTP/DIGIT.DIGIT.
+func isHTTPVersion(s string) bool {
+	return len(s) == 8 && strings.HasPrefix(s, "HTTP/") && s[6] == '.' &&
+		'0' <= s[5] && s[5] <= '9' && '0' <= s[7] && s[7] <= '9'
+}
+
+// ErrInvalidTransferEncoding is returned when chunked is not the final transfer coding
+// of a request, which leaves no way to tell where its body ends.
+var ErrInvalidTransferEncoding = errors.New("chunked must be the final transfer coding")
+
+// ErrConflictingFraming is returned for a request with both Content-Length and
+// Transfer-Encoding, which the parser won't guess between.
+var ErrConflictingFraming = errors.New("Content-Length sent with Transfer-Encoding")
+
+// ErrUnsupportedTransferEncoding is returned for transfer codings the parser can't decode.
+var ErrUnsupportedTransferEncoding = errors.New("unsupported transfer coding")
+
+// ErrRequestLineTooLong is returned when the request line exceeds RequestLimits.MaxRequestLineBytes.
+var ErrRequestLineTooLong = errors.New("request line too long")
+
+// ErrHeadersTooLarge is returned when the header section exceeds RequestLimits.
+var ErrHeadersTooLarge = errors.New("header fields too large")
+
+// RequestLimits bounds what ParseRequest accepts.
+type RequestLimits struct {
+	MaxRequestLineBytes int
+	// MaxHeaderBytes counts every header line, CRLFs included.
+	MaxHeaderBytes int
+	MaxHeaderCount int
+	// MaxBodySize is the largest Content-Length accepted, or decoded chunked
+	// body, 0 means no limit.
+	MaxBodySize int
+	// MaxQueryBytes and MaxQueryParams bound the query of the request
+	// target, so parsing it stays cheap. 0 means no limit.
+	MaxQueryBytes  int
+	MaxQueryParams int
+}
+
+// DefaultRequestLimits are the limits used by ParseRequest.
+var DefaultRequestLimits = RequestLimits{
+	MaxRequestLineBytes: 8 << 10,
+	MaxHeaderBytes:      64 << 10,
+	MaxHeaderCount:      100,
+	MaxBodySize:         64 << 20,
+	MaxQueryBytes:       4 << 10,
+	MaxQueryParams:      256,
+}
+
+// ResponseLimits bounds the header section of the responses handlers
+// produce. 0 means no limit.
+type ResponseLimits struct {
+	// MaxHeaderBytes counts every header line, CRLFs included.
+	MaxHeaderBytes int
+	MaxHeaderCount int
+}
+
+// DefaultResponseLimits leave plenty of room to handlers, they only catch
+// runaway ones.
+var DefaultResponseLimits = ResponseLimits{
+	MaxHeaderBytes: 256 << 10,
+	MaxHeaderCount: 1000,
+}
+
+// check reports whether the headers of res are over the limits.
+func (l ResponseLimits) check(res *Response) error {
+	if l.MaxHeaderCount > 0 && len(res.Headers) > l.MaxHeaderCount {
+		return fmt.Errorf("%d response header fields over the limit of %d", len(res.Headers), l.MaxHeaderCount)
+	}
+	if l.MaxHeaderBytes <= 0 {
+		return nil
+	}
+	size := 0
+	for name, value := range res.Headers {
+		size += len(name) + len(": ") + len(value) + len("\r\n")
+	}
+	if size > l.MaxHeaderBytes {
+		return fmt.Errorf("%d bytes of response header fields over the limit of %d", size, l.MaxHeaderBytes)
+	}
+	return nil
+}
+
+// errLineTooLong is returned by readLine for lines longer than its limit.
+var errLineTooLong = errors.New("line too long")
+
+// readLine reads up to and including the next LF, failing once more than limit bytes were read.
+func readLine(reader *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return "", errLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return string(line), err
+	}
+}
+
+// parseTransferEncoding returns the transfer codings of a Transfer-Encoding value, in order.
+// identity means no transformation and is dropped, so an empty result means the
+// body is framed by Content-Length as usual. chunked, when present, must come last,
+// even after an identity.
+func parseTransferEncoding(value string) ([]string, error) {
+	var listed []string
+	for _, coding := range strings.Split(value, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "" {
+			listed = append(listed, coding)
+		}
+	}
+
+	var codings []string
+	for i, coding := range listed {
+		if coding == "chunked" && i != len(listed)-1 {
+			return nil, badRequest("Invalid Transfer-Encoding", ErrInvalidTransferEncoding)
+		}
+		if coding != "identity" {
+			codings = append(codings, coding)
+		}
+	}
+	if len(codings) > 0 && codings[len(codings)-1] != "chunked" {
+		return nil, badRequest("Invalid Transfer-Encoding", ErrInvalidTransferEncoding)
+	}
+	return codings, nil
+}
+
 type Request struct {
 	RequestLine
-	Headers Headers
-	Body    string
+	Headers    Headers
+	Body       string
+	RemoteAddr string
+
+	ctx           context.Context
+	interim       func(code int, headers Headers) error
+	hijack        func() (net.Conn, *bufio.ReadWriter, error)
+	contentLength int64
+	// chunked is set for a body sent with Transfer-Encoding: chunked, whose
+	// decoded size is bounded by bodyLimit, 0 meaning no limit.
+	chunked   bool
+	bodyLimit int64
+	// admitted is set once the guards of the route let the request through.
+	admitted bool
+	// originalURI is the request target as received, when it was rewritten.
+	originalURI string
+	// tls is set for requests read from a TLS connection.
+	tls bool
+	// handlerStart is when the router handed the request to its handler.
+	handlerStart time.Time
+	// clock is the Clock of the server that read the request.
+	clock Clock
+	// encodingPending is set while the handlers within a middleware that
+	// may encode the response run: the ETag they compute isn't the one sent.
+	encodingPending bool
+	// authority is the host of an absolute-form request target, which takes
+	// precedence over the Host header. hostMismatch records that they differ.
+	authority    string
+	hostMismatch bool
+	// body is the unread body of a request to a streaming route, Body is
+	// empty until BufferBody reads it. stream is what handlers read of it,
+	// the body itself unless a middleware decodes it.
+	body   io.Reader
+	stream io.Reader
+}
+
+// now returns the time on the clock of the server, or of the wall outside one.
+func (r *Request) now() time.Time {
+	if r.clock == nil {
+		return time.Now()
+	}
+	return r.clock.Now()
+}
+
+// BodyReader returns the body of the request. For a route with StreamBody
+// set it reads from the connection, and can only be read once.
+func (r *Request) BodyReader() io.Reader {
+	if r.stream != nil {
+		return r.stream
+	}
+	return strings.NewReader(r.Body)
 }
 
+// BufferBody reads what is left of a streamed body into Body, for handlers
+// that need it whole. It does nothing when the body was read already.
+func (r *Request) BufferBody() error {
+	if r.stream == nil {
+		return nil
+	}
+	buf, err := io.ReadAll(r.stream)
+	r.stream = nil
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		return parseErr
+	}
+	if err != nil {
+		return badRequest("Incomplete Body", err)
+	}
+	r.Body = string(buf)
+	return nil
+}
+
+// StreamBody leaves the body announced by the request head in reader, to be
+// read by the handler through BodyReader.
+func (r *Request) StreamBody(reader *bufio.Reader) {
+	if r.chunked {
+		r.body = &chunkedReader{r: reader, limit: r.bodyLimit}
+	} else {
+		r.body = &bodyReader{r: reader, remaining: r.contentLength}
+	}
+	r.stream = r.body
+}
+
+// decodeBody has the handlers read the body through decoder, which reads
+// the body as received from BodyReader.
+func (r *Request) decodeBody(decoder io.Reader) {
+	r.stream = decoder
+}
+
+// bodyReader reads a body of known length, failing with io.ErrUnexpectedEOF
+// when the connection ends before it does.
+type bodyReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.r.Read(p)
+	b.remaining -= int64(n)
+	if err == io.EOF && b.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// maxChunkLine bounds the chunk size lines and trailer fields of a chunked body.
+const maxChunkLine = 4096
+
+// errChunkedTooLarge is returned for chunked bodies over their limit.
+var errChunkedTooLarge = errors.New("chunked body too large")
+
+// chunkedReader decodes a chunked body as it is read: chunk size in hex,
+// CRLF, data, CRLF, until the last chunk of size 0. The trailer fields are
+// dropped. limit caps the decoded size, 0 means no limit. Malformed framing
+// is a 400 ParseError, going over the limit a 413 one, and a connection
+// ending early io.ErrUnexpectedEOF.
+type chunkedReader struct {
+	r     *bufio.Reader
+	limit int64
+	read  int64
+	// left is what remains of the current chunk, whose data is followed by
+	// a CRLF once it is read.
+	left    int64
+	between bool
+	err     error
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.left == 0 {
+		if c.err = c.nextChunk(); c.err != nil {
+			return 0, c.err
+		}
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	c.read += int64(n)
+	c.between = c.left == 0
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	c.err = err
+	return n, err
+}
+
+// nextChunk reads up to the data of the next chunk, or past the trailer
+// fields after the last one, returning io.EOF then.
+func (c *chunkedReader) nextChunk() error {
+	if c.between {
+		if line, err := c.readLine(); err != nil {
+			return err
+		} else if line != "\r\n" {
+			return badRequest("Invalid Chunked Body", errors.New("chunk not followed by CRLF"))
+		}
+		c.between = false
+	}
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	// chunk-size [ chunk-ext ] CRLF
+	size, _, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+	size = strings.TrimSpace(size)
+	n, err := strconv.ParseInt(size, 16, 64)
+	if err != nil || n < 0 || strings.HasPrefix(size, "+") {
+		return badRequest("Invalid Chunked Body", fmt.Errorf("invalid chunk size '%s'", strings.TrimSpace(line)))
+	}
+	if n == 0 {
+		// Trailer fields, up to the blank line
+		for {
+			line, err := c.readLine()
+			if err != nil {
+				return err
+			}
+			if line == "\r\n" || line == "\n" {
+				return io.EOF
+			}
+		}
+	}
+	if c.limit > 0 && c.read+n > c.limit {
+		return bodyTooLarge(c.limit, errChunkedTooLarge)
+	}
+	c.left = n
+	return nil
+}
+
+// readLine reads a framing line, which the body can't end in.
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := readLine(c.r, maxChunkLine)
+	switch err {
+	case nil:
+		return line, nil
+	case io.EOF:
+		return "", io.ErrUnexpectedEOF
+	case errLineTooLong:
+		return "", badRequest("Invalid Chunked Body", errors.New("chunk size line too long"))
+	}
+	return "", err
+}
+
+// OriginalURI returns the request target as the client sent it, before any rewrite.
+func (r *Request) OriginalURI() string {
+	if r.originalURI != "" {
+		return r.originalURI
+	}
+	return r.RequestURI
+}
+
+// sentTarget returns the target as the client sent it, before any rewrite,
+// in origin-form: what a redirect to the same resource starts from.
+func (r *Request) sentTarget() string {
+	if r.authority != "" {
+		if u, err := url.Parse(r.originalURI); err == nil {
+			return u.RequestURI()
+		}
+	}
+	return r.OriginalURI()
+}
+
+// IsTLS reports whether the request came over TLS.
+func (r *Request) IsTLS() bool {
+	return r.tls
+}
+
+// EffectiveHost returns the host the request is for: the authority of an
+// absolute-form target, or else the Host header.
+func (r *Request) EffectiveHost() string {
+	if r.authority != "" {
+		return r.authority
+	}
+	host, _ := r.Headers.Get("Host")
+	return host
+}
+
+// useAbsoluteForm turns an absolute-form target (as sent to proxies) into the
+// origin-form the routes expect, keeping its authority as the effective host.
+func (r *Request) useAbsoluteForm() error {
+	scheme, _, _ := strings.Cut(r.RequestURI, "://")
+	if !strings.EqualFold(scheme, "http") && !strings.EqualFold(scheme, "https") {
+		return nil
+	}
+	u, err := url.Parse(r.RequestURI)
+	if err != nil || u.Host == "" || u.User != nil {
+		return badRequest("Malformed Request Line", fmt.Errorf("invalid request target '%s'", r.RequestURI))
+	}
+	r.originalURI = r.RequestURI
+	r.RequestURI = u.RequestURI()
+	r.authority = trimDefaultPort(strings.ToLower(u.Host), u.Scheme)
+	if host, found := r.Headers.Get("Host"); found {
+		r.hostMismatch = trimDefaultPort(strings.ToLower(host), u.Scheme) != r.authority
+	}
+	return nil
+}
+
+// trimDefaultPort leaves out the port of host when it is the default one of scheme.
+func trimDefaultPort(host, scheme string) string {
+	if strings.EqualFold(scheme, "https") {
+		return strings.TrimSuffix(host, ":443")
+	}
+	return strings.TrimSuffix(host, ":80")
+}
+
+// Query parses the query of the request target into its percent-decoded
+// parameters, every value of a repeated one kept in order. Malformed
+// parameters are left out. The parser bounds the query with RequestLimits.
+func (r *Request) Query() url.Values {
+	_, query, _ := strings.Cut(r.RequestURI, "?")
+	values, _ := url.ParseQuery(query)
+	return values
+}
+
+// Path returns the percent-decoded path of the request target, without the
+// query, which the routes are matched against. The server has removed its
+// dot segments before routing. An encoded slash decodes to a slash like any
+// other character, RawPath tells them apart.
+func (r *Request) Path() string {
+	raw := r.RawPath()
+	if !strings.Contains(raw, "%") {
+		return raw
+	}
+	// The parser only lets well-formed percent-encodings through
+	path, err := url.PathUnescape(raw)
+	if err != nil {
+		return raw
+	}
+	return path
+}
+
+// RawPath returns the path of the request target as sent, still
+// percent-encoded, without the query.
+func (r *Request) RawPath() string {
+	path, _, _ := strings.Cut(r.RequestURI, "?")
+	return path
+}
+
+// removeDotSegments resolves the "." and ".." segments of path, as RFC 3986
+// section 5.2.4 does, never going above the root. Percent-encoded dots count
+// as dots. With mergeSlashes, empty segments are dropped too, except a
+// trailing one.
+func removeDotSegments(path string, mergeSlashes bool) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	out := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch strings.ReplaceAll(strings.ToLower(segment), "%2e", ".") {
+		case ".":
+		case "..":
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		default:
+			if segment != "" || last || !mergeSlashes {
+				out = append(out, segment)
+			}
+			continue
+		}
+		// "/a/." and "/a/b/.." both name the directory "/a/"
+		if last {
+			out = append(out, "")
+		}
+	}
+	return "/" + strings.Join(out, "/")
+}
+
+// Context returns the context of the request. The server cancels it when the
+// client goes away or once the response has been written.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// RequestKey identifies a value attached to a request with Set. Keys are
+// compared by identity, so keys with the same name never collide.
+type RequestKey struct {
+	name string
+}
+
+// NewRequestKey creates a key, name only shows up when printing it.
+func NewRequestKey(name string) *RequestKey {
+	return &RequestKey{name: name}
+}
+
+func (k *RequestKey) String() string {
+	return "request key " + k.name
+}
+
+// Set attaches value to the request under key, for middleware to hand
+// data to the handlers after it. The value is carried by the request
+// context, so it reaches whatever the context is passed to.
+func (r *Request) Set(key *RequestKey, value any) {
+	r.ctx = context.WithValue(r.Context(), key, value)
+}
+
+// Get returns the value attached under key, reporting false when there is none.
+func (r *Request) Get(key *RequestKey) (any, bool) {
+	value := r.Context().Value(key)
+	return value, value != nil
+}
+
+// ErrResponseCommitted is returned when an interim response is attempted
+// after the final response started being written.
+var ErrResponseCommitted = errors.New("final response already committed")
+
+// ErrHijacked is returned by the writes attempted for a request whose
+// connection was taken over with Hijack.
+var ErrHijacked = errors.New("connection hijacked")
+
+// ErrHijackUnsupported is returned by Hijack for requests that didn't come
+// from a connection, like replayed ones.
+var ErrHijackUnsupported = errors.New("hijacking not supported")
+
+// Hijack hands the connection of the request over to the handler, which is
+// then in charge of closing it. The ReadWriter holds what the server had
+// read ahead, the rest of the body included: BodyReader can't be used any
+// more. The server writes nothing on the connection after that, whatever
+// the Response holds, and interim responses fail with ErrHijacked. Hijack
+// fails with ErrResponseCommitted once the final response is on its way.
+func (r *Request) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if r.hijack == nil {
+		return nil, nil, ErrHijackUnsupported
+	}
+	return r.hijack()
+}
+
+// EarlyHints sends a 103 Early Hints interim response carrying links as Link
+// header values (like `</style.css>; rel=preload; as=style`), so the client
+// can fetch them while the handler is still working. It can be called more
+// than once. HTTP/1.0 clients don't know about interim responses and are skipped.
+func (r *Request) EarlyHints(links []string) error {
+	if len(links) == 0 {
+		return nil
+	}
+	headers := NewHeaders()
+	headers.Set("Link", strings.Join(links, ", "))
+	return r.WriteInterim(103, headers)
+}
+
+// WriteInterim sends an informational (1xx) response ahead of the final one.
+// It can be called any number of times until the final response is
+// committed, after which it fails with ErrResponseCommitted. HTTP/1.0 clients
+// don't know about interim responses, for them it does nothing.
+func (r *Request) WriteInterim(code int, headers Headers) error {
+	if code < 100 || code > 199 || code == 101 {
+		return fmt.Errorf("%d is not an interim status code", code)
+	}
+	if r.interim == nil || r.HTTPVersion != "HTTP/1.1" {
+		return nil
+	}
+	return r.interim(code, headers)
+}
+
+// ExpectsContinue reports whether the client waits for a 100 Continue before sending its body.
+func (r *Request) ExpectsContinue() bool {
+	expect, _ := r.Headers.Get("Expect")
+	return strings.EqualFold(expect, "100-continue") && (r.contentLength > 0 || r.chunked)
+}
+
+// ParseRequest reads one request from reader with the DefaultRequestLimits.
+// Malformed requests are reported as a *ParseError.
 func ParseRequest(reader *bufio.Reader) (*Request, error) {
-	out, err := reader.ReadString('\n')
+	return ParseRequestWithLimits(reader, DefaultRequestLimits)
+}
+
+// ParseRequestWithLimits is ParseRequest with the given limits.
+func ParseRequestWithLimits(reader *bufio.Reader, limits RequestLimits) (*Request, error) {
+	req, err := ReadRequestHead(reader, limits)
 	if err != nil {
 		return nil, err
 	}
+	if err := req.ReadBody(reader); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
 
-	parts := strings.Split(out, " ")
-	if len(parts) != 3 {
-		return nil, fmt.Errorf("invalid request line")
+// ReadRequestHead reads the request line and the headers of the next request,
+// leaving the body in reader for ReadBody.
+func ReadRequestHead(reader *bufio.Reader, limits RequestLimits) (*Request, error) {
+	// What can't start a request line, like bytes trailing the body of the
+	// previous request, is refused without waiting for the end of the line
+	if b, err := reader.Peek(1); err == nil && !isTokenChar(b[0]) && strings.IndexByte(" \t\r\n", b[0]) < 0 {
+		return nil, badRequest("Malformed Request Line", fmt.Errorf("unexpected byte 0x%02x where a request line should start", b[0]))
+	}
+	out, err := readLine(reader, limits.MaxRequestLineBytes)
+	// One empty line may come before the request line (RFC 9112 section 2.2)
+	if err == nil && (out == "\r\n" || out == "\n") {
+		out, err = readLine(reader, limits.MaxRequestLineBytes)
+	}
+	if err == errLineTooLong {
+		return nil, &ParseError{StatusCode: 414, Reason: "URI Too Long", Err: ErrRequestLineTooLong}
+	}
+	// A connection ending in the middle of a request line didn't send a request
+	if err == io.EOF && strings.TrimSpace(out) != "" {
+		return nil, badRequest("Malformed Request Line", fmt.Errorf("incomplete request line '%s'", out))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	line := strings.TrimSuffix(strings.TrimSuffix(out, "\n"), "\r")
+	// Probes sending nothing but whitespace are hung up on, there's nothing to answer
+	if strings.TrimSpace(line) == "" {
+		return nil, io.EOF
+	}
+	// Method SP request-target SP HTTP-version, with exactly one space between them
+	parts := strings.Split(line, " ")
+	// Extra spaces between a method and a version are in the target, which
+	// the client failed to percent-encode
+	if len(parts) > 3 && isToken(parts[0]) && isHTTPVersion(parts[len(parts)-1]) && !slices.Contains(parts[1:len(parts)-1], "") {
+		target := strings.Join(parts[1:len(parts)-1], " ")
+		return nil, badRequest("Invalid Request Target", fmt.Errorf("%w: raw space in '%s'", ErrInvalidRequestTarget, target))
+	}
+	if len(parts) != 3 || strings.ContainsAny(line, "\t\v\f\r") {
+		return nil, badRequest("Malformed Request Line", fmt.Errorf("invalid request line '%s'", line))
+	}
+	if parts[1] == "" {
+		return nil, badRequest("Empty Request Target", ErrEmptyRequestTarget)
+	}
+	if !isToken(parts[0]) || !isHTTPVersion(parts[2]) {
+		return nil, badRequest("Malformed Request Line", fmt.Errorf("invalid request line '%s'", line))
+	}
+	if err := checkRequestTarget(parts[1]); err != nil {
+		return nil, badRequest("Invalid Request Target", err)
+	}
+	if _, query, found := strings.Cut(parts[1], "?"); found {
+		if limits.MaxQueryBytes > 0 && len(query) > limits.MaxQueryBytes {
+			return nil, &ParseError{StatusCode: 414, Reason: "URI Too Long", Err: fmt.Errorf("query of %d bytes over the limit of %d", len(query), limits.MaxQueryBytes)}
+		}
+		if n := strings.Count(query, "&") + 1; limits.MaxQueryParams > 0 && n > limits.MaxQueryParams {
+			return nil, badRequest("Too Many Query Parameters", fmt.Errorf("%d query parameters over the limit of %d", n, limits.MaxQueryParams))
+		}
+	}
+	if !slices.Contains(knownMethods, parts[0]) {
+		return nil, &ParseError{StatusCode: 501, Reason: "Not Implemented", Err: fmt.Errorf("%w '%s'", ErrUnknownMethod, parts[0])}
+	}
+	// The asterisk-form only exists for server-wide OPTIONS
+	if parts[1] == "*" && parts[0] != "OPTIONS" {
+		return nil, badRequest("Malformed Request Line", fmt.Errorf("asterisk-form request target with %s", parts[0]))
 	}
 
 	req := &Request{
@@ -68,35 +899,110 @@ func ParseRequest(reader *bufio.Reader) (*Request, error) {
 	}
 
 	// Parse headers
+	headerBytes, headerCount := 0, 0
 	for {
-		line, err := reader.ReadString('\n')
-		// CRLF that marks the end of the headers
-		if err != nil || line == "\r\n" {
+		line, err := readLine(reader, limits.MaxHeaderBytes-headerBytes)
+		if err == errLineTooLong {
+			return nil, &ParseError{StatusCode: 431, Reason: "Header Fields Too Large", Err: ErrHeadersTooLarge}
+		}
+		// The head only ends with the CRLF of an empty line, a connection
+		// ending before it leaves the request incomplete
+		if err != nil {
+			return nil, badRequest("Incomplete Request", fmt.Errorf("headers cut short: %w", err))
+		}
+		if line == "\r\n" {
 			break
 		}
-		// Split into at most n substrings
-		headerParts := strings.SplitN(strings.TrimSpace(line), ": ", 2)
-		if len(headerParts) == 2 {
-			req.Headers.Set(headerParts[0], headerParts[1])
+		headerBytes += len(line)
+		if headerCount++; headerCount > limits.MaxHeaderCount {
+			return nil, &ParseError{StatusCode: 431, Reason: "Too Many Header Fields", Err: ErrHeadersTooLarge}
 		}
+		// field-name ":" OWS field-value OWS, the name a token without
+		// whitespace before the colon. Anything else, folded lines included,
+		// is refused rather than guessed at.
+		name, value, ok := strings.Cut(strings.TrimRight(line, "\r\n"), ":")
+		if !ok {
+			// When a body was announced, this is most likely the body itself
+			if _, found := req.Headers.Get("Content-Length"); found {
+				return nil, badRequest("Malformed Header", ErrMissingHeaderTerminator)
+			}
+			return nil, badRequest("Malformed Header", fmt.Errorf("header line without a colon '%s'", strings.TrimSpace(line)))
+		}
+		if !isToken(name) {
+			return nil, badRequest("Malformed Header", fmt.Errorf("invalid header name '%s'", name))
+		}
+		req.Headers.Add(name, strings.TrimSpace(value))
 	}
 
-	if n, found := req.Headers.Get("Content-Length"); found && n != "0" {
-		num, err := strconv.Atoi(n)
+	if err := req.useAbsoluteForm(); err != nil {
+		return nil, err
+	}
+
+	if te, found := req.Headers.Get("Transfer-Encoding"); found {
+		codings, err := parseTransferEncoding(te)
 		if err != nil {
 			return nil, err
 		}
-		buf := make([]byte, num)
+		if len(codings) > 1 {
+			return nil, &ParseError{StatusCode: 501, Reason: "Not Implemented", Err: ErrUnsupportedTransferEncoding}
+		}
+		// Both framings at once are how requests get smuggled past proxies
+		if _, framed := req.Headers.Get("Content-Length"); framed && len(codings) == 1 {
+			return nil, badRequest("Invalid Transfer-Encoding", ErrConflictingFraming)
+		}
+		req.chunked = len(codings) == 1
+		req.bodyLimit = int64(limits.MaxBodySize)
+	}
+
+	if n, found := req.Headers.Get("Content-Length"); found && n != "0" {
+		// Repeated Content-Length fields are fine as long as they agree
+		if lengths := req.Headers.Values("Content-Length"); len(lengths) > 1 && !slices.ContainsFunc(lengths, func(l string) bool { return l != lengths[0] }) {
+			n = lengths[0]
+		}
+		// Content-Length = 1*DIGIT, 64 bits whatever the size of int
+		num, err := strconv.ParseInt(n, 10, 64)
+		if err != nil || strings.Trim(n, "0123456789") != "" {
+			return nil, badRequest("Invalid Content-Length", fmt.Errorf("invalid Content-Length '%s'", n))
+		}
+		if limits.MaxBodySize > 0 && num > int64(limits.MaxBodySize) {
+			return nil, bodyTooLarge(int64(limits.MaxBodySize), fmt.Errorf("Content-Length %d over the limit of %d", num, limits.MaxBodySize))
+		}
+		req.contentLength = num
+	}
 
-		_, err = io.ReadFull(reader, buf)
+	return req, nil
+}
+
+// ReadBody reads the body announced by the request head from reader.
+func (r *Request) ReadBody(reader *bufio.Reader) error {
+	if r.chunked {
+		body, err := io.ReadAll(&chunkedReader{r: reader, limit: r.bodyLimit})
+		var parseErr *ParseError
+		if errors.As(err, &parseErr) {
+			return parseErr
+		}
 		if err != nil {
-			return nil, err
+			return badRequest("Incomplete Body", err)
 		}
+		r.Body = string(body)
+		return nil
+	}
+	if r.contentLength == 0 {
+		return nil
+	}
+	// Without a MaxBodySize, a 32-bit int may not hold it
+	if r.contentLength > math.MaxInt {
+		return &ParseError{StatusCode: 413, Reason: StatusText(413), Err: fmt.Errorf("Content-Length %d too large to read", r.contentLength)}
+	}
 
-		req.Body = string(buf)
+	buf := make([]byte, r.contentLength)
+	_, err := io.ReadFull(reader, buf)
+	if err != nil {
+		return badRequest("Incomplete Body", err)
 	}
 
-	return req, nil
+	r.Body = string(buf)
+	return nil
 }
 
 // The first line of a Response message is the Status-Line,
@@ -114,24 +1020,262 @@ type Response struct {
 	StatusLine
 	Headers Headers
 	Body    string
+	// Stream, when set, produces the body progressively instead of Body.
+	// The response is sent with Transfer-Encoding: chunked, unless the
+	// handler set a Content-Length, in which case Stream must write exactly that many bytes.
+	Stream func(w io.Writer) error
+	// Close forces the connection to be closed after this response,
+	// whatever the client asked for.
+	Close bool
+	// SkipTransform exempts this response from the server's ResponseBodyTransform.
+	SkipTransform bool
+
+	// headOnly leaves the body out when writing, keeping the headers
+	// describing it, as the answer to a HEAD request.
+	headOnly bool
+	// closeDelimited sends a Stream without Content-Length as it comes,
+	// the connection being closed after it, instead of chunked.
+	closeDelimited bool
+	// abort releases what a Stream producing in the background holds on
+	// to. It runs once the response is written, whether the Stream ran or
+	// not (a HEAD, a head that failed to write) or when it is replaced.
+	abort func()
+	// bodyWritten counts the bytes written after the head by WriteTo, the
+	// framing of chunks included.
+	bodyWritten int64
+}
+
+// onAbort adds release to what is run when the response is done with.
+func (r *Response) onAbort(release func()) {
+	prev := r.abort
+	r.abort = func() {
+		if prev != nil {
+			prev()
+		}
+		release()
+	}
+}
+
+// release runs the abort hooks of the response, once.
+func (r *Response) release() {
+	if r.abort != nil {
+		r.abort()
+		r.abort = nil
+	}
 }
 
 func (r Response) HeaderToString() string {
 	if len(r.Headers) == 0 {
 		return ""
 	}
+	return string(r.appendHeaders(nil))
+}
 
-	var sb strings.Builder
-
+func (r Response) appendHeaders(b []byte) []byte {
 	for k, v := range r.Headers {
-		sb.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
+		b = append(b, k...)
+		b = append(b, ": "...)
+		b = append(b, v...)
+		b = append(b, "\r\n"...)
 	}
+	return b
+}
 
-	return sb.String()
+// appendHead appends the status line, the headers and the blank line that ends them.
+func (r Response) appendHead(b []byte) []byte {
+	b = append(b, r.HTTPVersion...)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(r.StatusCode), 10)
+	b = append(b, ' ')
+	b = append(b, r.ReasonPhrase...)
+	b = append(b, "\r\n"...)
+	b = r.appendHeaders(b)
+	return append(b, "\r\n"...)
 }
 
 func (r Response) String() string {
-	return fmt.Sprintf("%s %d %s\r\n%s\r\n%s", r.HTTPVersion, r.StatusCode, r.ReasonPhrase, r.HeaderToString(), r.Body)
+	return string(r.appendHead(make([]byte, 0, 128+len(r.Body)))) + r.Body
+}
+
+// Vary adds field to the Vary header, which lists the request headers the
+// response depends on, unless it is already listed or Vary is "*".
+func (r *Response) Vary(field string) {
+	if vary, _ := r.Headers.Get("Vary"); strings.TrimSpace(vary) == "" {
+		r.Headers.Set("Vary", field)
+		return
+	}
+	for _, listed := range r.Headers.Values("Vary") {
+		if strings.EqualFold(listed, field) || listed == "*" {
+			return
+		}
+	}
+	r.Headers.Add("Vary", field)
+}
+
+// sanitizeStatusLine keeps what the handler set from breaking the status
+// line: a code out of the 100-599 range becomes a 500, and the reason
+// phrase loses its control characters, defaulting to the standard one.
+func (r *Response) sanitizeStatusLine() {
+	if r.StatusCode < 100 || r.StatusCode > 599 {
+		fmt.Printf("Invalid status code %d, sending a 500 instead\n", r.StatusCode)
+		r.StatusCode = 500
+		r.ReasonPhrase = ""
+	}
+	r.ReasonPhrase = strings.Map(func(c rune) rune {
+		if c < ' ' && c != '\t' || c == 0x7f {
+			return -1
+		}
+		return c
+	}, r.ReasonPhrase)
+	if r.ReasonPhrase == "" {
+		r.ReasonPhrase = StatusText(r.StatusCode)
+	}
+}
+
+// bodyAllowed reports whether a response with this status code may carry a body.
+func bodyAllowed(code int) bool {
+	return code >= 200 && code != 204 && code != 304
+}
+
+// frameBody adds a Content-Length when the handler didn't, so a persistent
+// connection can tell where the body ends.
+func (r *Response) frameBody() {
+	if r.Stream != nil || !bodyAllowed(r.StatusCode) {
+		return
+	}
+	if _, found := r.Headers.Get("Content-Length"); !found {
+		r.Headers.Set("Content-Length", strconv.Itoa(len(r.Body)))
+	}
+}
+
+// WriteTo writes the full response to w. Streamed responses without a
+// Content-Length are framed as chunks, or end with the connection for
+// HTTP/1.0 clients.
+func (r *Response) WriteTo(w io.Writer) (int64, error) {
+	defer r.release()
+	r.sanitizeStatusLine()
+	r.bodyWritten = 0
+	if r.headOnly {
+		if _, found := r.Headers.Get("Content-Length"); r.Stream != nil && !found && !r.closeDelimited && bodyAllowed(r.StatusCode) {
+			r.Headers.Set("Transfer-Encoding", "chunked")
+		}
+		n, err := w.Write(r.appendHead(nil))
+		return int64(n), err
+	}
+
+	if r.Stream == nil {
+		// One buffer, one write
+		b := r.appendHead(make([]byte, 0, 128+len(r.Body)))
+		head := len(b)
+		b = append(b, r.Body...)
+		n, err := w.Write(b)
+		r.bodyWritten = max(int64(n-head), 0)
+		return int64(n), err
+	}
+
+	if _, found := r.Headers.Get("Content-Length"); found || r.closeDelimited {
+		head := r.appendHead(nil)
+		cw := &countingWriter{w: w}
+		if _, err := cw.Write(head); err != nil {
+			return cw.n, err
+		}
+		err := r.Stream(cw)
+		r.bodyWritten = cw.n - int64(len(head))
+		return cw.n, err
+	}
+
+	// Content-Length and Transfer-Encoding must never both be sent
+	r.Headers.Set("Transfer-Encoding", "chunked")
+
+	cw := &chunkedWriter{w: w}
+	n, err := w.Write(r.appendHead(nil))
+	if err != nil {
+		return int64(n), err
+	}
+	err = r.Stream(cw)
+	if err == nil {
+		var end int
+		end, err = io.WriteString(w, "0\r\n\r\n")
+		cw.n += int64(end)
+	}
+	r.bodyWritten = cw.n
+	return int64(n) + cw.n, err
+}
+
+// writeInterim writes an interim response head to w and flushes it, so the
+// client sees it before the final response is ready. Interim responses have
+// no body and don't affect the framing of what follows.
+func writeInterim(w io.Writer, code int, headers Headers) error {
+	interim := Response{
+		StatusLine: StatusLine{HTTPVersion: "HTTP/1.1", StatusCode: code, ReasonPhrase: StatusText(code)},
+		Headers:    headers,
+	}
+	if _, err := w.Write(interim.appendHead(nil)); err != nil {
+		return err
+	}
+	return flush(w)
+}
+
+// Flusher is implemented by the writer handed to Response.Stream when the
+// output is buffered. Flush sends everything written so far to the client,
+// for long polling or progressive rendering.
+type Flusher interface {
+	Flush() error
+}
+
+// flush flushes w if it is a Flusher.
+func flush(w io.Writer) error {
+	if f, ok := w.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (cw *countingWriter) Flush() error {
+	return flush(cw.w)
+}
+
+// chunkedWriter frames every Write as a single chunk: size in hex, CRLF, data, CRLF.
+type chunkedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *chunkedWriter) Write(p []byte) (int, error) {
+	// A zero-length chunk would terminate the body
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := fmt.Fprintf(cw.w, "%x\r\n", len(p))
+	cw.n += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	n, err = cw.w.Write(p)
+	cw.n += int64(n)
+	if err != nil {
+		return n, err
+	}
+	n2, err := io.WriteString(cw.w, "\r\n")
+	cw.n += int64(n2)
+	return n, err
+}
+
+// Flush only ever sends whole chunks, since every Write is one.
+func (cw *chunkedWriter) Flush() error {
+	return flush(cw.w)
 }
 
 // NewResponse creates a new Response with sensible defaults (HTTP/1.1 200 OK).
@@ -148,46 +1292,325 @@ func NewResponse() *Response {
 
 type HandlerFunc func(req *Request, res *Response)
 
+// Guard checks a request from its head alone. Returning false rejects it,
+// with res as the guard left it, before the body is read when possible.
+type Guard func(req *Request, res *Response) bool
+
+// AsGuard runs a middleware deciding from the request head, like
+// IPAllowlist or BasicAuth, as a Guard: the request passes if the
+// middleware calls the next handler.
+func AsGuard(m Middleware) Guard {
+	return func(req *Request, res *Response) bool {
+		passed := false
+		m(func(*Request, *Response) { passed = true })(req, res)
+		return passed
+	}
+}
+
 type Route struct {
 	Pattern  string
 	IsPrefix bool
 	Handler  HandlerFunc
+	// Methods the route answers to, nil means any.
+	Methods []string
+	// Guards run before Handler. For requests waiting on a 100 Continue
+	// they run before the body is sent.
+	Guards []Guard
+	// StreamBody hands the body to Handler unread, through BodyReader,
+	// instead of reading it into Body first.
+	StreamBody bool
+}
+
+// Stream makes the route stream request bodies to its handler.
+func (r *Route) Stream() *Route {
+	r.StreamBody = true
+	return r
+}
+
+// Guard adds guards to the route.
+func (r *Route) Guard(guards ...Guard) *Route {
+	r.Guards = append(r.Guards, guards...)
+	return r
+}
+
+// admit runs the guards of the route, once per request.
+func (r *Route) admit(req *Request, res *Response) bool {
+	if req.admitted {
+		return true
+	}
+	for _, guard := range r.Guards {
+		if !guard(req, res) {
+			return false
+		}
+	}
+	req.admitted = true
+	return true
+}
+
+func (r Route) matchesPath(path string) bool {
+	if r.IsPrefix {
+		return strings.HasPrefix(path, r.Pattern)
+	}
+	return path == r.Pattern
+}
+
+func (r Route) allows(method string) bool {
+	return r.Methods == nil || slices.Contains(r.Methods, method)
 }
 
 type Router struct {
-	routes []Route
+	routes []*Route
+
+	// CORS, when set, answers preflight requests for every registered path
+	// and adds the CORS headers to the responses to allowed origins.
+	CORS *CORSPolicy
+	// AutoHEAD makes every route answering GET answer HEAD too, unless
+	// another route for the path has a HEAD handler of its own.
+	AutoHEAD bool
+	// ErrorFormatter, when set, is given the 404 and 405 responses the router
+	// produces itself, with their status and headers (like Allow) already set,
+	// to add a body. It must not change the status.
+	ErrorFormatter HandlerFunc
 }
 
 func NewRouter() Router {
 	return Router{}
 }
 
-func (r *Router) HandleExact(path string, handler HandlerFunc) {
-	r.routes = append(r.routes, Route{path, false, handler})
+// HandleExact registers handler for path. Without methods it answers to any of them.
+func (r *Router) HandleExact(path string, handler HandlerFunc, methods ...string) *Route {
+	route := &Route{Pattern: path, Handler: handler, Methods: methodList(methods)}
+	r.routes = append(r.routes, route)
+	return route
 }
 
-func (r *Router) HandlePrefix(prefix string, handler HandlerFunc) {
-	r.routes = append(r.routes, Route{prefix, true, handler})
+// HandlePrefix registers handler for the paths starting with prefix.
+// Without methods it answers to any of them.
+func (r *Router) HandlePrefix(prefix string, handler HandlerFunc, methods ...string) *Route {
+	route := &Route{Pattern: prefix, IsPrefix: true, Handler: handler, Methods: methodList(methods)}
+	r.routes = append(r.routes, route)
+	return route
 }
 
-func (r *Router) Route(req *Request) *Response {
-	res := NewResponse()
+func methodList(methods []string) []string {
+	if len(methods) == 0 {
+		return nil
+	}
+	return methods
+}
 
+// appendMethods adds the methods not already in list.
+func appendMethods(list []string, methods ...string) []string {
+	for _, m := range methods {
+		if !slices.Contains(list, m) {
+			list = append(list, m)
+		}
+	}
+	return list
+}
+
+// sortMethods orders methods as knownMethods does, others last in
+// alphabetical order, so Allow lists don't depend on the order of the routes.
+func sortMethods(methods []string) []string {
+	rank := func(m string) int {
+		if i := slices.Index(knownMethods, m); i >= 0 {
+			return i
+		}
+		return len(knownMethods)
+	}
+	slices.SortFunc(methods, func(a, b string) int {
+		if ra, rb := rank(a), rank(b); ra != rb {
+			return ra - rb
+		}
+		return strings.Compare(a, b)
+	})
+	return methods
+}
+
+// RouteInfo describes a registered route.
+type RouteInfo struct {
+	Pattern string
+	// Kind is "exact" or "prefix".
+	Kind string
+	// Methods the route answers to, HEAD included when AutoHEAD provides it. nil means any.
+	Methods []string
+	Guarded bool
+}
+
+// Routes describes the registered routes, in the order they are matched.
+func (r *Router) Routes() []RouteInfo {
+	infos := make([]RouteInfo, 0, len(r.routes))
 	for _, route := range r.routes {
+		info := RouteInfo{Pattern: route.Pattern, Kind: "exact", Guarded: len(route.Guards) > 0}
 		if route.IsPrefix {
-			if strings.HasPrefix(req.RequestURI, route.Pattern) {
-				route.Handler(req, res)
-				return res
+			info.Kind = "prefix"
+		}
+		if route.Methods != nil {
+			info.Methods = r.withHEAD(slices.Clone(route.Methods))
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Methods returns every method registered on any route.
+func (r *Router) Methods() []string {
+	var methods []string
+	for _, route := range r.routes {
+		methods = appendMethods(methods, route.Methods...)
+	}
+	return r.withHEAD(methods)
+}
+
+// withHEAD adds HEAD to methods taking GET when AutoHEAD is on.
+func (r *Router) withHEAD(methods []string) []string {
+	if r.AutoHEAD && slices.Contains(methods, "GET") {
+		return appendMethods(methods, "HEAD")
+	}
+	return methods
+}
+
+// AllowedMethods returns the methods the routes matching path answer to,
+// OPTIONS included, or nil when no route matches path. A route taking any
+// method doesn't add to the list. Each method is listed once, in the order
+// of sortMethods.
+func (r *Router) AllowedMethods(path string) []string {
+	var allow []string
+	pathMatched := false
+	for _, route := range r.routes {
+		if route.matchesPath(path) {
+			pathMatched = true
+			allow = appendMethods(allow, route.Methods...)
+		}
+	}
+	if !pathMatched {
+		return nil
+	}
+	return sortMethods(appendMethods(r.withHEAD(allow), "OPTIONS"))
+}
+
+// match returns the route to run for req. When there is none, allow lists
+// the methods of the routes matching the path, empty if none does.
+func (r *Router) match(req *Request) (route *Route, allow []string) {
+	for _, route := range r.routes {
+		if !route.matchesPath(req.Path()) {
+			continue
+		}
+		if route.allows(req.Method) {
+			return route, nil
+		}
+		allow = appendMethods(allow, route.Methods...)
+	}
+
+	// No route has a HEAD handler of its own, use the GET one
+	if r.AutoHEAD && req.Method == "HEAD" {
+		for _, route := range r.routes {
+			if route.matchesPath(req.Path()) && route.allows("GET") {
+				return route, nil
 			}
-		} else {
-			if req.RequestURI == route.Pattern {
-				route.Handler(req, res)
+		}
+	}
+	return nil, allow
+}
+
+// Streams reports whether the route req goes to reads the body itself.
+func (r *Router) Streams(req *Request) bool {
+	route, _ := r.match(req)
+	return route != nil && route.StreamBody
+}
+
+// BuffersBody reports whether req goes to a handler that has its body read
+// beforehand, that is a route without StreamBody. Requests answered by the
+// router itself, like a 404, a 405 or a preflight, don't need their body.
+func (r *Router) BuffersBody(req *Request) bool {
+	if req.RequestURI == "*" || r.CORS != nil && r.CORS.isPreflight(req) && r.AllowedMethods(req.Path()) != nil {
+		return false
+	}
+	route, _ := r.match(req)
+	return route != nil && !route.StreamBody
+}
+
+// Admit runs the guards of the route req goes to, so a request can be
+// rejected before its body is read. Route doesn't run them again.
+func (r *Router) Admit(req *Request, res *Response) bool {
+	if req.RequestURI == "*" || r.CORS != nil && r.CORS.isPreflight(req) {
+		return true
+	}
+	if route, _ := r.match(req); route != nil {
+		return route.admit(req, res)
+	}
+	return true
+}
+
+// Route runs the first route matching both the path and the method of req,
+// once its guards let the request through. When the path matches but no
+// route takes the method, the answer is a 405 listing the allowed ones, or
+// for OPTIONS a 204 with the same list.
+//
+// The asterisk-form "OPTIONS *" asks about the server as a whole. It never
+// reaches a handler (so no route middleware runs for it) and is answered
+// with every method registered on any route.
+//
+// CORS preflights are answered before any route is matched, from the
+// methods registered for the path, since a route usually has no OPTIONS handler.
+func (r *Router) Route(req *Request) *Response {
+	res := NewResponse()
+
+	if req.RequestURI == "*" {
+		allowed(res, sortMethods(appendMethods(r.Methods(), "OPTIONS")))
+		return res
+	}
+
+	if r.CORS != nil {
+		defer r.CORS.decorate(req, res)
+		if r.CORS.isPreflight(req) {
+			if methods := r.AllowedMethods(req.Path()); methods != nil {
+				r.CORS.preflight(req, res, methods)
 				return res
 			}
 		}
 	}
 
+	route, allow := r.match(req)
+	if route != nil {
+		if route.admit(req, res) {
+			req.handlerStart = req.now()
+			route.Handler(req, res)
+		}
+		return res
+	}
+
+	if len(allow) > 0 {
+		allow = sortMethods(appendMethods(r.withHEAD(allow), "OPTIONS"))
+		// OPTIONS is answered for any path with routes, "/" included:
+		// with the home route that is "GET, HEAD, OPTIONS"
+		if req.Method == "OPTIONS" {
+			allowed(res, allow)
+			return res
+		}
+		res.StatusCode = 405
+		res.ReasonPhrase = "Method Not Allowed"
+		res.Headers.Set("Allow", strings.Join(allow, ", "))
+		r.formatError(req, res)
+		return res
+	}
+
 	res.StatusCode = 404
 	res.ReasonPhrase = "Not Found"
+	r.formatError(req, res)
 	return res
 }
+
+// formatError hands an error response to the ErrorFormatter.
+func (r *Router) formatError(req *Request, res *Response) {
+	if r.ErrorFormatter != nil {
+		r.ErrorFormatter(req, res)
+	}
+}
+
+// allowed answers an OPTIONS request with the methods available.
+func allowed(res *Response, methods []string) {
+	res.StatusCode = 204
+	res.ReasonPhrase = "No Content"
+	res.Headers.Set("Allow", strings.Join(methods, ", "))
+}
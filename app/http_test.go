@@ -0,0 +1,1180 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeadersCaseInsensitive(t *testing.T) {
+	for _, name := range []string{"USER-AGENT", "User-Agent", "user-agent", "uSeR-aGeNt"} {
+		h := NewHeaders()
+		h.Set(name, "curl")
+		for _, lookup := range []string{"USER-AGENT", "User-Agent", "user-agent"} {
+			if v, found := h.Get(lookup); !found || v != "curl" {
+				t.Errorf("Set(%q) then Get(%q): got %q, %v", name, lookup, v, found)
+			}
+			if v := h.Values(lookup); !slices.Equal(v, []string{"curl"}) {
+				t.Errorf("Set(%q) then Values(%q): got %q", name, lookup, v)
+			}
+		}
+		if len(h) != 1 {
+			t.Errorf("Set(%q): %d entries, want 1", name, len(h))
+		}
+	}
+
+	// A Set under another case replaces, an Add under another case appends
+	h := NewHeaders()
+	h.Set("Accept", "text/html")
+	h.Set("ACCEPT", "text/plain")
+	h.Add("accept", "application/json")
+	h.Add("AcCePt", `text/x; q="a,b"`)
+	if v, _ := h.Get("Accept"); v != `text/plain, application/json, text/x; q="a,b"` {
+		t.Errorf("Accept: got %q", v)
+	}
+	if v := h.Values("ACCEPT"); !slices.Equal(v, []string{"text/plain", "application/json", `text/x; q="a,b"`}) {
+		t.Errorf("Values: got %q", v)
+	}
+	if len(h) != 1 {
+		t.Errorf("%d entries, want 1", len(h))
+	}
+}
+
+func TestReadRequestHeadMergesHeaders(t *testing.T) {
+	raw := "GET / HTTP/1.1\r\nHost: x\r\nX-Tag: a\r\nx-tag: b\r\nX-TAG: c\r\nUSER-AGENT: curl\r\n\r\n"
+	req, err := ReadRequestHead(bufio.NewReader(strings.NewReader(raw)), DefaultRequestLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := req.Headers.Values("X-Tag"); !slices.Equal(v, []string{"a", "b", "c"}) {
+		t.Errorf("X-Tag: got %q", v)
+	}
+	if v, _ := req.Headers.Get("user-agent"); v != "curl" {
+		t.Errorf("User-Agent: got %q", v)
+	}
+}
+
+func TestReadRequestHead(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		status int // 0 for a request read without error
+		check  func(t *testing.T, req *Request)
+	}{
+		{
+			name: "simple GET",
+			raw:  "GET /echo/abc HTTP/1.1\r\nHost: x\r\n\r\n",
+			check: func(t *testing.T, req *Request) {
+				if req.Method != "GET" || req.RequestURI != "/echo/abc" || req.HTTPVersion != "HTTP/1.1" {
+					t.Errorf("got %q %q %q", req.Method, req.RequestURI, req.HTTPVersion)
+				}
+			},
+		},
+		{
+			name: "value whitespace trimmed, colon in value",
+			raw:  "GET / HTTP/1.1\r\nHost:  x:4221 \t\r\n\r\n",
+			check: func(t *testing.T, req *Request) {
+				if host, _ := req.Headers.Get("Host"); host != "x:4221" {
+					t.Errorf("Host: got %q", host)
+				}
+			},
+		},
+		{
+			name: "percent-encoded path",
+			raw:  "GET /files/my%20file.txt?x=1 HTTP/1.1\r\nHost: x\r\n\r\n",
+			check: func(t *testing.T, req *Request) {
+				if req.Path() != "/files/my file.txt" || req.RawPath() != "/files/my%20file.txt" {
+					t.Errorf("got %q, raw %q", req.Path(), req.RawPath())
+				}
+			},
+		},
+		{
+			name: "absolute form",
+			raw:  "GET http://example.com/echo/a HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			check: func(t *testing.T, req *Request) {
+				if req.RequestURI != "/echo/a" || req.EffectiveHost() != "example.com" {
+					t.Errorf("got %q for %q", req.RequestURI, req.EffectiveHost())
+				}
+			},
+		},
+		{name: "empty target", raw: "GET  HTTP/1.1\r\n\r\n", status: 400},
+		{
+			name: "asterisk-form",
+			raw:  "OPTIONS * HTTP/1.1\r\nHost: x\r\n\r\n",
+			check: func(t *testing.T, req *Request) {
+				if req.RequestURI != "*" {
+					t.Errorf("target %q", req.RequestURI)
+				}
+			},
+		},
+		{name: "asterisk-form of another method", raw: "GET * HTTP/1.1\r\nHost: x\r\n\r\n", status: 400},
+		{name: "raw space in target", raw: "GET /a b HTTP/1.1\r\nHost: x\r\n\r\n", status: 400},
+		{name: "bad percent-encoding", raw: "GET /a%zz HTTP/1.1\r\nHost: x\r\n\r\n", status: 400},
+		{name: "unknown method", raw: "BREW /pot HTTP/1.1\r\nHost: x\r\n\r\n", status: 501},
+		{name: "bad version", raw: "GET / HTTP/one\r\nHost: x\r\n\r\n", status: 400},
+		{name: "header without colon", raw: "GET / HTTP/1.1\r\nHost: x\r\nhello\r\n\r\n", status: 400},
+		{name: "body taken for a header", raw: "POST / HTTP/1.1\r\nHost: x\r\n{\"a\":1}\r\n\r\n", status: 400},
+		{name: "folded header", raw: "GET / HTTP/1.1\r\nHost: x\r\n continued\r\n\r\n", status: 400},
+		{name: "space before colon", raw: "GET / HTTP/1.1\r\nHost : x\r\n\r\n", status: 400},
+		{name: "head cut short", raw: "GET / HTTP/1.1\r\nHost: x\r\n", status: 400},
+		{name: "bad Content-Length", raw: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 1x\r\n\r\n", status: 400},
+		{name: "huge Content-Length", raw: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 99999999999999\r\n\r\n", status: 413},
+		{name: "Content-Length past 64 bits", raw: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 99999999999999999999\r\n\r\n", status: 400},
+		{name: "signed Content-Length", raw: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: +5\r\n\r\n", status: 400},
+		{name: "negative Content-Length", raw: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: -1\r\n\r\n", status: 400},
+		{
+			name: "Content-Length within the limit",
+			raw:  "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 0005\r\n\r\nhello",
+			check: func(t *testing.T, req *Request) {
+				if req.contentLength != 5 {
+					t.Errorf("Content-Length %d", req.contentLength)
+				}
+			},
+		},
+		{name: "Content-Length and chunked", raw: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n", status: 400},
+		{name: "unsupported coding", raw: "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip, chunked\r\n\r\n", status: 501},
+		{name: "too many headers", raw: "GET / HTTP/1.1\r\n" + strings.Repeat("X-A: b\r\n", DefaultRequestLimits.MaxHeaderCount+1) + "\r\n", status: 431},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := ReadRequestHead(bufio.NewReader(strings.NewReader(tt.raw)), DefaultRequestLimits)
+			if tt.status == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				tt.check(t, req)
+				return
+			}
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("got %v, want a %d ParseError", err, tt.status)
+			}
+			if perr.StatusCode != tt.status {
+				t.Errorf("got %d (%v), want %d", perr.StatusCode, err, tt.status)
+			}
+		})
+	}
+}
+
+func TestReadBodyChunked(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		want   string
+		status int
+	}{
+		{name: "chunks and trailer", body: "5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nX-T: y\r\n\r\n", want: "hello world"},
+		{name: "bad size", body: "zz\r\nhello\r\n0\r\n\r\n", status: 400},
+		{name: "missing CRLF", body: "5\r\nhelloXX0\r\n\r\n", status: 400},
+		{name: "truncated", body: "5\r\nhel", status: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "POST /files/x HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n" + tt.body
+			reader := bufio.NewReader(strings.NewReader(raw))
+			req, err := ReadRequestHead(reader, DefaultRequestLimits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = req.ReadBody(reader)
+			if tt.status == 0 {
+				if err != nil || req.Body != tt.want {
+					t.Errorf("got %q, %v, want %q", req.Body, err, tt.want)
+				}
+				return
+			}
+			var perr *ParseError
+			if !errors.As(err, &perr) || perr.StatusCode != tt.status {
+				t.Errorf("got %v, want a %d ParseError", err, tt.status)
+			}
+		})
+	}
+}
+
+func TestResponseWriteTo(t *testing.T) {
+	stream := func(w io.Writer) error {
+		_, err := io.WriteString(w, "hello")
+		return err
+	}
+	tests := []struct {
+		name string
+		res  *Response
+		// want is the message after the head, wantHead headers it must carry
+		want     string
+		wantHead []string
+	}{
+		{
+			name:     "body",
+			res:      &Response{Headers: Headers{"content-length": "5"}, Body: "hello"},
+			want:     "hello",
+			wantHead: []string{"content-length: 5"},
+		},
+		{
+			name:     "stream with length",
+			res:      &Response{Headers: Headers{"content-length": "5"}, Stream: stream},
+			want:     "hello",
+			wantHead: []string{"content-length: 5"},
+		},
+		{
+			name:     "stream chunked",
+			res:      &Response{Headers: NewHeaders(), Stream: stream},
+			want:     "5\r\nhello\r\n0\r\n\r\n",
+			wantHead: []string{"transfer-encoding: chunked"},
+		},
+		{
+			name: "stream until the close",
+			res:  &Response{Headers: NewHeaders(), Stream: stream, closeDelimited: true},
+			want: "hello",
+		},
+		{
+			name:     "HEAD keeps the headers",
+			res:      &Response{Headers: Headers{"content-length": "5"}, Body: "hello", headOnly: true},
+			wantHead: []string{"content-length: 5"},
+		},
+		{
+			name:     "HEAD of a stream",
+			res:      &Response{Headers: NewHeaders(), Stream: stream, headOnly: true},
+			wantHead: []string{"transfer-encoding: chunked"},
+		},
+		{
+			name: "no reason phrase",
+			res:  &Response{StatusLine: StatusLine{StatusCode: 404}, Headers: Headers{"content-length": "0"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.res.HTTPVersion = "HTTP/1.1"
+			if tt.res.StatusCode == 0 {
+				tt.res.StatusCode = 200
+			}
+			var out strings.Builder
+			n, err := tt.res.WriteTo(&out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int(n) != out.Len() {
+				t.Errorf("WriteTo returned %d, wrote %d bytes", n, out.Len())
+			}
+			head, body, found := strings.Cut(out.String(), "\r\n\r\n")
+			if !found {
+				t.Fatalf("no end of head in %q", out.String())
+			}
+			statusLine, _, _ := strings.Cut(head, "\r\n")
+			if want := fmt.Sprintf("HTTP/1.1 %d %s", tt.res.StatusCode, StatusText(tt.res.StatusCode)); statusLine != want {
+				t.Errorf("status line %q, want %q", statusLine, want)
+			}
+			for _, h := range tt.wantHead {
+				if !strings.Contains(head+"\r\n", "\r\n"+h+"\r\n") {
+					t.Errorf("no %q in %q", h, head)
+				}
+			}
+			if body != tt.want {
+				t.Errorf("body %q, want %q", body, tt.want)
+			}
+			if tt.res.bodyWritten != int64(len(body)) {
+				t.Errorf("bodyWritten %d, want %d", tt.res.bodyWritten, len(body))
+			}
+		})
+	}
+}
+
+// An unsized stream goes out chunked to HTTP/1.1 clients, and until the
+// close to HTTP/1.0 ones, which don't know chunks.
+func TestUnsizedStream(t *testing.T) {
+	router := &Router{}
+	router.HandleExact("/stream", func(req *Request, res *Response) {
+		if req.Query().Get("sized") != "" {
+			res.Headers.Set("Content-Length", "7")
+		}
+		res.Stream = func(w io.Writer) error {
+			io.WriteString(w, "abc")
+			_, err := io.WriteString(w, "defg")
+			return err
+		}
+	}, "GET")
+	_, addr := startServer(t, router)
+
+	tests := []struct {
+		name, request, head, body string
+		closed                    bool
+	}{
+		{"HTTP/1.1", "GET /stream HTTP/1.1\r\nHost: x\r\n\r\n", "transfer-encoding: chunked", "3\r\nabc\r\n4\r\ndefg\r\n0\r\n\r\n", false},
+		{"HTTP/1.0", "GET /stream HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", "connection: close", "abcdefg", true},
+		{"HTTP/1.0 sized", "GET /stream?sized=1 HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", "content-length: 7", "abcdefg", false},
+		{"HTTP/1.1 sized", "GET /stream?sized=1 HTTP/1.1\r\nHost: x\r\n\r\n", "content-length: 7", "abcdefg", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			io.WriteString(conn, tt.request)
+			reader := bufio.NewReader(conn)
+			head := readRaw(t, reader, "\r\n\r\n")
+			if !strings.Contains(head, "\r\n"+tt.head+"\r\n") {
+				t.Errorf("no %q in %q", tt.head, head)
+			}
+			if strings.Contains(head, "content-length") && strings.Contains(head, "transfer-encoding") {
+				t.Errorf("both Content-Length and Transfer-Encoding in %q", head)
+			}
+			if tt.closed {
+				body, err := io.ReadAll(reader)
+				if err != nil || string(body) != tt.body {
+					t.Errorf("got %q, %v, want %q then the close", body, err, tt.body)
+				}
+				return
+			}
+			if body := readRaw(t, reader, tt.body); body != tt.body {
+				t.Errorf("got %q, want %q", body, tt.body)
+			}
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if _, err := reader.ReadByte(); !isTimeout(err) {
+				t.Errorf("the connection didn't stay open: %v", err)
+			}
+		})
+	}
+}
+
+// The 413 for a body over MaxBodySize tells the client the limit.
+func TestBodyTooLargeTellsLimit(t *testing.T) {
+	_, addr := startServer(t, echoRouter(), func(s *Server) { s.RequestLimits.MaxBodySize = 100 })
+	c := dial(t, addr)
+
+	req := newTestRequest("POST", "/echo/x")
+	req.Body = strings.Repeat("x", 200)
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 413 || res.Body != "max 100 bytes\n" {
+		t.Errorf("got %d %q, want 413 with the limit", res.StatusCode, res.Body)
+	}
+}
+
+// A chunked body gets the same 413 as one announced by Content-Length,
+// read whole or streamed to a file.
+func TestChunkedBodyTooLarge(t *testing.T) {
+	router := fileRouter(t.TempDir())
+	router.HandleExact("/upload", func(req *Request, res *Response) {}, "POST")
+	_, addr := startServer(t, router, func(s *Server) { s.RequestLimits.MaxBodySize = 100 })
+
+	chunk := strings.Repeat("x", 60)
+	body := fmt.Sprintf("%x\r\n%s\r\n%x\r\n%s\r\n0\r\n\r\n", len(chunk), chunk, len(chunk), chunk)
+	for _, tt := range []struct{ method, target string }{{"POST", "/upload"}, {"PUT", "/files/chunked.txt"}} {
+		req := newTestRequest(tt.method, tt.target, "Transfer-Encoding", "chunked")
+		req.Body = body
+		res, err := dial(t, addr).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 413 || res.Body != "max 100 bytes\n" {
+			t.Errorf("%s %s: got %d %q, want 413 with the limit", tt.method, tt.target, res.StatusCode, res.Body)
+		}
+	}
+}
+
+func TestOptionsRoot(t *testing.T) {
+	server := &Server{}
+	router := echoRouter()
+	router.HandleExact("/", server.homeHandler, "GET")
+	router.HandleExact("/upload", func(req *Request, res *Response) {}, "POST")
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	for _, tt := range []struct {
+		target, allow string
+		status        int
+	}{
+		{"/", "GET, HEAD, OPTIONS", 204},
+		{"*", "GET, HEAD, POST, OPTIONS", 204},
+		{"/missing", "", 404},
+	} {
+		res, err := c.Do(newTestRequest("OPTIONS", tt.target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		allow, _ := res.Headers.Get("Allow")
+		if res.StatusCode != tt.status || allow != tt.allow {
+			t.Errorf("OPTIONS %s: got %d, Allow %q, want %d, Allow %q", tt.target, res.StatusCode, allow, tt.status, tt.allow)
+		}
+	}
+}
+
+// A client forgetting the blank line before the body gets a 400, the body
+// isn't read as headers.
+func TestMissingBlankLineBeforeBody(t *testing.T) {
+	for _, raw := range []string{
+		"POST /upload HTTP/1.1\r\nHost: x\r\nContent-Length: 7\r\nhello\r\n",
+		"POST /upload HTTP/1.1\r\nHost: x\r\nContent-Length: 12\r\nhello\r\nworld\r\n\r\n",
+	} {
+		_, err := ReadRequestHead(bufio.NewReader(strings.NewReader(raw)), DefaultRequestLimits)
+		var perr *ParseError
+		if !errors.Is(err, ErrMissingHeaderTerminator) || !errors.As(err, &perr) || perr.StatusCode != 400 {
+			t.Errorf("%q: got %v, want a 400 for the missing blank line", raw, err)
+		}
+	}
+
+	router := echoRouter()
+	router.HandleExact("/upload", func(req *Request, res *Response) {}, "POST")
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+	if _, err := c.conn.Write([]byte("POST /upload HTTP/1.1\r\nHost: x\r\nContent-Length: 7\r\nhello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ReadResponse(c.reader, "POST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connection, _ := res.Headers.Get("Connection"); res.StatusCode != 400 || connection != "close" {
+		t.Errorf("got %d, Connection %q, want 400 and close", res.StatusCode, connection)
+	}
+}
+
+// OPTIONS * lists every method of the server and reaches no handler, not
+// even one taking any path and method.
+func TestOptionsAsterisk(t *testing.T) {
+	reached := false
+	router := echoRouter()
+	router.HandleExact("/upload", func(req *Request, res *Response) {}, "POST", "PUT")
+	router.HandlePrefix("/", func(req *Request, res *Response) { reached = true })
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	res, err := c.Do(newTestRequest("OPTIONS", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	allow, _ := res.Headers.Get("Allow")
+	if res.StatusCode != 204 || res.Body != "" || allow != "GET, HEAD, POST, PUT, OPTIONS" {
+		t.Errorf("got %d %q, Allow %q", res.StatusCode, res.Body, allow)
+	}
+	if reached {
+		t.Error("a handler received OPTIONS *")
+	}
+}
+
+// Each way a request can fail to parse is answered with its own status
+// and reason phrase.
+func TestParseErrorStatusLines(t *testing.T) {
+	_, addr := startServer(t, echoRouter())
+	tests := []struct {
+		name, raw, statusLine string
+	}{
+		{"header section too large", "GET / HTTP/1.1\r\nHost: x\r\nX-Big: " + strings.Repeat("a", DefaultRequestLimits.MaxHeaderBytes) + "\r\n\r\n", "HTTP/1.1 431 Header Fields Too Large"},
+		{"too many headers", "GET / HTTP/1.1\r\n" + strings.Repeat("X-A: b\r\n", DefaultRequestLimits.MaxHeaderCount+1) + "\r\n", "HTTP/1.1 431 Too Many Header Fields"},
+		{"header without colon", "GET / HTTP/1.1\r\nHost: x\r\nnonsense\r\n\r\n", "HTTP/1.1 400 Malformed Header"},
+		{"target too long", "GET /" + strings.Repeat("a", DefaultRequestLimits.MaxRequestLineBytes) + " HTTP/1.1\r\nHost: x\r\n\r\n", "HTTP/1.1 414 URI Too Long"},
+		{"unknown method", "BREW /pot HTTP/1.1\r\nHost: x\r\n\r\n", "HTTP/1.1 501 Not Implemented"},
+		{"bad Content-Length", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: ten\r\n\r\n", "HTTP/1.1 400 Invalid Content-Length"},
+		{"empty target", "GET  HTTP/1.1\r\nHost: x\r\n\r\n", "HTTP/1.1 400 Empty Request Target"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte(tt.raw))
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSuffix(line, "\r\n"); got != tt.statusLine {
+				t.Errorf("got %q, want %q", got, tt.statusLine)
+			}
+		})
+	}
+}
+
+// readRaw reads from conn until want has been received, or fails.
+func readRaw(t *testing.T, reader *bufio.Reader, want string) string {
+	t.Helper()
+	var got strings.Builder
+	for !strings.Contains(got.String(), want) {
+		b, err := reader.ReadByte()
+		if err != nil {
+			t.Fatalf("%v after %q, waiting for %q", err, got.String(), want)
+		}
+		got.WriteByte(b)
+	}
+	return got.String()
+}
+
+func TestEarlyHints(t *testing.T) {
+	commitErr := make(chan error, 1)
+	router := &Router{}
+	router.HandleExact("/page", func(req *Request, res *Response) {
+		req.EarlyHints([]string{"</style.css>; rel=preload; as=style"})
+		req.EarlyHints([]string{"</app.js>; rel=preload; as=script", "</font.woff2>; rel=preload; as=font"})
+		res.Headers.Set("Content-Type", "text/html")
+		res.Stream = func(w io.Writer) error {
+			// Once the final response is on its way, it's too late
+			commitErr <- req.EarlyHints([]string{"</late.css>; rel=preload"})
+			_, err := io.WriteString(w, "<html></html>")
+			return err
+		}
+	}, "GET")
+	_, addr := startServer(t, router)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("GET /page HTTP/1.1\r\nHost: x\r\n\r\n"))
+	raw := readRaw(t, reader, "HTTP/1.1 200 OK\r\n")
+	wantHints := "HTTP/1.1 103 Early Hints\r\nlink: </style.css>; rel=preload; as=style\r\n\r\n" +
+		"HTTP/1.1 103 Early Hints\r\nlink: </app.js>; rel=preload; as=script, </font.woff2>; rel=preload; as=font\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\n"
+	if raw != wantHints {
+		t.Errorf("got %q, want %q", raw, wantHints)
+	}
+	final := readRaw(t, reader, "\r\n\r\n")
+	if !strings.Contains(strings.ToLower(final), "content-type: text/html\r\n") || strings.Contains(strings.ToLower(final), "link:") {
+		t.Errorf("final head %q", final)
+	}
+	if err := <-commitErr; !errors.Is(err, ErrResponseCommitted) {
+		t.Errorf("hints after the commit: %v", err)
+	}
+
+	// HTTP/1.0 clients just get the final response
+	conn10, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn10.Close()
+	conn10.Write([]byte("GET /page HTTP/1.0\r\nHost: x\r\n\r\n"))
+	if line, _ := bufio.NewReader(conn10).ReadString('\n'); !strings.HasPrefix(line, "HTTP/1.0 200 ") {
+		t.Errorf("HTTP/1.0 client got %q first", line)
+	}
+	<-commitErr
+}
+
+// A flush sends what was written so far as a chunk, before the handler
+// writes the rest.
+func TestStreamFlush(t *testing.T) {
+	release := make(chan struct{})
+	router := &Router{}
+	router.HandleExact("/progress", func(req *Request, res *Response) {
+		res.Stream = func(w io.Writer) error {
+			io.WriteString(w, "first")
+			if err := w.(Flusher).Flush(); err != nil {
+				return err
+			}
+			<-release
+			_, err := io.WriteString(w, "second")
+			return err
+		}
+	}, "GET")
+	_, addr := startServer(t, router)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("GET /progress HTTP/1.1\r\nHost: x\r\n\r\n"))
+	readRaw(t, reader, "\r\n\r\n")
+	if got := readRaw(t, reader, "first\r\n"); got != "5\r\nfirst\r\n" {
+		t.Errorf("first chunk %q", got)
+	}
+	close(release)
+	rest, err := readChunked(reader, 1<<20)
+	if err != nil || string(rest) != "second" {
+		t.Errorf("rest of the body %q, %v", rest, err)
+	}
+	// The framing holds: the connection is ready for the next request
+	conn.Write([]byte("GET /missing HTTP/1.1\r\nHost: x\r\n\r\n"))
+	if res, err := ReadResponse(reader, "GET"); err != nil || res.StatusCode != 404 {
+		t.Errorf("next request: %v, %+v", err, res)
+	}
+}
+
+// The 100 Continue goes out before the body is sent and leaves the
+// connection in step for the final response and the next request.
+func TestExpectContinueKeepAlive(t *testing.T) {
+	router := echoRouter()
+	router.HandleExact("/upload", func(req *Request, res *Response) {
+		res.StatusCode = 201
+		res.ReasonPhrase = StatusText(201)
+		res.Body = strings.ToUpper(req.Body)
+	}, "POST")
+	_, addr := startServer(t, router)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("POST /upload HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n"))
+	if raw := readRaw(t, reader, "\r\n\r\n"); raw != "HTTP/1.1 100 Continue\r\n\r\n" {
+		t.Fatalf("got %q before sending the body", raw)
+	}
+	conn.Write([]byte("shout"))
+	res, err := ReadResponse(reader, "POST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 201 || res.Body != "SHOUT" || res.Close {
+		t.Errorf("got %d %q, close %v", res.StatusCode, res.Body, res.Close)
+	}
+
+	conn.Write([]byte("GET /echo/next HTTP/1.1\r\nHost: x\r\n\r\n"))
+	if res, err := ReadResponse(reader, "GET"); err != nil || res.StatusCode != 200 || res.Body != "next" {
+		t.Errorf("next request: %v, %+v", err, res)
+	}
+}
+
+// Interim responses are skipped for HTTP/1.0 clients, and the handler
+// can't send a final status code or 101 as one.
+func TestWriteInterim(t *testing.T) {
+	errs := make(chan []error, 1)
+	router := &Router{}
+	router.HandleExact("/interim", func(req *Request, res *Response) {
+		errs <- []error{req.WriteInterim(102, NewHeaders()), req.WriteInterim(200, NewHeaders()), req.WriteInterim(101, NewHeaders())}
+		res.Body = "done"
+	}, "GET")
+	_, addr := startServer(t, router)
+
+	for _, version := range []string{"HTTP/1.1", "HTTP/1.0"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "GET /interim %s\r\nHost: x\r\n\r\n", version)
+		got := <-errs
+		if got[0] != nil || got[1] == nil || got[2] == nil {
+			t.Errorf("%s: WriteInterim errors %v", version, got)
+		}
+		line, _ := reader.ReadString('\n')
+		want := version + " 200 "
+		if version == "HTTP/1.1" {
+			want = "HTTP/1.1 102 "
+		}
+		if !strings.HasPrefix(line, want) {
+			t.Errorf("%s: got %q first, want %q", version, line, want)
+		}
+	}
+}
+
+// The ErrorFormatter writes the body of the router's 404 and 405, the
+// router keeping the status and working out Allow.
+func TestErrorFormatter(t *testing.T) {
+	router := &Router{ErrorFormatter: func(req *Request, res *Response) {
+		allow, _ := res.Headers.Get("Allow")
+		res.Headers.Set("Content-Type", "application/json")
+		res.Body = fmt.Sprintf(`{"status":%d,"allow":%q}`, res.StatusCode, allow)
+	}}
+	router.HandleExact("/things", func(req *Request, res *Response) {}, "GET", "POST")
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	for _, tt := range []struct {
+		method, target, allow, body string
+		status                      int
+	}{
+		{"DELETE", "/things", "GET, POST, OPTIONS", `{"status":405,"allow":"GET, POST, OPTIONS"}`, 405},
+		{"GET", "/missing", "", `{"status":404,"allow":""}`, 404},
+		{"GET", "/things", "", "", 200},
+	} {
+		res, err := c.Do(newTestRequest(tt.method, tt.target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		allow, _ := res.Headers.Get("Allow")
+		if res.StatusCode != tt.status || allow != tt.allow || res.Body != tt.body {
+			t.Errorf("%s %s: got %d, Allow %q, body %q", tt.method, tt.target, res.StatusCode, allow, res.Body)
+		}
+	}
+}
+
+func TestRemoveDotSegments(t *testing.T) {
+	tests := []struct {
+		path, want, merged string
+	}{
+		{"/", "/", "/"},
+		{"/a/b", "/a/b", "/a/b"},
+		{"/a/./b", "/a/b", "/a/b"},
+		{"/files/./a/../b.txt", "/files/b.txt", "/files/b.txt"},
+		{"/a/b/..", "/a/", "/a/"},
+		{"/a/b/.", "/a/b/", "/a/b/"},
+		{"/a/b/../", "/a/", "/a/"},
+		{"/..", "/", "/"},
+		{"/../../etc/passwd", "/etc/passwd", "/etc/passwd"},
+		{"/a/%2e%2E/b", "/b", "/b"},
+		{"/a/%2e/b", "/a/b", "/a/b"},
+		{"/a/.%2e", "/", "/"},
+		{"/a/...", "/a/...", "/a/..."},
+		{"/a/..b/c", "/a/..b/c", "/a/..b/c"},
+		{"/a//b", "/a//b", "/a/b"},
+		{"//a///b//", "//a///b//", "/a/b/"},
+		{"/a//../b", "/a/b", "/b"},
+	}
+	for _, tt := range tests {
+		if got := removeDotSegments(tt.path, false); got != tt.want {
+			t.Errorf("removeDotSegments(%q, false) = %q, want %q", tt.path, got, tt.want)
+		}
+		if got := removeDotSegments(tt.path, true); got != tt.merged {
+			t.Errorf("removeDotSegments(%q, true) = %q, want %q", tt.path, got, tt.merged)
+		}
+	}
+}
+
+// Routing sees the normalized path, the original target staying at hand.
+func TestNormalizedRouting(t *testing.T) {
+	router := &Router{}
+	router.HandlePrefix("/b/", func(req *Request, res *Response) {
+		res.Body = req.Path() + " " + req.OriginalURI()
+	}, "GET")
+	_, addr := startServer(t, router, func(s *Server) { s.MergeSlashes = true })
+	c := dial(t, addr)
+
+	for _, tt := range []struct{ target, body string }{
+		{"/a/../b/c", "/b/c /a/../b/c"},
+		{"/b/./c?x=/../", "/b/c /b/./c?x=/../"},
+		{"//b//c", "/b/c //b//c"},
+		{"/b/%2E%2e/b/c", "/b/c /b/%2E%2e/b/c"},
+	} {
+		res, err := c.Do(newTestRequest("GET", tt.target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 200 || res.Body != tt.body {
+			t.Errorf("GET %s: got %d %q, want %q", tt.target, res.StatusCode, res.Body, tt.body)
+		}
+	}
+	if res, err := c.Do(newTestRequest("GET", "/b/..")); err != nil || res.StatusCode != 404 {
+		t.Errorf("GET /b/..: %v, %+v", err, res)
+	}
+}
+
+func TestHopByHopHeaders(t *testing.T) {
+	h := NewHeaders()
+	h.Set("Connection", "Close, X-Debug ,keep-alive")
+	for _, name := range []string{"X-Debug", "Keep-Alive", "TE", "Transfer-Encoding", "Upgrade", "Proxy-Authorization", "Accept", "X-Trace"} {
+		h.Set(name, "v")
+	}
+	if got := h.ConnectionTokens(); !slices.Equal(got, []string{"close", "x-debug", "keep-alive"}) {
+		t.Errorf("ConnectionTokens: got %q", got)
+	}
+	h.RemoveHopByHop()
+	if len(h) != 2 || h["accept"] != "v" || h["x-trace"] != "v" {
+		t.Errorf("after RemoveHopByHop: %v", h)
+	}
+
+	for _, tt := range []struct{ connection, want string }{
+		{"close, X-Debug", "close"},
+		{"X-Present, X-Missing", "x-present"},
+		{"X-Missing", ""},
+		{"keep-alive", "keep-alive"},
+	} {
+		h := NewHeaders()
+		h.Set("Connection", tt.connection)
+		h.Set("X-Present", "v")
+		h.pruneConnection()
+		if got, _ := h.Get("Connection"); got != tt.want {
+			t.Errorf("pruneConnection(%q): got %q, want %q", tt.connection, got, tt.want)
+		}
+	}
+}
+
+// The keep-alive decision reads every token of Connection.
+func TestConnectionTokens(t *testing.T) {
+	_, addr := startServer(t, echoRouter())
+	for _, tt := range []struct {
+		version, connection string
+		close               bool
+	}{
+		{"HTTP/1.1", "X-Debug, close", true},
+		{"HTTP/1.1", "CLOSE", true},
+		{"HTTP/1.1", "X-Debug", false},
+		{"HTTP/1.0", "X-Debug, Keep-Alive", false},
+		{"HTTP/1.0", "keep-alive, close", true},
+		{"HTTP/1.0", "X-Debug", true},
+	} {
+		c := dial(t, addr)
+		req := newTestRequest("GET", "/echo/abc", "Connection", tt.connection, "X-Debug", "1")
+		req.HTTPVersion = tt.version
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Close != tt.close {
+			t.Errorf("%s, Connection %q: close %v, want %v", tt.version, tt.connection, res.Close, tt.close)
+		}
+	}
+}
+
+// Each malformed request line gets its status, while the whitespace probes
+// clients send are hung up on without an answer or a log line.
+func TestRequestLineGrammar(t *testing.T) {
+	_, addr := startServer(t, echoRouter())
+	tests := []struct {
+		name, raw, statusLine string // no status line for a silent close
+	}{
+		{"one empty line first", "\r\nGET /echo/ok HTTP/1.1\r\nHost: x\r\n\r\n", "HTTP/1.1 200 OK"},
+		{"bare LF empty line first", "\nGET /echo/ok HTTP/1.1\r\nHost: x\r\n\r\n", "HTTP/1.1 200 OK"},
+		{"two empty lines first", "\r\n\r\nGET /echo/ok HTTP/1.1\r\nHost: x\r\n\r\n", ""},
+		{"whitespace only", "  \t \r\n", ""},
+		{"nothing", "", ""},
+		{"two spaces", "GET  /echo/ok HTTP/1.1\r\nHost: x\r\n\r\n", "HTTP/1.1 400 Malformed Request Line"},
+		{"tab separator", "GET\t/echo/ok HTTP/1.1\r\nHost: x\r\n\r\n", "HTTP/1.1 400 Malformed Request Line"},
+		{"trailing space", "GET /echo/ok HTTP/1.1 \r\nHost: x\r\n\r\n", "HTTP/1.1 400 Malformed Request Line"},
+		{"leading space", " GET /echo/ok HTTP/1.1\r\nHost: x\r\n\r\n", "HTTP/1.1 400 Malformed Request Line"},
+		{"method not a token", "G@T /echo/ok HTTP/1.1\r\nHost: x\r\n\r\n", "HTTP/1.1 400 Malformed Request Line"},
+		{"lowercase method", "get /echo/ok HTTP/1.1\r\nHost: x\r\n\r\n", "HTTP/1.1 501 Not Implemented"},
+		{"two elements", "GET /echo/ok\r\nHost: x\r\n\r\n", "HTTP/1.1 400 Malformed Request Line"},
+		{"lowercase version", "GET /echo/ok http/1.1\r\nHost: x\r\n\r\n", "HTTP/1.1 400 Malformed Request Line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var line string
+			logged := captureStdout(t, func() {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				io.WriteString(conn, tt.raw)
+				if tt.statusLine == "" {
+					conn.(*net.TCPConn).CloseWrite()
+				}
+				line, err = bufio.NewReader(conn).ReadString('\n')
+				if tt.statusLine == "" && err != io.EOF {
+					t.Errorf("got %q, %v, want the connection closed", line, err)
+				}
+			})
+			if got := strings.TrimSuffix(line, "\r\n"); got != tt.statusLine {
+				t.Errorf("got %q, want %q", got, tt.statusLine)
+			}
+			if tt.statusLine == "" && logged != "" {
+				t.Errorf("logged %q", logged)
+			}
+		})
+	}
+}
+
+// Whatever the handler sets, the status line stays one valid line.
+func TestStatusLineSanitized(t *testing.T) {
+	tests := []struct {
+		code               int
+		reason, statusLine string
+	}{
+		{201, "", "HTTP/1.1 201 Created"},
+		{299, "", "HTTP/1.1 299 "},
+		{200, "Fine\r\nSet-Cookie: session=stolen", "HTTP/1.1 200 FineSet-Cookie: session=stolen"},
+		{404, "Gone\n\r\n<html>", "HTTP/1.1 404 Gone<html>"},
+		{418, "I'm\x00 a\x7f\tteapot", "HTTP/1.1 418 I'm a\tteapot"},
+		{0, "Zero", "HTTP/1.1 500 Internal Server Error"},
+		{99, "", "HTTP/1.1 500 Internal Server Error"},
+		{600, "", "HTTP/1.1 500 Internal Server Error"},
+		{1000, "Big\r\nX: y", "HTTP/1.1 500 Internal Server Error"},
+	}
+	router := &Router{}
+	for i, tt := range tests {
+		router.HandleExact(fmt.Sprintf("/%d", i), func(req *Request, res *Response) {
+			res.StatusCode = tt.code
+			res.ReasonPhrase = tt.reason
+			res.Body = "body"
+		}, "GET")
+	}
+	_, addr := startServer(t, router)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	for i, tt := range tests {
+		fmt.Fprintf(conn, "GET /%d HTTP/1.1\r\nHost: x\r\n\r\n", i)
+		head := readRaw(t, reader, "\r\n\r\n")
+		statusLine, headers, _ := strings.Cut(head, "\r\n")
+		if statusLine != tt.statusLine {
+			t.Errorf("%d %q: got %q, want %q", tt.code, tt.reason, statusLine, tt.statusLine)
+		}
+		if strings.Contains(strings.ToLower(headers), "set-cookie") {
+			t.Errorf("%d %q: the reason phrase made headers: %q", tt.code, tt.reason, head)
+		}
+		// The connection is still in step for the next response
+		if body := readRaw(t, reader, "body"); body != "body" {
+			t.Errorf("%d %q: body %q", tt.code, tt.reason, body)
+		}
+	}
+}
+
+func TestQueryLimits(t *testing.T) {
+	limits := DefaultRequestLimits
+	limits.MaxQueryParams = 10
+	limits.MaxQueryBytes = 100
+	params := func(n int) string {
+		var p []string
+		for i := range n {
+			p = append(p, fmt.Sprintf("p%d=%d", i, i))
+		}
+		return strings.Join(p, "&")
+	}
+	tests := []struct {
+		name, query string
+		status      int
+	}{
+		{"at the parameter limit", params(10), 0},
+		{"over the parameter limit", params(11), 400},
+		{"thousands of parameters", strings.Repeat("a&", 5000), 414},
+		{"empty parameters count too", strings.Repeat("&", 10), 400},
+		{"at the length limit", "q=" + strings.Repeat("x", 98), 0},
+		{"over the length limit", "q=" + strings.Repeat("x", 99), 414},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "GET /search?" + tt.query + " HTTP/1.1\r\nHost: x\r\n\r\n"
+			req, err := ReadRequestHead(bufio.NewReader(strings.NewReader(raw)), limits)
+			if tt.status == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want, _ := url.ParseQuery(tt.query); !reflect.DeepEqual(req.Query(), want) {
+					t.Errorf("Query: got %v", req.Query())
+				}
+				return
+			}
+			var perr *ParseError
+			if !errors.As(err, &perr) || perr.StatusCode != tt.status {
+				t.Errorf("got %v, want a %d", err, tt.status)
+			}
+		})
+	}
+
+	_, addr := startServer(t, echoRouter(), func(s *Server) { s.RequestLimits = limits })
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /echo/a?%s HTTP/1.1\r\nHost: x\r\n\r\n", params(11))
+	if line, _ := bufio.NewReader(conn).ReadString('\n'); line != "HTTP/1.1 400 Too Many Query Parameters\r\n" {
+		t.Errorf("got %q", line)
+	}
+}
+
+func TestResponseVary(t *testing.T) {
+	for _, tt := range []struct {
+		vary string
+		want []string
+	}{
+		{"", []string{"Origin"}},
+		{"Accept", []string{"Accept", "Origin"}},
+		{"accept, origin", []string{"accept", "origin"}},
+		{"*", []string{"*"}},
+	} {
+		res := NewResponse()
+		if tt.vary != "" {
+			res.Headers.Set("Vary", tt.vary)
+		}
+		res.Vary("Origin")
+		if got := res.Headers.Values("Vary"); !slices.Equal(got, tt.want) {
+			t.Errorf("Vary %q: got %q, want %q", tt.vary, got, tt.want)
+		}
+	}
+}
+
+// A compressed file varies with both headers, each listed once, and so
+// does a negotiated listing sent compressed.
+func TestVaryOnNegotiatedResponses(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "page.txt"), []byte(strings.Repeat("compress me ", 1000)), 0644)
+	for i := range 100 {
+		os.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%03d.txt", i)), []byte("x"), 0644)
+	}
+	_, addr := startServer(t, gzipFileRouter(dir))
+	c := dial(t, addr)
+
+	for _, tt := range []struct {
+		target string
+		accept string
+	}{
+		{"/files/page.txt", "*/*"},
+		{"/files/", "application/json"},
+		{"/files/", "text/html"},
+	} {
+		res, err := c.Do(newTestRequest("GET", tt.target, "Accept-Encoding", "gzip", "Accept", tt.accept))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vary := res.Headers.Values("Vary")
+		slices.Sort(vary)
+		if ce, _ := res.Headers.Get("Content-Encoding"); ce != "gzip" || !slices.Equal(vary, []string{"Accept", "Accept-Encoding"}) {
+			t.Errorf("GET %s, Accept %q: Content-Encoding %q, Vary %q", tt.target, tt.accept, ce, vary)
+		}
+	}
+}
+
+func TestRequestTargetCharacters(t *testing.T) {
+	tests := []struct {
+		target string
+		valid  bool
+	}{
+		{"/echo/a%20b", true},
+		{"/files/x.txt?q=1&r=a+b#frag", true},
+		{"/a;b,c:d@e!$'()*=~-._", true},
+		{"/%7e%7E", true},
+		{"/echo/a b", false},
+		{"/echo/a\x00b", false},
+		{"/echo/a\x7fb", false},
+		{"/echo/h\xc3\xa9llo", false},
+		{"/echo/<script>", false},
+		{"/a|b", false},
+		{"/a\\b", false},
+		{"/100%", false},
+		{"/%2", false},
+		{"/%zz", false},
+	}
+	for _, tt := range tests {
+		raw := "GET " + tt.target + " HTTP/1.1\r\nHost: x\r\n\r\n"
+		_, err := ReadRequestHead(bufio.NewReader(strings.NewReader(raw)), DefaultRequestLimits)
+		if tt.valid && err != nil {
+			t.Errorf("%q: %v", tt.target, err)
+		}
+		var parseErr *ParseError
+		if !tt.valid && (!errors.Is(err, ErrInvalidRequestTarget) || !errors.As(err, &parseErr) || parseErr.StatusCode != 400) {
+			t.Errorf("%q: got %v, want a 400 for an invalid target", tt.target, err)
+		}
+	}
+}
+
+// A raw space is told from an encoded one, on the wire too.
+func TestRequestTargetSpace(t *testing.T) {
+	_, addr := startServer(t, echoRouter())
+	for raw, statusLine := range map[string]string{
+		"GET /echo/a%20b HTTP/1.1\r\nHost: x\r\n\r\n": "HTTP/1.1 200 OK",
+		"GET /echo/a b HTTP/1.1\r\nHost: x\r\n\r\n":   "HTTP/1.1 400 Invalid Request Target",
+		"GET /echo/a b c HTTP/1.1\r\nHost: x\r\n\r\n": "HTTP/1.1 400 Invalid Request Target",
+		"GET /echo/a\"b HTTP/1.1\r\nHost: x\r\n\r\n":  "HTTP/1.1 400 Invalid Request Target",
+		"GET /echo/a  b HTTP/1.1\r\nHost: x\r\n\r\n":  "HTTP/1.1 400 Malformed Request Line",
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, raw)
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if got := strings.TrimSuffix(line, "\r\n"); got != statusLine {
+			t.Errorf("%q: got %q, want %q", raw, got, statusLine)
+		}
+	}
+}
+
+func TestRequestQuery(t *testing.T) {
+	tests := []struct {
+		target string
+		want   url.Values
+	}{
+		{"/search", url.Values{}},
+		{"/search?", url.Values{}},
+		{"/search?q=foo&limit=10", url.Values{"q": {"foo"}, "limit": {"10"}}},
+		{"/search?tag=a&tag=b&tag=a", url.Values{"tag": {"a", "b", "a"}}},
+		{"/search?q=h%C3%A9llo+w%20rld&a%26b=c%3Dd", url.Values{"q": {"héllo w rld"}, "a&b": {"c=d"}}},
+		{"/search?flag&empty=", url.Values{"flag": {""}, "empty": {""}}},
+		{"/search?bad=%zz&good=1", url.Values{"good": {"1"}}},
+	}
+	for _, tt := range tests {
+		req := newTestRequest("GET", tt.target)
+		if got := req.Query(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Query of %s: got %v, want %v", tt.target, got, tt.want)
+		}
+	}
+	if path := newTestRequest("GET", "/search%20me?q=1").Path(); path != "/search me" {
+		t.Errorf("Path: got %q", path)
+	}
+}
+
+// Routes match the path of the target, whatever its query.
+func TestRoutingIgnoresQuery(t *testing.T) {
+	router := echoRouter()
+	router.HandleExact("/user-agent", userAgentHandler, "GET")
+	router.HandleExact("/upload", func(req *Request, res *Response) {}, "POST")
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	tests := []struct {
+		method, target string
+		status         int
+		body, allow    string
+	}{
+		{"GET", "/echo/abc?x=1", 200, "abc", ""},
+		{"GET", "/user-agent?verbose=1", 200, "test-agent", ""},
+		{"GET", "/upload?x=1", 405, "", "POST, OPTIONS"},
+		{"OPTIONS", "/upload?x=1", 204, "", "POST, OPTIONS"},
+		{"GET", "/missing?echo/abc", 404, "", ""},
+	}
+	for _, tt := range tests {
+		res, err := c.Do(newTestRequest(tt.method, tt.target, "User-Agent", "test-agent"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		allow, _ := res.Headers.Get("Allow")
+		if res.StatusCode != tt.status || tt.status == 200 && res.Body != tt.body || allow != tt.allow {
+			t.Errorf("%s %s: got %d %q, Allow %q", tt.method, tt.target, res.StatusCode, res.Body, allow)
+		}
+	}
+}
+
+// Overlapping routes list each of their methods once in the Allow header,
+// in the same order whatever the order they were registered in.
+func TestAllowSorted(t *testing.T) {
+	noop := func(req *Request, res *Response) {}
+	registrations := []func(r *Router){
+		func(r *Router) { r.HandlePrefix("/api/", noop, "PUT", "GET") },
+		func(r *Router) { r.HandleExact("/api/items", noop, "POST", "GET", "DELETE", "GET") },
+		func(r *Router) { r.HandlePrefix("/api/", noop, "PURGE", "PATCH", "BAN", "PUT") },
+	}
+	const want = "GET, HEAD, POST, PUT, DELETE, OPTIONS, PATCH, BAN, PURGE"
+	for _, order := range [][]int{{0, 1, 2}, {2, 1, 0}, {1, 2, 0}} {
+		router := &Router{AutoHEAD: true}
+		for _, i := range order {
+			registrations[i](router)
+		}
+		if got := strings.Join(router.AllowedMethods("/api/items"), ", "); got != want {
+			t.Errorf("registered in the order %v: AllowedMethods %q, want %q", order, got, want)
+		}
+		for _, method := range []string{"PROPFIND", "OPTIONS"} {
+			res := router.Route(newTestRequest(method, "/api/items"))
+			if allow, _ := res.Headers.Get("Allow"); allow != want {
+				t.Errorf("registered in the order %v, %s: Allow %q, want %q", order, method, allow, want)
+			}
+		}
+	}
+	if got := sortMethods([]string{"ZZZ", "MKCOL", "AAA", "GET"}); !slices.Equal(got, []string{"GET", "MKCOL", "AAA", "ZZZ"}) {
+		t.Errorf("sortMethods: got %v", got)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// HTTPHandler adapts a net/http Handler to a HandlerFunc. The response is
+// streamed as the handler produces it, so handlers that write progressively
+// (like the pprof CPU profile) reach the client as they go.
+func HTTPHandler(h http.Handler) HandlerFunc {
+	return func(req *Request, res *Response) {
+		hreq, err := http.NewRequestWithContext(req.Context(), req.Method, req.RequestURI, req.BodyReader())
+		if err != nil {
+			res.StatusCode = 400
+			res.ReasonPhrase = "Bad Request"
+			return
+		}
+		// What concerns our connection with the client isn't the handler's business
+		headers := maps.Clone(req.Headers)
+		headers.RemoveHopByHop()
+		for k, v := range headers {
+			hreq.Header.Set(k, v)
+		}
+		hreq.Host = req.EffectiveHost()
+		hreq.RemoteAddr = req.RemoteAddr
+		hreq.RequestURI = req.RequestURI
+
+		pr, pw := io.Pipe()
+		w := &httpResponseWriter{
+			header:    make(http.Header),
+			pw:        pw,
+			committed: make(chan struct{}),
+		}
+
+		go func() {
+			defer pw.Close()
+			// A handler that never writes still sends a 200
+			defer w.WriteHeader(http.StatusOK)
+			h.ServeHTTP(w, hreq)
+		}()
+
+		<-w.committed
+
+		res.StatusCode = w.status
+		res.ReasonPhrase = http.StatusText(w.status)
+		for k, v := range w.sent {
+			res.Headers.Set(k, strings.Join(v, ", "))
+		}
+		// Unless the body is sent, the handler blocks on its next write
+		res.onAbort(func() { pr.CloseWithError(errAborted) })
+		res.Stream = func(dst io.Writer) error {
+			// Closing the reader makes any further write by the handler fail,
+			// so it stops if the client went away.
+			defer pr.Close()
+			// Every write of the handler reaches the client right away
+			buf := make([]byte, copyBufferSize)
+			for {
+				n, err := pr.Read(buf)
+				if n > 0 {
+					if _, werr := dst.Write(buf[:n]); werr != nil {
+						return werr
+					}
+					if ferr := flush(dst); ferr != nil {
+						return ferr
+					}
+				}
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// httpResponseWriter implements http.ResponseWriter and http.Flusher on top of a pipe.
+type httpResponseWriter struct {
+	header http.Header
+	sent   http.Header
+	status int
+	pw     *io.PipeWriter
+
+	once      sync.Once
+	committed chan struct{}
+}
+
+func (w *httpResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *httpResponseWriter) WriteHeader(code int) {
+	w.once.Do(func() {
+		w.status = code
+		w.sent = w.header.Clone()
+		close(w.committed)
+	})
+}
+
+func (w *httpResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pw.Write(p)
+}
+
+// Flush is a no-op: writes to the pipe block until they are copied and
+// flushed to the client.
+func (w *httpResponseWriter) Flush() {}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// RFC 9110 5.6.7 - HTTP-date = IMF-fixdate / obs-date
+// Senders only generate IMF-fixdate, recipients accept all three formats.
+const (
+	imfFixdate  = "Mon, 02 Jan 2006 15:04:05 GMT"
+	rfc850Date  = "Monday, 02-Jan-06 15:04:05 GMT"
+	asctimeDate = "Mon Jan _2 15:04:05 2006"
+)
+
+var errInvalidHTTPDate = errors.New("invalid HTTP-date")
+
+// ParseHTTPDate parses an HTTP-date in any of the IMF-fixdate, RFC 850 or asctime formats.
+// Callers should treat an error as if the header was absent.
+//
+// RFC 850 dates only carry two year digits. They are placed in the current
+// century, unless that would be more than 50 years in the future, in which
+// case the previous century is used (RFC 9110 5.6.7).
+func ParseHTTPDate(value string) (time.Time, error) {
+	return parseHTTPDate(value, time.Now())
+}
+
+// parseHTTPDate is ParseHTTPDate, placing RFC 850 dates in the century of now.
+func parseHTTPDate(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(imfFixdate, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(asctimeDate, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(rfc850Date, value)
+	if err != nil {
+		return time.Time{}, errInvalidHTTPDate
+	}
+
+	now = now.UTC()
+	year := now.Year()/100*100 + t.Year()%100
+	if year > now.Year()+50 {
+		year -= 100
+	}
+	return time.Date(year, t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC), nil
+}
+
+// FormatHTTPDate formats t as an IMF-fixdate, the only format HTTP senders may use.
+func FormatHTTPDate(t time.Time) string {
+	return t.UTC().Format(imfFixdate)
+}
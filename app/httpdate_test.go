@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseHTTPDate(t *testing.T) {
+	want := time.Date(1994, 11, 6, 8, 49, 37, 0, time.UTC)
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name, value string
+		ok          bool
+	}{
+		{"IMF-fixdate", "Sun, 06 Nov 1994 08:49:37 GMT", true},
+		{"RFC 850", "Sunday, 06-Nov-94 08:49:37 GMT", true},
+		{"asctime", "Sun Nov  6 08:49:37 1994", true},
+		{"empty", "", false},
+		{"other zone", "Sun, 06 Nov 1994 08:49:37 CET", false},
+		{"numeric zone", "Sun, 06 Nov 1994 08:49:37 +0000", false},
+		{"no weekday", "06 Nov 1994 08:49:37 GMT", false},
+		{"out of range", "Sun, 32 Nov 1994 08:49:37 GMT", false},
+		{"garbage", "yesterday", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHTTPDate(tt.value, now)
+			if !tt.ok {
+				if err == nil {
+					t.Errorf("parsed %q as %v", tt.value, got)
+				}
+				return
+			}
+			if err != nil || !got.Equal(want) {
+				t.Errorf("got %v, %v, want %v", got, err, want)
+			}
+		})
+	}
+}
+
+// An RFC 850 year lands in the century of now, unless that puts it more
+// than 50 years ahead.
+func TestParseHTTPDateYearPivot(t *testing.T) {
+	tests := []struct {
+		now  int
+		date string
+		year int
+	}{
+		{2030, "Sunday, 06-Nov-94 08:49:37 GMT", 1994},
+		{2030, "Thursday, 06-Nov-30 08:49:37 GMT", 2030},
+		{2030, "Tuesday, 06-Nov-80 08:49:37 GMT", 2080},
+		{2030, "Friday, 06-Nov-81 08:49:37 GMT", 1981},
+		{2070, "Sunday, 06-Nov-94 08:49:37 GMT", 2094},
+	}
+	for _, tt := range tests {
+		now := time.Date(tt.now, 1, 1, 0, 0, 0, 0, time.UTC)
+		got, err := parseHTTPDate(tt.date, now)
+		if err != nil || got.Year() != tt.year {
+			t.Errorf("%q in %d: got %v, %v, want %d", tt.date, tt.now, got, err, tt.year)
+		}
+	}
+}
+
+func TestFormatHTTPDateRoundTrip(t *testing.T) {
+	local := time.Date(2030, 5, 6, 9, 8, 9, 123456789, time.FixedZone("CEST", 2*3600))
+	formatted := FormatHTTPDate(local)
+	if formatted != "Mon, 06 May 2030 07:08:09 GMT" {
+		t.Errorf("got %q", formatted)
+	}
+	parsed, err := ParseHTTPDate(formatted)
+	if err != nil || !parsed.Equal(local.Truncate(time.Second)) {
+		t.Errorf("round trip: %v, %v", parsed, err)
+	}
+}
+
+// A date that can't be parsed counts as no condition at all.
+func TestInvalidConditionalDateIgnored(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+	_, addr := startServer(t, fileRouter(dir))
+	c := dial(t, addr)
+
+	for _, header := range []string{"If-Modified-Since", "If-Unmodified-Since"} {
+		res, err := c.Do(newTestRequest("GET", "/files/a.txt", header, "not a date"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 200 || res.Body != "a" {
+			t.Errorf("%s: got %d %q", header, res.StatusCode, res.Body)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dirListingCache keeps rendered directory listings so big directories aren't
+// read again on every request. An entry is reused while the directory mtime
+// is unchanged and it is younger than ttl (coarse mtimes can miss changes).
+// At most max listings are kept, the least recently used one goes first.
+type dirListingCache struct {
+	max int
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type dirListing struct {
+	key      string
+	modTime  time.Time
+	rendered time.Time
+	body     string
+}
+
+func newDirListingCache(max int, ttl time.Duration) *dirListingCache {
+	return &dirListingCache{
+		max:     max,
+		ttl:     ttl,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *dirListingCache) get(key string, modTime time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, found := c.entries[key]
+	if !found {
+		return "", false
+	}
+	entry := el.Value.(*dirListing)
+	if !entry.modTime.Equal(modTime) || c.now().Sub(entry.rendered) > c.ttl {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return "", false
+	}
+	c.lru.MoveToFront(el)
+	return entry.body, true
+}
+
+func (c *dirListingCache) put(key string, modTime time.Time, body string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &dirListing{key: key, modTime: modTime, rendered: c.now(), body: body}
+	if el, found := c.entries[key]; found {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dirListing).key)
+	}
+}
+
+var dirListings = newDirListingCache(128, 2*time.Second)
+
+// renderDirListingHTML renders the entries of dir that are listed as a list
+// of links. Links are relative to the request path, which may or may not
+// end with a slash.
+func renderDirListingHTML(ctx context.Context, urlPath, dir string, listed func(string, os.DirEntry) bool) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	base := ""
+	if !strings.HasSuffix(urlPath, "/") {
+		base = path.Base(urlPath) + "/"
+	}
+
+	var sb strings.Builder
+	title := html.EscapeString(urlPath)
+	fmt.Fprintf(&sb, "<!DOCTYPE html>\n<html>\n<head><title>Index of %s</title></head>\n<body>\n<h1>Index of %s</h1>\n<ul>\n", title, title)
+	for i, entry := range entries {
+		if i%1024 == 0 && ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if !listed(dir, entry) {
+			continue
+		}
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		href := base + (&url.URL{Path: name}).EscapedPath()
+		fmt.Fprintf(&sb, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	sb.WriteString("</ul>\n</body>\n</html>\n")
+	return sb.String(), nil
+}
+
+type dirEntryJSON struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	IsDir   bool      `json:"isDir"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// renderDirListingJSON renders the entries of dir that are listed as a JSON array.
+func renderDirListingJSON(ctx context.Context, dir string, listed func(string, os.DirEntry) bool) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	out := make([]dirEntryJSON, 0, len(entries))
+	for i, entry := range entries {
+		// Every entry costs a stat, give up early on huge directories
+		if i%1024 == 0 && ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if !listed(dir, entry) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Removed since the directory was read
+			continue
+		}
+		out = append(out, dirEntryJSON{
+			Name:    entry.Name(),
+			Size:    info.Size(),
+			IsDir:   entry.IsDir(),
+			ModTime: info.ModTime().UTC(),
+		})
+	}
+
+	body, err := json.Marshal(out)
+	return string(body), err
+}
+
+// dirListingHandler answers with the (possibly cached) listing of dir,
+// as JSON when the client prefers it, HTML otherwise.
+func (fs *FileServer) dirListingHandler(req *Request, res *Response, dir string, info os.FileInfo) {
+	asJSON := Negotiate(req, []string{"text/html", "application/json"}) == "application/json"
+	fs.serveDirListing(req, res, dir, info, asJSON)
+}
+
+// serveDirListing answers with the (possibly cached) listing of dir in the
+// given format. What is listed depends on Root, which is part of the key.
+func (fs *FileServer) serveDirListing(req *Request, res *Response, dir string, info os.FileInfo, asJSON bool) {
+	urlPath := req.RawPath()
+	contentType := "text/html; charset=utf-8"
+	render := func() (string, error) { return renderDirListingHTML(req.Context(), urlPath, dir, fs.listed) }
+	key := "html " + urlPath + " " + dir + " " + fs.Root
+	if asJSON {
+		contentType = "application/json"
+		render = func() (string, error) { return renderDirListingJSON(req.Context(), dir, fs.listed) }
+		key = "json " + dir + " " + fs.Root
+	}
+	res.Vary("Accept")
+
+	body, found := dirListings.get(key, info.ModTime())
+	if !found {
+		var err error
+		body, err = render()
+		if err != nil {
+			fmt.Printf("Error listing directory: %v\n", err)
+			res.StatusCode = 500
+			res.ReasonPhrase = "Internal Server Error"
+			return
+		}
+		dirListings.put(key, info.ModTime(), body)
+	}
+
+	res.Headers.Set("Content-Type", contentType)
+	res.Headers.Set("Content-Length", strconv.Itoa(len(body)))
+	res.Body = body
+}
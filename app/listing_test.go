@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Listings leave out what no request could reach: the dotfiles and the
+// links leading out of the root.
+func TestDirListingFilters(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "root")
+	os.Mkdir(dir, 0755)
+	os.WriteFile(filepath.Join(parent, "outside.txt"), []byte("outside"), 0644)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(dir, ".hidden"), []byte("h"), 0644)
+	if err := os.Symlink("a.txt", filepath.Join(dir, "inside-link")); err != nil {
+		t.Skip("no symbolic links here: ", err)
+	}
+	os.Symlink(filepath.Join(parent, "outside.txt"), filepath.Join(dir, "outside-link"))
+
+	router := &Router{AutoHEAD: true}
+	fs := NewFileServer("/files/", dir)
+	fs.WebDAV = true
+	router.HandlePrefix(fs.Prefix, fs.Handle, fs.Methods()...).Stream()
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	for _, tt := range []struct{ method, header, value string }{
+		{"GET", "Accept", "text/html"},
+		{"GET", "Accept", "application/json"},
+		{"PROPFIND", "Depth", "1"},
+	} {
+		res, err := c.Do(newTestRequest(tt.method, "/files/", tt.header, tt.value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"a.txt", "inside-link"} {
+			if !strings.Contains(res.Body, name) {
+				t.Errorf("%s %s: %s not listed", tt.method, tt.value, name)
+			}
+		}
+		for _, name := range []string{".hidden", "outside-link"} {
+			if strings.Contains(res.Body, name) {
+				t.Errorf("%s %s: %s listed", tt.method, tt.value, name)
+			}
+		}
+	}
+	if res, err := c.Do(newTestRequest("GET", "/files/outside-link")); err != nil || res.StatusCode != 403 {
+		t.Errorf("the link out of the root: %v, %+v", err, res)
+	}
+}
+
+func TestDirListingCache(t *testing.T) {
+	clock := newFakeClock(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC))
+	cache := newDirListingCache(2, time.Second)
+	cache.now = clock.Now
+	mtime := clock.Now()
+
+	cache.put("a", mtime, "listing a")
+	if body, found := cache.get("a", mtime); !found || body != "listing a" {
+		t.Errorf("fresh entry: %q, %v", body, found)
+	}
+	if _, found := cache.get("a", mtime.Add(time.Second)); found {
+		t.Error("entry kept after the directory changed")
+	}
+
+	cache.put("a", mtime, "listing a")
+	clock.Advance(2 * time.Second)
+	if _, found := cache.get("a", mtime); found {
+		t.Error("entry kept past its TTL")
+	}
+
+	// The least recently used listing goes first
+	cache.put("a", mtime, "listing a")
+	cache.put("b", mtime, "listing b")
+	cache.get("a", mtime)
+	cache.put("c", mtime, "listing c")
+	if _, found := cache.get("b", mtime); found {
+		t.Error("the least recently used entry was kept")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, found := cache.get(key, mtime); !found {
+			t.Errorf("%s evicted", key)
+		}
+	}
+}
+
+// A file added to a listed directory shows in the next listing.
+func TestDirListingInvalidated(t *testing.T) {
+	dir := t.TempDir()
+	_, addr := startServer(t, fileRouter(dir))
+	c := dial(t, addr)
+
+	os.WriteFile(filepath.Join(dir, "first.txt"), []byte("1"), 0644)
+	if res, err := c.Do(newTestRequest("GET", "/files/", "Accept", "application/json")); err != nil || !strings.Contains(res.Body, "first.txt") {
+		t.Fatalf("%v, %+v", err, res)
+	}
+	os.WriteFile(filepath.Join(dir, "second.txt"), []byte("2"), 0644)
+	// Coarse mtimes could miss the change, it is made visible
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(dir, later, later)
+	res, err := c.Do(newTestRequest("GET", "/files/", "Accept", "application/json"))
+	if err != nil || !strings.Contains(res.Body, "second.txt") {
+		t.Errorf("the new file is missing: %v, %+v", err, res)
+	}
+}
+
+// BenchmarkDirListing lists a directory of 10k files. Uncached, every
+// request reads the directory and stats each entry; cached, a request
+// costs one stat of the directory, whatever its size.
+func BenchmarkDirListing(b *testing.B) {
+	dir := b.TempDir()
+	for i := range 10000 {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%05d.txt", i)), nil, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	fs := NewFileServer("/files/", dir)
+	req := newTestRequest("GET", "/files/", "Accept", "application/json")
+
+	saved := dirListings
+	b.Cleanup(func() { dirListings = saved })
+	for _, bb := range []struct {
+		name  string
+		cache *dirListingCache
+	}{
+		// A cache keeping nothing renders every time
+		{"uncached", newDirListingCache(0, time.Minute)},
+		{"cached", newDirListingCache(128, time.Minute)},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			dirListings = bb.cache
+			b.ReportAllocs()
+			for b.Loop() {
+				info, err := os.Stat(dir)
+				if err != nil {
+					b.Fatal(err)
+				}
+				res := NewResponse()
+				fs.serveDirListing(req, res, dir, info, true)
+				if res.StatusCode != 200 || len(res.Body) == 0 {
+					b.Fatalf("got %d", res.StatusCode)
+				}
+			}
+		})
+	}
+}
+
+func TestDirListingJSON(t *testing.T) {
+	dir := t.TempDir()
+	modified := time.Date(2030, 5, 6, 7, 8, 9, 0, time.UTC)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("12345"), 0644)
+	os.Chtimes(filepath.Join(dir, "a.txt"), modified, modified)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	_, addr := startServer(t, fileRouter(dir))
+	c := dial(t, addr)
+
+	res, err := c.Do(newTestRequest("GET", "/files/", "Accept", "application/json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType, _ := res.Headers.Get("Content-Type"); res.StatusCode != 200 || contentType != "application/json" {
+		t.Fatalf("got %d, %s", res.StatusCode, contentType)
+	}
+	var entries []dirEntryJSON
+	if err := json.Unmarshal([]byte(res.Body), &entries); err != nil {
+		t.Fatalf("%v in %q", err, res.Body)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %+v", entries)
+	}
+	if a := entries[0]; a.Name != "a.txt" || a.Size != 5 || a.IsDir || !a.ModTime.Equal(modified) {
+		t.Errorf("file entry %+v", a)
+	}
+	if sub := entries[1]; sub.Name != "sub" || !sub.IsDir {
+		t.Errorf("directory entry %+v", sub)
+	}
+	if vary, _ := res.Headers.Get("Vary"); !strings.Contains(vary, "Accept") {
+		t.Errorf("Vary %q", vary)
+	}
+
+	// Browsers get the HTML page
+	res, err = c.Do(newTestRequest("GET", "/files/", "Accept", "text/html,application/xhtml+xml,*/*;q=0.8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType, _ := res.Headers.Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") || !strings.Contains(res.Body, `<a href="sub/">sub/</a>`) {
+		t.Errorf("got %s %q", contentType, res.Body)
+	}
+}
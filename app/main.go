@@ -1,132 +1,396 @@
 package main
 
 import (
-	"bufio"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"net"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
-	"unicode/utf8"
+	"syscall"
+	"time"
 )
 
-var FILE_DIRECTORY = "/tmp/"
-
-func homeHandler(req *Request, res *Response) {
+// homeHandler serves the RootBody of the server.
+func (s *Server) homeHandler(req *Request, res *Response) {
+	if s.RootBody == "" {
+		return
+	}
+	contentType := s.RootContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	res.Headers.Set("Content-Type", contentType)
+	res.Headers.Set("Content-Length", strconv.Itoa(len(s.RootBody)))
+	res.Body = s.RootBody
 }
 
 func echoHandler(req *Request, res *Response) {
-	value := strings.TrimPrefix(req.RequestURI, "/echo/")
+	value := strings.TrimPrefix(req.Path(), "/echo/")
 	res.Headers.Set("Content-Type", "text/plain")
-	res.Headers.Set("Content-Length", strconv.Itoa(utf8.RuneCountInString(value)))
+	res.Headers.Set("Content-Length", strconv.Itoa(len(value)))
 	res.Body = value
 }
 
 func userAgentHandler(req *Request, res *Response) {
 	if ua, found := req.Headers.Get("User-Agent"); found {
 		res.Headers.Set("Content-Type", "text/plain")
-		res.Headers.Set("Content-Length", strconv.Itoa(utf8.RuneCountInString(ua)))
+		res.Headers.Set("Content-Length", strconv.Itoa(len(ua)))
 		res.Body = ua
 	}
 }
 
-func fileReturnHandler(req *Request, res *Response) {
-	filePath := strings.TrimPrefix(req.RequestURI, "/files/")
-	filePath = filepath.Join(FILE_DIRECTORY, filePath)
-	dat, err := os.ReadFile(filePath)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			fmt.Printf("File '%s' not found, need to create it\n", filePath)
-			res.StatusCode = 404
-			res.ReasonPhrase = "Not Found"
-		} else {
-			fmt.Printf("Error opening file: %v\n", err)
-			res.StatusCode = 500
-			res.ReasonPhrase = "Internal Server Error"
-		}
-		return
-	}
+// repeatedFlag collects the values of a flag given several times.
+type repeatedFlag []string
 
-	res.Headers.Set("Content-Type", "application/octet-stream")
-	res.Headers.Set("Content-Length", strconv.Itoa(utf8.RuneCountInString(string(dat))))
-	res.Body = string(dat)
+func (m *repeatedFlag) String() string {
+	return strings.Join(*m, ", ")
 }
 
-func fileCreateHandler(req *Request, res *Response) {
-	filePath := strings.TrimPrefix(req.RequestURI, "/files/")
-	filePath = filepath.Join(FILE_DIRECTORY, filePath)
-
-	err := os.WriteFile(filePath, []byte(req.Body), 0644)
-	if err != nil {
-		fmt.Printf("Error writing file: %v\n", err)
-		res.StatusCode = 500
-		res.ReasonPhrase = "Internal Server Error"
-		return
-	}
+func (m *repeatedFlag) Set(value string) error {
+	*m = append(*m, value)
+	return nil
+}
 
-	res.StatusCode = 201
-	res.ReasonPhrase = "Created"
+// envFlags name the environment variables standing in for the flags that
+// matter most in containers. A flag given on the command line wins over
+// its variable, which wins over the default.
+var envFlags = []struct{ flag, env string }{
+	{"addr", "HTTP_SERVER_ADDR"},
+	{"directory", "HTTP_SERVER_DIRECTORY"},
+	{"max-body-size", "HTTP_SERVER_MAX_BODY_SIZE"},
+	{"shutdown-grace", "HTTP_SERVER_SHUTDOWN_GRACE"},
+	{"tls-handshake-timeout", "HTTP_SERVER_TLS_HANDSHAKE_TIMEOUT"},
+	{"tls-cert", "HTTP_SERVER_TLS_CERT"},
+	{"tls-key", "HTTP_SERVER_TLS_KEY"},
 }
 
-func fileHandler(req *Request, res *Response) {
-	if req.Method == "POST" {
-		fileCreateHandler(req, res)
-		return
+// documentEnv mentions the variable of every flag of envFlags in its usage.
+func documentEnv(flags *flag.FlagSet) {
+	for _, e := range envFlags {
+		if f := flags.Lookup(e.flag); f != nil {
+			f.Usage += " Environment: " + e.env + "."
+		}
 	}
-	fileReturnHandler(req, res)
 }
 
-func handleConnection(conn net.Conn, router *Router) {
-	defer conn.Close()
-
-	req, err := ParseRequest(bufio.NewReader(conn))
-	if err != nil {
-		if err == io.EOF {
-			return
+// applyEnv sets the flags of envFlags left off the command line from their
+// variables, once flags is parsed.
+func applyEnv(flags *flag.FlagSet) error {
+	given := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, e := range envFlags {
+		value, found := os.LookupEnv(e.env)
+		if !found || given[e.flag] {
+			continue
+		}
+		if err := flags.Set(e.flag, value); err != nil {
+			return fmt.Errorf("invalid %s '%s': %w", e.env, value, err)
 		}
-		fmt.Println("Error reading from connection: ", err.Error())
-		return
 	}
+	return nil
+}
 
-	res := router.Route(req)
-
-	_, err = conn.Write([]byte(res.String()))
-	if err != nil {
-		fmt.Println("Error writing to connection: ", err.Error())
-		return
+// splitList splits a comma-separated flag value, dropping blank entries.
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
 	}
+	return list
 }
 
 func main() {
+	addr := flag.String("addr", "0.0.0.0:4221", "Address to listen on, as host:port.")
+	maxBodySize := flag.Int("max-body-size", DefaultRequestLimits.MaxBodySize, "Largest request body accepted, in bytes, 0 means no limit.")
 	directory := flag.String("directory", "/tmp/", "Specifies the directory where the files are stored, as an absolute path.")
+	var mounts repeatedFlag
+	flag.Var(&mounts, "mount", "Serve a directory at a URL prefix, as /prefix=/dir[;ro][;nolisting][;index=NAME][;maxage=SECONDS]. Repeatable.")
+	mountsFile := flag.String("mounts-file", "", "Read more mounts from this file, one --mount value per line. Blank lines and lines starting with # are skipped.")
+	var defaultHeaders repeatedFlag
+	flag.Var(&defaultHeaders, "default-header", "Add a header, as \"Name: value\", to every response that doesn't set it. Repeatable.")
+
+	secureHeaders := flag.Bool("secure-headers", false, "Add the usual security headers (HSTS over https, nosniff, X-Frame-Options, Referrer-Policy) to the content routes, and mark their cookies Secure over https.")
+	rootBody := flag.String("root-body", "", "Body served at /, empty by default.")
+	rootBodyFile := flag.String("root-body-file", "", "File whose content is served at /, read at startup. Takes precedence over --root-body.")
+	rootContentType := flag.String("root-content-type", "", "Content-Type of the body served at /, text/plain when empty.")
+	csp := flag.String("csp", "", "Content-Security-Policy sent with --secure-headers.")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated networks whose X-Forwarded-Proto is believed by --secure-headers.")
+	serverTiming := flag.Bool("server-timing", false, "Add a Server-Timing header with the time spent parsing, routing, handling and serializing.")
+	gunzipRequests := flag.Bool("gunzip-requests", false, "Decompress the gzip-encoded bodies of file uploads.")
+	gunzipMaxSize := flag.Int64("gunzip-max-size", 64<<20, "Largest decompressed upload body accepted with --gunzip-requests, 0 means no limit.")
+	gunzipMaxRatio := flag.Int64("gunzip-max-ratio", 100, "Reject upload bodies decompressing to more than this many times their size, 0 disables the check.")
+	gzipResponses := flag.Bool("gzip", true, "Compress the responses of /, /echo/, /user-agent and the files on the fly for clients accepting gzip. --gzip=false sends them as they are.")
+	debugRoutes := flag.Bool("debug-routes", false, "Expose the route table as JSON at /debug/routes.")
+	debugStats := flag.Bool("debug-stats", false, "Expose a JSON snapshot of the server internals at /debug/stats.")
+	debugStatsRedact := flag.Bool("debug-stats-redact", false, "Leave remote addresses out of /debug/stats.")
+	enablePprof := flag.Bool("enable-pprof", false, "Serve the runtime profiles at /debug/pprof/.")
+	pprofAllow := flag.String("pprof-allow", strings.Join(LoopbackNetworks, ","), "Comma-separated networks allowed to reach /debug/pprof/.")
+	enableAdmin := flag.Bool("enable-admin", false, "Serve POST /admin/shutdown and /admin/drain. Requires --admin-user and --admin-password.")
+	adminUser := flag.String("admin-user", "", "Basic auth user for the admin endpoints.")
+	adminPassword := flag.String("admin-password", "", "Basic auth password for the admin endpoints.")
+	adminAllow := flag.String("admin-allow", strings.Join(LoopbackNetworks, ","), "Comma-separated networks allowed to reach /admin/.")
+	handshakeTimeout := flag.Duration("tls-handshake-timeout", 10*time.Second, "Drop TLS clients that haven't completed the handshake after this long, 0 disables it.")
+	shutdownGrace := flag.Duration("shutdown-grace", 10*time.Second, "How long a graceful shutdown waits for in-flight requests.")
+	accessLogPath := flag.String("access-log", "", "Append the access log to this file instead of stdout. Reopened on SIGHUP.")
+	tlsCert := flag.String("tls-cert", "", "Serve TLS with this certificate file. Reloaded on SIGHUP.")
+	tlsKey := flag.String("tls-key", "", "Private key for --tls-cert.")
+	maxConns := flag.Int("max-conns", 0, "Maximum number of connections handled at once, 0 means no limit.")
+	connLimitMode := flag.String("conn-limit-mode", ConnLimitQueue, "What happens over --max-conns or once the --workers queue is full: \"queue\" leaves clients waiting, \"reject\" answers 503.")
+	workers := flag.Int("workers", 0, "Handle connections on a pool of this many goroutines, 0 uses one goroutine per connection.")
+	workerQueue := flag.Int("worker-queue", 0, "Number of accepted connections waiting for a free worker with --workers.")
+	slowRequest := flag.Duration("slow-request-threshold", 0, "Log a warning for requests taking longer than this, 0 disables it.")
+	corsOrigins := flag.String("cors-origins", "", "Comma-separated origins allowed to make cross-origin requests, \"*\" for any.")
+	corsHeaders := flag.String("cors-headers", "Content-Type", "Comma-separated request headers allowed in cross-origin requests.")
+	captureDir := flag.String("capture-dir", "", "Save the raw bytes of every request to this directory, credentials redacted, for offline debugging.")
+	replayDir := flag.String("replay", "", "Run the requests captured in this directory through the routes, handlers included, report divergences from the recorded statuses and exit.")
+	replayMethod := flag.String("replay-method", "", "Only replay the captured requests with this method.")
+	replayPath := flag.String("replay-path", "", "Only replay the captured requests whose path starts with this prefix.")
+	upgradeInsecure := flag.String("upgrade-insecure-url", "", "Redirect browsers sending Upgrade-Insecure-Requests to this https URL, e.g. https://example.com.")
+	strictHost := flag.Bool("strict-host", true, "Reject absolute-form requests whose Host header names another authority.")
+	mergeSlashes := flag.Bool("merge-slashes", false, "Collapse repeated slashes in request paths before routing.")
+	mmapThreshold := flag.Int64("mmap-threshold", 0, "Serve files of at least this many bytes from memory mappings, 0 disables it.")
+	consistentReads := flag.Bool("consistent-reads", false, "Only serve files that aren't being changed, answering 503 to a request for a file still being written.")
+	writeConflict := flag.Bool("write-conflict", false, "Answer 409 Conflict to a file upload while another one to the same path is in progress, instead of queueing it.")
+	rateLimit := flag.Float64("rate-limit", 0, "Requests per second each client IP may make to the file mounts, 0 means no limit. Over it, clients get a 429, before sending the body of an upload expecting 100-continue.")
+	rateBurst := flag.Int("rate-burst", 10, "Requests a client may make at once to the file mounts with --rate-limit.")
+	webdav := flag.Bool("webdav", false, "Answer WebDAV PROPFIND requests on the file mounts.")
+	httpVersion := flag.String("http-version", "", "Answer every request with this HTTP version, \"HTTP/1.0\" or \"HTTP/1.1\". By default responses use the version of the request.")
+	logFormat := flag.String("log-format", LogFormatStructured, "Access log format: \"structured\" or \"combined\".")
 
+	documentEnv(flag.CommandLine)
 	flag.Parse()
+	if err := applyEnv(flag.CommandLine); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
 
-	FILE_DIRECTORY = *directory
+	if *logFormat != LogFormatStructured && *logFormat != LogFormatCombined {
+		fmt.Printf("Unknown log format '%s'\n", *logFormat)
+		os.Exit(1)
+	}
 
-	l, err := net.Listen("tcp", "0.0.0.0:4221")
-	if err != nil {
-		fmt.Println("Failed to bind to port 4221")
+	if *connLimitMode != ConnLimitQueue && *connLimitMode != ConnLimitReject {
+		fmt.Printf("Unknown connection limit mode '%s'\n", *connLimitMode)
+		os.Exit(1)
+	}
+
+	if *httpVersion != "" && *httpVersion != "HTTP/1.0" && *httpVersion != "HTTP/1.1" {
+		fmt.Printf("Unknown HTTP version '%s'\n", *httpVersion)
+		os.Exit(1)
+	}
+
+	fileServers := []*FileServer{NewFileServer("/files/", *directory)}
+	for _, spec := range mounts {
+		fs, err := ParseMount(spec)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		fileServers = append(fileServers, fs)
+	}
+	if *mountsFile != "" {
+		fromFile, err := ReadMountsFile(*mountsFile)
+		if err != nil {
+			fmt.Println("Error reading mounts: ", err.Error())
+			os.Exit(1)
+		}
+		fileServers = append(fileServers, fromFile...)
+	}
+	for _, fs := range fileServers {
+		fs.WebDAV = *webdav
+		fs.ConflictOnBusyWrite = *writeConflict
+		fs.MmapThreshold = *mmapThreshold
+		fs.ConsistentReads = *consistentReads
+	}
+	if err := CheckMounts(fileServers); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	router := &Router{AutoHEAD: true}
+	if *corsOrigins != "" {
+		router.CORS = &CORSPolicy{
+			AllowedOrigins: splitList(*corsOrigins),
+			AllowedHeaders: splitList(*corsHeaders),
+			MaxAge:         10 * time.Minute,
+		}
+	}
+	server := NewServer(*addr, router)
+	server.RequestLimits.MaxBodySize = *maxBodySize
+	server.LogFormat = *logFormat
+	server.ShutdownGrace = *shutdownGrace
+	server.HandshakeTimeout = *handshakeTimeout
+	server.SlowRequestThreshold = *slowRequest
+	dirListings.now = server.Clock.Now
+	for _, fs := range fileServers {
+		go func() {
+			if err := RemoveStaleUploads(fs.Root, server.Clock.Now()); err != nil {
+				fmt.Println("Error removing stale uploads: ", err.Error())
+			}
+		}()
+	}
+	server.MaxConns = *maxConns
+	server.ConnLimitMode = *connLimitMode
+	server.Workers = *workers
+	server.WorkerQueue = *workerQueue
+	server.MergeSlashes = *mergeSlashes
+	server.HTTPVersion = *httpVersion
+	for _, header := range defaultHeaders {
+		name, value, _ := strings.Cut(header, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if err := ValidateHeader(name, value); err != nil {
+			fmt.Println("Invalid --default-header: ", err.Error())
+			os.Exit(1)
+		}
+		server.DefaultHeaders.Add(name, value)
+	}
+	server.StrictHost = *strictHost
+	server.ServerTiming = *serverTiming
+	server.UpgradeInsecureURL = *upgradeInsecure
+	server.RootBody = *rootBody
+	server.RootContentType = *rootContentType
+	if *rootBodyFile != "" {
+		body, err := os.ReadFile(*rootBodyFile)
+		if err != nil {
+			fmt.Println("Error reading --root-body-file: ", err.Error())
+			os.Exit(1)
+		}
+		server.RootBody = string(body)
+	}
+	if err := ValidateHeader("Content-Type", server.RootContentType); err != nil {
+		fmt.Println("Invalid --root-content-type: ", err.Error())
 		os.Exit(1)
 	}
+	if *captureDir != "" {
+		if err := os.MkdirAll(*captureDir, 0700); err != nil {
+			fmt.Println("Error creating capture directory: ", err.Error())
+			os.Exit(1)
+		}
+		server.Capture = NewRequestCapture(*captureDir)
+	}
+	if *accessLogPath != "" {
+		if err := server.OpenAccessLog(*accessLogPath); err != nil {
+			fmt.Println("Error opening access log: ", err.Error())
+			os.Exit(1)
+		}
+	}
 
-	router := &Router{}
+	var contentMiddlewares []Middleware
+	if *secureHeaders {
+		opts := DefaultSecureHeaders
+		opts.ContentSecurityPolicy = *csp
+		opts.TrustedProxies = splitList(*trustedProxies)
+		secure, err := SecureHeaders(opts)
+		if err != nil {
+			fmt.Println("Invalid security headers: ", err.Error())
+			os.Exit(1)
+		}
+		contentMiddlewares = append(contentMiddlewares, secure)
+	}
 
-	router.HandleExact("/", homeHandler)
-	router.HandleExact("/user-agent", userAgentHandler)
-	router.HandlePrefix("/echo/", echoHandler)
-	router.HandlePrefix("/files/", fileHandler)
+	// The generated pages are small, every one of them is worth compressing
+	pageMiddlewares := slices.Clone(contentMiddlewares)
+	if *gzipResponses {
+		pageMiddlewares = append(pageMiddlewares, Gzip(0))
+	}
+	router.HandleExact("/", Chain(server.homeHandler, pageMiddlewares...), "GET")
+	router.HandleExact("/user-agent", Chain(userAgentHandler, pageMiddlewares...), "GET")
+	router.HandlePrefix("/echo/", Chain(echoHandler, pageMiddlewares...), "GET")
+	fileMiddlewares := slices.Clone(contentMiddlewares)
+	if *gunzipRequests {
+		fileMiddlewares = append(fileMiddlewares, GunzipBody(*gunzipMaxSize, *gunzipMaxRatio))
+	}
+	if *gzipResponses {
+		fileMiddlewares = append(fileMiddlewares, Gzip(1<<10))
+	}
+	fileMiddlewares = append(fileMiddlewares, ETag(1<<20))
+	var fileGuards []Guard
+	if *rateLimit > 0 {
+		if *rateBurst < 1 {
+			fmt.Println("--rate-burst must be at least 1")
+			os.Exit(1)
+		}
+		// One limiter for every mount, so a client can't spread over them
+		fileGuards = append(fileGuards, AsGuard(RateLimit(*rateLimit, *rateBurst)))
+	}
+	for _, fs := range fileServers {
+		router.HandlePrefix(fs.Prefix, Chain(fs.Handle, fileMiddlewares...), fs.Methods()...).Stream().Guard(fileGuards...)
+	}
+	router.HandleExact("/healthz", server.healthHandler, "GET")
 
-	for {
-		conn, err := l.Accept()
+	if *debugRoutes {
+		router.HandleExact("/debug/routes", routesHandler(router), "GET")
+	}
+	if *debugStats {
+		router.HandleExact("/debug/stats", server.statsHandler(*debugStatsRedact), "GET")
+	}
+
+	if *enablePprof {
+		allowlist, err := IPAllowlist(strings.Split(*pprofAllow, ","))
 		if err != nil {
-			fmt.Println("Error accepting connection: ", err.Error())
+			fmt.Println("Invalid --pprof-allow: ", err.Error())
 			os.Exit(1)
 		}
-		go handleConnection(conn, router)
+		router.HandlePrefix("/debug/pprof/", pprofHandler(), "GET", "POST").Guard(AsGuard(allowlist))
+	}
+
+	if *enableAdmin {
+		// Refuse to expose the admin endpoints without credentials
+		if *adminUser == "" || *adminPassword == "" {
+			fmt.Println("--enable-admin requires --admin-user and --admin-password")
+			os.Exit(1)
+		}
+		allowlist, err := IPAllowlist(strings.Split(*adminAllow, ","))
+		if err != nil {
+			fmt.Println("Invalid --admin-allow: ", err.Error())
+			os.Exit(1)
+		}
+		// As guards they turn clients down before any body is sent
+		guards := []Guard{AsGuard(allowlist), AsGuard(BasicAuth(*adminUser, *adminPassword, "admin"))}
+		router.HandleExact("/admin/shutdown", server.adminShutdownHandler, "POST").Guard(guards...)
+		router.HandleExact("/admin/drain", server.adminDrainHandler, "POST").Guard(guards...)
+	}
+
+	if *replayDir != "" {
+		os.Exit(server.Replay(*replayDir, ReplayFilter{Method: *replayMethod, PathPrefix: *replayPath}, os.Stdout))
+	}
+
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		fmt.Printf("Failed to bind to %s\n", server.Addr)
+		os.Exit(1)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				server.Reload()
+				continue
+			}
+			server.Shutdown()
+			return
+		}
+	}()
+
+	if *tlsCert != "" || *tlsKey != "" {
+		err = server.ServeTLS(l, *tlsCert, *tlsKey)
+	} else {
+		err = server.Serve(l)
+	}
+	if err != nil {
+		if errors.Is(err, ErrServerClosed) {
+			<-server.Done()
+			return
+		}
+		fmt.Println("Error accepting connection: ", err.Error())
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envFlagSet defines some of the flags of envFlags as main does.
+func envFlagSet() (*flag.FlagSet, *string, *string, *int, *time.Duration) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	addr := flags.String("addr", "0.0.0.0:4221", "Address to listen on.")
+	directory := flags.String("directory", "", "Directory served.")
+	maxBodySize := flags.Int("max-body-size", 1024, "Largest request body.")
+	grace := flags.Duration("shutdown-grace", 10*time.Second, "Shutdown grace.")
+	return flags, addr, directory, maxBodySize, grace
+}
+
+// A variable sets its flag when the command line doesn't, the default
+// standing when neither does.
+func TestApplyEnv(t *testing.T) {
+	t.Setenv("HTTP_SERVER_ADDR", "127.0.0.1:8080")
+	t.Setenv("HTTP_SERVER_DIRECTORY", "/srv/env")
+	t.Setenv("HTTP_SERVER_MAX_BODY_SIZE", "2048")
+
+	flags, addr, directory, maxBodySize, grace := envFlagSet()
+	if err := flags.Parse([]string{"--directory", "/srv/flag"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyEnv(flags); err != nil {
+		t.Fatal(err)
+	}
+	if *addr != "127.0.0.1:8080" || *directory != "/srv/flag" || *maxBodySize != 2048 || *grace != 10*time.Second {
+		t.Errorf("got addr %q, directory %q, max body size %d, grace %s", *addr, *directory, *maxBodySize, *grace)
+	}
+
+	t.Setenv("HTTP_SERVER_SHUTDOWN_GRACE", "soon")
+	flags, _, _, _, _ = envFlagSet()
+	flags.Parse(nil)
+	if err := applyEnv(flags); err == nil || !strings.Contains(err.Error(), "HTTP_SERVER_SHUTDOWN_GRACE") {
+		t.Errorf("invalid variable: got %v", err)
+	}
+	// Given on the command line, the flag makes the variable irrelevant
+	flags, _, _, _, grace = envFlagSet()
+	flags.Parse([]string{"--shutdown-grace", "3s"})
+	if err := applyEnv(flags); err != nil || *grace != 3*time.Second {
+		t.Errorf("got %s, %v", *grace, err)
+	}
+}
+
+func TestDocumentEnv(t *testing.T) {
+	flags, _, _, _, _ := envFlagSet()
+	documentEnv(flags)
+	if usage := flags.Lookup("addr").Usage; !strings.HasSuffix(usage, " Environment: HTTP_SERVER_ADDR.") {
+		t.Errorf("addr usage %q", usage)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Middleware wraps a HandlerFunc with extra behaviour.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Chain wraps handler with the given middlewares. The first one is the outermost.
+func Chain(handler HandlerFunc, middlewares ...Middleware) HandlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// LoopbackNetworks only allows requests coming from the local machine.
+var LoopbackNetworks = []string{"127.0.0.0/8", "::1/128"}
+
+// IPAllowlist only lets requests from the given networks through, everyone else gets a 403.
+// Entries are CIDR prefixes or plain IP addresses.
+func IPAllowlist(networks []string) (Middleware, error) {
+	allowed, err := networkMatcher(networks)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *Request, res *Response) {
+			if !allowed(req.RemoteAddr) {
+				res.StatusCode = 403
+				res.ReasonPhrase = "Forbidden"
+				return
+			}
+			next(req, res)
+		}
+	}, nil
+}
+
+// networkMatcher returns a function reporting whether a remote address,
+// with or without its port, belongs to one of networks.
+func networkMatcher(networks []string) (func(remoteAddr string) bool, error) {
+	var prefixes []netip.Prefix
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if network == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(network); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network '%s'", network)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	allowed := func(remoteAddr string) bool {
+		addr, err := netip.ParseAddr(remoteIP(remoteAddr))
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap()
+		for _, prefix := range prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	return allowed, nil
+}
+
+// AuthUserKey holds the user name BasicAuth authenticated the request with.
+var AuthUserKey = NewRequestKey("auth user")
+
+// BasicAuth only lets requests with the given credentials through, everyone else gets a 401.
+// The user name is attached to the request under AuthUserKey.
+func BasicAuth(username, password, realm string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *Request, res *Response) {
+			if !checkBasicAuth(req, username, password) {
+				res.StatusCode = 401
+				res.ReasonPhrase = "Unauthorized"
+				res.Headers.Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+				return
+			}
+			req.Set(AuthUserKey, username)
+			next(req, res)
+		}
+	}
+}
+
+func checkBasicAuth(req *Request, username, password string) bool {
+	auth, found := req.Headers.Get("Authorization")
+	if !found {
+		return false
+	}
+	scheme, encoded, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+	// Compare both so the timing doesn't tell which one was wrong
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+	return userOK && passOK
+}
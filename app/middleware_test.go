@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// BasicAuth attaches the user it let in, and the handler reads it back.
+// A key of the same name made elsewhere doesn't see the value.
+func TestRequestValues(t *testing.T) {
+	otherUserKey := NewRequestKey("auth user")
+	router := &Router{}
+	router.HandleExact("/whoami", Chain(func(req *Request, res *Response) {
+		user, found := req.Get(AuthUserKey)
+		_, other := req.Get(otherUserKey)
+		res.Body = fmt.Sprintf("%v %v %v", user, found, other)
+	}, BasicAuth("alice", "secret", "test")), "GET")
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	res, err := c.Do(newTestRequest("GET", "/whoami", "Authorization", auth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 || res.Body != "alice true false" {
+		t.Errorf("got %d %q", res.StatusCode, res.Body)
+	}
+	if res, err := c.Do(newTestRequest("GET", "/whoami")); err != nil || res.StatusCode != 401 {
+		t.Errorf("without credentials: %v, %+v", err, res)
+	}
+
+	req := newTestRequest("GET", "/")
+	if value, found := req.Get(AuthUserKey); found || value != nil {
+		t.Errorf("new request: got %v, %v", value, found)
+	}
+}
+
+// A net/http handler never sees the headers about the client's connection,
+// and the response doesn't name headers it lacks in Connection.
+func TestHTTPHandlerHopByHop(t *testing.T) {
+	router := &Router{}
+	router.HandleExact("/adapted", HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var names []string
+		for name := range r.Header {
+			names = append(names, strings.ToLower(name))
+		}
+		slices.Sort(names)
+		w.Header().Set("Connection", "X-Not-There")
+		fmt.Fprint(w, strings.Join(names, " "))
+	})), "GET")
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	res, err := c.Do(newTestRequest("GET", "/adapted",
+		"Connection", "keep-alive, X-Debug", "X-Debug", "1", "Keep-Alive", "timeout=5",
+		"TE", "trailers", "Proxy-Authorization", "Basic eA==", "X-Trace", "abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Body != "host x-trace" {
+		t.Errorf("the handler got the headers %q", res.Body)
+	}
+	if connection, _ := res.Headers.Get("Connection"); strings.Contains(strings.ToLower(connection), "x-not-there") {
+		t.Errorf("Connection: %q", connection)
+	}
+}
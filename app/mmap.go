@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// mappedFileChunk is how much of a mapping is written between two checks
+// of the request context.
+const mappedFileChunk = 1 << 20
+
+// fileMapping is a file mapped in memory. It is unmapped once the file
+// changed on disk and no response is using it anymore.
+type fileMapping struct {
+	data  []byte
+	info  os.FileInfo
+	users int
+	stale bool
+}
+
+// fileMappings caches the mappings of the files served with mmap, by path.
+type fileMappings struct {
+	mu       sync.Mutex
+	mappings map[string]*fileMapping
+}
+
+var mappedFiles = &fileMappings{mappings: make(map[string]*fileMapping)}
+
+// acquire returns the mapping of the file at path, mapping it if needed. It
+// fails when the file on disk isn't the one described by info anymore, the
+// caller then reads the file as usual. The mapping must be released.
+func (fm *fileMappings) acquire(path string, info os.FileInfo) (*fileMapping, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	current, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !sameVersion(current, info) {
+		return nil, fmt.Errorf("file '%s' changed since it was looked up", path)
+	}
+
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if m, found := fm.mappings[path]; found {
+		if sameVersion(m.info, current) {
+			m.users++
+			return m, nil
+		}
+		// Replaced or rewritten: the old mapping goes once its last response is done
+		m.stale = true
+		delete(fm.mappings, path)
+		if m.users == 0 {
+			munmap(m.data)
+		}
+	}
+
+	data, err := mmapFile(f, current.Size())
+	if err != nil {
+		return nil, err
+	}
+	m := &fileMapping{data: data, info: current, users: 1}
+	fm.mappings[path] = m
+	return m, nil
+}
+
+// release gives back a mapping from acquire.
+func (fm *fileMappings) release(m *fileMapping) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	m.users--
+	if m.stale && m.users == 0 {
+		munmap(m.data)
+	}
+}
+
+// sameVersion reports whether a and b describe the same file, unchanged.
+func sameVersion(a, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// serveMapped is ServeFile sending the body from a memory mapping of the
+// file. Whenever the file can't be mapped it is read as usual.
+func serveMapped(req *Request, res *Response, filePath string, info os.FileInfo) {
+	section := serveFile(req, res, filePath, info)
+	read := res.Stream
+	if read == nil {
+		return
+	}
+	res.Stream = func(w io.Writer) error {
+		m, err := mappedFiles.acquire(filePath, info)
+		if err != nil {
+			return read(w)
+		}
+		defer mappedFiles.release(m)
+		for data := m.data[section.offset : section.offset+section.length]; len(data) > 0; {
+			if err := req.Context().Err(); err != nil {
+				return err
+			}
+			n := min(len(data), mappedFileChunk)
+			if _, err := w.Write(data[:n]); err != nil {
+				return err
+			}
+			data = data[n:]
+		}
+		return nil
+	}
+}
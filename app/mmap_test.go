@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mappedTestFile writes content to a new file and returns its path and info.
+func mappedTestFile(t *testing.T, dir, content string) (string, os.FileInfo) {
+	t.Helper()
+	path := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, info
+}
+
+// A mapping is shared while the file is unchanged. Once the file is
+// replaced or rewritten, new responses get a new mapping, and the old one
+// lives on until the responses using it are done.
+func TestMappedFileInvalidation(t *testing.T) {
+	fm := &fileMappings{mappings: make(map[string]*fileMapping)}
+	dir := t.TempDir()
+	path, info := mappedTestFile(t, dir, "version one")
+
+	first, err := fm.acquire(path, info)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("no memory mappings here")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := fm.acquire(path, info)
+	if err != nil || again != first || first.users != 2 || string(first.data) != "version one" {
+		t.Fatalf("second acquire: %v, same mapping %v, %d users", err, again == first, first.users)
+	}
+	fm.release(again)
+
+	// Replaced by a rename: another file, another mapping
+	replacement := filepath.Join(dir, "new.bin")
+	os.WriteFile(replacement, []byte("version two!"), 0644)
+	if err := os.Rename(replacement, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fm.acquire(path, info); err == nil {
+		t.Error("acquire with the info of the replaced file succeeded")
+	}
+	info, _ = os.Stat(path)
+	second, err := fm.acquire(path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first || string(second.data) != "version two!" {
+		t.Errorf("after the replace: same mapping %v, %q", second == first, second.data)
+	}
+	// The response still sending the first version can finish it
+	if !first.stale || string(first.data) != "version one" {
+		t.Errorf("old mapping: stale %v, %q", first.stale, first.data)
+	}
+	fm.release(first)
+	fm.release(second)
+
+	// Rewritten in place: same file, other content
+	os.WriteFile(path, []byte("version 3!!!"), 0644)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(path, later, later)
+	info, _ = os.Stat(path)
+	third, err := fm.acquire(path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == second || !second.stale || string(third.data) != "version 3!!!" {
+		t.Errorf("after the rewrite: same mapping %v, old stale %v, %q", third == second, second.stale, third.data)
+	}
+	fm.release(third)
+	if len(fm.mappings) != 1 || fm.mappings[path] != third || third.users != 0 {
+		t.Errorf("%d mappings cached, %d users", len(fm.mappings), third.users)
+	}
+}
+
+func mmapRouter(dir string, threshold int64) *Router {
+	router := &Router{}
+	fs := NewFileServer("/files/", dir)
+	fs.MmapThreshold = threshold
+	router.HandlePrefix(fs.Prefix, fs.Handle, fs.Methods()...).Stream()
+	return router
+}
+
+// Files above the threshold are sent from their mapping, ranges included,
+// and a replaced file is sent anew.
+func TestServeMapped(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Repeat("0123456789", 300<<10)
+	path, _ := mappedTestFile(t, dir, content)
+	_, addr := startServer(t, mmapRouter(dir, 1<<10))
+	c := dial(t, addr)
+
+	res, err := c.Do(newTestRequest("GET", "/files/data.bin"))
+	if err != nil || res.StatusCode != 200 || res.Body != content {
+		t.Fatalf("whole file: %v, %d, %d bytes", err, res.StatusCode, len(res.Body))
+	}
+	res, err = c.Do(newTestRequest("GET", "/files/data.bin", "Range", "bytes=1500000-1500009"))
+	if err != nil || res.StatusCode != 206 || res.Body != "0123456789" {
+		t.Errorf("range: %v, %+v", err, res)
+	}
+
+	replacement := filepath.Join(dir, "new.bin")
+	os.WriteFile(replacement, []byte(strings.Repeat("abcdefghij", 300<<10)), 0644)
+	if err := os.Rename(replacement, path); err != nil {
+		t.Fatal(err)
+	}
+	res, err = c.Do(newTestRequest("GET", "/files/data.bin", "Range", "bytes=-10"))
+	if err != nil || res.StatusCode != 206 || res.Body != "abcdefghij" {
+		t.Errorf("range of the replaced file: %v, %+v", err, res)
+	}
+}
+
+// BenchmarkRangeRequests compares sending ranges of a large file from its
+// mapping with reading them, clients asking concurrently.
+func BenchmarkRangeRequests(b *testing.B) {
+	dir := b.TempDir()
+	const size, rangeSize = 64 << 20, 256 << 10
+	if err := os.WriteFile(filepath.Join(dir, "data.bin"), make([]byte, size), 0644); err != nil {
+		b.Fatal(err)
+	}
+	for _, bench := range []struct {
+		name      string
+		threshold int64
+	}{{"read", 0}, {"mmap", 1}} {
+		b.Run(bench.name, func(b *testing.B) {
+			_, addr := startServer(b, mmapRouter(dir, bench.threshold))
+			b.ReportAllocs()
+			b.SetBytes(rangeSize)
+			b.RunParallel(func(pb *testing.PB) {
+				c, err := Dial(addr)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer c.Close()
+				for i := 0; pb.Next(); i++ {
+					start := i * 7919 % (size / rangeSize) * rangeSize
+					req := newTestRequest("GET", "/files/data.bin", "Range", fmt.Sprintf("bytes=%d-%d", start, start+rangeSize-1))
+					res, err := c.Do(req)
+					if err != nil || res.StatusCode != 206 || len(res.Body) != rangeSize {
+						b.Errorf("range at %d: %v, %+v", start, err, res)
+						return
+					}
+				}
+			})
+		})
+	}
+}
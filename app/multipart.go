@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// uploadTooLargeError is returned when a part or the whole upload is over its limit.
+type uploadTooLargeError struct {
+	limit int64
+}
+
+func (e *uploadTooLargeError) Error() string {
+	return fmt.Sprintf("upload over the limit of %d bytes", e.limit)
+}
+
+type uploadedFile struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+	ETag string `json:"etag"`
+}
+
+type uploadPart struct {
+	uploadedFile
+	filePath string
+	data     []byte
+}
+
+// multipartBoundary returns the boundary of a multipart/form-data request body.
+func multipartBoundary(req *Request) (string, bool) {
+	contentType, found := req.Headers.Get("Content-Type")
+	if !found {
+		return "", false
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return "", false
+	}
+	return params["boundary"], true
+}
+
+// multipartUploadHandler stores every file part of a multipart/form-data
+// body in the directory at dirURI, under the file name the client gave it.
+// Non-file fields are ignored. Nothing is written unless every part is
+// acceptable, and the response lists what was stored.
+func (fs *FileServer) multipartUploadHandler(req *Request, res *Response, dirURI, boundary string) {
+	if !bufferBody(req, res) {
+		return
+	}
+	parts, err := fs.readUploadParts(dirURI, boundary, req.Body)
+	var conflict *duplicateFileError
+	var directory *directoryTargetError
+	var tooLarge *uploadTooLargeError
+	switch {
+	case errors.As(err, &tooLarge):
+		res.StatusCode = 413
+		res.ReasonPhrase = StatusText(413)
+		res.Headers.Set("Content-Type", "text/plain; charset=utf-8")
+		res.Body = fmt.Sprintf("max %d bytes\n", tooLarge.limit)
+		return
+	case errors.As(err, &conflict), errors.As(err, &directory):
+		res.StatusCode = 409
+		res.ReasonPhrase = "Conflict"
+		return
+	case err != nil:
+		fmt.Println("Error reading multipart upload: ", err.Error())
+		res.StatusCode = 400
+		res.ReasonPhrase = "Bad Request"
+		return
+	}
+
+	if err := storeUploadParts(req.Context(), parts); err != nil {
+		fmt.Printf("Error writing file: %v\n", err)
+		res.StatusCode = 500
+		res.ReasonPhrase = "Internal Server Error"
+		return
+	}
+	stored := make([]uploadedFile, 0, len(parts))
+	for _, part := range parts {
+		stored = append(stored, part.uploadedFile)
+	}
+
+	body, err := json.Marshal(stored)
+	if err != nil {
+		res.StatusCode = 500
+		res.ReasonPhrase = "Internal Server Error"
+		return
+	}
+	res.StatusCode = 201
+	res.ReasonPhrase = "Created"
+	res.Headers.Set("Content-Type", "application/json")
+	res.Headers.Set("Content-Length", strconv.Itoa(len(body)))
+	res.Body = string(body)
+}
+
+// storeUploadParts writes every part to a temporary file, and only once all
+// of them are written renames them into place, so a failure part way leaves
+// none of the files changed. The paths are locked in order, which keeps two
+// uploads sharing files from waiting on each other.
+func storeUploadParts(ctx context.Context, parts []uploadPart) error {
+	sorted := slices.Clone(parts)
+	slices.SortFunc(sorted, func(a, b uploadPart) int { return strings.Compare(a.filePath, b.filePath) })
+	for _, part := range sorted {
+		unlock := filePathLocks.lock(part.filePath)
+		defer unlock()
+	}
+
+	staged := make([]string, 0, len(sorted))
+	renamed := 0
+	defer func() {
+		// Whatever wasn't renamed into place is removed
+		for _, tmp := range staged[renamed:] {
+			os.Remove(tmp)
+		}
+	}()
+	for _, part := range sorted {
+		tmp, err := stageFile(ctx, part.filePath, bytes.NewReader(part.data), 0644, nil)
+		if err != nil {
+			return err
+		}
+		staged = append(staged, tmp)
+	}
+	for ; renamed < len(sorted); renamed++ {
+		if err := os.Rename(staged[renamed], sorted[renamed].filePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// duplicateFileError reports a file name used by two parts of one upload.
+type duplicateFileError struct {
+	name string
+}
+
+func (e *duplicateFileError) Error() string {
+	return fmt.Sprintf("file '%s' is uploaded twice", e.name)
+}
+
+// directoryTargetError reports a file name taken by a directory.
+type directoryTargetError struct {
+	name string
+}
+
+func (e *directoryTargetError) Error() string {
+	return fmt.Sprintf("'%s' is a directory", e.name)
+}
+
+// readUploadParts reads and checks every file part of body before anything is stored.
+func (fs *FileServer) readUploadParts(dirURI, boundary, body string) ([]uploadPart, error) {
+	reader := multipart.NewReader(strings.NewReader(body), boundary)
+	seen := make(map[string]bool)
+	var parts []uploadPart
+	var total int64
+	for {
+		p, err := reader.NextPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p.FileName() == "" {
+			continue
+		}
+
+		name := path.Base(strings.ReplaceAll(p.FileName(), "\\", "/"))
+		if name == "." || name == ".." || name == "/" {
+			return nil, fmt.Errorf("invalid file name '%s'", p.FileName())
+		}
+		if fs.SanitizeName != nil {
+			if name, err = fs.SanitizeName(name); err != nil {
+				return nil, err
+			}
+		}
+		filePath, ok := fs.resolve(strings.TrimSuffix(dirURI, "/") + "/" + name)
+		if !ok || name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid file name '%s'", p.FileName())
+		}
+		if seen[name] {
+			return nil, &duplicateFileError{name: name}
+		}
+		seen[name] = true
+		if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+			return nil, &directoryTargetError{name: name}
+		}
+
+		var src io.Reader = p
+		if fs.MaxPartSize > 0 {
+			src = io.LimitReader(p, fs.MaxPartSize+1)
+		}
+		data, err := io.ReadAll(src)
+		if err != nil {
+			return nil, err
+		}
+		total += int64(len(data))
+		if fs.MaxPartSize > 0 && int64(len(data)) > fs.MaxPartSize {
+			return nil, &uploadTooLargeError{limit: fs.MaxPartSize}
+		}
+		if fs.MaxUploadSize > 0 && total > fs.MaxUploadSize {
+			return nil, &uploadTooLargeError{limit: fs.MaxUploadSize}
+		}
+
+		parts = append(parts, uploadPart{
+			uploadedFile: uploadedFile{
+				Name: name,
+				Size: len(data),
+				ETag: contentETag(sha256.Sum256(data)),
+			},
+			filePath: filePath,
+			data:     data,
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// multipartRequest builds a POST of files, name to content, to target.
+func multipartRequest(t *testing.T, target string, files [][2]string) *Request {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.WriteField("comment", "not a file")
+	for _, f := range files {
+		part, err := w.CreateFormFile("file", f[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(f[1]))
+	}
+	w.Close()
+	req := newTestRequest("POST", target, "Content-Type", w.FormDataContentType())
+	req.Body = body.String()
+	return req
+}
+
+func TestMultipartUpload(t *testing.T) {
+	dir := t.TempDir()
+	_, addr := startServer(t, fileRouter(dir))
+	c := dial(t, addr)
+
+	res, err := c.Do(multipartRequest(t, "/files/", [][2]string{{"a.txt", "alpha"}, {"b.txt", "beta"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 201 {
+		t.Fatalf("got %d %q", res.StatusCode, res.Body)
+	}
+	var stored []uploadedFile
+	if err := json.Unmarshal([]byte(res.Body), &stored); err != nil || len(stored) != 2 {
+		t.Fatalf("response %q: %v", res.Body, err)
+	}
+	for _, f := range [][2]string{{"a.txt", "alpha"}, {"b.txt", "beta"}} {
+		if got, err := os.ReadFile(filepath.Join(dir, f[0])); err != nil || string(got) != f[1] {
+			t.Errorf("%s: got %q, %v", f[0], got, err)
+		}
+	}
+}
+
+// A part that can't be stored keeps all of them from being stored.
+func TestMultipartUploadAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "taken"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, addr := startServer(t, fileRouter(dir))
+	c := dial(t, addr)
+
+	tests := []struct {
+		name   string
+		files  [][2]string
+		status int
+	}{
+		{name: "directory in the way", files: [][2]string{{"first.txt", "1"}, {"taken", "2"}}, status: 409},
+		{name: "same name twice", files: [][2]string{{"first.txt", "1"}, {"first.txt", "2"}}, status: 409},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := c.Do(multipartRequest(t, "/files/", tt.files))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.status {
+				t.Errorf("got %d, want %d", res.StatusCode, tt.status)
+			}
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != 1 {
+				t.Errorf("%d entries in the directory, want only the one there before", len(entries))
+			}
+		})
+	}
+}
+
+func TestStoreUploadPartsCleansUp(t *testing.T) {
+	dir := t.TempDir()
+	parts := []uploadPart{
+		{filePath: filepath.Join(dir, "a.txt"), data: []byte("a")},
+		// Staging next to a file in a missing directory fails
+		{filePath: filepath.Join(dir, "missing", "b.txt"), data: []byte("b")},
+	}
+	if err := storeUploadParts(t.Context(), parts); err == nil {
+		t.Fatal("stored a part in a missing directory")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("left %d entries behind, first %s", len(entries), entries[0].Name())
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// mediaRange is one element of an Accept header, like "text/*;q=0.5".
+type mediaRange struct {
+	typ, subtype string
+	q            float64
+}
+
+func parseAccept(value string) []mediaRange {
+	var ranges []mediaRange
+	for _, element := range strings.Split(value, ",") {
+		params := strings.Split(element, ";")
+		typ, subtype, ok := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+		if !ok {
+			continue
+		}
+		mr := mediaRange{typ: typ, subtype: subtype, q: 1}
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				// A malformed weight counts as the default
+				if q, err := strconv.ParseFloat(value, 64); err == nil && q >= 0 && q <= 1 {
+					mr.q = q
+				}
+			}
+		}
+		ranges = append(ranges, mr)
+	}
+	return ranges
+}
+
+// quality returns the weight the most specific matching range gives to offer, -1 if none matches.
+func (mr mediaRange) quality(offerType, offerSubtype string) (q float64, specificity int) {
+	switch {
+	case mr.typ == offerType && mr.subtype == offerSubtype:
+		return mr.q, 2
+	case mr.typ == offerType && mr.subtype == "*":
+		return mr.q, 1
+	case mr.typ == "*" && mr.subtype == "*":
+		return mr.q, 0
+	}
+	return -1, -1
+}
+
+// Negotiate picks the offered media type the request's Accept header prefers.
+// Without an Accept header the first offer wins, and ties go to the earlier offer.
+// It returns "" when the client accepts none of the offers.
+func Negotiate(req *Request, offers []string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	accept, found := req.Headers.Get("Accept")
+	if !found {
+		return offers[0]
+	}
+
+	ranges := parseAccept(accept)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		offerType, offerSubtype, _ := strings.Cut(strings.ToLower(offer), "/")
+		q, specificity := 0.0, -1
+		for _, mr := range ranges {
+			if mq, ms := mr.quality(offerType, offerSubtype); ms > specificity {
+				q, specificity = mq, ms
+			}
+		}
+		if specificity >= 0 && q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// encodingWeights parses the Accept-Encoding header of req into the weight
+// of each content coding listed, "*" included. A malformed weight counts
+// as the default.
+func encodingWeights(req *Request) map[string]float64 {
+	weights := make(map[string]float64)
+	for _, element := range req.Headers.Values("Accept-Encoding") {
+		params := strings.Split(element, ";")
+		q := 1.0
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				if weight, err := strconv.ParseFloat(value, 64); err == nil && weight >= 0 && weight <= 1 {
+					q = weight
+				}
+			}
+		}
+		if name := strings.ToLower(strings.TrimSpace(params[0])); name != "" {
+			weights[name] = q
+		}
+	}
+	return weights
+}
+
+// codingWeight returns the weight of coding, -1 when it isn't listed. An
+// explicit weight for it wins over the one of "*".
+func codingWeight(weights map[string]float64, coding string) float64 {
+	if q, found := weights[strings.ToLower(coding)]; found {
+		return q
+	}
+	if q, found := weights["*"]; found {
+		return q
+	}
+	return -1
+}
+
+// AcceptsEncoding reports whether the Accept-Encoding header of req allows
+// coding.
+func AcceptsEncoding(req *Request, coding string) bool {
+	return codingWeight(encodingWeights(req), coding) > 0
+}
+
+// NegotiateEncoding picks the content coding of supported the request's
+// Accept-Encoding header weighs the most, ties going to the earlier one.
+// Codings with q=0 are refused. It returns "" when none is acceptable, or
+// when identity wins: the response is then sent as it is.
+func NegotiateEncoding(req *Request, supported []string) string {
+	weights := encodingWeights(req)
+	best, bestQ := "", 0.0
+	for _, coding := range supported {
+		if q := codingWeight(weights, coding); q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	if strings.EqualFold(best, "identity") {
+		return ""
+	}
+	return best
+}
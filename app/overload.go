@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RetryAfterPolicy holds how long clients are told to wait, per cause of overload.
+type RetryAfterPolicy struct {
+	// Shutdown applies to requests arriving while the server shuts down.
+	Shutdown time.Duration
+	// LoadShed applies to requests shed by the LoadShedder without a delay of their own.
+	LoadShed time.Duration
+	// ConnLimit applies to connections rejected over Server.MaxConns.
+	ConnLimit time.Duration
+}
+
+// What to do with connections over Server.MaxConns.
+const (
+	ConnLimitQueue  = "queue"
+	ConnLimitReject = "reject"
+)
+
+// connLimitResponse is the fixed reply to connections over the limit,
+// built once so rejecting a client costs a single write.
+func connLimitResponse(retryAfter time.Duration) []byte {
+	return []byte("HTTP/1.1 503 Service Unavailable\r\n" +
+		"Retry-After: " + strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))) + "\r\n" +
+		"Connection: close\r\n" +
+		"Content-Length: 0\r\n" +
+		"\r\n")
+}
+
+// rejectConn writes response to conn and closes it, without parsing
+// anything. The request the client may have sent already is drained by
+// lingerClose for a moment, so closing doesn't reset the connection before
+// the response is read. The deadlines bound the time spent on each client.
+func rejectConn(conn net.Conn, response []byte) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write(response)
+	lingerClose(conn)
+	conn.Close()
+}
+
+// setRetryAfter advertises d, rounded up to whole seconds, in a Retry-After header.
+func setRetryAfter(res *Response, d time.Duration) {
+	res.Headers.Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// unavailable turns res into a 503 telling the client when to come back.
+func unavailable(res *Response, retryAfter time.Duration) {
+	res.StatusCode = 503
+	res.ReasonPhrase = "Service Unavailable"
+	setRetryAfter(res, retryAfter)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Over MaxConns in reject mode, the extra connections get the 503 at once,
+// the request they sent notwithstanding.
+func TestConnLimitReject(t *testing.T) {
+	const limit = 2
+	_, addr := startServer(t, echoRouter(), func(s *Server) {
+		s.MaxConns = limit
+		s.ConnLimitMode = ConnLimitReject
+		s.RetryAfter.ConnLimit = 3 * time.Second
+	})
+	for range limit {
+		c := dial(t, addr)
+		if _, err := c.Do(newTestRequest("GET", "/echo/held")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := string(connLimitResponse(3 * time.Second))
+	for i := range 3 {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// Unread by the server, this would reset the connection on close
+		if _, err := io.WriteString(conn, "GET /echo/extra HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		start := time.Now()
+		got, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("extra connection %d: %v after %q", i, err, got)
+		}
+		if string(got) != want {
+			t.Errorf("extra connection %d: got %q, want %q", i, got, want)
+		}
+		if !strings.HasPrefix(string(got), "HTTP/1.1 503 ") || time.Since(start) > time.Second {
+			t.Errorf("extra connection %d: answered after %s", i, time.Since(start))
+		}
+	}
+}
+
+// With every worker busy and the queue full, a new connection gets the 503
+// with its Retry-After.
+func TestWorkerQueueFullReject(t *testing.T) {
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	_, addr := startServer(t, blockingRouter(entered, release), func(s *Server) {
+		s.Workers = 1
+		s.WorkerQueue = 1
+		s.ConnLimitMode = ConnLimitReject
+		s.RetryAfter.ConnLimit = 4 * time.Second
+	})
+	busy := dial(t, addr)
+	done := make(chan error, 1)
+	go func() {
+		_, err := busy.Do(newTestRequest("GET", "/block"))
+		done <- err
+	}()
+	<-entered
+	defer func() {
+		close(release)
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	queued, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queued.Close()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /echo/extra HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(conn); err != nil || string(got) != string(connLimitResponse(4*time.Second)) {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+// In queue mode, with every worker busy and the queue full, a new
+// connection waits and is served once a worker is free.
+func TestWorkerQueueFullWaits(t *testing.T) {
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	_, addr := startServer(t, blockingRouter(entered, release), func(s *Server) {
+		s.Workers = 1
+		s.WorkerQueue = 1
+	})
+	busy := dial(t, addr)
+	done := make(chan error, 1)
+	go func() {
+		_, err := busy.Do(newTestRequest("GET", "/block"))
+		done <- err
+	}()
+	<-entered
+
+	var waiting []net.Conn
+	for _, name := range []string{"queued", "waiting"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "GET /echo/"+name+" HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		waiting = append(waiting, conn)
+	}
+	waiting[1].SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := waiting[1].Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("answered with every worker busy: %d bytes, %v", n, err)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	busy.Close()
+	for i, name := range []string{"queued", "waiting"} {
+		waiting[i].SetReadDeadline(time.Now().Add(2 * time.Second))
+		res, err := ReadResponse(bufio.NewReader(waiting[i]), "GET")
+		if err != nil || res.StatusCode != 200 || res.Body != name {
+			t.Errorf("%s connection: %v, %+v", name, err, res)
+		}
+	}
+}
+
+// Connections still waiting for a worker at shutdown are closed unserved.
+func TestWorkerQueueShutdown(t *testing.T) {
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	s, addr := startServer(t, blockingRouter(entered, release), func(s *Server) {
+		s.Workers = 1
+		s.WorkerQueue = 4
+		s.ShutdownGrace = 5 * time.Second
+	})
+	busy := dial(t, addr)
+	done := make(chan error, 1)
+	go func() {
+		_, err := busy.Do(newTestRequest("GET", "/block"))
+		done <- err
+	}()
+	<-entered
+	queued, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queued.Close()
+	io.WriteString(queued, "GET /echo/late HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	// Give the server the time to accept it
+	time.Sleep(50 * time.Millisecond)
+
+	shutdown := make(chan struct{})
+	go func() {
+		s.Shutdown()
+		close(shutdown)
+	}()
+	for !s.closing.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	queued.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// Its request unread, the connection may be reset rather than closed
+	if got, err := io.ReadAll(queued); isTimeout(err) || len(got) != 0 {
+		t.Errorf("queued connection: got %q, %v", got, err)
+	}
+	<-shutdown
+}
+
+func TestLoadShedder(t *testing.T) {
+	handled := 0
+	router := echoRouter()
+	router.HandleExact("/busy", func(req *Request, res *Response) { handled++ }, "GET")
+	router.HandleExact("/default", func(req *Request, res *Response) { handled++ }, "GET")
+	_, addr := startServer(t, router, func(s *Server) {
+		s.RetryAfter.LoadShed = 2 * time.Second
+		s.LoadShedder = func(req *Request) (bool, time.Duration) {
+			switch req.Path() {
+			case "/busy":
+				return true, 6500 * time.Millisecond
+			case "/default":
+				return true, 0
+			}
+			return false, 0
+		}
+	})
+	c := dial(t, addr)
+
+	for _, tt := range []struct {
+		target     string
+		status     int
+		retryAfter string
+	}{
+		{"/busy", 503, "7"},
+		{"/default", 503, "2"},
+		{"/echo/free", 200, ""},
+	} {
+		res, err := c.Do(newTestRequest("GET", tt.target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		retryAfter, _ := res.Headers.Get("Retry-After")
+		if res.StatusCode != tt.status || retryAfter != tt.retryAfter {
+			t.Errorf("%s: got %d, Retry-After %q, want %d, %q", tt.target, res.StatusCode, retryAfter, tt.status, tt.retryAfter)
+		}
+	}
+	if handled != 0 {
+		t.Errorf("%d shed requests reached their handler", handled)
+	}
+}
+
+// A request whose head arrives once the shutdown started is turned down
+// with the Retry-After of the shutdown.
+func TestShutdownRetryAfter(t *testing.T) {
+	s, addr := startServer(t, echoRouter(), func(s *Server) {
+		s.RetryAfter.Shutdown = 9 * time.Second
+		s.ShutdownGrace = 5 * time.Second
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Half a head makes the connection busy, so the shutdown waits for it
+	io.WriteString(conn, "GET /echo/late HTTP/1.1\r\n")
+	for i := 0; len(s.conns.snapshot()) == 0 || !s.conns.snapshot()[0].active.Load(); i++ {
+		if i == 100 {
+			t.Fatal("the connection isn't active")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	go s.Shutdown()
+	for !s.closing.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	io.WriteString(conn, "Host: localhost\r\n\r\n")
+
+	res, err := ReadResponse(bufio.NewReader(conn), "GET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	retryAfter, _ := res.Headers.Get("Retry-After")
+	connection, _ := res.Headers.Get("Connection")
+	if res.StatusCode != 503 || retryAfter != "9" || connection != "close" {
+		t.Errorf("got %d, Retry-After %q, Connection %q", res.StatusCode, retryAfter, connection)
+	}
+}
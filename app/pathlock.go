@@ -0,0 +1,66 @@
+package main
+
+import "sync"
+
+// pathLocks serializes the changes to a file: creating, replacing or deleting
+// it and every chunk of a resumable upload. Changes to different paths still
+// run in parallel. Preconditions are checked with the lock held, so a write
+// and a conditional delete of the same path can't interleave between check
+// and change.
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	users int
+}
+
+var filePathLocks = &pathLocks{locks: make(map[string]*pathLock)}
+
+// lock locks path and returns the function unlocking it. Locks are dropped
+// once nobody holds or waits for them.
+func (l *pathLocks) lock(path string) (unlock func()) {
+	l.mu.Lock()
+	pl, found := l.locks[path]
+	if !found {
+		pl = &pathLock{}
+		l.locks[path] = pl
+	}
+	pl.users++
+	l.mu.Unlock()
+
+	pl.Lock()
+	return l.unlocker(path, pl)
+}
+
+// tryLock is lock without waiting: it reports false when path is already
+// locked, and there is nothing to unlock then.
+func (l *pathLocks) tryLock(path string) (unlock func(), ok bool) {
+	l.mu.Lock()
+	pl, found := l.locks[path]
+	if !found {
+		pl = &pathLock{}
+		l.locks[path] = pl
+	}
+	if !pl.TryLock() {
+		l.mu.Unlock()
+		return nil, false
+	}
+	pl.users++
+	l.mu.Unlock()
+	return l.unlocker(path, pl), true
+}
+
+func (l *pathLocks) unlocker(path string, pl *pathLock) func() {
+	return func() {
+		pl.Unlock()
+		l.mu.Lock()
+		pl.users--
+		if pl.users == 0 {
+			delete(l.locks, path)
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPathLocks(t *testing.T) {
+	locks := &pathLocks{locks: make(map[string]*pathLock)}
+
+	// One holder at a time per path
+	var holders, most atomic.Int32
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := locks.lock("same")
+			n := holders.Add(1)
+			for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+			}
+			time.Sleep(time.Millisecond)
+			holders.Add(-1)
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if most.Load() != 1 {
+		t.Errorf("%d holders of one path at once", most.Load())
+	}
+
+	// Other paths don't wait, the same one can't be tried
+	unlock := locks.lock("a")
+	done := make(chan struct{})
+	go func() {
+		locks.lock("b")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("locking b waited for a")
+	}
+	if _, ok := locks.tryLock("a"); ok {
+		t.Error("tryLock of a locked path succeeded")
+	}
+	unlock()
+	unlockA, ok := locks.tryLock("a")
+	if !ok {
+		t.Fatal("tryLock of an unlocked path failed")
+	}
+	unlockA()
+
+	if len(locks.locks) != 0 {
+		t.Errorf("%d locks left once all were unlocked", len(locks.locks))
+	}
+}
+
+// Writers replacing one file all at once leave it with the content of one
+// of them, and no temporary file behind.
+func TestConcurrentWritesSamePath(t *testing.T) {
+	dir := t.TempDir()
+	_, addr := startServer(t, fileRouter(dir))
+
+	const writers = 20
+	payloads := make(map[string]bool, writers)
+	var wg sync.WaitGroup
+	for i := range writers {
+		payload := strings.Repeat(fmt.Sprintf("writer %d;", i), 4<<10)
+		payloads[payload] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := Dial(addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+			req := newTestRequest("PUT", "/files/shared.txt")
+			req.Body = payload
+			res, err := c.Do(req)
+			if err != nil {
+				t.Error(err)
+			} else if res.StatusCode != 201 {
+				t.Errorf("writer %d: got %d", i, res.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := os.ReadFile(filepath.Join(dir, "shared.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !payloads[string(got)] {
+		t.Errorf("the file (%d bytes) is not the payload of any one writer", len(got))
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d entries in the directory, want the file alone", len(entries))
+	}
+}
+
+// A PUT replacing a file and a DELETE conditioned on the version it
+// replaces end one way or the other: the delete goes first and the PUT
+// creates the file anew, or the PUT goes first and the delete fails.
+// Either way the new content is what's left.
+func TestPutConditionalDeleteRace(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "doc.txt")
+	_, addr := startServer(t, fileRouter(dir))
+	put, del := dial(t, addr), dial(t, addr)
+
+	outcomes := make(map[int]int)
+	for round := range 50 {
+		old := fmt.Sprintf("version %d", round)
+		if err := os.WriteFile(filePath, []byte(old), 0644); err != nil {
+			t.Fatal(err)
+		}
+		etag, err := fileETag(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var putRes, delRes *Response
+		var putErr, delErr error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			req := newTestRequest("PUT", "/files/doc.txt")
+			req.Body = old + " updated"
+			putRes, putErr = put.Do(req)
+		}()
+		go func() {
+			defer wg.Done()
+			delRes, delErr = del.Do(newTestRequest("DELETE", "/files/doc.txt", "If-Match", etag))
+		}()
+		wg.Wait()
+		if putErr != nil || delErr != nil {
+			t.Fatal(putErr, delErr)
+		}
+
+		got, err := os.ReadFile(filePath)
+		switch {
+		case putRes.StatusCode != 201:
+			t.Errorf("round %d: PUT got %d", round, putRes.StatusCode)
+		case delRes.StatusCode != 204 && delRes.StatusCode != 412:
+			t.Errorf("round %d: DELETE got %d", round, delRes.StatusCode)
+		case err != nil || string(got) != old+" updated":
+			t.Errorf("round %d: DELETE %d left %q, %v", round, delRes.StatusCode, got, err)
+		}
+		outcomes[delRes.StatusCode]++
+	}
+	t.Logf("DELETE outcomes: %v", outcomes)
+}
+
+// With ConflictOnBusyWrite, an upload finding another one in progress on
+// its path is refused with a 409, and the first one completes untouched.
+func TestConflictOnBusyWrite(t *testing.T) {
+	dir := t.TempDir()
+	router := &Router{}
+	fs := NewFileServer("/files/", dir)
+	fs.ConflictOnBusyWrite = true
+	router.HandlePrefix(fs.Prefix, fs.Handle, fs.Methods()...).Stream()
+	_, addr := startServer(t, router)
+
+	// The first upload sends half its body, holding the path meanwhile
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	first.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(first, "PUT /files/busy.txt HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\nfirst")
+	filePath := filepath.Join(dir, "busy.txt")
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		unlock, ok := filePathLocks.tryLock(filePath)
+		if !ok {
+			break
+		}
+		unlock()
+		if time.Now().After(deadline) {
+			t.Fatal("the first upload never took the path")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	c := dial(t, addr)
+	for _, target := range []string{"/files/busy.txt", "/files/other.txt"} {
+		req := newTestRequest("PUT", target)
+		req.Body = "second"
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 409
+		if target == "/files/other.txt" {
+			want = 201
+		}
+		if res.StatusCode != want {
+			t.Errorf("PUT %s during the first upload: got %d, want %d", target, res.StatusCode, want)
+		}
+	}
+
+	io.WriteString(first, " half")
+	if res, err := ReadResponse(bufio.NewReader(first), "PUT"); err != nil || res.StatusCode != 201 {
+		t.Fatalf("first upload: %v, %+v", err, res)
+	}
+	if got, _ := os.ReadFile(filePath); string(got) != "first half" {
+		t.Errorf("got %q", got)
+	}
+	// Once it's done the path takes writes again
+	req := newTestRequest("PUT", "/files/busy.txt")
+	req.Body = "second"
+	if res, err := c.Do(req); err != nil || res.StatusCode != 201 {
+		t.Errorf("PUT after the first upload: %v, %+v", err, res)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pprofRouter(t *testing.T, allow []string) *Router {
+	t.Helper()
+	allowlist, err := IPAllowlist(allow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := &Router{AutoHEAD: true}
+	router.HandlePrefix("/debug/pprof/", pprofHandler(), "GET", "POST").Guard(AsGuard(allowlist))
+	return router
+}
+
+func TestPprofGoroutineDump(t *testing.T) {
+	_, addr := startServer(t, pprofRouter(t, LoopbackNetworks))
+	c := dial(t, addr)
+
+	res, err := c.Do(newTestRequest("GET", "/debug/pprof/goroutine?debug=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 || !strings.HasPrefix(res.Body, "goroutine profile: total ") || !strings.Contains(res.Body, "handleConnection") {
+		t.Errorf("got %d %.200q", res.StatusCode, res.Body)
+	}
+	if res, err = c.Do(newTestRequest("GET", "/debug/pprof/")); err != nil || !strings.Contains(res.Body, "heap") {
+		t.Errorf("index: %v, %+v", err, res)
+	}
+}
+
+func TestPprofOutsideAllowlist(t *testing.T) {
+	_, addr := startServer(t, pprofRouter(t, []string{"192.0.2.0/24"}))
+	c := dial(t, addr)
+
+	res, err := c.Do(newTestRequest("GET", "/debug/pprof/goroutine?debug=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 403 || strings.Contains(res.Body, "goroutine") {
+		t.Errorf("got %d %.200q", res.StatusCode, res.Body)
+	}
+}
+
+// What a net/http handler writes reaches the client before it returns, as
+// the CPU profile needs.
+func TestHTTPHandlerStreams(t *testing.T) {
+	release := make(chan struct{})
+	router := &Router{}
+	router.HandleExact("/progressive", HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second\n"))
+	})), "GET")
+	_, addr := startServer(t, router)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /progressive HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var head strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%v after %q", err, head.String())
+		}
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	if !strings.HasPrefix(head.String(), "HTTP/1.1 200 OK\r\n") || !strings.Contains(strings.ToLower(head.String()), "transfer-encoding: chunked") {
+		t.Fatalf("head %q", head.String())
+	}
+	// The first chunk comes while the handler is still waiting
+	size, _ := reader.ReadString('\n')
+	chunk, _ := reader.ReadString('\n')
+	if size != "6\r\n" || chunk != "first\n" {
+		t.Errorf("first chunk: %q %q", size, chunk)
+	}
+	close(release)
+	res, err := readAfterChunk(reader)
+	if err != nil || res != "second\n" {
+		t.Errorf("rest: %q, %v", res, err)
+	}
+}
+
+// readAfterChunk reads the chunks left of a chunked body, past the CRLF
+// ending the one already read.
+func readAfterChunk(reader *bufio.Reader) (string, error) {
+	if _, err := reader.ReadString('\n'); err != nil {
+		return "", err
+	}
+	body, err := readChunked(reader, 1<<20)
+	return string(body), err
+}
+
+// A handler whose body isn't sent, as for a HEAD, has its writes fail
+// instead of blocking forever.
+func TestHTTPHandlerStoppedWithoutBody(t *testing.T) {
+	stopped := make(chan struct{})
+	router := &Router{AutoHEAD: true}
+	router.HandleExact("/endless", HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(stopped)
+		for {
+			if _, err := w.Write([]byte("more\n")); err != nil {
+				return
+			}
+		}
+	})), "GET")
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	res, err := c.Do(newTestRequest("HEAD", "/endless"))
+	if err != nil || res.StatusCode != 200 {
+		t.Fatalf("%v, %+v", err, res)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Error("the handler is still writing")
+	}
+}
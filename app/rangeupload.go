@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// contentRange is a parsed "Content-Range: bytes start-end/total" header.
+type contentRange struct {
+	start, end, total int64
+}
+
+func parseContentRange(value string) (contentRange, error) {
+	var cr contentRange
+	spec, ok := strings.CutPrefix(strings.TrimSpace(value), "bytes ")
+	if !ok {
+		return cr, errors.New("unsupported range unit")
+	}
+	rng, total, ok := strings.Cut(spec, "/")
+	if !ok {
+		return cr, errors.New("missing complete length")
+	}
+	first, last, ok := strings.Cut(rng, "-")
+	if !ok {
+		return cr, errors.New("invalid byte range")
+	}
+
+	var err error
+	if cr.start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return cr, err
+	}
+	if cr.end, err = strconv.ParseInt(last, 10, 64); err != nil {
+		return cr, err
+	}
+	if cr.total, err = strconv.ParseInt(total, 10, 64); err != nil {
+		return cr, err
+	}
+	if cr.start < 0 || cr.end < cr.start || cr.end >= cr.total {
+		return cr, errors.New("invalid byte range")
+	}
+	return cr, nil
+}
+
+// partialUploadTTL is how long an upload nobody adds to is kept before its
+// staging file is removed.
+const partialUploadTTL = time.Hour
+
+// partialUpload tracks which bytes of a file have been received so far.
+// They are written to a staging file that replaces the file once complete.
+type partialUpload struct {
+	total   int64
+	created bool
+	ranges  [][2]int64 // sorted, non-overlapping, inclusive
+	staging string
+	updated time.Time
+	// digests are the ones last announced, checked once every byte is in
+	digests uploadDigests
+}
+
+// stagingPath is where the bytes of an upload to filePath are gathered,
+// next to it so the final rename stays on the same file system.
+func stagingPath(filePath string) string {
+	return filepath.Join(filepath.Dir(filePath), "."+filepath.Base(filePath)+".upload")
+}
+
+func (u *partialUpload) add(start, end int64) {
+	u.ranges = append(u.ranges, [2]int64{start, end})
+	sort.Slice(u.ranges, func(i, j int) bool { return u.ranges[i][0] < u.ranges[j][0] })
+
+	merged := u.ranges[:1]
+	for _, r := range u.ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r[0] <= last[1]+1 {
+			last[1] = max(last[1], r[1])
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	u.ranges = merged
+}
+
+func (u *partialUpload) complete() bool {
+	return len(u.ranges) == 1 && u.ranges[0][0] == 0 && u.ranges[0][1] == u.total-1
+}
+
+var (
+	partialUploadsMu sync.Mutex
+	partialUploads   = make(map[string]*partialUpload)
+)
+
+// expirePartialUploads forgets the uploads idle for longer than
+// partialUploadTTL and removes their staging files. partialUploadsMu must
+// be held, so no upload to the same path starts over meanwhile.
+func expirePartialUploads(now time.Time) {
+	for filePath, upload := range partialUploads {
+		if now.Sub(upload.updated) > partialUploadTTL {
+			os.Remove(upload.staging)
+			delete(partialUploads, filePath)
+		}
+	}
+}
+
+// isStagingName reports whether name is the one of a staging file, of a
+// resumable upload or of an atomic write.
+func isStagingName(name string) bool {
+	return strings.HasPrefix(name, ".") && (strings.HasSuffix(name, ".upload") || strings.Contains(name, ".tmp-"))
+}
+
+// RemoveStaleUploads removes the staging files under root untouched for
+// longer than partialUploadTTL. partialUploads only lives in memory, so
+// the uploads abandoned before a restart are only found this way.
+func RemoveStaleUploads(root string, now time.Time) error {
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil && path == root {
+			return err
+		}
+		if err != nil || entry.IsDir() || !isStagingName(entry.Name()) {
+			// What can't be read is left alone, the rest is still walked
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && now.Sub(info.ModTime()) > partialUploadTTL {
+			if err := os.Remove(path); err != nil {
+				fmt.Println("Error removing stale upload: ", err.Error())
+			}
+		}
+		return nil
+	})
+}
+
+// fileETag computes the ETag the ETag middleware gives the content of filePath.
+func fileETag(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	var sum [sha256.Size]byte
+	hash.Sum(sum[:0])
+	return contentETag(sum), nil
+}
+
+// verify reads the staging file through the digests announced for the
+// upload, if any.
+func (u *partialUpload) verify() error {
+	if len(u.digests) == 0 {
+		return nil
+	}
+	f, err := os.Open(u.staging)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(u.digests.writer(), f); err != nil {
+		return err
+	}
+	return u.digests.verify()
+}
+
+// fileRangeUploadHandler writes the body of a request carrying a Content-Range
+// at the right offset. It answers 308 Resume Incomplete until every byte has
+// been received, then moves the file into place and answers 201 Created (or
+// 200 OK when replacing a file) with its ETag. Chunks may come in any order
+// and be sent again. A Content-MD5 or Repr-Digest describes the whole file,
+// whichever chunk carries it, and is checked against the final assembly.
+func fileRangeUploadHandler(req *Request, res *Response, filePath string, value string) {
+	if !bufferBody(req, res) {
+		return
+	}
+	cr, err := parseContentRange(value)
+	if err != nil || int64(len(req.Body)) != cr.end-cr.start+1 {
+		res.StatusCode = 400
+		res.ReasonPhrase = "Bad Request"
+		return
+	}
+	digests, err := parseUploadDigests(req.Headers)
+	if err != nil {
+		fmt.Println("Error reading upload digest: ", err.Error())
+		res.StatusCode = 400
+		res.ReasonPhrase = "Bad Request"
+		return
+	}
+
+	// The path lock covers the whole change, as for every other change to
+	// the file. partialUploadsMu only guards the map, so uploads to
+	// different paths proceed in parallel.
+	unlock := filePathLocks.lock(filePath)
+	defer unlock()
+	now := req.now()
+	partialUploadsMu.Lock()
+	expirePartialUploads(now)
+	upload, found := partialUploads[filePath]
+	if found {
+		// Refreshed while the map is held, so no sweep expires it meanwhile
+		upload.updated = now
+	}
+	partialUploadsMu.Unlock()
+	if found && upload.total != cr.total {
+		res.StatusCode = 400
+		res.ReasonPhrase = "Bad Request"
+		return
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if !found {
+		_, statErr := os.Stat(filePath)
+		upload = &partialUpload{
+			total:   cr.total,
+			created: errors.Is(statErr, os.ErrNotExist),
+			staging: stagingPath(filePath),
+		}
+		upload.updated = now
+		flags |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(upload.staging, flags, 0644)
+	if err == nil {
+		_, err = f.WriteAt([]byte(req.Body), cr.start)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Printf("Error writing file: %v\n", err)
+		res.StatusCode = 500
+		res.ReasonPhrase = "Internal Server Error"
+		return
+	}
+
+	upload.add(cr.start, cr.end)
+	if len(digests) > 0 {
+		upload.digests = digests
+	}
+	if !upload.complete() {
+		partialUploadsMu.Lock()
+		partialUploads[filePath] = upload
+		partialUploadsMu.Unlock()
+		res.StatusCode = 308
+		res.ReasonPhrase = "Resume Incomplete"
+		if first := upload.ranges[0]; first[0] == 0 {
+			res.Headers.Set("Range", fmt.Sprintf("bytes=0-%d", first[1]))
+		}
+		return
+	}
+
+	partialUploadsMu.Lock()
+	delete(partialUploads, filePath)
+	partialUploadsMu.Unlock()
+	if err := upload.verify(); err != nil {
+		os.Remove(upload.staging)
+		fmt.Println("Rejected upload: ", err.Error())
+		var mismatch *digestMismatchError
+		if errors.As(err, &mismatch) {
+			res.StatusCode = mismatch.statusCode()
+		} else {
+			res.StatusCode = 500
+		}
+		res.ReasonPhrase = StatusText(res.StatusCode)
+		return
+	}
+	etag, err := fileETag(upload.staging)
+	if err == nil {
+		err = os.Rename(upload.staging, filePath)
+	}
+	if err != nil {
+		os.Remove(upload.staging)
+		fmt.Printf("Error writing file: %v\n", err)
+		res.StatusCode = 500
+		res.ReasonPhrase = "Internal Server Error"
+		return
+	}
+	res.Headers.Set("ETag", etag)
+	upload.digests.echo(res.Headers)
+	if upload.created {
+		res.StatusCode = 201
+		res.ReasonPhrase = "Created"
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Writers racing on one path each upload a whole file in a single range:
+// whoever finishes last wins, but the file is never a mix of two of them.
+func TestRangeUploadConcurrentWriters(t *testing.T) {
+	dir := t.TempDir()
+	_, addr := startServer(t, fileRouter(dir))
+
+	const writers, size = 50, 64 << 10
+	payloads := make(map[string]bool, writers)
+	var wg sync.WaitGroup
+	for i := range writers {
+		payload := strings.Repeat(string(rune('A'+i%26))+fmt.Sprint(i), size)[:size]
+		payloads[payload] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := Dial(addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+			req := newTestRequest("PUT", "/files/same.txt",
+				"Content-Range", fmt.Sprintf("bytes 0-%d/%d", size-1, size))
+			req.Body = payload
+			res, err := c.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if res.StatusCode != 200 && res.StatusCode != 201 {
+				t.Errorf("writer %d: got %d", i, res.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := os.ReadFile(filepath.Join(dir, "same.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !payloads[string(got)] {
+		t.Errorf("the file (%d bytes) is not the payload of any one writer", len(got))
+	}
+	if _, err := os.Stat(stagingPath(filepath.Join(dir, "same.txt"))); !os.IsNotExist(err) {
+		t.Errorf("staging file left behind: %v", err)
+	}
+}
+
+// Uploads to different paths, sent in pieces, go on side by side and each
+// ends with its own content.
+func TestRangeUploadDifferentPaths(t *testing.T) {
+	dir := t.TempDir()
+	_, addr := startServer(t, fileRouter(dir))
+
+	const files, pieces, pieceSize = 10, 4, 1 << 10
+	var wg sync.WaitGroup
+	for i := range files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := Dial(addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+			piece := strings.Repeat(fmt.Sprint(i%10), pieceSize)
+			for p := range pieces {
+				req := newTestRequest("PATCH", fmt.Sprintf("/files/f%d.txt", i),
+					"Content-Range", fmt.Sprintf("bytes %d-%d/%d", p*pieceSize, (p+1)*pieceSize-1, pieces*pieceSize))
+				req.Body = piece
+				res, err := c.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				want := 308
+				if p == pieces-1 {
+					want = 201
+				}
+				if res.StatusCode != want {
+					t.Errorf("f%d piece %d: got %d, want %d", i, p, res.StatusCode, want)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range files {
+		got, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("f%d.txt", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.Repeat(fmt.Sprint(i%10), pieces*pieceSize); string(got) != want {
+			t.Errorf("f%d.txt: got %d bytes, not its own content", i, len(got))
+		}
+	}
+}
+
+func TestRangeUploadOutOfOrder(t *testing.T) {
+	dir := t.TempDir()
+	_, addr := startServer(t, fileRouter(dir))
+	c := dial(t, addr)
+	content := "aaaabbbbcccc"
+
+	steps := []struct {
+		first, last int
+		status      int
+		wantRange   string
+	}{
+		{8, 11, 308, ""},
+		{0, 3, 308, "bytes=0-3"},
+		// Sent again, the chunk changes nothing
+		{0, 3, 308, "bytes=0-3"},
+		{4, 7, 201, ""},
+	}
+	for _, step := range steps {
+		req := newTestRequest("PATCH", "/files/three.txt",
+			"Content-Range", fmt.Sprintf("bytes %d-%d/%d", step.first, step.last, len(content)))
+		req.Body = content[step.first : step.last+1]
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotRange, _ := res.Headers.Get("Range")
+		if res.StatusCode != step.status || gotRange != step.wantRange {
+			t.Errorf("bytes %d-%d: got %d, Range %q, want %d, Range %q", step.first, step.last, res.StatusCode, gotRange, step.status, step.wantRange)
+		}
+		if res.StatusCode == 201 {
+			want, _ := fileETag(filepath.Join(dir, "three.txt"))
+			if etag, _ := res.Headers.Get("ETag"); etag == "" || etag != want {
+				t.Errorf("ETag %q, want %q", etag, want)
+			}
+		}
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "three.txt")); err != nil || string(got) != content {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d entries in the directory, want the file alone", len(entries))
+	}
+}
+
+func TestRangeUploadRejects(t *testing.T) {
+	_, addr := startServer(t, fileRouter(t.TempDir()))
+	c := dial(t, addr)
+	send := func(contentRange, body string) int {
+		t.Helper()
+		req := newTestRequest("PATCH", "/files/bad.txt", "Content-Range", contentRange)
+		req.Body = body
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode
+	}
+
+	if status := send("bytes 0-3/8", "abcd"); status != 308 {
+		t.Fatalf("first chunk: got %d", status)
+	}
+	for _, tt := range []struct{ name, contentRange, body string }{
+		{"total changed", "bytes 4-7/9", "efgh"},
+		{"beyond the total", "bytes 6-9/8", "ghij"},
+		{"body of another length", "bytes 4-7/8", "ef"},
+		{"other unit", "items 4-7/8", "efgh"},
+	} {
+		if status := send(tt.contentRange, tt.body); status != 400 {
+			t.Errorf("%s: got %d, want 400", tt.name, status)
+		}
+	}
+}
+
+// The staging files live next to the files, but no request reaches them.
+func TestStagingFilesHidden(t *testing.T) {
+	dir := t.TempDir()
+	router := &Router{AutoHEAD: true}
+	fs := NewFileServer("/files/", dir)
+	fs.WebDAV = true
+	router.HandlePrefix(fs.Prefix, fs.Handle, fs.Methods()...).Stream()
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	req := newTestRequest("PATCH", "/files/big.txt", "Content-Range", "bytes 0-3/8")
+	req.Body = "half"
+	if res, err := c.Do(req); err != nil || res.StatusCode != 308 {
+		t.Fatalf("first half: %v, %+v", err, res)
+	}
+	staging := filepath.Base(stagingPath(filepath.Join(dir, "big.txt")))
+	if _, err := os.Stat(filepath.Join(dir, staging)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{"GET", "PUT", "DELETE", "PROPFIND"} {
+		res, err := c.Do(newTestRequest(method, "/files/"+staging, "Depth", "0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 403 {
+			t.Errorf("%s of the staging file: got %d, want 403", method, res.StatusCode)
+		}
+	}
+	for _, headers := range [][]string{{"Accept", "text/html"}, {"Accept", "application/json"}, {"Depth", "1"}} {
+		method := "GET"
+		if headers[0] == "Depth" {
+			method = "PROPFIND"
+		}
+		res, err := c.Do(newTestRequest(method, "/files/", headers...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(res.Body, staging) {
+			t.Errorf("%s %v lists the staging file: %s", method, headers, res.Body)
+		}
+	}
+}
+
+func TestRemoveStaleUploads(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	old := now.Add(-partialUploadTTL - time.Minute)
+	files := []struct {
+		name    string
+		modTime time.Time
+		kept    bool
+	}{
+		{".stale.txt.upload", old, false},
+		{".stale.txt.tmp-123", old, false},
+		{".fresh.txt.upload", now, true},
+		{"old.txt", old, true},
+		{".profile", old, true},
+	}
+	for _, f := range files {
+		name := filepath.Join(dir, f.name)
+		if err := os.WriteFile(name, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, f.modTime, f.modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := RemoveStaleUploads(dir, now); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(dir, f.name))
+		if kept := err == nil; kept != f.kept {
+			t.Errorf("%s: kept %v, want %v", f.name, kept, f.kept)
+		}
+	}
+	if err := RemoveStaleUploads(filepath.Join(dir, "missing"), now); err == nil {
+		t.Error("no error for a missing root")
+	}
+}
+
+// Two PUTs fill a file in. The file only changes once it is complete: a
+// new one is then 201 Created, a replaced one 200 OK.
+func TestRangeUploadTwoPieces(t *testing.T) {
+	dir := t.TempDir()
+	_, addr := startServer(t, fileRouter(dir))
+	c := dial(t, addr)
+	put := func(name, contentRange, body string) *Response {
+		t.Helper()
+		req := newTestRequest("PUT", "/files/"+name, "Content-Range", contentRange)
+		req.Body = body
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	os.WriteFile(filepath.Join(dir, "old.txt"), []byte("old"), 0644)
+	for name, complete := range map[string]int{"new.txt": 201, "old.txt": 200} {
+		if res := put(name, "bytes 0-4/10", "01234"); res.StatusCode != 308 {
+			t.Fatalf("%s, first piece: got %d", name, res.StatusCode)
+		}
+		if got, err := os.ReadFile(filepath.Join(dir, name)); name == "new.txt" && err == nil || name == "old.txt" && string(got) != "old" {
+			t.Errorf("%s changed before it was complete: %q, %v", name, got, err)
+		}
+		if res := put(name, "bytes 5-9/10", "56789"); res.StatusCode != complete {
+			t.Errorf("%s, second piece: got %d, want %d", name, res.StatusCode, complete)
+		}
+		if got, _ := os.ReadFile(filepath.Join(dir, name)); string(got) != "0123456789" {
+			t.Errorf("%s: got %q", name, got)
+		}
+	}
+}
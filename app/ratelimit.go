@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket holds the requests a client may still make, refilled over time.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimit lets each client IP make rate requests per second on average,
+// in bursts of up to burst, and answers 429 Too Many Requests with a
+// Retry-After to the rest. It decides from the request head alone, so as a
+// Guard it turns an upload down before its body is sent.
+func RateLimit(rate float64, burst int) Middleware {
+	var mu sync.Mutex
+	buckets := make(map[string]*tokenBucket)
+	// A bucket left alone this long is full again, as good as a new one
+	refill := time.Duration(float64(burst) / rate * float64(time.Second))
+	var swept time.Time
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *Request, res *Response) {
+			now := req.now()
+			ip := remoteIP(req.RemoteAddr)
+
+			mu.Lock()
+			if now.Sub(swept) > refill {
+				for key, b := range buckets {
+					if now.Sub(b.last) > refill {
+						delete(buckets, key)
+					}
+				}
+				swept = now
+			}
+			b, found := buckets[ip]
+			if !found {
+				b = &tokenBucket{tokens: float64(burst), last: now}
+				buckets[ip] = b
+			}
+			b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+			b.last = now
+			allowed := b.tokens >= 1
+			if allowed {
+				b.tokens--
+			}
+			wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+			mu.Unlock()
+
+			if !allowed {
+				res.StatusCode = 429
+				res.ReasonPhrase = StatusText(429)
+				setRetryAfter(res, wait)
+				return
+			}
+			next(req, res)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Clients over the limit get their 429 in answer to the head of their
+// upload, before they send the body.
+func TestRateLimitBeforeBody(t *testing.T) {
+	dir := t.TempDir()
+	clock := newFakeClock(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC))
+	router := &Router{AutoHEAD: true}
+	fs := NewFileServer("/files/", dir)
+	router.HandlePrefix(fs.Prefix, fs.Handle, fs.Methods()...).Stream().Guard(AsGuard(RateLimit(1, 2)))
+	_, addr := startServer(t, router, func(s *Server) { s.Clock = clock })
+
+	upload := func(name string) (int, string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "PUT /files/%s HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n", name)
+		res, err := ReadResponse(reader, "PUT")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 100 {
+			retryAfter, _ := res.Headers.Get("Retry-After")
+			return res.StatusCode, retryAfter
+		}
+		conn.Write([]byte("body"))
+		if res, err = ReadResponse(reader, "PUT"); err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, ""
+	}
+
+	for i, want := range []int{201, 201, 429} {
+		name := fmt.Sprintf("f%d.txt", i)
+		status, retryAfter := upload(name)
+		if status != want {
+			t.Errorf("upload %d: got %d, want %d", i, status, want)
+		}
+		_, err := os.Stat(filepath.Join(dir, name))
+		if want == 429 {
+			if retryAfter != "1" {
+				t.Errorf("Retry-After %q, want 1", retryAfter)
+			}
+			if err == nil {
+				t.Error("the rejected upload was stored")
+			}
+		} else if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// A second later the client may upload again, once
+	clock.Advance(time.Second)
+	if status, _ := upload("again.txt"); status != 201 {
+		t.Errorf("after a second: got %d, want 201", status)
+	}
+	if status, _ := upload("again2.txt"); status != 429 {
+		t.Errorf("right after: got %d, want 429", status)
+	}
+}
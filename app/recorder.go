@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// errAborted stops the producer of a recorded stream whose body isn't sent.
+var errAborted = errors.New("response aborted")
+
+// ResponseRecorder buffers streamed responses for middleware that needs the
+// whole body after the handler ran (ETag, compression, size logging).
+// Bodies larger than MaxBuffer are left streaming.
+type ResponseRecorder struct {
+	MaxBuffer int
+}
+
+// NewResponseRecorder creates a ResponseRecorder buffering at most maxBuffer bytes.
+func NewResponseRecorder(maxBuffer int) *ResponseRecorder {
+	return &ResponseRecorder{MaxBuffer: maxBuffer}
+}
+
+// Record makes res.Body hold the complete body, draining res.Stream if needed.
+// It reports false when the streamed body is bigger than MaxBuffer; res then
+// still streams the complete body, including the bytes already read.
+func (rr *ResponseRecorder) Record(res *Response) (bool, error) {
+	if res.Stream == nil {
+		return true, nil
+	}
+
+	stream := res.Stream
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(stream(pw))
+	}()
+
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, pr, int64(rr.MaxBuffer)+1)
+	if err == io.EOF {
+		res.Stream = nil
+		res.Body = buf.String()
+		res.Headers.Set("Content-Length", strconv.Itoa(buf.Len()))
+		return true, nil
+	}
+	if err != nil {
+		pr.CloseWithError(err)
+		return false, err
+	}
+
+	// Too big: replay what was read and keep streaming the rest. If that
+	// never happens, the producer must still be let go.
+	res.onAbort(func() { pr.CloseWithError(errAborted) })
+	res.Stream = func(w io.Writer) error {
+		defer pr.Close()
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, pr)
+		return err
+	}
+	return false, nil
+}
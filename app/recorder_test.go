@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamOf streams body in pieces of 4 bytes.
+func streamOf(body string) func(io.Writer) error {
+	return func(w io.Writer) error {
+		for i := 0; i < len(body); i += 4 {
+			if _, err := io.WriteString(w, body[i:min(i+4, len(body))]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func TestETagBufferedAndStreamed(t *testing.T) {
+	small, big := "hello etag", strings.Repeat("x", 100)
+	router := &Router{AutoHEAD: true}
+	for path, handler := range map[string]HandlerFunc{
+		"/buffered":     func(req *Request, res *Response) { res.Body = small },
+		"/small-stream": func(req *Request, res *Response) { res.Stream = streamOf(small) },
+		"/big-stream":   func(req *Request, res *Response) { res.Stream = streamOf(big) },
+	} {
+		router.HandleExact(path, Chain(handler, ETag(16)), "GET")
+	}
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	var smallTag string
+	for _, tt := range []struct {
+		path, body string
+		tagged     bool
+	}{
+		{"/buffered", small, true},
+		{"/small-stream", small, true},
+		{"/big-stream", big, false},
+	} {
+		res, err := c.Do(newTestRequest("GET", tt.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		etag, found := res.Headers.Get("ETag")
+		if res.StatusCode != 200 || res.Body != tt.body || found != tt.tagged {
+			t.Errorf("%s: got %d, %d bytes, ETag %q", tt.path, res.StatusCode, len(res.Body), etag)
+		}
+		if tt.path == "/buffered" {
+			smallTag = etag
+		} else if tt.tagged && etag != smallTag {
+			t.Errorf("%s: ETag %q, want the one of the same buffered body %q", tt.path, etag, smallTag)
+		}
+	}
+
+	res, err := c.Do(newTestRequest("GET", "/small-stream", "If-None-Match", smallTag))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 304 || res.Body != "" {
+		t.Errorf("If-None-Match: got %d %q", res.StatusCode, res.Body)
+	}
+}
+
+// A stream too big to buffer whose body is never sent has its producer let go.
+func TestResponseRecorderRelease(t *testing.T) {
+	produced := make(chan error, 1)
+	res := NewResponse()
+	res.Stream = func(w io.Writer) error {
+		for i := 0; ; i++ {
+			if _, err := fmt.Fprintf(w, "line %d\n", i); err != nil {
+				produced <- err
+				return err
+			}
+		}
+	}
+	buffered, err := NewResponseRecorder(64).Record(res)
+	if err != nil || buffered {
+		t.Fatalf("Record: %v, buffered %v", err, buffered)
+	}
+	res.release()
+	select {
+	case err := <-produced:
+		if !errors.Is(err, errAborted) {
+			t.Errorf("the producer stopped with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the producer is still blocked")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reopenableFile is an append-only writer over a file that can be reopened
+// in place, so log rotation tools can rename it from under us.
+type reopenableFile struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openReopenableFile(path string) (*reopenableFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &reopenableFile{path: path, f: f}, nil
+}
+
+func (r *reopenableFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Write(p)
+}
+
+// Reopen swaps the underlying file for a freshly opened one at the same path.
+// On error the old file stays in use.
+func (r *reopenableFile) Reopen() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	old := r.f
+	r.f = f
+	r.mu.Unlock()
+	return old.Close()
+}
+
+// certReloader hands out the current TLS certificate and can replace it with
+// the one on disk. Only new handshakes see the replacement.
+type certReloader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the certificate and key again. On error the old pair stays in use.
+func (c *certReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// OpenAccessLog makes the access log append to the file at path.
+// Reload reopens it.
+func (s *Server) OpenAccessLog(path string) error {
+	f, err := openReopenableFile(path)
+	if err != nil {
+		return err
+	}
+	s.logFile = f
+	s.AccessLog = f
+	return nil
+}
+
+// ServeTLS is like Serve but runs TLS on top of l, using the given
+// certificate and key. Reload picks up renewed files.
+func (s *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	s.certs = certs
+	return s.Serve(tls.NewListener(l, &tls.Config{GetCertificate: certs.GetCertificate}))
+}
+
+// handshake completes the TLS handshake of conn within HandshakeTimeout, so
+// a client stalling it doesn't hold the connection. Plain connections are
+// left alone.
+func (s *Server) handshake(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if s.HandshakeTimeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+		defer tlsConn.SetDeadline(time.Time{})
+	}
+	err := tlsConn.Handshake()
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &recordErr) && recordErr.Conn != nil && looksLikeHTTP(recordErr.RecordHeader[:]) {
+		// Answer in plain text, a TLS alert means nothing to an HTTP client
+		recordErr.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		recordErr.Conn.Write([]byte(plainHTTPOnTLSResponse))
+		recordErr.Conn.Close()
+		return errors.New("plain HTTP request on the TLS port")
+	}
+	return err
+}
+
+// plainHTTPOnTLSResponse answers a plain HTTP request sent to the TLS port.
+const plainHTTPOnTLSResponse = "HTTP/1.1 400 Bad Request\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Connection: close\r\n" +
+	"Content-Length: 34\r\n" +
+	"\r\n" +
+	"This port expects HTTPS, not HTTP\n"
+
+// looksLikeHTTP reports whether the first bytes of a connection, the ones
+// the TLS stack read as a record header, start an HTTP request line.
+func looksLikeHTTP(prefix []byte) bool {
+	for _, method := range knownMethods {
+		m := method + " "
+		if len(m) > len(prefix) {
+			m = m[:len(prefix)]
+		}
+		if strings.HasPrefix(string(prefix), m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload reopens the access log file and reloads the TLS certificate, if
+// either is configured. Whatever fails to reload keeps its previous state.
+func (s *Server) Reload() error {
+	var errs []error
+	if s.logFile != nil {
+		if err := s.logFile.Reopen(); err != nil {
+			errs = append(errs, fmt.Errorf("reopening access log: %w", err))
+		}
+	}
+	if s.certs != nil {
+		if err := s.certs.Reload(); err != nil {
+			errs = append(errs, fmt.Errorf("reloading TLS certificate: %w", err))
+		}
+	}
+	err := errors.Join(errs...)
+	if err != nil {
+		fmt.Println("RELOAD FAILED, keeping the previous state: ", err.Error())
+	}
+	return err
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForLines waits until the file at path holds n lines, then returns them.
+func waitForLines(t *testing.T, path string, n int) []string {
+	t.Helper()
+	var lines []string
+	for range 100 {
+		data, _ := os.ReadFile(path)
+		if lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"); len(data) > 0 && len(lines) >= n {
+			return lines
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s: want %d lines, got %q", path, n, lines)
+	return nil
+}
+
+// After logrotate renamed the log, a reload starts a new file at the path.
+// A reload that can't open it keeps writing to the old one.
+func TestReloadAccessLog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	s, addr := startServer(t, echoRouter(), func(s *Server) {
+		if err := s.OpenAccessLog(path); err != nil {
+			t.Fatal(err)
+		}
+	})
+	c := dial(t, addr)
+	request := func(value string) {
+		t.Helper()
+		if _, err := c.Do(newTestRequest("GET", "/echo/"+value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	request("before")
+	waitForLines(t, path, 1)
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	request("after")
+	if lines := waitForLines(t, path, 1); len(lines) != 1 || !strings.Contains(lines[0], "/echo/after") {
+		t.Errorf("new log: %q", lines)
+	}
+	if lines := waitForLines(t, rotated, 1); len(lines) != 1 || !strings.Contains(lines[0], "/echo/before") {
+		t.Errorf("rotated log: %q", lines)
+	}
+
+	// The path can't be opened any more: the file in use stays
+	os.Rename(path, rotated)
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Error("no error reopening a directory")
+	}
+	request("failed")
+	if lines := waitForLines(t, rotated, 2); !strings.Contains(lines[1], "/echo/failed") {
+		t.Errorf("log after the failed reload: %q", lines)
+	}
+}
+
+// New handshakes get the certificate on disk once reloaded, connections
+// already open keep going. Broken files leave the last good one in use.
+func TestReloadCertificate(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(l.Addr().String(), echoRouter())
+	s.AccessLog = nil
+	s.ShutdownGrace = time.Second
+	served := make(chan error, 1)
+	go func() { served <- s.ServeTLS(l, certFile, keyFile) }()
+	t.Cleanup(func() {
+		s.Shutdown()
+		if err := <-served; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("ServeTLS returned %v", err)
+		}
+	})
+	handshake := func() (*tls.Conn, []byte) {
+		t.Helper()
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, conn.ConnectionState().PeerCertificates[0].Raw
+	}
+
+	open, first := handshake()
+	renewedCert, renewedKey := writeTestCert(t)
+	for from, to := range map[string]string{renewedCert: certFile, renewedKey: keyFile} {
+		data, _ := os.ReadFile(from)
+		if err := os.WriteFile(to, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	_, second := handshake()
+	if bytes.Equal(first, second) {
+		t.Error("the renewed certificate isn't used")
+	}
+	c := &Client{conn: open, reader: bufio.NewReader(open)}
+	if res, err := c.Do(newTestRequest("GET", "/echo/open")); err != nil || res.Body != "open" {
+		t.Errorf("connection opened before the reload: %v, %+v", err, res)
+	}
+
+	os.WriteFile(certFile, []byte("not a certificate"), 0600)
+	if err := s.Reload(); err == nil {
+		t.Error("no error loading a broken certificate")
+	}
+	if _, third := handshake(); !bytes.Equal(second, third) {
+		t.Error("a broken certificate replaced the good one")
+	}
+}
+
+// A client stalling its TLS handshake is dropped after HandshakeTimeout,
+// while one done with it can keep the connection idle for longer.
+func TestHandshakeTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the handshake timeout")
+	}
+	certFile, keyFile := writeTestCert(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(l.Addr().String(), echoRouter())
+	s.AccessLog = nil
+	s.ShutdownGrace = time.Second
+	s.HandshakeTimeout = 200 * time.Millisecond
+	served := make(chan error, 1)
+	go func() { served <- s.ServeTLS(l, certFile, keyFile) }()
+	t.Cleanup(func() {
+		s.Shutdown()
+		if err := <-served; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("ServeTLS returned %v", err)
+		}
+	})
+
+	// The start of a ClientHello record, the rest never comes
+	stalled, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	stalled.Write([]byte{0x16, 0x03, 0x01})
+	stalled.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	_, err = stalled.Read(make([]byte, 1))
+	if isTimeout(err) || err == nil {
+		t.Fatalf("stalled handshake still open: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < s.HandshakeTimeout {
+		t.Errorf("dropped after %s, before the timeout", elapsed)
+	}
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(2 * s.HandshakeTimeout)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /echo/late HTTP/1.1\r\nHost: x\r\n\r\n")
+	if res, err := ReadResponse(bufio.NewReader(conn), "GET"); err != nil || res.Body != "late" {
+		t.Errorf("request after an idle handshaken connection: %v, %+v", err, res)
+	}
+}
+
+// A plain HTTP request on the TLS port is told what's wrong in plain text.
+func TestPlainHTTPOnTLSPort(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(l.Addr().String(), echoRouter())
+	s.AccessLog = nil
+	s.ShutdownGrace = time.Second
+	served := make(chan error, 1)
+	go func() { served <- s.ServeTLS(l, certFile, keyFile) }()
+	t.Cleanup(func() {
+		s.Shutdown()
+		if err := <-served; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("ServeTLS returned %v", err)
+		}
+	})
+
+	for _, request := range []string{"GET /echo/abc HTTP/1.1\r\nHost: x\r\n\r\n", "OPTIONS * HTTP/1.1\r\nHost: x\r\n\r\n"} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, request)
+		res, err := ReadResponse(bufio.NewReader(conn), "GET")
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 400 || res.Body != "This port expects HTTPS, not HTTP\n" || !res.Close {
+			t.Errorf("%q: got %d %q", request, res.StatusCode, res.Body)
+		}
+	}
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /echo/secure HTTP/1.1\r\nHost: x\r\n\r\n")
+	if res, err := ReadResponse(bufio.NewReader(conn), "GET"); err != nil || res.Body != "secure" {
+		t.Errorf("TLS request: %v, %+v", err, res)
+	}
+}
+
+func TestLooksLikeHTTP(t *testing.T) {
+	for _, tt := range []struct {
+		prefix string
+		want   bool
+	}{
+		{"GET /", true},
+		{"PUT /", true},
+		{"DELET", true},
+		{"PROPF", true},
+		{"GETX ", false},
+		{"get /", false},
+		{"\x16\x03\x01\x02\x00", false},
+		{"SSH-2", false},
+	} {
+		if got := looksLikeHTTP([]byte(tt.prefix)); got != tt.want {
+			t.Errorf("looksLikeHTTP(%q) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
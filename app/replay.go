@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ReplayFilter selects the captured requests to replay. Empty fields match anything.
+type ReplayFilter struct {
+	Method     string
+	PathPrefix string
+}
+
+func (f ReplayFilter) matches(req *Request) bool {
+	return (f.Method == "" || strings.EqualFold(req.Method, f.Method)) &&
+		strings.HasPrefix(req.RequestURI, f.PathPrefix)
+}
+
+// Replay runs the requests saved by a RequestCapture in dir through the
+// server, without any socket, in the order they were captured. It writes
+// one line per request to out, flagging those whose status differs from
+// the recorded one, and returns the exit code: 0 when everything matched,
+// 1 on divergences, 2 when the captures can't be read.
+//
+// Handlers really run, so replayed uploads do write files.
+func (s *Server) Replay(dir string, filter ReplayFilter, out io.Writer) int {
+	captures, err := filepath.Glob(filepath.Join(dir, "*.http"))
+	if err != nil {
+		fmt.Fprintln(out, "Error listing captures: ", err.Error())
+		return 2
+	}
+	// Capture names start with their timestamp
+	sort.Strings(captures)
+
+	replayed, diverged := 0, 0
+	for _, capture := range captures {
+		name := strings.TrimSuffix(filepath.Base(capture), ".http")
+		raw, err := os.ReadFile(capture)
+		if err != nil {
+			fmt.Fprintln(out, "Error reading capture: ", err.Error())
+			return 2
+		}
+		var info captureInfo
+		if sidecar, err := os.ReadFile(strings.TrimSuffix(capture, ".http") + ".json"); err == nil {
+			if err := json.Unmarshal(sidecar, &info); err != nil {
+				fmt.Fprintf(out, "Error reading capture info of %s: %s\n", name, err.Error())
+				return 2
+			}
+		}
+
+		req, err := ParseRequestWithLimits(bufio.NewReader(bytes.NewReader(raw)), s.RequestLimits)
+		// A filter can't tell what an unparsable request was after
+		if err != nil && filter != (ReplayFilter{}) || err == nil && !filter.matches(req) {
+			continue
+		}
+		if info.Truncated {
+			fmt.Fprintf(out, "%s skipped, body truncated by the capture\n", name)
+			continue
+		}
+
+		start := time.Now()
+		status := 0
+		label := "unparsable request"
+		var perr *ParseError
+		switch {
+		case errors.As(err, &perr):
+			status = perr.StatusCode
+		case err != nil:
+			status = 400
+		default:
+			label = req.Method + " " + req.RequestURI
+			status = s.replayOne(req, info.Remote)
+		}
+		replayed++
+
+		line := fmt.Sprintf("%s %s status=%d recorded=%d latency=%s", name, label, status, info.Status, time.Since(start))
+		if info.Status != 0 && status != info.Status {
+			diverged++
+			line += " DIVERGED"
+		}
+		fmt.Fprintln(out, line)
+	}
+
+	fmt.Fprintf(out, "%d replayed, %d diverged\n", replayed, diverged)
+	if diverged > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replayOne answers req the way a connection would, discarding the response.
+func (s *Server) replayOne(req *Request, remote string) int {
+	req.RemoteAddr = remote
+	if req.RemoteAddr == "" {
+		req.RemoteAddr = "127.0.0.1:0"
+	}
+	var cancel context.CancelFunc
+	req.ctx, cancel = context.WithCancel(req.Context())
+	defer cancel()
+	if err := s.checkHost(req); err != nil {
+		return 400
+	}
+	s.rewritePath(req)
+
+	res := s.dispatch(req)
+	s.finalize(req, res)
+	res.headOnly = req.Method == "HEAD"
+	if _, err := res.WriteTo(io.Discard); err != nil {
+		fmt.Println("Error writing response: ", err.Error())
+	}
+	return res.StatusCode
+}
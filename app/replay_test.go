@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// replayCorpus is a small capture directory: a request still answered as
+// it was, one whose status changed since, one whose body wasn't all kept
+// and one the server couldn't parse. The names sort in capture order.
+var replayCorpus = []struct{ name, raw, info string }{
+	{"20300101T000000.000000000Z-1", "GET /echo/abc HTTP/1.1\r\nHost: localhost\r\n\r\n", `{"remote":"192.0.2.1:1234","status":200}`},
+	{"20300101T000001.000000000Z-2", "GET /gone HTTP/1.1\r\nHost: localhost\r\n\r\n", `{"status":200}`},
+	{"20300101T000002.000000000Z-3", "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100\r\n\r\nshort", `{"status":201,"truncated":true}`},
+	{"20300101T000003.000000000Z-4", "NOT A REQUEST\r\n\r\n", `{"status":400}`},
+}
+
+func writeReplayCorpus(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	// Written last first, so the replay order can't come from the directory
+	for i := len(replayCorpus) - 1; i >= 0; i-- {
+		c := replayCorpus[i]
+		if err := os.WriteFile(filepath.Join(dir, c.name+".http"), []byte(c.raw), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, c.name+".json"), []byte(c.info), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestReplay(t *testing.T) {
+	dir := writeReplayCorpus(t)
+	latency := regexp.MustCompile(` latency=\S+`)
+	tests := []struct {
+		name   string
+		filter ReplayFilter
+		want   string
+		code   int
+	}{
+		{
+			name: "everything",
+			want: "20300101T000000.000000000Z-1 GET /echo/abc status=200 recorded=200\n" +
+				"20300101T000001.000000000Z-2 GET /gone status=404 recorded=200 DIVERGED\n" +
+				"20300101T000002.000000000Z-3 skipped, body truncated by the capture\n" +
+				"20300101T000003.000000000Z-4 unparsable request status=400 recorded=400\n" +
+				"3 replayed, 1 diverged\n",
+			code: 1,
+		},
+		{
+			name:   "by path",
+			filter: ReplayFilter{PathPrefix: "/echo/"},
+			want:   "20300101T000000.000000000Z-1 GET /echo/abc status=200 recorded=200\n1 replayed, 0 diverged\n",
+			code:   0,
+		},
+		{
+			name:   "by method",
+			filter: ReplayFilter{Method: "get"},
+			want: "20300101T000000.000000000Z-1 GET /echo/abc status=200 recorded=200\n" +
+				"20300101T000001.000000000Z-2 GET /gone status=404 recorded=200 DIVERGED\n" +
+				"2 replayed, 1 diverged\n",
+			code: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer("localhost:4221", echoRouter())
+			var out strings.Builder
+			code := s.Replay(dir, tt.filter, &out)
+			if got := latency.ReplaceAllString(out.String(), ""); got != tt.want || code != tt.code {
+				t.Errorf("exit code %d, report:\n%s\nwant %d, report:\n%s", code, got, tt.code, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayUnreadableInfo(t *testing.T) {
+	dir := writeReplayCorpus(t)
+	os.WriteFile(filepath.Join(dir, replayCorpus[1].name+".json"), []byte("{"), 0600)
+	var out strings.Builder
+	if code := NewServer("localhost:4221", echoRouter()).Replay(dir, ReplayFilter{}, &out); code != 2 {
+		t.Errorf("exit code %d, report:\n%s", code, out.String())
+	}
+}
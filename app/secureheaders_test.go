@@ -0,0 +1,129 @@
+package main
+
+import "testing"
+
+func TestSecureHeaders(t *testing.T) {
+	opts := DefaultSecureHeaders
+	opts.ContentSecurityPolicy = "default-src 'self'"
+	opts.FrameOptions = ""
+	opts.TrustedProxies = []string{"10.0.0.0/8"}
+	mw, err := SecureHeaders(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := mw(func(req *Request, res *Response) {
+		res.Headers.Set("Set-Cookie", "session=1; HttpOnly")
+		if req.RequestURI == "/own" {
+			res.Headers.Set("Referrer-Policy", "no-referrer")
+			res.Headers.Set("Strict-Transport-Security", "max-age=60")
+		}
+	})
+
+	tests := []struct {
+		name, target, remote, proto string
+		tls                         bool
+		hsts, referrer, cookie      string
+	}{
+		{name: "plain", target: "/", remote: "192.0.2.1:1234",
+			referrer: "strict-origin-when-cross-origin", cookie: "session=1; HttpOnly"},
+		{name: "TLS", target: "/", remote: "192.0.2.1:1234", tls: true,
+			hsts: "max-age=31536000; includeSubDomains", referrer: "strict-origin-when-cross-origin", cookie: "session=1; HttpOnly; Secure"},
+		{name: "https through a trusted proxy", target: "/", remote: "10.1.2.3:1234", proto: "https",
+			hsts: "max-age=31536000; includeSubDomains", referrer: "strict-origin-when-cross-origin", cookie: "session=1; HttpOnly; Secure"},
+		{name: "https claimed by anyone", target: "/", remote: "192.0.2.1:1234", proto: "https",
+			referrer: "strict-origin-when-cross-origin", cookie: "session=1; HttpOnly"},
+		{name: "set by the handler", target: "/own", remote: "192.0.2.1:1234", tls: true,
+			hsts: "max-age=60", referrer: "no-referrer", cookie: "session=1; HttpOnly; Secure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newTestRequest("GET", tt.target)
+			req.RemoteAddr = tt.remote
+			req.tls = tt.tls
+			if tt.proto != "" {
+				req.Headers.Set("X-Forwarded-Proto", tt.proto)
+			}
+			res := NewResponse()
+			handler(req, res)
+			hsts, _ := res.Headers.Get("Strict-Transport-Security")
+			referrer, _ := res.Headers.Get("Referrer-Policy")
+			cookie, _ := res.Headers.Get("Set-Cookie")
+			if hsts != tt.hsts || referrer != tt.referrer || cookie != tt.cookie {
+				t.Errorf("got HSTS %q, Referrer-Policy %q, Set-Cookie %q", hsts, referrer, cookie)
+			}
+			nosniff, _ := res.Headers.Get("X-Content-Type-Options")
+			csp, _ := res.Headers.Get("Content-Security-Policy")
+			if _, found := res.Headers.Get("X-Frame-Options"); found || nosniff != "nosniff" || csp != "default-src 'self'" {
+				t.Errorf("got %v", res.Headers)
+			}
+		})
+	}
+
+	for _, bad := range []SecureHeadersOptions{
+		{ContentSecurityPolicy: "default-src 'self'\r\nSet-Cookie: a=b"},
+		{TrustedProxies: []string{"not a network"}},
+	} {
+		if _, err := SecureHeaders(bad); err == nil {
+			t.Errorf("SecureHeaders(%+v) accepted", bad)
+		}
+	}
+}
+
+// The default profile denies framing and, over https only, sends HSTS and
+// marks cookies Secure.
+func TestSecureHeadersDefaults(t *testing.T) {
+	mw, err := SecureHeaders(DefaultSecureHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tls := range []bool{false, true} {
+		req := newTestRequest("GET", "/")
+		req.tls = tls
+		res := NewResponse()
+		mw(func(req *Request, res *Response) {
+			res.Headers.Set("Set-Cookie", "id=2; secure")
+		})(req, res)
+		frame, _ := res.Headers.Get("X-Frame-Options")
+		_, hsts := res.Headers.Get("Strict-Transport-Security")
+		cookie, _ := res.Headers.Get("Set-Cookie")
+		if frame != "DENY" || hsts != tls || cookie != "id=2; secure" {
+			t.Errorf("TLS %v: X-Frame-Options %q, HSTS %v, Set-Cookie %q", tls, frame, hsts, cookie)
+		}
+	}
+
+	opts := DefaultSecureHeaders
+	opts.SecureCookies = false
+	mw, _ = SecureHeaders(opts)
+	req := newTestRequest("GET", "/")
+	req.tls = true
+	res := NewResponse()
+	mw(func(req *Request, res *Response) {
+		res.Headers.Set("Set-Cookie", "id=3")
+		res.Headers.Set("X-Frame-Options", "SAMEORIGIN")
+	})(req, res)
+	frame, _ := res.Headers.Get("X-Frame-Options")
+	cookie, _ := res.Headers.Get("Set-Cookie")
+	if frame != "SAMEORIGIN" || cookie != "id=3" {
+		t.Errorf("got X-Frame-Options %q, Set-Cookie %q", frame, cookie)
+	}
+}
+
+func TestHasCookieAttribute(t *testing.T) {
+	tests := []struct {
+		cookie string
+		want   bool
+	}{
+		{"a=b; Secure", true},
+		{"a=b;SECURE; HttpOnly", true},
+		{"a=b; Secure=1", true},
+		{"a=b; HttpOnly", false},
+		{"Secure=b", false},
+		{"a=Secure", false},
+		{"a=b; Path=/Secure", false},
+	}
+	for _, tt := range tests {
+		if got := hasCookieAttribute(tt.cookie, "Secure"); got != tt.want {
+			t.Errorf("hasCookieAttribute(%q) = %v, want %v", tt.cookie, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connReadBufferSize bounds how much of the requests pipelined on a connection is read ahead.
+const connReadBufferSize = 4096
+
+// Server accepts connections on a listener and dispatches each request
+// read from them to its Router.
+type Server struct {
+	Addr   string
+	Router *Router
+
+	// AccessLog receives one line per handled request, nil disables it.
+	AccessLog io.Writer
+	// LogFormat selects the access log layout: LogFormatStructured or LogFormatCombined.
+	LogFormat string
+	// ShutdownGrace is how long Shutdown waits for in-flight requests.
+	ShutdownGrace time.Duration
+	// RetryAfter is advertised on the 503 responses generated by the server itself.
+	RetryAfter RetryAfterPolicy
+	// LoadShedder, when set, is consulted before routing every request. Shed
+	// requests get a 503 without reaching any handler. A zero retryAfter
+	// falls back to RetryAfter.LoadShed.
+	LoadShedder func(req *Request) (shed bool, retryAfter time.Duration)
+	// RequestLimits bounds the size of the request line and headers.
+	RequestLimits RequestLimits
+	// ResponseLimits bounds the headers of responses. A handler going over
+	// them gets its response replaced with an empty 500.
+	ResponseLimits ResponseLimits
+	// MaxConns caps the number of connections handled at once, 0 means no limit.
+	MaxConns int
+	// ConnLimitMode selects what happens to connections over MaxConns:
+	// ConnLimitQueue leaves them waiting to be accepted, ConnLimitReject
+	// answers them with a 503 and hangs up.
+	ConnLimitMode string
+	// Workers, when positive, handles connections on a pool of that many
+	// goroutines instead of a goroutine each. Accepted connections wait for
+	// a worker in a queue of WorkerQueue connections. Once it is full,
+	// ConnLimitMode applies: ConnLimitQueue stops accepting until a worker
+	// is free, ConnLimitReject answers the new connections with a 503.
+	// An idle keep-alive connection holds on to its worker until the
+	// client closes it.
+	Workers     int
+	WorkerQueue int
+	// ResponseBodyTransform, when set, may rewrite res.Body of every response
+	// after its handler ran. Content-Length is recomputed afterwards. Streamed
+	// responses and those with SkipTransform set are left alone.
+	ResponseBodyTransform func(req *Request, res *Response)
+	// Clock provides the current time, it defaults to the wall clock.
+	Clock Clock
+	// SlowRequestThreshold logs a warning for requests taking longer than this, 0 disables it.
+	SlowRequestThreshold time.Duration
+	// PathRewrite, when set, maps the path of every request target (the
+	// query is kept) before routing. The access log shows the original target.
+	// It is given the path with its dot segments removed.
+	PathRewrite func(path string) string
+	// MergeSlashes collapses runs of slashes in request paths into one.
+	MergeSlashes bool
+	// OnRequestEnd, when set, is called once a response has been written,
+	// with the time spent on each phase of the request.
+	OnRequestEnd func(req *Request, res *Response, t Timings)
+	// ServerTiming adds a Server-Timing header with the phases measured
+	// before the response is written.
+	ServerTiming bool
+	// DefaultHeaders are added to every response whose handler didn't set them.
+	DefaultHeaders Headers
+	// HandshakeTimeout bounds the TLS handshake of a connection, 0 means no
+	// limit. Clients that don't complete it in time are dropped.
+	HandshakeTimeout time.Duration
+	// UpgradeInsecureURL, when set on a server without TLS, is the https URL
+	// (scheme and authority) browsers sending Upgrade-Insecure-Requests: 1
+	// are redirected to, keeping the request target.
+	UpgradeInsecureURL string
+	// StrictHost rejects absolute-form requests whose Host header names
+	// another authority than the target. Otherwise the target wins.
+	StrictHost bool
+	// Capture, when set, saves every request read, as received.
+	Capture *RequestCapture
+	// RootBody is served at "/" with the RootContentType, text/plain when
+	// empty. Without it "/" is an empty 200.
+	RootBody        string
+	RootContentType string
+	// HTTPVersion, when set, is the version of every response, HTTP/1.0 or
+	// HTTP/1.1. Otherwise HTTP/1.0 requests get HTTP/1.0 responses and all
+	// others HTTP/1.1 ones.
+	HTTPVersion string
+
+	conns     *connRegistry
+	metrics   *metrics
+	accessLog *accessLogger
+	logFile   *reopenableFile
+	certs     *certReloader
+
+	mu           sync.Mutex
+	listener     net.Listener
+	draining     atomic.Bool
+	closing      atomic.Bool
+	shutdownOnce sync.Once
+	done         chan struct{}
+}
+
+// NewServer creates a Server listening on addr and routing with router.
+func NewServer(addr string, router *Router) *Server {
+	return &Server{
+		Addr:             addr,
+		Router:           router,
+		AccessLog:        os.Stdout,
+		LogFormat:        LogFormatStructured,
+		ShutdownGrace:    10 * time.Second,
+		HandshakeTimeout: 10 * time.Second,
+		DefaultHeaders:   NewHeaders(),
+		RequestLimits:    DefaultRequestLimits,
+		ResponseLimits:   DefaultResponseLimits,
+		ConnLimitMode:    ConnLimitQueue,
+		StrictHost:       true,
+		Clock:            realClock{},
+		RetryAfter: RetryAfterPolicy{
+			Shutdown:  5 * time.Second,
+			LoadShed:  1 * time.Second,
+			ConnLimit: 1 * time.Second,
+		},
+		conns:   newConnRegistry(),
+		metrics: &metrics{},
+		done:    make(chan struct{}),
+	}
+}
+
+// ListenAndServe binds to s.Addr and serves connections until the listener fails.
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// maxDrain is the most of an unread request body skipped to keep the
+// connection open.
+const maxDrain = 256 << 10
+
+// Serve accepts connections on l, handling each one in its own goroutine,
+// or on the worker pool when Workers is set. After Shutdown it returns
+// ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	if s.AccessLog != nil {
+		s.accessLog = newAccessLogger(s.AccessLog, s.LogFormat)
+	}
+
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+	if s.closing.Load() {
+		l.Close()
+		return ErrServerClosed
+	}
+
+	var slots chan struct{}
+	if s.MaxConns > 0 {
+		slots = make(chan struct{}, s.MaxConns)
+	}
+	rejection := connLimitResponse(s.RetryAfter.ConnLimit)
+	release := func() {
+		if slots != nil {
+			<-slots
+		}
+	}
+	var queue chan net.Conn
+	if s.Workers > 0 {
+		queue = make(chan net.Conn, s.WorkerQueue)
+		defer close(queue)
+		for range s.Workers {
+			go s.worker(queue, release)
+		}
+	}
+
+	for {
+		// Queue mode: leave new clients in the listen backlog until a slot frees up
+		if slots != nil && s.ConnLimitMode != ConnLimitReject {
+			slots <- struct{}{}
+		}
+
+		conn, err := l.Accept()
+		if err != nil {
+			if s.closing.Load() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		s.metrics.accepted.Add(1)
+
+		if slots != nil && s.ConnLimitMode == ConnLimitReject {
+			select {
+			case slots <- struct{}{}:
+			default:
+				go rejectConn(conn, rejection)
+				continue
+			}
+		}
+
+		if queue == nil {
+			go func() {
+				s.handleConnection(conn)
+				release()
+			}()
+			continue
+		}
+		if s.ConnLimitMode != ConnLimitReject {
+			queue <- conn
+			continue
+		}
+		select {
+		case queue <- conn:
+		default:
+			release()
+			go rejectConn(conn, rejection)
+		}
+	}
+}
+
+// worker handles the connections of queue one after the other, until it is
+// closed. Those still waiting when the server shuts down are hung up on.
+func (s *Server) worker(queue <-chan net.Conn, release func()) {
+	for conn := range queue {
+		if s.closing.Load() {
+			conn.Close()
+		} else {
+			s.handleConnection(conn)
+		}
+		release()
+	}
+}
+
+func (s *Server) handleConnection(netConn net.Conn) {
+	conn := s.conns.track(netConn, s.metrics, s.Clock.Now())
+	defer s.conns.untrack(conn)
+	// A hijacked connection belongs to the handler that took it
+	var hijacked atomic.Bool
+	defer func() {
+		if !hijacked.Load() {
+			conn.Close()
+		}
+	}()
+	if err := s.handshake(netConn); err != nil {
+		fmt.Println("Error in TLS handshake: ", err.Error())
+		return
+	}
+
+	// Pipelined requests are read one at a time: the next one is only parsed
+	// once the previous response has been written, so what a client sends ahead
+	// waits in this fixed-size buffer and then in the socket, where TCP flow
+	// control pushes back on it.
+	var src io.Reader = conn
+	var tee *captureReader
+	if s.Capture != nil {
+		tee = &captureReader{r: conn, limit: s.Capture.limit(s.RequestLimits)}
+		src = tee
+	}
+	reader := bufio.NewReaderSize(src, connReadBufferSize)
+	writer := bufio.NewWriter(conn)
+	// captureFailed saves a request that couldn't be read, with all that came after it
+	captureFailed := func(res *Response, start time.Time) {
+		if tee != nil {
+			raw, size := tee.take(0)
+			s.Capture.save(raw, size, captureInfo{
+				Remote: conn.RemoteAddr().String(),
+				Start:  start,
+				Status: res.StatusCode,
+			})
+		}
+	}
+	for {
+		// The clock of the parse phase starts with the first byte
+		reader.Peek(1)
+		received := s.Clock.Now()
+		req, err := ReadRequestHead(reader, s.RequestLimits)
+		// A request that couldn't be parsed leaves the stream at an unknown
+		// place, so the connection is closed after the error. Errors decided
+		// once the request was read, like a 404, leave it open.
+		if err != nil {
+			// Shutdown closing an idle connection isn't the client's doing
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			start := s.Clock.Now()
+			captureFailed(s.rejectRequest(conn, err), start)
+			return
+		}
+
+		start := s.Clock.Now()
+		if err := s.checkHost(req); err != nil {
+			captureFailed(s.rejectRequest(conn, err), start)
+			return
+		}
+		req.RemoteAddr = conn.RemoteAddr().String()
+		req.clock = s.Clock
+		_, req.tls = netConn.(*tls.Conn)
+		s.rewritePath(req)
+
+		var committed atomic.Bool
+		req.interim = func(code int, headers Headers) error {
+			if hijacked.Load() {
+				return ErrHijacked
+			}
+			if committed.Load() {
+				return ErrResponseCommitted
+			}
+			return writeInterim(writer, code, headers)
+		}
+
+		if expect, found := req.Headers.Get("Expect"); found && !strings.EqualFold(expect, "100-continue") {
+			res := NewResponse()
+			res.StatusCode = 417
+			res.ReasonPhrase = StatusText(417)
+			res.Headers.Set("Connection", "close")
+			s.finalize(req, res)
+			res.WriteTo(writer)
+			writer.Flush()
+			lingerClose(conn.Conn)
+			return
+		}
+		if req.ExpectsContinue() {
+			// Turn the request down before the client sends the body if it's going to be
+			if res := s.admit(req); res != nil {
+				committed.Store(true)
+				s.finalize(req, res)
+				res.Headers.Set("Connection", "close")
+				if _, err := res.WriteTo(writer); err == nil && writer.Flush() == nil {
+					s.accessLog.log(req, res, start, s.Clock.Now().Sub(start))
+				}
+				lingerClose(conn.Conn)
+				return
+			}
+			if err := req.WriteInterim(100, NewHeaders()); err != nil {
+				fmt.Println("Error writing to connection: ", err.Error())
+				return
+			}
+		}
+		// The body is only read ahead for a handler that wants it so. One
+		// turned down from its head alone, or going to no handler at all,
+		// is left unread, and skipped once answered.
+		var early *Response
+		buffered := s.Router.BuffersBody(req)
+		if buffered && !req.ExpectsContinue() {
+			early = s.admit(req)
+		}
+		streamed := !buffered || early != nil
+		if streamed {
+			req.StreamBody(reader)
+		} else if err := req.ReadBody(reader); err != nil {
+			captureFailed(s.rejectRequest(conn, err), start)
+			return
+		}
+
+		parsed := s.Clock.Now()
+
+		// Once the body has been read, anything coming in belongs to the next
+		// request, or is the end of the connection, which cancels this one.
+		// A streamed body is still being read: the handler sees the client
+		// going away as a failed read instead.
+		var cancel context.CancelFunc
+		req.ctx, cancel = context.WithCancel(req.Context())
+		peeked := make(chan struct{})
+		var raw []byte
+		var rawSize int
+		if streamed {
+			close(peeked)
+		} else {
+			// The request has been read, and the peek reads through tee
+			if tee != nil {
+				raw, rawSize = tee.take(reader.Buffered())
+			}
+			go func() {
+				defer close(peeked)
+				if _, err := reader.Peek(1); err != nil && !hijacked.Load() {
+					cancel()
+				}
+			}()
+		}
+		req.hijack = func() (net.Conn, *bufio.ReadWriter, error) {
+			if hijacked.Load() {
+				return nil, nil, ErrHijacked
+			}
+			if !committed.CompareAndSwap(false, true) {
+				return nil, nil, ErrResponseCommitted
+			}
+			hijacked.Store(true)
+			// Wake the peek up, the reader isn't the server's any more
+			conn.SetReadDeadline(time.Unix(1, 0))
+			<-peeked
+			conn.SetReadDeadline(time.Time{})
+			s.conns.untrack(conn)
+			// The reader may hold the error of the interrupted peek, only
+			// what it buffered is handed over
+			ahead, _ := reader.Peek(reader.Buffered())
+			src := io.MultiReader(bytes.NewReader(bytes.Clone(ahead)), conn)
+			return conn, bufio.NewReadWriter(bufio.NewReader(src), writer), nil
+		}
+
+		res := early
+		if res == nil {
+			res = s.dispatch(req)
+		}
+		if hijacked.Load() {
+			res.release()
+			cancel()
+			return
+		}
+		dispatched := s.Clock.Now()
+		committed.Store(true)
+		// What the handler left of a streamed body is skipped to get to the
+		// next request, an incomplete one leaves nothing to get to. Past
+		// maxDrain, hanging up costs less than reading it all.
+		bodyLeft := false
+		if known, ok := req.body.(*bodyReader); ok && known.remaining > maxDrain {
+			bodyLeft = true
+		} else if req.body != nil {
+			n, err := io.CopyN(io.Discard, req.body, maxDrain+1)
+			bodyLeft = n > maxDrain || err != io.EOF
+		}
+		if tee != nil && streamed {
+			raw, rawSize = tee.take(reader.Buffered())
+		}
+		// Whoever produced it, the answer to a HEAD has no body
+		res.headOnly = req.Method == "HEAD"
+		res.HTTPVersion = s.responseVersion(req)
+
+		s.finalize(req, res)
+		// HTTP/1.0 has no chunked encoding, the end of the connection ends
+		// a body of unknown length
+		http10 := req.HTTPVersion == "HTTP/1.0" || res.HTTPVersion == "HTTP/1.0"
+		_, sized := res.Headers.Get("Content-Length")
+		res.closeDelimited = http10 && res.Stream != nil && !sized
+		keepAlive := s.keepAlive(req, res) && !bodyLeft && !res.closeDelimited
+		if !keepAlive {
+			res.Headers.Set("Connection", "close")
+		} else if http10 || slices.Contains(req.Headers.ConnectionTokens(), "keep-alive") {
+			// Persistence is the default of HTTP/1.1 only, whoever asked
+			// for it otherwise is told it was granted
+			res.Headers.Set("Connection", "keep-alive")
+		}
+		timings := Timings{Parse: parsed.Sub(received), Route: dispatched.Sub(parsed)}
+		if !req.handlerStart.IsZero() {
+			timings.Route = req.handlerStart.Sub(parsed)
+			timings.Handler = dispatched.Sub(req.handlerStart)
+		}
+		timings.Serialize = s.Clock.Now().Sub(dispatched)
+		if s.ServerTiming {
+			res.Headers.Set("Server-Timing", timings.serverTiming())
+		}
+
+		serialized := s.Clock.Now()
+		timings.BytesWritten, err = res.WriteTo(writer)
+		if err == nil {
+			err = writer.Flush()
+		}
+		timings.Write = s.Clock.Now().Sub(serialized)
+		timings.Total = s.Clock.Now().Sub(received)
+		cancel()
+		conn.setIdle()
+		if err != nil {
+			fmt.Println("Error writing to connection: ", err.Error())
+			return
+		}
+		s.metrics.served.Add(1)
+		d := s.Clock.Now().Sub(start)
+		s.accessLog.log(req, res, start, d)
+		if s.OnRequestEnd != nil {
+			s.OnRequestEnd(req, res, timings)
+		}
+		if tee != nil {
+			go s.Capture.save(raw, rawSize, captureInfo{
+				Remote:     req.RemoteAddr,
+				Start:      start,
+				DurationMS: float64(d.Microseconds()) / 1000,
+				Status:     res.StatusCode,
+			})
+		}
+		if s.SlowRequestThreshold > 0 && d > s.SlowRequestThreshold {
+			fmt.Printf("Slow request: %s %s took %s\n", req.Method, req.OriginalURI(), d)
+		}
+
+		if !keepAlive {
+			if bodyLeft {
+				lingerClose(conn.Conn)
+			}
+			return
+		}
+		// The reader can't be shared with the peek
+		<-peeked
+	}
+}
+
+// rewritePath normalizes the path of the target of req and applies PathRewrite to it.
+func (s *Server) rewritePath(req *Request) {
+	if !strings.HasPrefix(req.RequestURI, "/") {
+		return
+	}
+	path, query, hasQuery := strings.Cut(req.RequestURI, "?")
+	rewritten := removeDotSegments(path, s.MergeSlashes)
+	if s.PathRewrite != nil {
+		rewritten = s.PathRewrite(rewritten)
+	}
+	if hasQuery {
+		rewritten += "?" + query
+	}
+	if rewritten != req.RequestURI {
+		if req.originalURI == "" {
+			req.originalURI = req.RequestURI
+		}
+		req.RequestURI = rewritten
+	}
+}
+
+// checkHost refuses, in StrictHost mode, a request whose target and Host
+// header disagree on the authority.
+func (s *Server) checkHost(req *Request) error {
+	if !s.StrictHost || !req.hostMismatch {
+		return nil
+	}
+	host, _ := req.Headers.Get("Host")
+	return badRequest("Host Mismatch", fmt.Errorf("target authority '%s' but Host header '%s'", req.authority, host))
+}
+
+// rejectRequest answers a request that couldn't be read and closes the connection.
+// It returns the response sent.
+func (s *Server) rejectRequest(conn *trackedConn, err error) *Response {
+	fmt.Println("Error reading from connection: ", err.Error())
+	res := NewResponse()
+	res.StatusCode = 400
+	res.ReasonPhrase = "Bad Request"
+	var perr *ParseError
+	if errors.As(err, &perr) {
+		perr.respond(res)
+	}
+	res.Headers.Set("Connection", "close")
+	s.addDefaultHeaders(res)
+	conn.Write([]byte(res.String()))
+	lingerClose(conn.Conn)
+	return res
+}
+
+// dispatch produces the response to req. Requests are shed before they
+// reach the router when the server is shutting down or the LoadShedder says so.
+func (s *Server) dispatch(req *Request) *Response {
+	// An admitted request went through shedding already
+	if !req.admitted {
+		if res := s.shed(req); res != nil {
+			return res
+		}
+	}
+	if s.UpgradeInsecureURL == "" || s.certs != nil {
+		return s.Router.Route(req)
+	}
+	// Whether the content is served depends on the header from now on
+	res := s.upgradeInsecure(req)
+	if res == nil {
+		res = s.Router.Route(req)
+	}
+	res.Vary("Upgrade-Insecure-Requests")
+	return res
+}
+
+// upgradeInsecure returns the redirect to UpgradeInsecureURL for a client
+// asking for it, nil otherwise.
+func (s *Server) upgradeInsecure(req *Request) *Response {
+	if value, _ := req.Headers.Get("Upgrade-Insecure-Requests"); strings.TrimSpace(value) != "1" {
+		return nil
+	}
+	target := req.sentTarget()
+	res := NewResponse()
+	res.StatusCode = 307
+	res.ReasonPhrase = StatusText(307)
+	res.Headers.Set("Location", strings.TrimSuffix(s.UpgradeInsecureURL, "/")+target)
+	return res
+}
+
+// admit makes the checks that only need the head of req: shedding and the
+// guards of its route. It returns the response rejecting req, nil if it may go on.
+func (s *Server) admit(req *Request) *Response {
+	if res := s.shed(req); res != nil {
+		return res
+	}
+	res := NewResponse()
+	if !s.Router.Admit(req, res) {
+		return res
+	}
+	return nil
+}
+
+// shed returns the 503 for a request the server won't handle now, nil otherwise.
+func (s *Server) shed(req *Request) *Response {
+	if s.closing.Load() {
+		res := NewResponse()
+		unavailable(res, s.RetryAfter.Shutdown)
+		res.Close = true
+		return res
+	}
+	if s.LoadShedder != nil {
+		if shed, retryAfter := s.LoadShedder(req); shed {
+			res := NewResponse()
+			if retryAfter == 0 {
+				retryAfter = s.RetryAfter.LoadShed
+			}
+			unavailable(res, retryAfter)
+			return res
+		}
+	}
+	return nil
+}
+
+// finalize applies the server-wide steps between the handler and the write.
+func (s *Server) finalize(req *Request, res *Response) {
+	if s.ResponseBodyTransform != nil && !res.SkipTransform && res.Stream == nil {
+		s.ResponseBodyTransform(req, res)
+		if bodyAllowed(res.StatusCode) {
+			res.Headers.Set("Content-Length", strconv.Itoa(len(res.Body)))
+		}
+	}
+
+	res.sanitizeStatusLine()
+	// The DefaultHeaders are sent too, they count against the limits
+	s.addDefaultHeaders(res)
+	if err := s.ResponseLimits.check(res); err != nil {
+		fmt.Printf("Invalid response to %s %s, sending a 500 instead: %v\n", req.Method, req.OriginalURI(), err)
+		res.release()
+		res.StatusCode = 500
+		res.ReasonPhrase = StatusText(500)
+		res.Headers = NewHeaders()
+		res.Body = ""
+		res.Stream = nil
+		s.addDefaultHeaders(res)
+	}
+	res.frameBody()
+	res.Headers.pruneConnection()
+	if _, found := res.Headers.Get("Date"); !found {
+		res.Headers.Set("Date", FormatHTTPDate(s.Clock.Now()))
+	}
+}
+
+// addDefaultHeaders sets the DefaultHeaders res doesn't have.
+func (s *Server) addDefaultHeaders(res *Response) {
+	for name, value := range s.DefaultHeaders {
+		if _, found := res.Headers.Get(name); !found {
+			res.Headers.Set(name, value)
+		}
+	}
+}
+
+// lingerClose stops writing to conn and discards what the client is still
+// sending for a moment. Closing with unread data makes the kernel answer
+// with a reset, which can destroy the error response before it is read.
+func lingerClose(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	io.CopyN(io.Discard, conn, 256<<10)
+}
+
+// responseVersion returns the HTTP version to answer req with.
+func (s *Server) responseVersion(req *Request) string {
+	if s.HTTPVersion != "" {
+		return s.HTTPVersion
+	}
+	if req.HTTPVersion == "HTTP/1.0" {
+		return "HTTP/1.0"
+	}
+	return "HTTP/1.1"
+}
+
+// keepAlive decides whether the connection stays open after res.
+// HTTP/1.1 connections persist unless either side asks to close,
+// HTTP/1.0 ones only when the client asks for keep-alive.
+func (s *Server) keepAlive(req *Request, res *Response) bool {
+	// A handler may ask to close with the header as well as with Close
+	if res.Close || s.closing.Load() || slices.Contains(res.Headers.ConnectionTokens(), "close") {
+		return false
+	}
+	tokens := req.Headers.ConnectionTokens()
+	if req.HTTPVersion == "HTTP/1.0" {
+		return slices.Contains(tokens, "keep-alive") && !slices.Contains(tokens, "close")
+	}
+	return !slices.Contains(tokens, "close")
+}
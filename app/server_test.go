@@ -0,0 +1,1088 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer serves router on a loopback port until the test ends and
+// returns the server with its address. configure, when given, adjusts the
+// server before it starts.
+func startServer(tb testing.TB, router *Router, configure ...func(*Server)) (*Server, string) {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s := NewServer(l.Addr().String(), router)
+	s.AccessLog = nil
+	s.ShutdownGrace = time.Second
+	for _, c := range configure {
+		c(s)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+	tb.Cleanup(func() {
+		s.Shutdown()
+		if err := <-served; !errors.Is(err, ErrServerClosed) {
+			tb.Errorf("Serve returned %v", err)
+		}
+	})
+	return s, l.Addr().String()
+}
+
+// dial connects a Client to addr, closed when the test ends.
+func dial(tb testing.TB, addr string) *Client {
+	tb.Helper()
+	c, err := Dial(addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { c.Close() })
+	return c
+}
+
+// newTestRequest builds a request the way a client would send it.
+func newTestRequest(method, target string, headers ...string) *Request {
+	req := &Request{
+		RequestLine: RequestLine{Method: method, RequestURI: target, HTTPVersion: "HTTP/1.1"},
+		Headers:     NewHeaders(),
+	}
+	req.Headers.Set("Host", "localhost")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Headers.Set(headers[i], headers[i+1])
+	}
+	return req
+}
+
+func echoRouter() *Router {
+	router := &Router{AutoHEAD: true}
+	router.HandlePrefix("/echo/", echoHandler, "GET")
+	return router
+}
+
+func TestEcho(t *testing.T) {
+	_, addr := startServer(t, echoRouter())
+	c := dial(t, addr)
+
+	for _, value := range []string{"abc", "a%20b", "h%C3%A9llo"} {
+		res, err := c.Do(newTestRequest("GET", "/echo/"+value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := url.PathUnescape(value)
+		if res.StatusCode != 200 || res.Body != want {
+			t.Errorf("GET /echo/%s: got %d %q, want 200 %q", value, res.StatusCode, res.Body, want)
+		}
+		if n, _ := res.Headers.Get("Content-Length"); n != strconv.Itoa(len(want)) {
+			t.Errorf("GET /echo/%s: Content-Length %s, want %d bytes", value, n, len(want))
+		}
+	}
+}
+
+// Content-Length counts the bytes of a non-ASCII body, not its runes,
+// whoever sets it.
+func TestContentLengthBytes(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "greeting.txt"), []byte("héllo wörld"), 0644)
+	router := fileRouter(dir)
+	router.HandleExact("/user-agent", userAgentHandler, "GET")
+	router.HandleExact("/plain", func(req *Request, res *Response) {
+		res.Body = "日本語"
+	}, "GET")
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	tests := []struct {
+		target, want string
+		headers      []string
+	}{
+		{"/user-agent", "héllo/1.0", []string{"User-Agent", "héllo/1.0"}},
+		{"/files/greeting.txt", "héllo wörld", nil},
+		{"/plain", "日本語", nil},
+	}
+	for _, tt := range tests {
+		res, err := c.Do(newTestRequest("GET", tt.target, tt.headers...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 200 || res.Body != tt.want {
+			t.Errorf("GET %s: got %d %q", tt.target, res.StatusCode, res.Body)
+		}
+		if n, _ := res.Headers.Get("Content-Length"); n != strconv.Itoa(len(tt.want)) {
+			t.Errorf("GET %s: Content-Length %s, want %d bytes", tt.target, n, len(tt.want))
+		}
+	}
+}
+
+// BenchmarkEcho measures GET /echo/ over one keep-alive connection,
+// through the real connection loop and router.
+func BenchmarkEcho(b *testing.B) {
+	_, addr := startServer(b, echoRouter())
+	c := dial(b, addr)
+	req := newTestRequest("GET", "/echo/benchmark")
+
+	b.ReportAllocs()
+	for b.Loop() {
+		res, err := c.Do(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if res.Body != "benchmark" {
+			b.Fatalf("got %q", res.Body)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+}
+
+// The echo handler and the write of its response took 18 allocations
+// when the handler counted runes for Content-Length and the response was
+// formatted with fmt.Sprintf. Appending the response to one buffer, with
+// the byte length of the value, brought them down to 4. Framing and the
+// percent-decoding of the path have brought them to 6 since.
+const echoWriteAllocBudget = 6
+
+func TestEchoWriteAllocs(t *testing.T) {
+	req := newTestRequest("GET", "/echo/abc")
+	var out bytes.Buffer
+	allocs := testing.AllocsPerRun(100, func() {
+		out.Reset()
+		res := NewResponse()
+		echoHandler(req, res)
+		res.frameBody()
+		if _, err := res.WriteTo(&out); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > echoWriteAllocBudget {
+		t.Errorf("echo handler and write: %.0f allocations, the budget is %d", allocs, echoWriteAllocBudget)
+	}
+}
+
+// echoAllocBudget bounds the allocations of the whole answer to GET
+// /echo/: parsing the request, routing it, finalizing and writing the
+// response.
+const echoAllocBudget = 27
+
+func TestEchoAllocs(t *testing.T) {
+	router := echoRouter()
+	s := NewServer("", router)
+	raw := "GET /echo/abc HTTP/1.1\r\nHost: localhost\r\nUser-Agent: test\r\n\r\n"
+	var in strings.Reader
+	reader := bufio.NewReader(&in)
+	var out bytes.Buffer
+
+	allocs := testing.AllocsPerRun(100, func() {
+		in.Reset(raw)
+		reader.Reset(&in)
+		out.Reset()
+		req, err := ReadRequestHead(reader, s.RequestLimits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := router.Route(req)
+		s.finalize(req, res)
+		if _, err := res.WriteTo(&out); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > echoAllocBudget {
+		t.Errorf("GET /echo/abc: %.0f allocations, the budget is %d", allocs, echoAllocBudget)
+	}
+}
+
+// A handler setting thousands of headers, or a few huge ones, gets a clean
+// 500 instead, and the connection goes on.
+func TestResponseLimits(t *testing.T) {
+	router := echoRouter()
+	router.HandleExact("/headers", func(req *Request, res *Response) {
+		count, _ := strconv.Atoi(req.Query().Get("count"))
+		size, _ := strconv.Atoi(req.Query().Get("size"))
+		for i := range count {
+			res.Headers.Set("X-Header-"+strconv.Itoa(i), strings.Repeat("v", size))
+		}
+		res.Body = "bloated"
+	}, "GET")
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"count=5000&size=1", 500},
+		{"count=4&size=100000", 500},
+		{"count=50&size=100", 200},
+		{"count=2&size=20000", 200},
+	}
+	for _, tt := range tests {
+		res, err := c.Do(newTestRequest("GET", "/headers?"+tt.query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.query, res.StatusCode, tt.status)
+		}
+		if tt.status == 500 {
+			if _, found := res.Headers.Get("X-Header-0"); found || res.Body != "" || len(res.Headers) > 5 {
+				t.Errorf("%s: the 500 kept the handler's response: %d headers, body %q", tt.query, len(res.Headers), res.Body)
+			}
+		}
+	}
+}
+
+// A response over the limits is replaced by a 500, which still gets the
+// DefaultHeaders.
+func TestResponseLimitsDefaultHeaders(t *testing.T) {
+	router := echoRouter()
+	router.HandleExact("/many", func(req *Request, res *Response) {
+		for i := range 20 {
+			res.Headers.Set("X-Header-"+strconv.Itoa(i), "v")
+		}
+	}, "GET")
+	_, addr := startServer(t, router, func(s *Server) {
+		s.ResponseLimits = ResponseLimits{MaxHeaderCount: 10}
+		s.DefaultHeaders = Headers{"x-content-type-options": "nosniff"}
+	})
+	c := dial(t, addr)
+
+	res, err := c.Do(newTestRequest("GET", "/many"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 500 {
+		t.Errorf("got %d, want 500", res.StatusCode)
+	}
+	if v, _ := res.Headers.Get("X-Content-Type-Options"); v != "nosniff" {
+		t.Errorf("X-Content-Type-Options %q on the 500, want nosniff", v)
+	}
+}
+
+// A request turned down once it was read, like a 404, leaves the connection
+// ready for the next one. One that couldn't be parsed closes it.
+func TestConnReusedAfterClientError(t *testing.T) {
+	_, addr := startServer(t, echoRouter())
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	requests := []struct {
+		raw    string
+		status int
+	}{
+		{"GET /missing HTTP/1.1\r\nHost: localhost\r\n\r\n", 404},
+		// The body nobody reads is skipped to get to the next request
+		{"POST /missing HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello", 404},
+		{"DELETE /echo/abc HTTP/1.1\r\nHost: localhost\r\n\r\n", 405},
+		{"GET /echo/abc HTTP/1.1\r\nHost: localhost\r\n\r\n", 200},
+	}
+	for _, r := range requests {
+		if _, err := conn.Write([]byte(r.raw)); err != nil {
+			t.Fatal(err)
+		}
+		res, err := ReadResponse(reader, "GET")
+		if err != nil {
+			t.Fatalf("%q: %v", r.raw, err)
+		}
+		if connection, _ := res.Headers.Get("Connection"); res.StatusCode != r.status || connection == "close" {
+			t.Errorf("%q: got %d, Connection %q, want %d on an open connection", r.raw, res.StatusCode, connection, r.status)
+		}
+	}
+
+	if _, err := conn.Write([]byte("GET /echo/abc HTTP/1.1\r\nHost: localhost\r\nbroken header\r\n\r\nGET /echo/abc HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ReadResponse(reader, "GET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connection, _ := res.Headers.Get("Connection"); res.StatusCode != 400 || connection != "close" {
+		t.Errorf("malformed request: got %d, Connection %q, want 400 and close", res.StatusCode, connection)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	res, err = ReadResponse(reader, "GET")
+	if err == nil {
+		t.Errorf("the request after a malformed one was answered: %d", res.StatusCode)
+	} else if isTimeout(err) {
+		t.Error("the connection was left open after a malformed request")
+	}
+}
+
+// A handler setting Close ends a keep-alive connection after its response,
+// with the header saying so. Asking for the close with the header does too.
+func TestHandlerForcesClose(t *testing.T) {
+	router := echoRouter()
+	router.HandleExact("/close", func(req *Request, res *Response) {
+		res.Close = true
+		res.Body = "bye"
+	}, "GET")
+	router.HandleExact("/close-header", func(req *Request, res *Response) {
+		res.Headers.Set("Connection", "close")
+	}, "GET")
+	_, addr := startServer(t, router)
+
+	for _, target := range []string{"/close", "/close-header"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		// Keep-alive is the default of HTTP/1.1, the client asks for it anyway
+		conn.Write([]byte("GET /echo/first HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n"))
+		if res, err := ReadResponse(reader, "GET"); err != nil || res.Body != "first" {
+			t.Fatalf("first request: %v, %+v", err, res)
+		}
+		conn.Write([]byte("GET " + target + " HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n"))
+		res, err := ReadResponse(reader, "GET")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if connection, _ := res.Headers.Get("Connection"); connection != "close" {
+			t.Errorf("%s: Connection %q, want close", target, connection)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if n, err := reader.Read(make([]byte, 1)); n != 0 || err == nil || isTimeout(err) {
+			t.Errorf("%s: the connection is still open: %d, %v", target, n, err)
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// The root goes to the home route, a request without any target is a 400.
+func TestRootBody(t *testing.T) {
+	tests := []struct {
+		server      *Server
+		contentType string
+	}{
+		{&Server{}, ""},
+		{&Server{RootBody: "héllo\n"}, "text/plain; charset=utf-8"},
+		{&Server{RootBody: "<h1>hi</h1>", RootContentType: "text/html"}, "text/html"},
+	}
+	for _, tt := range tests {
+		router := &Router{AutoHEAD: true}
+		router.HandleExact("/", tt.server.homeHandler, "GET")
+		_, addr := startServer(t, router)
+		c := dial(t, addr)
+		for _, method := range []string{"GET", "HEAD"} {
+			res, err := c.Do(newTestRequest(method, "/"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.server.RootBody
+			if method == "HEAD" {
+				want = ""
+			}
+			contentType, _ := res.Headers.Get("Content-Type")
+			length, _ := res.Headers.Get("Content-Length")
+			if res.StatusCode != 200 || res.Body != want || contentType != tt.contentType || length != strconv.Itoa(len(tt.server.RootBody)) {
+				t.Errorf("%s / with %q: got %d %q, Content-Type %q, Content-Length %s", method, tt.server.RootBody, res.StatusCode, res.Body, contentType, length)
+			}
+		}
+	}
+}
+
+func TestEmptyTargetAndRoot(t *testing.T) {
+	server := &Server{RootBody: "home"}
+	router := echoRouter()
+	router.HandleExact("/", server.homeHandler, "GET")
+	_, addr := startServer(t, router)
+
+	for _, tt := range []struct {
+		requestLine string
+		status      int
+		body        string
+	}{
+		{"GET / HTTP/1.1", 200, "home"},
+		{"GET  HTTP/1.1", 400, ""},
+		{"GET HTTP/1.1", 400, ""},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(tt.requestLine + "\r\nHost: localhost\r\n\r\n"))
+		res, err := ReadResponse(bufio.NewReader(conn), "GET")
+		if err != nil {
+			t.Fatalf("%q: %v", tt.requestLine, err)
+		}
+		if res.StatusCode != tt.status || tt.body != "" && res.Body != tt.body {
+			t.Errorf("%q: got %d %q, want %d", tt.requestLine, res.StatusCode, res.Body, tt.status)
+		}
+	}
+}
+
+func TestResponseBodyTransform(t *testing.T) {
+	router := echoRouter()
+	router.HandleExact("/skipped", func(req *Request, res *Response) {
+		res.Headers.Set("Content-Type", "text/plain")
+		res.Body = "left alone"
+		res.SkipTransform = true
+	}, "GET")
+	router.HandleExact("/streamed", func(req *Request, res *Response) {
+		res.Headers.Set("Content-Type", "text/plain")
+		res.Stream = func(w io.Writer) error {
+			_, err := io.WriteString(w, "streamed")
+			return err
+		}
+	}, "GET")
+	router.HandleExact("/binary", func(req *Request, res *Response) {
+		res.Headers.Set("Content-Type", "application/octet-stream")
+		res.Body = "bytes"
+	}, "GET")
+	_, addr := startServer(t, router, func(s *Server) {
+		s.ResponseBodyTransform = func(req *Request, res *Response) {
+			if contentType, _ := res.Headers.Get("Content-Type"); strings.HasPrefix(contentType, "text/") {
+				res.Body = strings.ToUpper(res.Body) + "!!"
+			}
+		}
+	})
+	c := dial(t, addr)
+
+	for _, tt := range []struct{ target, body string }{
+		{"/echo/shout", "SHOUT!!"},
+		{"/skipped", "left alone"},
+		{"/streamed", "streamed"},
+		{"/binary", "bytes"},
+	} {
+		res, err := c.Do(newTestRequest("GET", tt.target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Body != tt.body {
+			t.Errorf("%s: got %q, want %q", tt.target, res.Body, tt.body)
+		}
+		if length, found := res.Headers.Get("Content-Length"); found && length != strconv.Itoa(len(tt.body)) {
+			t.Errorf("%s: Content-Length %s for %d bytes", tt.target, length, len(tt.body))
+		}
+	}
+}
+
+// Thousands of requests sent at once on a connection are answered one by
+// one, in order, the rest waiting for the server to read further.
+func TestPipelinedFlood(t *testing.T) {
+	_, addr := startServer(t, echoRouter())
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	const requests = 2000
+	go func() {
+		var batch bytes.Buffer
+		for i := range requests {
+			fmt.Fprintf(&batch, "GET /echo/%d HTTP/1.1\r\nHost: x\r\n\r\n", i)
+		}
+		conn.Write(batch.Bytes())
+	}()
+
+	reader := bufio.NewReader(conn)
+	for i := range requests {
+		res, err := ReadResponse(reader, "GET")
+		if err != nil {
+			t.Fatalf("response %d: %v", i, err)
+		}
+		if want := strconv.Itoa(i); res.StatusCode != 200 || res.Body != want {
+			t.Fatalf("response %d: got %d %q", i, res.StatusCode, res.Body)
+		}
+	}
+}
+
+// A rewritten path is routed to its new handler, which can still see the
+// target as sent, like the access log does.
+func TestPathRewrite(t *testing.T) {
+	router := &Router{}
+	router.HandlePrefix("/new/", func(req *Request, res *Response) {
+		res.Body = req.RequestURI + " " + req.OriginalURI()
+	}, "GET")
+	router.HandlePrefix("/old/", func(req *Request, res *Response) {
+		res.Body = "old handler"
+	}, "GET")
+	logs, logWriter := io.Pipe()
+	defer logs.Close()
+	_, addr := startServer(t, router, func(s *Server) {
+		s.PathRewrite = func(path string) string {
+			if rest, found := strings.CutPrefix(path, "/old/"); found {
+				return "/new/" + rest
+			}
+			return path
+		}
+		s.AccessLog = logWriter
+		s.LogFormat = LogFormatCombined
+	})
+	c := dial(t, addr)
+
+	res, err := c.Do(newTestRequest("GET", "/old/x?q=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 || res.Body != "/new/x?q=1 /old/x?q=1" {
+		t.Errorf("got %d %q", res.StatusCode, res.Body)
+	}
+	line, err := bufio.NewReader(logs).ReadString('\n')
+	if err != nil || !strings.Contains(line, `"GET /old/x?q=1 HTTP/1.1" 200`) {
+		t.Errorf("access log %q, %v", line, err)
+	}
+	if res, err := c.Do(newTestRequest("GET", "/new/y")); err != nil || res.Body != "/new/y /new/y" {
+		t.Errorf("target left alone: %v, %+v", err, res)
+	}
+}
+
+// An absolute-form target names the host, whatever the Host header says,
+// and in strict mode the two must agree.
+func TestAbsoluteFormHost(t *testing.T) {
+	tests := []struct {
+		name, target, host string
+		strict, lax        string
+	}{
+		{"origin-form", "/host", "example.com", "example.com /host", "example.com /host"},
+		{"matching", "http://Example.com/host?q=1", "example.com", "example.com /host?q=1", "example.com /host?q=1"},
+		{"default port", "https://example.com:443/host", "example.com", "example.com /host", "example.com /host"},
+		{"mismatching", "http://evil.example/host", "example.com", "400", "evil.example /host"},
+		{"other port", "http://example.com:8080/host", "example.com", "400", "example.com:8080 /host"},
+		{"no Host", "http://example.com/host", "", "example.com /host", "example.com /host"},
+	}
+	router := &Router{}
+	router.HandleExact("/host", func(req *Request, res *Response) {
+		res.Body = req.EffectiveHost() + " " + req.RequestURI
+	}, "GET")
+	for _, strict := range []bool{true, false} {
+		_, addr := startServer(t, router, func(s *Server) { s.StrictHost = strict })
+		for _, tt := range tests {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			head := "GET " + tt.target + " HTTP/1.1\r\n"
+			if tt.host != "" {
+				head += "Host: " + tt.host + "\r\n"
+			}
+			io.WriteString(conn, head+"\r\n")
+			res, err := ReadResponse(bufio.NewReader(conn), "GET")
+			conn.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.lax
+			if strict {
+				want = tt.strict
+			}
+			got := res.Body
+			if res.StatusCode != 200 {
+				got = strconv.Itoa(res.StatusCode)
+			}
+			if got != want {
+				t.Errorf("%s, strict %v: got %q, want %q", tt.name, strict, got, want)
+			}
+		}
+	}
+}
+
+func TestUpgradeInsecureRequests(t *testing.T) {
+	_, addr := startServer(t, echoRouter(), func(s *Server) { s.UpgradeInsecureURL = "https://example.com/" })
+	c := dial(t, addr)
+
+	res, err := c.Do(newTestRequest("GET", "/echo/abc?x=1", "Upgrade-Insecure-Requests", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	location, _ := res.Headers.Get("Location")
+	if res.StatusCode != 307 || location != "https://example.com/echo/abc?x=1" || !slices.Contains(res.Headers.Values("Vary"), "Upgrade-Insecure-Requests") {
+		t.Errorf("with the header: got %d, Location %q, Vary %v", res.StatusCode, location, res.Headers.Values("Vary"))
+	}
+
+	res, err = c.Do(newTestRequest("GET", "/echo/abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 || res.Body != "abc" || !slices.Contains(res.Headers.Values("Vary"), "Upgrade-Insecure-Requests") {
+		t.Errorf("without the header: got %d %q, Vary %v", res.StatusCode, res.Body, res.Headers.Values("Vary"))
+	}
+
+	// Not configured, the header changes nothing
+	_, addr = startServer(t, echoRouter())
+	c = dial(t, addr)
+	res, err = c.Do(newTestRequest("GET", "/echo/abc", "Upgrade-Insecure-Requests", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 || len(res.Headers.Values("Vary")) != 0 {
+		t.Errorf("not configured: got %d, Vary %v", res.StatusCode, res.Headers.Values("Vary"))
+	}
+}
+
+// The default headers are on every response, those of the router and the
+// parse errors included, unless the handler set its own.
+func TestDefaultHeaders(t *testing.T) {
+	router := echoRouter()
+	router.HandleExact("/framed", func(req *Request, res *Response) {
+		res.Headers.Set("X-Frame-Options", "SAMEORIGIN")
+	}, "GET")
+	router.HandleExact("/empty", func(req *Request, res *Response) {
+		res.StatusCode = 204
+		res.ReasonPhrase = StatusText(204)
+	}, "GET")
+	_, addr := startServer(t, router, func(s *Server) {
+		s.DefaultHeaders.Set("X-Content-Type-Options", "nosniff")
+		s.DefaultHeaders.Set("X-Frame-Options", "DENY")
+		s.DefaultHeaders.Set("X-Environment", "test")
+	})
+	c := dial(t, addr)
+
+	for _, tt := range []struct {
+		method, target string
+		status         int
+		frame          string
+	}{
+		{"GET", "/echo/abc", 200, "DENY"},
+		{"HEAD", "/echo/abc", 200, "DENY"},
+		{"GET", "/empty", 204, "DENY"},
+		{"GET", "/missing", 404, "DENY"},
+		{"POST", "/echo/abc", 405, "DENY"},
+		{"GET", "/framed", 200, "SAMEORIGIN"},
+	} {
+		res, err := c.Do(newTestRequest(tt.method, tt.target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nosniff, _ := res.Headers.Get("X-Content-Type-Options")
+		frame, _ := res.Headers.Get("X-Frame-Options")
+		env, _ := res.Headers.Get("X-Environment")
+		if res.StatusCode != tt.status || nosniff != "nosniff" || frame != tt.frame || env != "test" {
+			t.Errorf("%s %s: got %d, %q %q %q", tt.method, tt.target, res.StatusCode, nosniff, frame, env)
+		}
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\nnonsense\r\n\r\n")
+	res, err := ReadResponse(bufio.NewReader(conn), "GET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env, _ := res.Headers.Get("X-Environment"); res.StatusCode != 400 || env != "test" {
+		t.Errorf("parse error: got %d, X-Environment %q", res.StatusCode, env)
+	}
+}
+
+func TestValidateHeader(t *testing.T) {
+	for _, tt := range []struct {
+		name, value string
+		ok          bool
+	}{
+		{"X-Environment", "staging", true},
+		{"X-Empty", "", true},
+		{"X Space", "v", false},
+		{"X-Colon:", "v", false},
+		{"", "v", false},
+		{"X-Split", "v\r\nSet-Cookie: a=b", false},
+		{"X-Newline", "v\nw", false},
+		{"X-Nul", "v\x00", false},
+	} {
+		if err := ValidateHeader(tt.name, tt.value); (err == nil) != tt.ok {
+			t.Errorf("ValidateHeader(%q, %q): got %v", tt.name, tt.value, err)
+		}
+	}
+}
+
+// Bytes trailing a framed body get the request answered, then a 400 and
+// the connection closed.
+func TestTrailingDataAfterBody(t *testing.T) {
+	router := echoRouter()
+	router.HandleExact("/upload", func(req *Request, res *Response) {
+		res.Body = req.Body
+	}, "POST")
+	_, addr := startServer(t, router)
+
+	for _, tt := range []struct{ name, junk string }{
+		{"binary", "\x00\x01\xff"},
+		{"json", "{\"extra\": true}\r\n"},
+		{"partial line", "garbage"},
+		{"text line", "more body text\r\n\r\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhello"+tt.junk)
+			conn.(*net.TCPConn).CloseWrite()
+			reader := bufio.NewReader(conn)
+			if res, err := ReadResponse(reader, "POST"); err != nil || res.StatusCode != 200 || res.Body != "hello" {
+				t.Fatalf("the framed request: %v, %+v", err, res)
+			}
+			res, err := ReadResponse(reader, "GET")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != 400 || !res.Close {
+				t.Errorf("the trailing data: got %d, close %v", res.StatusCode, res.Close)
+			}
+		})
+	}
+}
+
+// unreadRouter has a POST route guarded by the X-Token header.
+func unreadRouter() *Router {
+	router := echoRouter()
+	router.HandleExact("/upload", func(req *Request, res *Response) {
+		res.Body = req.Body
+	}, "POST").Guard(func(req *Request, res *Response) bool {
+		if token, _ := req.Headers.Get("X-Token"); token != "ok" {
+			res.StatusCode = 403
+			res.ReasonPhrase = StatusText(403)
+			return false
+		}
+		return true
+	})
+	return router
+}
+
+// A request turned down from its head leaves its body unread, skipped
+// afterwards to reach the next request.
+func TestUnreadBody(t *testing.T) {
+	_, addr := startServer(t, unreadRouter())
+	for target, status := range map[string]int{"/upload": 403, "/missing": 404, "/echo/get-only": 405} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		reader := bufio.NewReader(conn)
+		io.WriteString(conn, "POST "+target+" HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello")
+		if res, err := ReadResponse(reader, "POST"); err != nil || res.StatusCode != status {
+			t.Fatalf("%s: got %v, %+v, want %d", target, err, res, status)
+		}
+		io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nX-Token: ok\r\nContent-Length: 3\r\n\r\nabc")
+		if res, err := ReadResponse(reader, "POST"); err != nil || res.StatusCode != 200 || res.Body != "abc" {
+			t.Errorf("%s, next request: %v, %+v", target, err, res)
+		}
+	}
+}
+
+// Skipping a large unread body costs more than a new connection: the
+// server answers without waiting for it, and hangs up.
+func TestUnreadLargeBody(t *testing.T) {
+	_, addr := startServer(t, unreadRouter())
+	for target, status := range map[string]int{"/upload": 403, "/missing": 404} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		reader := bufio.NewReader(conn)
+		// The body is never sent
+		fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: localhost\r\nContent-Length: %d\r\n\r\n", target, maxDrain+1)
+		if res, err := ReadResponse(reader, "POST"); err != nil || res.StatusCode != status {
+			t.Fatalf("%s: got %v, %+v, want %d", target, err, res, status)
+		}
+		if _, err := reader.ReadByte(); err == nil || isTimeout(err) {
+			t.Errorf("%s: the connection is still open: %v", target, err)
+		}
+	}
+}
+
+// A handler that hijacks the connection owns it: the server writes nothing
+// more on it, whatever the Response holds, and leaves it open.
+func TestHijack(t *testing.T) {
+	errs := make(chan error, 4)
+	router := echoRouter()
+	router.HandleExact("/hijack", func(req *Request, res *Response) {
+		res.Body = "from the server"
+		conn, rw, err := req.Hijack()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		_, _, err = req.Hijack()
+		errs <- err
+		errs <- req.WriteInterim(102, NewHeaders())
+		// What the client sent after the request was read ahead
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			errs <- err
+			return
+		}
+		rw.WriteString("custom protocol\n" + line)
+		rw.Flush()
+		// The server must not close the connection, nor write after this
+		time.Sleep(50 * time.Millisecond)
+		rw.WriteString("still mine\n")
+		rw.Flush()
+	}, "GET")
+	_, addr := startServer(t, router)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, "GET /hijack HTTP/1.1\r\nHost: localhost\r\n\r\nping\n")
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "custom protocol\nping\nstill mine\n" {
+		t.Errorf("got %q", got)
+	}
+	if err := <-errs; !errors.Is(err, ErrHijacked) {
+		t.Errorf("second Hijack: %v", err)
+	}
+	if err := <-errs; !errors.Is(err, ErrHijacked) {
+		t.Errorf("interim response after the hijack: %v", err)
+	}
+
+	if _, _, err := newTestRequest("GET", "/").Hijack(); !errors.Is(err, ErrHijackUnsupported) {
+		t.Errorf("request from no connection: %v", err)
+	}
+}
+
+// Once the response is on its way, the connection is the server's.
+func TestHijackAfterCommit(t *testing.T) {
+	errs := make(chan error, 1)
+	router := echoRouter()
+	router.HandleExact("/late", func(req *Request, res *Response) {
+		res.Stream = func(w io.Writer) error {
+			_, _, err := req.Hijack()
+			errs <- err
+			_, err = io.WriteString(w, "streamed")
+			return err
+		}
+	}, "GET")
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+	res, err := c.Do(newTestRequest("GET", "/late"))
+	if err != nil || res.Body != "streamed" {
+		t.Fatalf("got %v, %+v", err, res)
+	}
+	if err := <-errs; !errors.Is(err, ErrResponseCommitted) {
+		t.Errorf("Hijack while streaming: %v", err)
+	}
+}
+
+// Pipelined requests get their responses in order on the one connection,
+// each telling whether it stays open.
+func TestPersistentConnection(t *testing.T) {
+	_, addr := startServer(t, echoRouter())
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, "GET /echo/one HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /echo/two HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive\r\n\r\n"+
+		"GET /echo/three HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"+
+		"GET /echo/four HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	for _, want := range []struct{ body, connection string }{
+		{"one", ""},
+		{"two", "keep-alive"},
+		{"three", "keep-alive"},
+		{"four", "close"},
+	} {
+		res, err := ReadResponse(reader, "GET")
+		if err != nil {
+			t.Fatalf("response %q: %v", want.body, err)
+		}
+		if connection, _ := res.Headers.Get("Connection"); res.Body != want.body || connection != want.connection {
+			t.Errorf("got %q with Connection %q, want %q with %q", res.Body, connection, want.body, want.connection)
+		}
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("after Connection: close, got %v", err)
+	}
+
+	// Without Connection: keep-alive, an HTTP/1.0 connection closes
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, "GET /echo/old HTTP/1.0\r\n\r\n")
+	reader = bufio.NewReader(conn)
+	if res, err := ReadResponse(reader, "GET"); err != nil || res.Body != "old" {
+		t.Fatalf("got %v, %+v", err, res)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("HTTP/1.0 connection left open: %v", err)
+	}
+}
+
+// Connection: close from either side closes the connection once the
+// response is sent, the response saying so.
+func TestConnectionClose(t *testing.T) {
+	router := echoRouter()
+	router.HandleExact("/bye", func(req *Request, res *Response) {
+		res.Headers.Set("Connection", "Close")
+		res.Body = "bye"
+	}, "GET")
+	_, addr := startServer(t, router)
+
+	tests := []struct {
+		name, request, body string
+	}{
+		{"client", "GET /echo/a HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n", "a"},
+		{"client, in a list", "GET /echo/b HTTP/1.1\r\nHost: x\r\nConnection: keep-alive, CLOSE\r\n\r\n", "b"},
+		{"handler", "GET /bye HTTP/1.1\r\nHost: x\r\n\r\n", "bye"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			// The second request is never answered
+			io.WriteString(conn, tt.request+"GET /echo/again HTTP/1.1\r\nHost: x\r\n\r\n")
+			reader := bufio.NewReader(conn)
+			res, err := ReadResponse(reader, "GET")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if connection, _ := res.Headers.Get("Connection"); res.Body != tt.body || !strings.EqualFold(connection, "close") {
+				t.Errorf("got %q with Connection %q", res.Body, connection)
+			}
+			if rest, err := io.ReadAll(reader); len(rest) != 0 {
+				t.Errorf("after the close: %q, %v", rest, err)
+			}
+		})
+	}
+}
+
+func TestResponseVersion(t *testing.T) {
+	router := echoRouter()
+	router.HandleExact("/stream", func(req *Request, res *Response) {
+		res.Stream = func(w io.Writer) error {
+			_, err := io.WriteString(w, "streamed")
+			return err
+		}
+	}, "GET")
+	tests := []struct {
+		name, forced, request, statusLine string
+		closed                            bool
+	}{
+		{"HTTP/1.0 request", "", "GET /echo/a HTTP/1.0\r\n\r\n", "HTTP/1.0 200 OK", true},
+		{"HTTP/1.0 keep-alive", "", "GET /echo/a HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", "HTTP/1.0 200 OK", false},
+		{"HTTP/1.1 request", "", "GET /echo/a HTTP/1.1\r\nHost: x\r\n\r\n", "HTTP/1.1 200 OK", false},
+		{"forced HTTP/1.0", "HTTP/1.0", "GET /echo/a HTTP/1.1\r\nHost: x\r\n\r\n", "HTTP/1.0 200 OK", false},
+		{"forced HTTP/1.0, unsized stream", "HTTP/1.0", "GET /stream HTTP/1.1\r\nHost: x\r\n\r\n", "HTTP/1.0 200 OK", true},
+		{"forced HTTP/1.1", "HTTP/1.1", "GET /echo/a HTTP/1.0\r\n\r\n", "HTTP/1.1 200 OK", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startServer(t, router, func(s *Server) { s.HTTPVersion = tt.forced })
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			io.WriteString(conn, tt.request)
+			reader := bufio.NewReader(conn)
+			res, err := ReadResponse(reader, "GET")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if statusLine := res.HTTPVersion + " " + strconv.Itoa(res.StatusCode) + " " + res.ReasonPhrase; statusLine != tt.statusLine {
+				t.Errorf("got %q, want %q", statusLine, tt.statusLine)
+			}
+			if te, found := res.Headers.Get("Transfer-Encoding"); found && tt.statusLine[:8] == "HTTP/1.0" {
+				t.Errorf("Transfer-Encoding %q to HTTP/1.0", te)
+			}
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			_, err = reader.ReadByte()
+			if closed := !isTimeout(err); closed != tt.closed {
+				t.Errorf("closed %v, want %v: %v", closed, tt.closed, err)
+			}
+		})
+	}
+}
+
+// HEAD gets the status and headers of GET, Content-Length included, and no
+// body, which the access log doesn't count either.
+func TestHeadLikeGet(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "foo.txt"), []byte("some file content"), 0644)
+	router := fileRouter(dir)
+	router.HandleExact("/user-agent", userAgentHandler, "GET")
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	_, addr := startServer(t, router, func(s *Server) {
+		s.LogFormat = LogFormatCombined
+		if err := s.OpenAccessLog(logPath); err != nil {
+			t.Fatal(err)
+		}
+	})
+	c := dial(t, addr)
+
+	targets := []string{"/echo/abc", "/user-agent", "/files/foo.txt", "/files/missing.txt"}
+	for _, target := range targets {
+		get, err := c.Do(newTestRequest("GET", target, "User-Agent", "head-test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		head, err := c.Do(newTestRequest("HEAD", target, "User-Agent", "head-test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head.StatusCode != get.StatusCode || head.Body != "" {
+			t.Errorf("HEAD %s: got %d with %q, GET got %d", target, head.StatusCode, head.Body, get.StatusCode)
+		}
+		for _, name := range []string{"Content-Length", "Content-Type", "ETag", "Last-Modified"} {
+			want, _ := get.Headers.Get(name)
+			if got, _ := head.Headers.Get(name); got != want {
+				t.Errorf("HEAD %s: %s %q, GET has %q", target, name, got, want)
+			}
+		}
+	}
+
+	heads := 0
+	for _, line := range waitForLines(t, logPath, 2*len(targets)) {
+		if !strings.Contains(line, `"HEAD `) {
+			continue
+		}
+		heads++
+		if !strings.Contains(line, `" 200 - "`) && !strings.Contains(line, `" 404 - "`) {
+			t.Errorf("HEAD logged with body bytes: %s", line)
+		}
+	}
+	if heads != len(targets) {
+		t.Errorf("%d HEAD requests logged, want %d", heads, len(targets))
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve once Shutdown has been called.
+var ErrServerClosed = errors.New("server closed")
+
+// Drain marks the server as going away: the health endpoint starts
+// answering 503 so load balancers stop sending traffic, but requests
+// are still served.
+func (s *Server) Drain() {
+	s.draining.Store(true)
+}
+
+// Shutdown stops accepting connections and waits up to ShutdownGrace for
+// in-flight requests to finish before closing whatever is left.
+// Calling it more than once is harmless; every call waits for the first to finish.
+func (s *Server) Shutdown() {
+	s.shutdownOnce.Do(func() {
+		s.Drain()
+		s.closing.Store(true)
+
+		s.mu.Lock()
+		if s.listener != nil {
+			s.listener.Close()
+		}
+		s.mu.Unlock()
+
+		deadline := time.Now().Add(s.ShutdownGrace)
+		for {
+			open := 0
+			for _, c := range s.conns.snapshot() {
+				// Nobody is waiting on an idle connection
+				if !c.active.Load() || time.Now().After(deadline) {
+					c.Close()
+					continue
+				}
+				open++
+			}
+			if open == 0 {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		close(s.done)
+	})
+	<-s.done
+}
+
+// Done is closed once Shutdown has finished.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// healthHandler answers 200 while the server takes traffic and 503 once it drains.
+func (s *Server) healthHandler(req *Request, res *Response) {
+	body := "ok"
+	if s.draining.Load() {
+		unavailable(res, s.RetryAfter.Shutdown)
+		body = "draining"
+	}
+	res.Headers.Set("Content-Type", "text/plain")
+	res.Headers.Set("Content-Length", fmt.Sprint(len(body)))
+	res.Body = body
+}
+
+// adminShutdownHandler starts a graceful shutdown and answers 202 right away.
+func (s *Server) adminShutdownHandler(req *Request, res *Response) {
+	if user, ok := req.Get(AuthUserKey); ok {
+		fmt.Printf("Shutdown requested by %v\n", user)
+	}
+	// The shutdown waits for this very request, so it can't block here
+	go s.Shutdown()
+
+	body := fmt.Sprintf("shutting down, grace period %s\n", s.ShutdownGrace)
+	res.StatusCode = 202
+	res.ReasonPhrase = "Accepted"
+	res.Headers.Set("Content-Type", "text/plain")
+	res.Headers.Set("Content-Length", fmt.Sprint(len(body)))
+	res.Body = body
+}
+
+// adminDrainHandler flips the health endpoint to 503 without stopping the server.
+func (s *Server) adminDrainHandler(req *Request, res *Response) {
+	if user, ok := req.Get(AuthUserKey); ok {
+		fmt.Printf("Drain requested by %v\n", user)
+	}
+	s.Drain()
+
+	body := "draining\n"
+	res.StatusCode = 202
+	res.ReasonPhrase = "Accepted"
+	res.Headers.Set("Content-Type", "text/plain")
+	res.Headers.Set("Content-Length", fmt.Sprint(len(body)))
+	res.Body = body
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingRouter answers GET /block once release is closed, telling entered
+// when a request gets to the handler.
+func blockingRouter(entered chan<- struct{}, release <-chan struct{}) *Router {
+	router := echoRouter()
+	router.HandleExact("/block", func(req *Request, res *Response) {
+		entered <- struct{}{}
+		<-release
+		res.Body = "finished"
+	}, "GET")
+	return router
+}
+
+// Shutdown stops taking connections at once, but lets the requests in
+// flight finish within the grace period, closing their connections after.
+func TestShutdownWaitsForInFlight(t *testing.T) {
+	entered, release := make(chan struct{}, 2), make(chan struct{})
+	s, addr := startServer(t, blockingRouter(entered, release), func(s *Server) { s.ShutdownGrace = 5 * time.Second })
+	idle := dial(t, addr)
+	if _, err := idle.Do(newTestRequest("GET", "/echo/idle")); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		res *Response
+		err error
+	}
+	results := make(chan result, 2)
+	for range 2 {
+		c := dial(t, addr)
+		go func() {
+			res, err := c.Do(newTestRequest("GET", "/block"))
+			results <- result{res, err}
+		}()
+		<-entered
+	}
+
+	shutdown := make(chan struct{})
+	go func() {
+		s.Shutdown()
+		close(shutdown)
+	}()
+	// The listener closes without waiting for the requests
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("still accepting connections during the shutdown")
+		}
+	}
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned with requests in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// The idle connection was closed right away
+	if _, err := idle.Do(newTestRequest("GET", "/echo/again")); err == nil {
+		t.Error("idle connection still served during the shutdown")
+	}
+
+	close(release)
+	for range 2 {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.res.StatusCode != 200 || r.res.Body != "finished" || !r.res.Close {
+			t.Errorf("in-flight request: got %d %q, close %v", r.res.StatusCode, r.res.Body, r.res.Close)
+		}
+	}
+	select {
+	case <-shutdown:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown didn't return once the requests were done")
+	}
+}
+
+// A request still running when the grace period ends has its connection
+// closed under it.
+func TestShutdownGraceExpires(t *testing.T) {
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	s, addr := startServer(t, blockingRouter(entered, release), func(s *Server) { s.ShutdownGrace = 200 * time.Millisecond })
+	c := dial(t, addr)
+	failed := make(chan error, 1)
+	go func() {
+		_, err := c.Do(newTestRequest("GET", "/block"))
+		failed <- err
+	}()
+	<-entered
+
+	start := time.Now()
+	s.Shutdown()
+	if took := time.Since(start); took < 200*time.Millisecond || took > 2*time.Second {
+		t.Errorf("Shutdown took %s with a grace period of 200ms", took)
+	}
+	if err := <-failed; err == nil {
+		t.Error("the request outliving the grace period got a response")
+	}
+}
+
+// The admin endpoints drain, then shut the server down, twice each to no
+// further effect. Only the admin credentials get through.
+func TestAdminDrainThenShutdown(t *testing.T) {
+	router := echoRouter()
+	s, addr := startServer(t, router, func(s *Server) {
+		allowlist, err := IPAllowlist(LoopbackNetworks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		guards := []Guard{AsGuard(allowlist), AsGuard(BasicAuth("admin", "secret", "admin"))}
+		router.HandleExact("/admin/shutdown", s.adminShutdownHandler, "POST").Guard(guards...)
+		router.HandleExact("/admin/drain", s.adminDrainHandler, "POST").Guard(guards...)
+		router.HandleExact("/healthz", s.healthHandler, "GET")
+	})
+	c := dial(t, addr)
+	do := func(method, target string, auth bool) *Response {
+		t.Helper()
+		req := newTestRequest(method, target)
+		if auth {
+			req.Headers.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:secret")))
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if res := do("GET", "/healthz", false); res.StatusCode != 200 || res.Body != "ok" {
+		t.Errorf("healthz before the drain: %d %q", res.StatusCode, res.Body)
+	}
+	if res := do("POST", "/admin/drain", false); res.StatusCode != 401 {
+		t.Errorf("drain without credentials: got %d", res.StatusCode)
+	}
+	for range 2 {
+		if res := do("POST", "/admin/drain", true); res.StatusCode != 202 {
+			t.Errorf("drain: got %d", res.StatusCode)
+		}
+	}
+	if res := do("GET", "/healthz", false); res.StatusCode != 503 || res.Body != "draining" {
+		t.Errorf("healthz after the drain: %d %q", res.StatusCode, res.Body)
+	}
+	// Draining, the server still serves
+	if res := do("GET", "/echo/still", false); res.StatusCode != 200 {
+		t.Errorf("request while draining: got %d", res.StatusCode)
+	}
+
+	if res := do("POST", "/admin/shutdown", false); res.StatusCode != 401 {
+		t.Errorf("shutdown without credentials: got %d", res.StatusCode)
+	}
+	res := do("POST", "/admin/shutdown", true)
+	if res.StatusCode != 202 || !strings.Contains(res.Body, s.ShutdownGrace.String()) {
+		t.Errorf("shutdown: got %d %q", res.StatusCode, res.Body)
+	}
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server hasn't shut down")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("the listener still takes connections")
+	}
+	// A second shutdown returns at once
+	s.Shutdown()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics holds the server-wide counters. All fields are updated atomically
+// so they can be read at any time without stopping the world.
+type metrics struct {
+	accepted atomic.Int64
+	served   atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+// trackedConn wraps a net.Conn so the registry knows whether it is busy
+// and the metrics see every byte that crosses it.
+type trackedConn struct {
+	net.Conn
+	metrics  *metrics
+	accepted time.Time
+	active   atomic.Bool
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.active.Store(true)
+		c.metrics.bytesIn.Add(int64(n))
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.metrics.bytesOut.Add(int64(n))
+	return n, err
+}
+
+// setIdle marks the connection as waiting for its next request.
+func (c *trackedConn) setIdle() {
+	c.active.Store(false)
+}
+
+// connRegistry keeps track of every open connection.
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{conns: make(map[*trackedConn]struct{})}
+}
+
+func (r *connRegistry) track(conn net.Conn, m *metrics, now time.Time) *trackedConn {
+	c := &trackedConn{Conn: conn, metrics: m, accepted: now}
+	r.mu.Lock()
+	r.conns[c] = struct{}{}
+	r.mu.Unlock()
+	return c
+}
+
+func (r *connRegistry) untrack(c *trackedConn) {
+	r.mu.Lock()
+	delete(r.conns, c)
+	r.mu.Unlock()
+}
+
+// snapshot copies the registry under the lock so callers can work on the
+// result without holding up connections being opened or closed.
+func (r *connRegistry) snapshot() []*trackedConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]*trackedConn, 0, len(r.conns))
+	for c := range r.conns {
+		out = append(out, c)
+	}
+	return out
+}
+
+type connStats struct {
+	RemoteAddr string  `json:"remote_addr"`
+	State      string  `json:"state"`
+	AgeSeconds float64 `json:"age_seconds"`
+}
+
+type serverStats struct {
+	Goroutines  int            `json:"goroutines"`
+	Accepted    int64          `json:"accepted"`
+	Served      int64          `json:"served"`
+	BytesIn     int64          `json:"bytes_in"`
+	BytesOut    int64          `json:"bytes_out"`
+	Limits      map[string]any `json:"limits"`
+	Connections []connStats    `json:"connections"`
+}
+
+// limits reports the configured limits of the server.
+func (s *Server) limits() map[string]any {
+	return map[string]any{
+		"max_request_line_bytes":    s.RequestLimits.MaxRequestLineBytes,
+		"max_header_bytes":          s.RequestLimits.MaxHeaderBytes,
+		"max_header_count":          s.RequestLimits.MaxHeaderCount,
+		"max_body_size":             s.RequestLimits.MaxBodySize,
+		"max_query_bytes":           s.RequestLimits.MaxQueryBytes,
+		"max_query_params":          s.RequestLimits.MaxQueryParams,
+		"max_response_header_bytes": s.ResponseLimits.MaxHeaderBytes,
+		"max_response_header_count": s.ResponseLimits.MaxHeaderCount,
+		"max_conns":                 s.MaxConns,
+		"conn_limit_mode":           s.ConnLimitMode,
+		"workers":                   s.Workers,
+		"worker_queue":              s.WorkerQueue,
+	}
+}
+
+type routeStats struct {
+	Pattern string   `json:"pattern"`
+	Kind    string   `json:"kind"`
+	Methods []string `json:"methods"`
+	Guarded bool     `json:"guarded"`
+}
+
+// routesHandler serves the route table of router as JSON. A route answering
+// any method lists "*".
+func routesHandler(router *Router) HandlerFunc {
+	return func(req *Request, res *Response) {
+		routes := []routeStats{}
+		for _, info := range router.Routes() {
+			methods := info.Methods
+			if methods == nil {
+				methods = []string{"*"}
+			}
+			routes = append(routes, routeStats{Pattern: info.Pattern, Kind: info.Kind, Methods: methods, Guarded: info.Guarded})
+		}
+
+		body, err := json.Marshal(routes)
+		if err != nil {
+			res.StatusCode = 500
+			res.ReasonPhrase = "Internal Server Error"
+			return
+		}
+		res.Headers.Set("Content-Type", "application/json")
+		res.Headers.Set("Content-Length", strconv.Itoa(len(body)))
+		res.Body = string(body)
+	}
+}
+
+// statsHandler serves a JSON snapshot of the server internals.
+// When redact is set the remote addresses are left out.
+func (s *Server) statsHandler(redact bool) HandlerFunc {
+	return func(req *Request, res *Response) {
+		now := s.Clock.Now()
+		stats := serverStats{
+			Goroutines:  runtime.NumGoroutine(),
+			Accepted:    s.metrics.accepted.Load(),
+			Served:      s.metrics.served.Load(),
+			BytesIn:     s.metrics.bytesIn.Load(),
+			BytesOut:    s.metrics.bytesOut.Load(),
+			Limits:      s.limits(),
+			Connections: []connStats{},
+		}
+		for _, c := range s.conns.snapshot() {
+			cs := connStats{
+				RemoteAddr: c.RemoteAddr().String(),
+				State:      "idle",
+				AgeSeconds: now.Sub(c.accepted).Seconds(),
+			}
+			if c.active.Load() {
+				cs.State = "active"
+			}
+			if redact {
+				cs.RemoteAddr = "redacted"
+			}
+			stats.Connections = append(stats.Connections, cs)
+		}
+
+		body, err := json.Marshal(stats)
+		if err != nil {
+			res.StatusCode = 500
+			res.ReasonPhrase = "Internal Server Error"
+			return
+		}
+		res.Headers.Set("Content-Type", "application/json")
+		res.Headers.Set("Content-Length", strconv.Itoa(len(body)))
+		res.Body = string(body)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// A request in flight shows as an active connection, one waiting for its
+// next request as an idle one.
+func TestStatsShowsActiveRequest(t *testing.T) {
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	router := blockingRouter(entered, release)
+	_, addr := startServer(t, router, func(s *Server) {
+		router.HandleExact("/debug/stats", s.statsHandler(false), "GET")
+		router.HandleExact("/debug/stats/redacted", s.statsHandler(true), "GET")
+	})
+
+	idle := dial(t, addr)
+	if _, err := idle.Do(newTestRequest("GET", "/echo/idle")); err != nil {
+		t.Fatal(err)
+	}
+	slow := dial(t, addr)
+	done := make(chan error, 1)
+	go func() {
+		_, err := slow.Do(newTestRequest("GET", "/block"))
+		done <- err
+	}()
+	<-entered
+	defer func() {
+		close(release)
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	c := dial(t, addr)
+	res, err := c.Do(newTestRequest("GET", "/debug/stats"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats serverStats
+	if err := json.Unmarshal([]byte(res.Body), &stats); err != nil {
+		t.Fatalf("%v in %q", err, res.Body)
+	}
+	states := make(map[string]string)
+	for _, conn := range stats.Connections {
+		states[conn.RemoteAddr] = conn.State
+	}
+	for client, want := range map[*Client]string{idle: "idle", slow: "active", c: "active"} {
+		if got := states[client.conn.LocalAddr().String()]; got != want {
+			t.Errorf("connection from %s: %q, want %q", client.conn.LocalAddr(), got, want)
+		}
+	}
+	if stats.Accepted < 3 || stats.Served < 1 || stats.BytesIn == 0 || stats.BytesOut == 0 || stats.Goroutines == 0 {
+		t.Errorf("counters: %+v", stats)
+	}
+	if _, found := stats.Limits["max_body_size"]; !found {
+		t.Errorf("limits: %v", stats.Limits)
+	}
+
+	if res, err = c.Do(newTestRequest("GET", "/debug/stats/redacted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(res.Body), &stats); err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range stats.Connections {
+		if conn.RemoteAddr != "redacted" {
+			t.Errorf("remote address %q left in", conn.RemoteAddr)
+		}
+	}
+}
+
+func TestRoutesHandler(t *testing.T) {
+	router := echoRouter()
+	router.HandleExact("/upload", func(req *Request, res *Response) {}, "POST").Guard(AsGuard(BasicAuth("a", "b", "test")))
+	router.HandlePrefix("/proxy/", func(req *Request, res *Response) {})
+	router.HandleExact("/debug/routes", routesHandler(router), "GET")
+	_, addr := startServer(t, router)
+	c := dial(t, addr)
+
+	res, err := c.Do(newTestRequest("GET", "/debug/routes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct, _ := res.Headers.Get("Content-Type"); res.StatusCode != 200 || ct != "application/json" {
+		t.Fatalf("got %d, %q", res.StatusCode, ct)
+	}
+	var routes []routeStats
+	if err := json.Unmarshal([]byte(res.Body), &routes); err != nil {
+		t.Fatal(err)
+	}
+	want := []routeStats{
+		{Pattern: "/echo/", Kind: "prefix", Methods: []string{"GET", "HEAD"}},
+		{Pattern: "/upload", Kind: "exact", Methods: []string{"POST"}, Guarded: true},
+		{Pattern: "/proxy/", Kind: "prefix", Methods: []string{"*"}},
+		{Pattern: "/debug/routes", Kind: "exact", Methods: []string{"GET", "HEAD"}},
+	}
+	if !reflect.DeepEqual(routes, want) {
+		t.Errorf("got %+v\nwant %+v", routes, want)
+	}
+}
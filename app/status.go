@@ -0,0 +1,40 @@
+package main
+
+// statusText holds the standard reason phrase of the status codes the server uses.
+var statusText = map[int]string{
+	100: "Continue",
+	103: "Early Hints",
+	200: "OK",
+	201: "Created",
+	202: "Accepted",
+	204: "No Content",
+	206: "Partial Content",
+	207: "Multi-Status",
+	301: "Moved Permanently",
+	304: "Not Modified",
+	307: "Temporary Redirect",
+	308: "Permanent Redirect",
+	400: "Bad Request",
+	401: "Unauthorized",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	409: "Conflict",
+	412: "Precondition Failed",
+	413: "Content Too Large",
+	414: "URI Too Long",
+	415: "Unsupported Media Type",
+	416: "Range Not Satisfiable",
+	417: "Expectation Failed",
+	422: "Unprocessable Content",
+	429: "Too Many Requests",
+	431: "Request Header Fields Too Large",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	503: "Service Unavailable",
+}
+
+// StatusText returns the reason phrase of code, or "" when it isn't known.
+func StatusText(code int) string {
+	return statusText[code]
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timings splits the time the server spent on a request into phases.
+type Timings struct {
+	// Parse runs from the first byte of the request until its body is read.
+	// A streamed body is read by the handler instead.
+	Parse time.Duration
+	// Route covers shedding, matching the route and running its guards.
+	Route   time.Duration
+	Handler time.Duration
+	// Serialize covers the server-wide steps between the handler and the write.
+	Serialize time.Duration
+	// Write includes producing a streamed response body.
+	Write        time.Duration
+	Total        time.Duration
+	BytesWritten int64
+}
+
+// serverTiming renders the phases known before the response is written as
+// a Server-Timing header value, in milliseconds.
+func (t Timings) serverTiming() string {
+	var b strings.Builder
+	for i, phase := range []struct {
+		name string
+		d    time.Duration
+	}{{"parse", t.Parse}, {"route", t.Route}, {"handler", t.Handler}, {"serialize", t.Serialize}} {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(phase.name)
+		b.WriteString(";dur=")
+		b.WriteString(strconv.FormatFloat(float64(phase.d.Microseconds())/1000, 'f', 3, 64))
+	}
+	return b.String()
+}
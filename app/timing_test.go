@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func timingRouter(clock *fakeClock) *Router {
+	router := echoRouter()
+	router.HandleExact("/work", func(req *Request, res *Response) {
+		clock.Advance(100 * time.Millisecond)
+		res.Stream = func(w io.Writer) error {
+			clock.Advance(50 * time.Millisecond)
+			_, err := io.WriteString(w, "done")
+			return err
+		}
+	}, "GET")
+	return router
+}
+
+func TestTimingPhases(t *testing.T) {
+	clock := newFakeClock(time.Date(2030, 5, 6, 7, 8, 9, 0, time.UTC))
+	ended := make(chan Timings, 1)
+	_, addr := startServer(t, timingRouter(clock), func(s *Server) {
+		s.Clock = clock
+		s.ServerTiming = true
+		s.OnRequestEnd = func(req *Request, res *Response, t Timings) { ended <- t }
+	})
+	c := dial(t, addr)
+
+	res, err := c.Do(newTestRequest("GET", "/work"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timings := <-ended
+	want := Timings{Handler: 100 * time.Millisecond, Write: 50 * time.Millisecond, Total: 150 * time.Millisecond}
+	if timings.BytesWritten == 0 || timings.BytesWritten < int64(len(res.Body)) {
+		t.Errorf("%d bytes written", timings.BytesWritten)
+	}
+	timings.BytesWritten = 0
+	if timings != want {
+		t.Errorf("got %+v, want %+v", timings, want)
+	}
+	// The header only knows the phases before the write
+	if header, _ := res.Headers.Get("Server-Timing"); header != "parse;dur=0.000, route;dur=0.000, handler;dur=100.000, serialize;dur=0.000" {
+		t.Errorf("Server-Timing %q", header)
+	}
+}
+
+// On a real clock the phases add up to the total, give or take the time
+// between two of them.
+func TestTimingPhasesSum(t *testing.T) {
+	ended := make(chan Timings, 10)
+	_, addr := startServer(t, echoRouter(), func(s *Server) {
+		s.ServerTiming = true
+		s.OnRequestEnd = func(req *Request, res *Response, t Timings) { ended <- t }
+	})
+	c := dial(t, addr)
+	metric := regexp.MustCompile(`^[a-z]+;dur=\d+\.\d{3}$`)
+
+	for range 5 {
+		res, err := c.Do(newTestRequest("GET", "/echo/abc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		timings := <-ended
+		sum := timings.Parse + timings.Route + timings.Handler + timings.Serialize + timings.Write
+		if diff := timings.Total - sum; diff < 0 || diff > time.Millisecond {
+			t.Errorf("phases sum to %s, total %s", sum, timings.Total)
+		}
+		values := res.Headers.Values("Server-Timing")
+		if len(values) != 4 {
+			t.Fatalf("Server-Timing %q", values)
+		}
+		for _, value := range values {
+			if !metric.MatchString(value) {
+				t.Errorf("Server-Timing metric %q", value)
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Just enough WebDAV (RFC 4918) for sync clients to explore the files:
+// PROPFIND with Depth 0 or 1, answering every property below.
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName      string          `xml:"D:displayname"`
+	GetContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	GetLastModified  string          `xml:"D:getlastmodified"`
+	GetETag          string          `xml:"D:getetag,omitempty"`
+	ResourceType     davResourceType `xml:"D:resourcetype"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+// davResponseFor describes the file or directory at filePath, found at href.
+func davResponseFor(href, filePath string, info os.FileInfo) davResponse {
+	prop := davProp{
+		DisplayName:     info.Name(),
+		GetLastModified: FormatHTTPDate(info.ModTime().Truncate(time.Second)),
+	}
+	if info.IsDir() {
+		prop.ResourceType.Collection = &struct{}{}
+	} else {
+		size := info.Size()
+		prop.GetContentLength = &size
+		// Hashing is what it costs, keep it to the files the ETag middleware would hash
+		if size <= metadataHashLimit {
+			if etag, err := fileETag(filePath); err == nil {
+				prop.GetETag = etag
+			}
+		}
+	}
+	return davResponse{
+		Href:     href,
+		Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"},
+	}
+}
+
+// propfindHandler answers a PROPFIND for the resource at uri with a 207
+// Multi-Status. Depth 1 adds the children of a directory, infinite depth
+// is refused with a 403 as walking a whole tree is too costly.
+func (fs *FileServer) propfindHandler(req *Request, res *Response, uri, filePath string) {
+	depth, found := req.Headers.Get("Depth")
+	depth = strings.TrimSpace(depth)
+	if !found || (depth != "0" && depth != "1") {
+		res.StatusCode = 403
+		res.ReasonPhrase = "Forbidden"
+		return
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		statError(res, filePath, err)
+		return
+	}
+
+	// The href is the target as sent, still percent-encoded
+	href := uri
+	if info.IsDir() && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+	ms := davMultistatus{Namespace: "DAV:", Responses: []davResponse{davResponseFor(href, filePath, info)}}
+
+	if depth == "1" && info.IsDir() {
+		entries, err := os.ReadDir(filePath)
+		if err != nil {
+			statError(res, filePath, err)
+			return
+		}
+		for i, entry := range entries {
+			if i%1024 == 0 && req.Context().Err() != nil {
+				return
+			}
+			if !fs.listed(filePath, entry) {
+				continue
+			}
+			child, err := entry.Info()
+			if err != nil {
+				// Removed since the directory was read
+				continue
+			}
+			name := entry.Name()
+			if entry.IsDir() {
+				name += "/"
+			}
+			childHref := href + (&url.URL{Path: name}).EscapedPath()
+			ms.Responses = append(ms.Responses, davResponseFor(childHref, filepath.Join(filePath, entry.Name()), child))
+		}
+	}
+
+	body, err := xml.MarshalIndent(ms, "", "  ")
+	if err != nil {
+		fmt.Printf("Error rendering PROPFIND: %v\n", err)
+		res.StatusCode = 500
+		res.ReasonPhrase = "Internal Server Error"
+		return
+	}
+	res.StatusCode = 207
+	res.ReasonPhrase = StatusText(207)
+	res.Headers.Set("Content-Type", "application/xml; charset=utf-8")
+	res.Body = xml.Header + string(body) + "\n"
+	res.Headers.Set("Content-Length", strconv.Itoa(len(res.Body)))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The multistatus as a client reads it, whatever prefix the server uses.
+type davTestMultistatus struct {
+	XMLName   xml.Name `xml:"DAV: multistatus"`
+	Responses []struct {
+		Href   string `xml:"DAV: href"`
+		Status string `xml:"DAV: propstat>status"`
+		Prop   struct {
+			DisplayName   string    `xml:"DAV: displayname"`
+			ContentLength *int64    `xml:"DAV: getcontentlength"`
+			LastModified  string    `xml:"DAV: getlastmodified"`
+			ETag          string    `xml:"DAV: getetag"`
+			Collection    *struct{} `xml:"DAV: resourcetype>collection"`
+		} `xml:"DAV: propstat>prop"`
+	} `xml:"DAV: response"`
+}
+
+func webdavRouter(dir string) *Router {
+	router := &Router{}
+	fs := NewFileServer("/files/", dir)
+	fs.WebDAV = true
+	router.HandlePrefix(fs.Prefix, fs.Handle, fs.Methods()...).Stream()
+	return router
+}
+
+func TestPropfind(t *testing.T) {
+	dir := t.TempDir()
+	modTime := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Mkdir(filepath.Join(dir, "docs"), 0755)
+	name := filepath.Join(dir, "docs", "a&b <1>.txt")
+	os.WriteFile(name, []byte("hello"), 0644)
+	os.Chtimes(name, modTime, modTime)
+	os.Mkdir(filepath.Join(dir, "docs", "sub"), 0755)
+	_, addr := startServer(t, webdavRouter(dir))
+	c := dial(t, addr)
+	propfind := func(target, depth string) (*Response, davTestMultistatus) {
+		t.Helper()
+		res, err := c.Do(newTestRequest("PROPFIND", target, "Depth", depth))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ms davTestMultistatus
+		if res.StatusCode == 207 {
+			if err := xml.Unmarshal([]byte(res.Body), &ms); err != nil {
+				t.Fatalf("PROPFIND %s: %v in %s", target, err, res.Body)
+			}
+		}
+		return res, ms
+	}
+
+	res, ms := propfind("/files/docs/a&b%20%3C1%3E.txt", "0")
+	if ct, _ := res.Headers.Get("Content-Type"); res.StatusCode != 207 || !strings.HasPrefix(ct, "application/xml") {
+		t.Fatalf("file, depth 0: got %d, %q", res.StatusCode, ct)
+	}
+	if !strings.Contains(res.Body, "a&amp;b &lt;1&gt;.txt") {
+		t.Errorf("the name isn't escaped: %s", res.Body)
+	}
+	etag, _ := fileETag(name)
+	if len(ms.Responses) != 1 {
+		t.Fatalf("file, depth 0: %d responses", len(ms.Responses))
+	}
+	file := ms.Responses[0]
+	if file.Href != "/files/docs/a&b%20%3C1%3E.txt" || file.Status != "HTTP/1.1 200 OK" || file.Prop.DisplayName != "a&b <1>.txt" ||
+		file.Prop.ContentLength == nil || *file.Prop.ContentLength != 5 || file.Prop.LastModified != FormatHTTPDate(modTime) ||
+		file.Prop.ETag != etag || file.Prop.Collection != nil {
+		t.Errorf("file, depth 0: got %+v", file)
+	}
+
+	// Depth 1 on a directory lists it then its two children
+	_, ms = propfind("/files/docs", "1")
+	var hrefs []string
+	for _, r := range ms.Responses {
+		hrefs = append(hrefs, r.Href)
+		if isDir := strings.HasSuffix(r.Href, "/"); isDir != (r.Prop.Collection != nil) || isDir != (r.Prop.ContentLength == nil) {
+			t.Errorf("%s: collection %v, length %v", r.Href, r.Prop.Collection, r.Prop.ContentLength)
+		}
+	}
+	want := []string{"/files/docs/", "/files/docs/a&b%20%3C1%3E.txt", "/files/docs/sub/"}
+	if strings.Join(hrefs, " ") != strings.Join(want, " ") {
+		t.Errorf("directory, depth 1: got %q, want %q", hrefs, want)
+	}
+	if _, ms = propfind("/files/docs/", "0"); len(ms.Responses) != 1 || ms.Responses[0].Prop.DisplayName != "docs" {
+		t.Errorf("directory, depth 0: got %+v", ms.Responses)
+	}
+
+	for _, tt := range []struct {
+		target, depth string
+		status        int
+	}{
+		{"/files/docs/", "infinity", 403},
+		{"/files/docs/", "2", 403},
+		{"/files/missing", "0", 404},
+	} {
+		if res, _ := propfind(tt.target, tt.depth); res.StatusCode != tt.status {
+			t.Errorf("PROPFIND %s, depth %s: got %d, want %d", tt.target, tt.depth, res.StatusCode, tt.status)
+		}
+	}
+
+	// Without WebDAV, the mount takes no PROPFIND
+	_, addr = startServer(t, fileRouter(dir))
+	c = dial(t, addr)
+	if res, _ := propfind("/files/docs/", "0"); res.StatusCode != 405 {
+		t.Errorf("PROPFIND with WebDAV off: got %d", res.StatusCode)
+	}
+}